@@ -0,0 +1,349 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+const storeAuditName = ".audit"
+
+// AuditOperation defines the operation recorded by an [AuditEvent].
+type AuditOperation string
+
+const (
+	AuditOperationCreate  AuditOperation = "Create"
+	AuditOperationAccess  AuditOperation = "Access"
+	AuditOperationSign    AuditOperation = "Sign"
+	AuditOperationMerge   AuditOperation = "Merge"
+	AuditOperationRevoke  AuditOperation = "Revoke"
+	AuditOperationRenew   AuditOperation = "Renew"
+	AuditOperationExport  AuditOperation = "Export"
+	AuditOperationRotate  AuditOperation = "Rotate"
+	AuditOperationUpgrade AuditOperation = "Upgrade"
+	AuditOperationMigrate AuditOperation = "Migrate"
+	AuditOperationRestore AuditOperation = "Restore"
+	AuditOperationBackup  AuditOperation = "Backup"
+	AuditOperationDelete  AuditOperation = "Delete"
+)
+
+// AuditObject defines the type of object affected by an [AuditEvent].
+type AuditObject string
+
+const (
+	AuditObjectCertificate        AuditObject = "Certificate"
+	AuditObjectCertificateRequest AuditObject = "CertificateRequest"
+	AuditObjectRevocationList     AuditObject = "RevocationList"
+	AuditObjectKey                AuditObject = "Key"
+	AuditObjectEntry              AuditObject = "Entry"
+	AuditObjectSecret             AuditObject = "Secret"
+)
+
+// AuditOutcome defines the outcome of the operation recorded by an [AuditEvent].
+//
+// Failed operations are recorded with outcome [AuditOutcomeFailure] and the failure cause as [AuditDetailError].
+type AuditOutcome string
+
+const (
+	AuditOutcomeSuccess AuditOutcome = "Success"
+	AuditOutcomeFailure AuditOutcome = "Failure"
+)
+
+// Well-known keys of [AuditEvent.Details].
+const (
+	AuditDetailSerial  = "serial"
+	AuditDetailFormat  = "format"
+	AuditDetailVersion = "version"
+	AuditDetailIssuer  = "issuer"
+	AuditDetailError   = "error"
+	AuditDetailSecret  = "secret"
+	AuditDetailKeys    = "keys"
+)
+
+// An AuditEvent represents a single record of a store's audit log.
+type AuditEvent struct {
+	// Time is the time the event has been recorded.
+	Time time.Time `json:"time"`
+	// Operation is the recorded operation.
+	Operation AuditOperation `json:"operation"`
+	// Object is the type of the affected object.
+	Object AuditObject `json:"object"`
+	// Name is the name of the affected store entry.
+	Name string `json:"name"`
+	// User is the name of the user invoking the operation.
+	User string `json:"user"`
+	// Outcome is the outcome of the operation.
+	Outcome AuditOutcome `json:"outcome"`
+	// Details contains additional operation specific information (see AuditDetail* constants).
+	Details map[string]string `json:"details,omitempty"`
+	// Sequence is the position of the event within the audit chain (0 for records written before chaining has been introduced).
+	Sequence uint64 `json:"seq,omitempty"`
+	// MAC is the base64 encoded HMAC chaining the event to its predecessor (see [Registry.VerifyAudit]).
+	MAC string `json:"mac,omitempty"`
+}
+
+func (event *AuditEvent) String() string {
+	return fmt.Sprintf("%d;%s;%s;%s;%s;%s", event.Time.UnixMilli(), event.Operation, event.Object, event.Name, event.User, event.Outcome)
+}
+
+type auditKind struct {
+	operation AuditOperation
+	object    AuditObject
+}
+
+var (
+	auditCreateCertificate        = auditKind{AuditOperationCreate, AuditObjectCertificate}
+	auditCreateCertificateRequest = auditKind{AuditOperationCreate, AuditObjectCertificateRequest}
+	auditCreateRevocationList     = auditKind{AuditOperationCreate, AuditObjectRevocationList}
+	auditAccessKey                = auditKind{AuditOperationAccess, AuditObjectKey}
+	auditSignCertificateRequest   = auditKind{AuditOperationSign, AuditObjectCertificateRequest}
+	auditMergeCertificate         = auditKind{AuditOperationMerge, AuditObjectCertificate}
+	auditMergeCertificateRequest  = auditKind{AuditOperationMerge, AuditObjectCertificateRequest}
+	auditMergeKey                 = auditKind{AuditOperationMerge, AuditObjectKey}
+	auditMergeRevocationList      = auditKind{AuditOperationMerge, AuditObjectRevocationList}
+	auditRevokeCertificate        = auditKind{AuditOperationRevoke, AuditObjectCertificate}
+	auditRenewCertificate         = auditKind{AuditOperationRenew, AuditObjectCertificate}
+	auditExportCertificate        = auditKind{AuditOperationExport, AuditObjectCertificate}
+	auditRotateSecret             = auditKind{AuditOperationRotate, AuditObjectSecret}
+	auditUpgradeKeys              = auditKind{AuditOperationUpgrade, AuditObjectKey}
+	auditMigrate                  = auditKind{AuditOperationMigrate, AuditObjectEntry}
+	auditRestore                  = auditKind{AuditOperationRestore, AuditObjectEntry}
+	auditDelete                   = auditKind{AuditOperationDelete, AuditObjectEntry}
+	auditBackup                   = auditKind{AuditOperationBackup, AuditObjectEntry}
+)
+
+type auditDetail struct {
+	key   string
+	value string
+}
+
+func auditSerial(serialNumber *big.Int) auditDetail {
+	return auditDetail{key: AuditDetailSerial, value: serialNumber.Text(16)}
+}
+
+func auditFormat(format ExportFormat) auditDetail {
+	return auditDetail{key: AuditDetailFormat, value: format.Name()}
+}
+
+func auditVersion(version storage.Version) auditDetail {
+	return auditDetail{key: AuditDetailVersion, value: strconv.FormatUint(uint64(version), 10)}
+}
+
+func auditSecret(secretID uint32) auditDetail {
+	return auditDetail{key: AuditDetailSecret, value: strconv.FormatUint(uint64(secretID), 10)}
+}
+
+func auditKeys(included bool) auditDetail {
+	return auditDetail{key: AuditDetailKeys, value: strconv.FormatBool(included)}
+}
+
+func auditIssuer(issuerName string) auditDetail {
+	return auditDetail{key: AuditDetailIssuer, value: issuerName}
+}
+
+func auditError(err error) auditDetail {
+	return auditDetail{key: AuditDetailError, value: err.Error()}
+}
+
+func (registry *Registry) audit(kind auditKind, name string, user string, details ...auditDetail) error {
+	return registry.writeAuditEvent(newAuditEvent(kind, name, user, AuditOutcomeSuccess, details))
+}
+
+// auditFailure records the failed invocation of an operation and returns the submitted cause. As the cause is
+// reported to the caller anyway, failing to record the event is only logged.
+func (registry *Registry) auditFailure(kind auditKind, name string, user string, cause error, details ...auditDetail) error {
+	_ = registry.writeAuditEvent(newAuditEvent(kind, name, user, AuditOutcomeFailure, append(details, auditError(cause))))
+	return cause
+}
+
+func newAuditEvent(kind auditKind, name string, user string, outcome AuditOutcome, details []auditDetail) *AuditEvent {
+	event := &AuditEvent{
+		Time:      time.Now(),
+		Operation: kind.operation,
+		Object:    kind.object,
+		Name:      name,
+		User:      user,
+		Outcome:   outcome,
+	}
+	if len(details) > 0 {
+		event.Details = make(map[string]string, len(details))
+		for _, detail := range details {
+			event.Details[detail.key] = detail.value
+		}
+	}
+	return event
+}
+
+// writeAuditEvent writes the submitted event to the store's own audit log (applying the store's [AuditFailurePolicy]
+// in case of failure) and afterwards to the additional audit sinks (whose failures are only logged).
+func (registry *Registry) writeAuditEvent(event *AuditEvent) error {
+	err := registry.auditSink.Write(event)
+	if err != nil {
+		if registry.auditFailurePolicy == AuditFailureExit {
+			registry.logger.Fatal().Err(err).Msgf("failed to write audit log '%s'", event)
+		}
+		registry.logger.Error().Err(err).Msgf("failed to write audit log '%s'", event)
+		return fmt.Errorf("%w '%s' (cause: %w)", ErrAuditFailed, event, err)
+	}
+	if registry.auditSinks != nil {
+		err = registry.auditSinks.Write(event)
+		if err != nil {
+			registry.logger.Error().Err(err).Msgf("failed to forward audit log '%s'", event)
+		}
+	}
+	return nil
+}
+
+// An AuditFilter selects the events returned by [Registry.AuditLog].
+//
+// Unset (zero) fields do not restrict the selection.
+type AuditFilter struct {
+	// From selects the events recorded at or after the given time.
+	From time.Time
+	// To selects the events recorded before the given time.
+	To time.Time
+	// User selects the events of the given user.
+	User string
+	// Name selects the events affecting the given store entry.
+	Name string
+	// Operation selects the events of the given operation.
+	Operation AuditOperation
+}
+
+func (filter *AuditFilter) match(event *AuditEvent) bool {
+	if filter == nil {
+		return true
+	}
+	if !filter.From.IsZero() && event.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !event.Time.Before(filter.To) {
+		return false
+	}
+	if filter.User != "" && event.User != filter.User {
+		return false
+	}
+	if filter.Name != "" && event.Name != filter.Name {
+		return false
+	}
+	if filter.Operation != "" && event.Operation != filter.Operation {
+		return false
+	}
+	return true
+}
+
+// AuditEvents represents a traversable collection of audit events.
+type AuditEvents struct {
+	events []*AuditEvent
+	next   int
+}
+
+// Next gets the next audit event (in the order they have been recorded).
+//
+// nil is returned, if the end of the collection has been reached.
+func (events *AuditEvents) Next() (*AuditEvent, error) {
+	if events.next >= len(events.events) {
+		return nil, nil
+	}
+	event := events.events[events.next]
+	events.next++
+	return event, nil
+}
+
+// AuditLog reads the store's audit log and returns the events matching the submitted filter.
+//
+// A nil filter selects all events. Records written by previous versions in the legacy
+// semicolon separated format are converted into [AuditEvent]s.
+func (registry *Registry) AuditLog(filter *AuditFilter) (*AuditEvents, error) {
+	lines, err := readAuditLines(registry.backend, storeAuditName)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*AuditEvent, 0)
+	for lineIndex, line := range lines {
+		lineEvents, err := parseAuditLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse audit log line %d (cause: %w)", lineIndex+1, err)
+		}
+		for _, event := range lineEvents {
+			if filter.match(event) {
+				events = append(events, event)
+			}
+		}
+	}
+	return &AuditEvents{events: events}, nil
+}
+
+func parseAuditLine(line []byte) ([]*AuditEvent, error) {
+	if line[0] == '{' {
+		event := &AuditEvent{}
+		err := json.Unmarshal(line, event)
+		if err != nil {
+			return nil, err
+		}
+		return []*AuditEvent{event}, nil
+	}
+	return parseLegacyAuditRecords(string(line))
+}
+
+// Legacy records have been written without separator (e.g. "1700000000000;Create;Certificate;name;user1700000000001;Access;...").
+// Record boundaries are detected via the leading millisecond timestamp followed by a known operation.
+var legacyAuditRecordStart = regexp.MustCompile(`\d{13};(Create|Access|Sign|Merge|Revoke|Renew|Restore|Delete);`)
+
+func parseLegacyAuditRecords(records string) ([]*AuditEvent, error) {
+	starts := legacyAuditRecordStart.FindAllStringIndex(records, -1)
+	if len(starts) == 0 || starts[0][0] != 0 {
+		return nil, fmt.Errorf("unrecognized audit record '%s'", records)
+	}
+	events := make([]*AuditEvent, 0, len(starts))
+	for startIndex, start := range starts {
+		end := len(records)
+		if startIndex+1 < len(starts) {
+			end = starts[startIndex+1][0]
+		}
+		event, err := parseLegacyAuditRecord(records[start[0]:end])
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func parseLegacyAuditRecord(record string) (*AuditEvent, error) {
+	fields := strings.SplitN(record, ";", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid audit record '%s'", record)
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit record timestamp '%s' (cause: %w)", fields[0], err)
+	}
+	separator := strings.LastIndex(fields[3], ";")
+	if separator < 0 {
+		return nil, fmt.Errorf("invalid audit record '%s'", record)
+	}
+	object := AuditObject(fields[2])
+	if object == "-" {
+		object = AuditObjectEntry
+	}
+	return &AuditEvent{
+		Time:      time.UnixMilli(timestamp),
+		Operation: AuditOperation(fields[1]),
+		Object:    object,
+		Name:      fields[3][:separator],
+		User:      fields[3][separator+1:],
+		Outcome:   AuditOutcomeSuccess,
+	}, nil
+}
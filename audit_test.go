@@ -0,0 +1,290 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	name := "TestAuditLog"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	// legacy records
+	err = os.MkdirAll(filepath.Join(path, ".audit"), 0700)
+	require.NoError(t, err)
+	legacy := "1700000000000;Create;Certificate;legacy;legacyUser1700000000001;Access;Key;legacy;legacyUser1700000000002;Delete;-;legacy;legacyUser"
+	err = os.WriteFile(filepath.Join(path, ".audit", "log"), []byte(legacy), 0600)
+	require.NoError(t, err)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	registry, err := certstore.NewStore(backend, testCacheTTL)
+	require.NoError(t, err)
+	start := time.Now()
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	err = entry.Export(io.Discard, certstore.ExportFormatPEM, certstore.ExportOptionKey, "", user)
+	require.NoError(t, err)
+	// all
+	events := readAuditEvents(t, registry, nil)
+	require.Len(t, events, 6)
+	require.Equal(t, &certstore.AuditEvent{
+		Time:      time.UnixMilli(1700000000001),
+		Operation: certstore.AuditOperationAccess,
+		Object:    certstore.AuditObjectKey,
+		Name:      "legacy",
+		User:      "legacyUser",
+		Outcome:   certstore.AuditOutcomeSuccess,
+	}, events[1])
+	require.Equal(t, certstore.AuditObjectEntry, events[2].Object)
+	require.Equal(t, certstore.AuditOperationCreate, events[3].Operation)
+	require.Equal(t, entry.Certificate().SerialNumber.Text(16), events[3].Details[certstore.AuditDetailSerial])
+	require.Equal(t, certstore.AuditOperationExport, events[5].Operation)
+	require.Equal(t, certstore.ExportFormatPEM.Name(), events[5].Details[certstore.AuditDetailFormat])
+	// time range
+	events = readAuditEvents(t, registry, &certstore.AuditFilter{From: start})
+	require.Len(t, events, 3)
+	events = readAuditEvents(t, registry, &certstore.AuditFilter{To: start})
+	require.Len(t, events, 3)
+	// user
+	events = readAuditEvents(t, registry, &certstore.AuditFilter{User: "legacyUser"})
+	require.Len(t, events, 3)
+	// name and operation
+	events = readAuditEvents(t, registry, &certstore.AuditFilter{Name: createdName, Operation: certstore.AuditOperationAccess})
+	require.Len(t, events, 1)
+	require.Equal(t, certstore.AuditObjectKey, events[0].Object)
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	name := "TestAuditLogFailure"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	err = registry.Delete(name, user)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	events := readAuditEvents(t, registry, &certstore.AuditFilter{Name: name})
+	require.Len(t, events, 1)
+	require.Equal(t, certstore.AuditOperationDelete, events[0].Operation)
+	require.Equal(t, certstore.AuditOutcomeFailure, events[0].Outcome)
+	require.Equal(t, err.Error(), events[0].Details[certstore.AuditDetailError])
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func TestAuditLogEmpty(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	events := readAuditEvents(t, registry, nil)
+	require.Empty(t, events)
+}
+
+func readAuditEvents(t *testing.T, registry *certstore.Registry, filter *certstore.AuditFilter) []*certstore.AuditEvent {
+	auditEvents, err := registry.AuditLog(filter)
+	require.NoError(t, err)
+	events := make([]*certstore.AuditEvent, 0)
+	for {
+		event, err := auditEvents.Next()
+		require.NoError(t, err)
+		if event == nil {
+			break
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestVerifyAudit(t *testing.T) {
+	name := "TestVerifyAudit"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	for range 249 {
+		entry.Key(user)
+	}
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, 250, verification.Records)
+	require.Equal(t, 3, verification.Checkpoints)
+}
+
+func TestVerifyAuditCheckpointSigner(t *testing.T) {
+	name := "TestVerifyAuditCheckpointSigner"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	registry, err := certstore.NewStore(backend, 0, certstore.WithAuditCheckpointSigner(signer))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	for range 99 {
+		entry.Key(user)
+	}
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, 2, verification.Checkpoints)
+	require.Equal(t, 2, verification.Signed)
+	// signed checkpoints are not verifiable without the signer
+	unsigned, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	verification, err = unsigned.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, 0, verification.Signed)
+	// another signer
+	_, otherSigner, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := certstore.NewStore(backend, 0, certstore.WithAuditCheckpointSigner(otherSigner))
+	require.NoError(t, err)
+	verification, err = other.VerifyAudit()
+	require.NoError(t, err)
+	require.False(t, verification.Valid())
+	require.Equal(t, "invalid checkpoint signature", verification.Reason)
+	// unsigned checkpoints
+	entry, err = unsigned.Entry(createdName)
+	require.NoError(t, err)
+	for range 100 {
+		entry.Key(user)
+	}
+	verification, err = registry.VerifyAudit()
+	require.NoError(t, err)
+	require.False(t, verification.Valid())
+	require.Equal(t, uint64(200), verification.Broken)
+	require.Equal(t, "unsigned checkpoint", verification.Reason)
+}
+
+func TestVerifyAuditSharedBackend(t *testing.T) {
+	name := "TestVerifyAuditSharedBackend"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry1 := openTestFSStore(t, path)
+	createdName, err := registry1.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	registry2 := openTestFSStore(t, path)
+	entry1, err := registry1.Entry(createdName)
+	require.NoError(t, err)
+	entry2, err := registry2.Entry(createdName)
+	require.NoError(t, err)
+	// both registries continue the same chain
+	for range 60 {
+		require.NotNil(t, entry1.Key(user))
+		require.NotNil(t, entry2.Key(user))
+	}
+	for _, registry := range []*certstore.Registry{registry1, registry2} {
+		verification, err := registry.VerifyAudit()
+		require.NoError(t, err)
+		require.True(t, verification.Valid(), verification.Reason)
+		require.Equal(t, 121, verification.Records)
+		require.Equal(t, 2, verification.Checkpoints)
+	}
+}
+
+func TestVerifyAuditTampered(t *testing.T) {
+	name := "TestVerifyAuditTampered"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	// legacy records
+	err = os.MkdirAll(filepath.Join(path, ".audit"), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(path, ".audit", "log"), []byte("1700000000000;Create;Certificate;legacy;legacyUser"), 0600)
+	require.NoError(t, err)
+	registry := openTestFSStore(t, path)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	// re-open to continue existing chain
+	registry = openTestFSStore(t, path)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	for range 109 {
+		entry.Key(user)
+	}
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, 111, verification.Records)
+	require.Equal(t, 1, verification.Unchained)
+	require.Equal(t, 2, verification.Checkpoints)
+	logPath := filepath.Join(path, ".audit", "log")
+	original, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(original), "\n")
+	// modified record
+	tampered := slices.Clone(lines)
+	tampered[5] = strings.Replace(tampered[5], user, "Mallory", 1)
+	checkTamperedAudit(t, registry, logPath, tampered, 5, "MAC mismatch")
+	// removed record
+	tampered = slices.Delete(slices.Clone(lines), 10, 11)
+	checkTamperedAudit(t, registry, logPath, tampered, 10, "missing record")
+	// truncated log
+	tampered = slices.Clone(lines)[:50]
+	checkTamperedAudit(t, registry, logPath, tampered, 50, "missing record")
+	// records re-written as unchained records
+	tampered = []string{lines[0], lines[0]}
+	checkTamperedAudit(t, registry, logPath, tampered, 1, "unchained records")
+	// truncated log without checkpoints
+	checkpointsPath := filepath.Join(path, ".audit.checkpoints", "log")
+	checkpoints, err := os.ReadFile(checkpointsPath)
+	require.NoError(t, err)
+	err = os.Remove(checkpointsPath)
+	require.NoError(t, err)
+	tampered = slices.Clone(lines)[:50]
+	checkTamperedAudit(t, registry, logPath, tampered, 1, "missing checkpoint log")
+	// intact log
+	err = os.WriteFile(checkpointsPath, checkpoints, 0600)
+	require.NoError(t, err)
+	err = os.WriteFile(logPath, original, 0600)
+	require.NoError(t, err)
+	verification, err = registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func checkTamperedAudit(t *testing.T, registry *certstore.Registry, logPath string, lines []string, broken uint64, reason string) {
+	err := os.WriteFile(logPath, []byte(strings.Join(lines, "")), 0600)
+	require.NoError(t, err)
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.False(t, verification.Valid())
+	require.Equal(t, broken, verification.Broken)
+	require.Contains(t, verification.Reason, reason)
+}
+
+func openTestFSStore(t *testing.T, path string) *certstore.Registry {
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	registry, err := certstore.NewStore(backend, testCacheTTL)
+	require.NoError(t, err)
+	return registry
+}
@@ -0,0 +1,684 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/hkdf"
+)
+
+const storeAuditCheckpointsName = ".audit.checkpoints"
+
+const auditCheckpointInterval = 100
+
+// countUnchainedAuditRecords counts the leading audit records written before chaining has been introduced.
+func countUnchainedAuditRecords(backend storage.Backend) (int, error) {
+	lines, err := readAuditLines(backend, storeAuditName)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	unchained := 0
+	for _, line := range lines {
+		events, err := parseAuditLine(line)
+		if err != nil || events[0].Sequence != 0 {
+			break
+		}
+		unchained += len(events)
+	}
+	return unchained, nil
+}
+
+// lastAuditSequence gets the sequence number of the audit log's last record (0, if the log is empty or unchained).
+func lastAuditSequence(backend storage.Backend) (uint64, error) {
+	lines, err := readAuditLines(backend, storeAuditName)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(lines) == 0 {
+		return 0, nil
+	}
+	sequence, _, err := parseAuditChainHead(lines[len(lines)-1])
+	return sequence, err
+}
+
+const auditKeyInfo = "certstore audit"
+const auditCheckpointKeyInfo = "certstore audit checkpoint"
+
+// WithAuditCheckpointSigner sets the [crypto.Signer] used for signing the checkpoints of the store's audit log
+// (see [Registry.VerifyAudit]). Supported are RSA, ECDSA and Ed25519 keys (including keys held by a [keys.KeyStore]).
+//
+// Without a checkpoint signer, checkpoints are authenticated with a key derived from the store's audit key. As the
+// audit key is kept in the store's settings, anyone able to read the settings and to write the audit logs can forge
+// records as well as checkpoints. A checkpoint signer kept outside of the store (e.g. in a HSM) anchors the audit
+// log independently of the store's settings.
+func WithAuditCheckpointSigner(signer crypto.Signer) StoreOption {
+	return func(options *storeOptions) {
+		options.auditCheckpointSigner = signer
+	}
+}
+
+// auditChain links the records of the audit log via HMACs and periodically writes signed checkpoints of
+// the chain's head to a separate log. The chain state is initialized lazily from the existing audit log.
+type auditChain struct {
+	backend       storage.Backend
+	key           []byte
+	checkpointKey []byte
+	signer        crypto.Signer
+	signerID      string
+	mutex         sync.Mutex
+	initialized   bool
+	sequence      uint64
+	mac           []byte
+	logger        *zerolog.Logger
+}
+
+func newAuditChain(backend storage.Backend, settings *storeSettings, signer crypto.Signer, logger *zerolog.Logger) (*auditChain, error) {
+	masterKey, err := settings.auditKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveAuditKey(masterKey, auditKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	checkpointKey, err := deriveAuditKey(masterKey, auditCheckpointKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	chain := &auditChain{
+		backend:       backend,
+		key:           key,
+		checkpointKey: checkpointKey,
+		signer:        signer,
+		logger:        logger,
+	}
+	if signer != nil {
+		chain.signerID, err = auditSignerID(signer.Public())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// auditSignerID identifies a checkpoint signer via the SHA-256 digest of its public key.
+func auditSignerID(publicKey crypto.PublicKey) (string, error) {
+	publicKeyData, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit checkpoint signer (cause: %w)", err)
+	}
+	digest := sha256.Sum256(publicKeyData)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func deriveAuditKey(masterKey []byte, info string) ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(info)), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive audit key (cause: %w)", err)
+	}
+	return key, nil
+}
+
+// Name implements [AuditSink].
+func (chain *auditChain) Name() string {
+	return "store"
+}
+
+// Write implements [AuditSink].
+//
+// If the store's backend implements [storage.LogAppenderBackend], the chain's head is read from the audit log while
+// appending the event. Hence multiple registries (or processes) sharing the same backend continue a single chain.
+// Otherwise the chain's head is read once and tracked in memory, which is only consistent for a single writer.
+// A checkpoint is written for the first record of the chain as well as for every 100th record.
+func (chain *auditChain) Write(event *AuditEvent) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	var mac []byte
+	appender, ok := chain.backend.(storage.LogAppenderBackend)
+	if ok {
+		err := appender.AppendLog(storeAuditName, func(last []byte) (string, []storage.LogMessage, error) {
+			sequence, previousMAC, err := parseAuditChainHead(last)
+			if err != nil {
+				return "", nil, err
+			}
+			chain.sequence = sequence
+			chain.mac = previousMAC
+			var message string
+			message, mac, err = chain.chainEvent(event)
+			if err != nil {
+				return "", nil, err
+			}
+			if !isAuditCheckpoint(event.Sequence) {
+				return message, nil, nil
+			}
+			checkpoint, err := chain.checkpointMessage(event.Sequence, mac)
+			if err != nil {
+				return "", nil, err
+			}
+			return message, []storage.LogMessage{{Name: storeAuditCheckpointsName, Message: checkpoint}}, nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		if !chain.initialized {
+			err := chain.init()
+			if err != nil {
+				return err
+			}
+		}
+		var message string
+		var err error
+		message, mac, err = chain.chainEvent(event)
+		if err != nil {
+			return err
+		}
+		err = chain.backend.Log(storeAuditName, message)
+		if err != nil {
+			return err
+		}
+		if isAuditCheckpoint(event.Sequence) {
+			checkpoint, err := chain.checkpointMessage(event.Sequence, mac)
+			if err != nil {
+				return err
+			}
+			err = chain.backend.Log(storeAuditCheckpointsName, checkpoint)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	chain.sequence = event.Sequence
+	chain.mac = mac
+	return nil
+}
+
+// commit chains the submitted events, stages the resulting audit records within the submitted transaction and
+// commits the latter. Hence the events are recorded if and only if the transaction's modifications are applied.
+// The chain is locked until the commit has finished, so that the staged records continue the chain's current head.
+func (chain *auditChain) commit(tx *storage.Transaction, events []*AuditEvent) error {
+	if len(events) == 0 {
+		return tx.Commit()
+	}
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	err := chain.head()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sequence := chain.sequence
+	mac := chain.mac
+	for _, event := range events {
+		err = chain.stageEvent(tx, event)
+		if err != nil {
+			tx.Rollback()
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil && !errors.Is(err, storage.ErrCommitPending) {
+		chain.sequence = sequence
+		chain.mac = mac
+	}
+	return err
+}
+
+// head determines the chain's current head. If the store's backend implements [storage.LogAppenderBackend], the
+// head is read from the audit log. Otherwise the tracked head is used.
+func (chain *auditChain) head() error {
+	appender, ok := chain.backend.(storage.LogAppenderBackend)
+	if ok {
+		return appender.AppendLog(storeAuditName, func(last []byte) (string, []storage.LogMessage, error) {
+			sequence, mac, err := parseAuditChainHead(last)
+			if err != nil {
+				return "", nil, err
+			}
+			chain.sequence = sequence
+			chain.mac = mac
+			return "", nil, nil
+		})
+	}
+	if !chain.initialized {
+		return chain.init()
+	}
+	return nil
+}
+
+func (chain *auditChain) stageEvent(tx *storage.Transaction, event *AuditEvent) error {
+	message, mac, err := chain.chainEvent(event)
+	if err != nil {
+		return err
+	}
+	err = tx.Log(storeAuditName, message)
+	if err != nil {
+		return err
+	}
+	if isAuditCheckpoint(event.Sequence) {
+		checkpoint, err := chain.checkpointMessage(event.Sequence, mac)
+		if err != nil {
+			return err
+		}
+		err = tx.Log(storeAuditCheckpointsName, checkpoint)
+		if err != nil {
+			return err
+		}
+	}
+	chain.sequence = event.Sequence
+	chain.mac = mac
+	return nil
+}
+
+func isAuditCheckpoint(sequence uint64) bool {
+	return sequence == 1 || sequence%auditCheckpointInterval == 0
+}
+
+// anchor writes a checkpoint of the chain's current head, if the store has been set up before checkpoints became
+// mandatory and no checkpoint has been written so far. If always is set (the audit key has been replaced), the
+// checkpoint is written in any case.
+func (chain *auditChain) anchor(always bool) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	checkpointLines, err := readAuditLines(chain.backend, storeAuditCheckpointsName)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(checkpointLines) > 0 && !always {
+		return nil
+	}
+	appender, ok := chain.backend.(storage.LogAppenderBackend)
+	if ok {
+		return appender.AppendLog(storeAuditName, func(last []byte) (string, []storage.LogMessage, error) {
+			sequence, mac, err := parseAuditChainHead(last)
+			if err != nil || sequence == 0 {
+				return "", nil, err
+			}
+			checkpoint, err := chain.checkpointMessage(sequence, mac)
+			if err != nil {
+				return "", nil, err
+			}
+			return "", []storage.LogMessage{{Name: storeAuditCheckpointsName, Message: checkpoint}}, nil
+		})
+	}
+	if !chain.initialized {
+		err = chain.init()
+		if err != nil {
+			return err
+		}
+	}
+	if chain.sequence == 0 {
+		return nil
+	}
+	checkpoint, err := chain.checkpointMessage(chain.sequence, chain.mac)
+	if err != nil {
+		return err
+	}
+	return chain.backend.Log(storeAuditCheckpointsName, checkpoint)
+}
+
+// chainEvent links the submitted event to the chain's current head and returns the resulting audit record
+// as well as the record's MAC.
+func (chain *auditChain) chainEvent(event *AuditEvent) (string, []byte, error) {
+	event.Sequence = chain.sequence + 1
+	mac, err := chain.eventMAC(event, chain.mac)
+	if err != nil {
+		return "", nil, err
+	}
+	event.MAC = base64.StdEncoding.EncodeToString(mac)
+	message, err := json.Marshal(event)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal audit event (cause: %w)", err)
+	}
+	chain.logger.Info().Msgf("audit: %s", message)
+	return string(message), mac, nil
+}
+
+// Close implements [AuditSink].
+func (chain *auditChain) Close() error {
+	return nil
+}
+
+func (chain *auditChain) init() error {
+	lines, err := readAuditLines(chain.backend, storeAuditName)
+	if errors.Is(err, errors.ErrUnsupported) {
+		chain.logger.Warn().Err(err).Msg("audit log not readable; starting new audit chain")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(lines) > 0 {
+		chain.sequence, chain.mac, err = parseAuditChainHead(lines[len(lines)-1])
+		if err != nil {
+			return err
+		}
+	}
+	chain.initialized = true
+	return nil
+}
+
+// parseAuditChainHead determines sequence and MAC of the chain's head from the last audit record. If the log is
+// empty or the last record has been written before chaining has been introduced, a new chain is started.
+func parseAuditChainHead(last []byte) (uint64, []byte, error) {
+	if len(last) == 0 {
+		return 0, nil, nil
+	}
+	events, err := parseAuditLine(last)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse last audit record (cause: %w)", err)
+	}
+	head := events[len(events)-1]
+	if head.Sequence == 0 {
+		return 0, nil, nil
+	}
+	mac, err := base64.StdEncoding.DecodeString(head.MAC)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decode last audit record MAC (cause: %w)", err)
+	}
+	return head.Sequence, mac, nil
+}
+
+func (chain *auditChain) eventMAC(event *AuditEvent, previousMAC []byte) ([]byte, error) {
+	unsigned := *event
+	unsigned.MAC = ""
+	message, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal audit event (cause: %w)", err)
+	}
+	hash := hmac.New(sha256.New, chain.key)
+	hash.Write(previousMAC)
+	hash.Write(message)
+	return hash.Sum(nil), nil
+}
+
+type auditCheckpoint struct {
+	Time      time.Time `json:"time"`
+	Sequence  uint64    `json:"seq"`
+	MAC       string    `json:"mac"`
+	Signer    string    `json:"signer,omitempty"`
+	Signature string    `json:"signature"`
+}
+
+func (chain *auditChain) checkpointMessage(sequence uint64, mac []byte) (string, error) {
+	checkpoint := &auditCheckpoint{
+		Time:     time.Now(),
+		Sequence: sequence,
+		MAC:      base64.StdEncoding.EncodeToString(mac),
+	}
+	if chain.signer != nil {
+		checkpoint.Signer = chain.signerID
+		digest := checkpoint.digest()
+		signature, err := chain.signer.Sign(rand.Reader, digest, auditSignerOpts(chain.signer.Public()))
+		if err != nil {
+			return "", fmt.Errorf("failed to sign audit checkpoint (cause: %w)", err)
+		}
+		checkpoint.Signature = base64.StdEncoding.EncodeToString(signature)
+	} else {
+		checkpoint.Signature = base64.StdEncoding.EncodeToString(chain.checkpointSignature(checkpoint))
+	}
+	message, err := json.Marshal(checkpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit checkpoint (cause: %w)", err)
+	}
+	chain.logger.Debug().Msgf("writing audit checkpoint %d...", checkpoint.Sequence)
+	return string(message), nil
+}
+
+func (chain *auditChain) checkpointSignature(checkpoint *auditCheckpoint) []byte {
+	hash := hmac.New(sha256.New, chain.checkpointKey)
+	hash.Write(binary.BigEndian.AppendUint64(nil, checkpoint.Sequence))
+	hash.Write(binary.BigEndian.AppendUint64(nil, uint64(checkpoint.Time.UnixNano())))
+	hash.Write([]byte(checkpoint.MAC))
+	return hash.Sum(nil)
+}
+
+func (checkpoint *auditCheckpoint) digest() []byte {
+	hash := sha256.New()
+	hash.Write(binary.BigEndian.AppendUint64(nil, checkpoint.Sequence))
+	hash.Write(binary.BigEndian.AppendUint64(nil, uint64(checkpoint.Time.UnixNano())))
+	hash.Write([]byte(checkpoint.MAC))
+	hash.Write([]byte(checkpoint.Signer))
+	return hash.Sum(nil)
+}
+
+// auditSignerOpts gets the options for signing a checkpoint digest. Ed25519 keys sign the digest as is.
+func auditSignerOpts(publicKey crypto.PublicKey) crypto.SignerOpts {
+	_, ok := publicKey.(ed25519.PublicKey)
+	if ok {
+		return crypto.Hash(0)
+	}
+	return crypto.SHA256
+}
+
+// verifyCheckpointSignature verifies a checkpoint signed by the chain's checkpoint signer.
+func (chain *auditChain) verifyCheckpointSignature(checkpoint *auditCheckpoint) bool {
+	signature, err := base64.StdEncoding.DecodeString(checkpoint.Signature)
+	if err != nil {
+		return false
+	}
+	digest := checkpoint.digest()
+	switch publicKey := chain.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(publicKey, digest, signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, digest, signature)
+	}
+	return false
+}
+
+// AuditVerification reports the result of an audit log verification (see [Registry.VerifyAudit]).
+type AuditVerification struct {
+	// Records is the number of records found in the audit log.
+	Records int
+	// Unchained is the number of leading records written before chaining has been introduced (and hence not verifiable).
+	// Unchained records are reported as broken, if their number differs from the one recorded while introducing chaining.
+	Unchained int
+	// Unverified is the number of chained records, whose MAC could not be verified, because they have been chained with
+	// an audit key replaced in the meantime (see [Registry.VerifyAudit]). These records are only checked for continuity.
+	Unverified int
+	// Checkpoints is the number of checkpoints found.
+	Checkpoints int
+	// Signed is the number of checkpoints verified against the checkpoint signer (see [WithAuditCheckpointSigner]).
+	Signed int
+	// Broken is the sequence number of the first broken or missing record (0, if the audit log is intact).
+	Broken uint64
+	// Reason describes why the record denoted by Broken failed verification.
+	Reason string
+}
+
+// Valid determines whether the verified audit log is intact (true) or not (false).
+func (verification *AuditVerification) Valid() bool {
+	return verification.Broken == 0
+}
+
+func (verification *AuditVerification) fail(sequence uint64, reason string) {
+	if verification.Broken == 0 || sequence < verification.Broken {
+		verification.Broken = sequence
+		verification.Reason = reason
+	}
+}
+
+// VerifyAudit verifies the integrity of the store's audit log.
+//
+// Each audit record is chained to its predecessor via an HMAC keyed with the store's audit key. Every 100 records
+// a signed checkpoint of the chain's head is written to a separate log. Verification recomputes the chain and
+// checks it against the checkpoints. Hence modified, removed or inserted records as well as a truncated audit log
+// (up to the last checkpoint) are detected. Records re-written as unchained records as well as a missing checkpoint log
+// are detected, too. Records chained before a store's audit key has been replaced by a dedicated one while
+// migrating schema 0 settings are only checked for continuity and are reported as unverified.
+//
+// The audit key is kept in the store's settings. Hence the chain only protects against parties able to modify
+// the audit logs, but not able to read the store's settings. To protect against the latter, checkpoints have to be
+// signed by a checkpoint signer kept outside of the store (see [WithAuditCheckpointSigner]). If this registry has
+// been opened with a checkpoint signer, unsigned checkpoints following a signed one are reported as broken.
+// If this registry has been opened without a checkpoint signer, signed checkpoints are only checked against the
+// chain.
+//
+// The returned [AuditVerification] reports the first broken or missing record. An error is returned only, if the
+// audit log cannot be read.
+func (registry *Registry) VerifyAudit() (*AuditVerification, error) {
+	chain := registry.auditChain
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+	verification := &AuditVerification{}
+	lines, err := readAuditLines(registry.backend, storeAuditName)
+	if err != nil {
+		return nil, err
+	}
+	heads := make(map[uint64]string)
+	anchored := registry.settings.Schema >= storeSettingsSchemaV2
+	rekeyed := registry.settings.AuditRekeyed
+	var previousMAC []byte
+	sequence := uint64(0)
+	for _, line := range lines {
+		events, err := parseAuditLine(line)
+		if err != nil {
+			verification.fail(sequence+1, fmt.Sprintf("malformed record (cause: %s)", err))
+			break
+		}
+		verification.Records += len(events)
+		event := events[0]
+		if event.Sequence == 0 {
+			if sequence == 0 {
+				verification.Unchained += len(events)
+				continue
+			}
+			verification.fail(sequence+1, "unchained record")
+			break
+		}
+		if event.Sequence != sequence+1 {
+			verification.fail(sequence+1, fmt.Sprintf("missing record (found sequence %d)", event.Sequence))
+			break
+		}
+		var mac []byte
+		if event.Sequence <= rekeyed {
+			// chained with the audit key previously derived from the initial store secret
+			mac, err = base64.StdEncoding.DecodeString(event.MAC)
+			if err != nil {
+				verification.fail(event.Sequence, "malformed MAC")
+				break
+			}
+			verification.Unverified += len(events)
+		} else {
+			mac, err = chain.eventMAC(event, previousMAC)
+			if err != nil {
+				return nil, err
+			}
+			if !hmac.Equal([]byte(base64.StdEncoding.EncodeToString(mac)), []byte(event.MAC)) {
+				verification.fail(event.Sequence, "MAC mismatch")
+				break
+			}
+		}
+		sequence = event.Sequence
+		previousMAC = mac
+		heads[sequence] = event.MAC
+	}
+	if anchored && verification.Unchained != registry.settings.AuditUnchained {
+		verification.fail(1, fmt.Sprintf("unchained records (expected: %d found: %d)", registry.settings.AuditUnchained, verification.Unchained))
+	}
+	checkpointLines, err := readAuditLines(registry.backend, storeAuditCheckpointsName)
+	if err != nil {
+		return nil, err
+	}
+	if anchored && sequence > 0 && len(checkpointLines) == 0 {
+		verification.fail(1, "missing checkpoint log")
+	}
+	signed := uint64(0)
+	for _, checkpointLine := range checkpointLines {
+		checkpoint := &auditCheckpoint{}
+		err = json.Unmarshal(checkpointLine, checkpoint)
+		if err != nil {
+			verification.fail(sequence+1, fmt.Sprintf("malformed checkpoint (cause: %s)", err))
+			continue
+		}
+		verification.Checkpoints++
+		if checkpoint.Signer != "" {
+			if chain.signer != nil {
+				if checkpoint.Signer != chain.signerID || !chain.verifyCheckpointSignature(checkpoint) {
+					verification.fail(checkpoint.Sequence, "invalid checkpoint signature")
+					continue
+				}
+				verification.Signed++
+				signed = max(signed, checkpoint.Sequence)
+			}
+		} else if chain.signer != nil && signed > 0 {
+			verification.fail(checkpoint.Sequence, "unsigned checkpoint")
+			continue
+		} else {
+			signature, err := base64.StdEncoding.DecodeString(checkpoint.Signature)
+			if err != nil || !hmac.Equal(signature, chain.checkpointSignature(checkpoint)) {
+				// checkpoints of records chained with the previous audit key may be signed with this key as well
+				if checkpoint.Sequence > rekeyed {
+					verification.fail(checkpoint.Sequence, "invalid checkpoint signature")
+				}
+				continue
+			}
+		}
+		head, found := heads[checkpoint.Sequence]
+		if !found {
+			verification.fail(sequence+1, fmt.Sprintf("missing record (checkpoint %d)", checkpoint.Sequence))
+		} else if head != checkpoint.MAC {
+			verification.fail(checkpoint.Sequence, "checkpoint mismatch")
+		}
+	}
+	return verification, nil
+}
+
+func readAuditLines(backend storage.Backend, name string) ([][]byte, error) {
+	logReader, err := logReaderBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	log, err := logReader.ReadLog(name)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lines := make([][]byte, 0)
+	start := 0
+	for index, b := range log {
+		if b == '\n' {
+			if index > start {
+				lines = append(lines, log[start:index])
+			}
+			start = index + 1
+		}
+	}
+	if start < len(log) {
+		lines = append(lines, log[start:])
+	}
+	return lines, nil
+}
@@ -0,0 +1,667 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+// ErrPassphraseRequired indicates a backup archive operation requiring a passphrase (see [BackupOptions]).
+var ErrPassphraseRequired = errors.New("passphrase required")
+
+// ErrInvalidBackup indicates a backup archive which is either corrupted, has been tampered with or cannot be decrypted.
+var ErrInvalidBackup = errors.New("invalid backup archive")
+
+// ErrStoreNotEmpty indicates a restore attempt into a non-empty storage backend.
+var ErrStoreNotEmpty = errors.New("store not empty")
+
+const (
+	backupFormat        = "certstore-backup"
+	backupFormatVersion = 1
+)
+
+// backupPlainSecretSettings lists the store settings attributes holding plain secrets (omitted from unencrypted archives).
+var backupPlainSecretSettings = []string{"secret", "retired_secrets", "audit_key"}
+
+const (
+	backupManifestFile         = "manifest.json"
+	backupSettingsFile         = "store"
+	backupAuditFile            = "audit"
+	backupAuditCheckpointsFile = "audit.checkpoints"
+	backupEntriesDir           = "entries/"
+)
+
+// BackupOptions defines the options used by [Registry.Backup].
+type BackupOptions struct {
+	// IncludeKeys includes the entries' keys in the backup archive. Requires Passphrase to be set.
+	IncludeKeys bool
+	// Passphrase is used to encrypt the backup archive (using Argon2id and AES-GCM). If empty, the archive is
+	// written unencrypted and the plain store secrets are omitted (see [RestoreStore]).
+	Passphrase string
+}
+
+// backupHeader is written as the first line of a backup archive.
+type backupHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Protection contains the key derivation parameters of an encrypted archive (the wrapped secret is not used).
+	Protection *storeSecretProtection `json:"protection,omitempty"`
+	// Checksum is the SHA-256 checksum of an unencrypted archive's payload (encrypted payloads are authenticated).
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// backupManifest describes the content of a backup archive.
+type backupManifest struct {
+	Created time.Time     `json:"created"`
+	Source  string        `json:"source"`
+	Keys    bool          `json:"keys"`
+	Entries []backupEntry `json:"entries"`
+	// Checksums contains the SHA-256 checksums of all archive files (except the manifest itself).
+	Checksums map[string]string `json:"checksums"`
+}
+
+type backupEntry struct {
+	Name string `json:"name"`
+	// Versions lists the retained versions (oldest first).
+	Versions []storage.Version `json:"versions"`
+	// Times lists the times the retained versions have been written (in the order of Versions).
+	Times   []time.Time `json:"times,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	// DeletedTime is the time the entry has been deleted.
+	DeletedTime *time.Time `json:"deleted_time,omitempty"`
+}
+
+// versionTime gets the time the submitted version has been written (zero, if the archive does not record it).
+func (entry *backupEntry) versionTime(versionIndex int) time.Time {
+	if len(entry.Times) != len(entry.Versions) {
+		return time.Time{}
+	}
+	return entry.Times[versionIndex]
+}
+
+// deletedTime gets the time the entry has been deleted (zero, if the archive does not record it).
+func (entry *backupEntry) deletedTime() time.Time {
+	if entry.DeletedTime == nil {
+		return time.Time{}
+	}
+	return *entry.DeletedTime
+}
+
+func (entry *backupEntry) versionFile(index int, version storage.Version) string {
+	return backupEntriesDir + strconv.Itoa(index) + "/" + strconv.FormatUint(uint64(version), 10)
+}
+
+// Backup writes a backup archive of the whole store to the given writer.
+//
+// The archive contains all store entries (including deleted ones) with all of their retained versions, the store
+// settings and the audit log. It is restored via [RestoreStore]. Unless [BackupOptions.IncludeKeys] is set, the
+// entries' keys are omitted (key references are retained). As keys are protected by the store settings' secret
+// only, a passphrase is mandatory to include them ([ErrPassphraseRequired] is returned otherwise). Unencrypted
+// archives do not contain the store settings' plain secrets. A nil options value is equivalent to default options.
+//
+// If the store's backend does not implement [storage.HistoryBackend] and [storage.LogReaderBackend],
+// [errors.ErrUnsupported] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name. A successful backup is
+// recorded after the archive has been written completely (hence the archive does not contain its own record).
+func (registry *Registry) Backup(out io.Writer, options *BackupOptions, user string) error {
+	if options == nil {
+		options = &BackupOptions{}
+	}
+	if options.IncludeKeys && options.Passphrase == "" {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, fmt.Errorf("%w (backup includes keys)", ErrPassphraseRequired), auditKeys(options.IncludeKeys))
+	}
+	history, err := historyBackend(registry.backend)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	logReader, err := logReaderBackend(registry.backend)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	registry.settings.rotation.Lock()
+	defer registry.settings.rotation.Unlock()
+	registry.logger.Info().Msgf("creating backup of store '%s'...", registry.backend.URI())
+	manifest := &backupManifest{
+		Created:   time.Now(),
+		Source:    registry.backend.URI(),
+		Keys:      options.IncludeKeys,
+		Entries:   make([]backupEntry, 0),
+		Checksums: make(map[string]string),
+	}
+	files := make(map[string][]byte)
+	err = registry.backupSettings(manifest, files, options.Passphrase == "")
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	err = registry.backupEntries(history, manifest, files, options.IncludeKeys)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	err = backupAuditLogs(logReader, manifest, files)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	payload, err := writeBackupPayload(manifest, files)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+	}
+	header := &backupHeader{Format: backupFormat, Version: backupFormatVersion}
+	if options.Passphrase != "" {
+		header.Protection, payload, err = encryptBackupPayload(payload, options.Passphrase)
+		if err != nil {
+			return registry.auditFailure(auditBackup, storeSettingsName, user, err, auditKeys(options.IncludeKeys))
+		}
+	} else {
+		header.Checksum = backupChecksum(payload)
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, fmt.Errorf("failed to marshal backup header (cause: %w)", err), auditKeys(options.IncludeKeys))
+	}
+	_, err = out.Write(append(headerBytes, '\n'))
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, fmt.Errorf("failed to write backup header (cause: %w)", err), auditKeys(options.IncludeKeys))
+	}
+	_, err = out.Write(payload)
+	if err != nil {
+		return registry.auditFailure(auditBackup, storeSettingsName, user, fmt.Errorf("failed to write backup payload (cause: %w)", err), auditKeys(options.IncludeKeys))
+	}
+	registry.logger.Info().Msgf("backup of %d entries created", len(manifest.Entries))
+	return registry.audit(auditBackup, storeSettingsName, user, auditKeys(options.IncludeKeys))
+}
+
+func (registry *Registry) backupSettings(manifest *backupManifest, files map[string][]byte, stripSecrets bool) error {
+	settingsBytes, err := registry.backend.Get(storeSettingsName)
+	if err != nil {
+		return fmt.Errorf("failed to read store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	if stripSecrets {
+		settingsBytes, err = stripBackupSecrets(settingsBytes)
+		if err != nil {
+			return err
+		}
+	}
+	addBackupFile(manifest, files, backupSettingsFile, settingsBytes)
+	return nil
+}
+
+func (registry *Registry) backupEntries(history storage.HistoryBackend, manifest *backupManifest, files map[string][]byte, includeKeys bool) error {
+	names, err := history.ListHistory()
+	if err != nil {
+		return err
+	}
+	sortedNames := make([]string, 0)
+	for {
+		name := names.Next()
+		if name == "" {
+			break
+		}
+		if registry.isValidEntryName(name) {
+			sortedNames = append(sortedNames, name)
+		}
+	}
+	sort.Strings(sortedNames)
+	for index, name := range sortedNames {
+		entryHistory, err := history.GetHistory(name)
+		if err != nil {
+			return err
+		}
+		entry := backupEntry{
+			Name:     name,
+			Versions: make([]storage.Version, 0, len(entryHistory.Versions)),
+			Times:    make([]time.Time, 0, len(entryHistory.Versions)),
+			Deleted:  !entryHistory.Deleted.IsZero(),
+		}
+		if entry.Deleted {
+			entry.DeletedTime = &entryHistory.Deleted
+		}
+		for versionIndex := len(entryHistory.Versions) - 1; versionIndex >= 0; versionIndex-- {
+			version := entryHistory.Versions[versionIndex].Version
+			dataBytes, err := history.GetHistoryVersion(name, version)
+			if err != nil {
+				return err
+			}
+			if !includeKeys {
+				dataBytes, err = stripBackupKey(name, dataBytes)
+				if err != nil {
+					return err
+				}
+			}
+			entry.Versions = append(entry.Versions, version)
+			entry.Times = append(entry.Times, entryHistory.Versions[versionIndex].Time)
+			addBackupFile(manifest, files, entry.versionFile(index, version), dataBytes)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	return nil
+}
+
+// stripBackupSecrets removes the plain secrets from the submitted store settings. Protected secrets are retained.
+func stripBackupSecrets(settingsBytes []byte) ([]byte, error) {
+	settings := make(map[string]json.RawMessage)
+	err := json.Unmarshal(settingsBytes, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	for _, attribute := range backupPlainSecretSettings {
+		delete(settings, attribute)
+	}
+	strippedBytes, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	return strippedBytes, nil
+}
+
+// stripBackupKey removes the encoded key from the submitted entry data. All other attributes are retained
+// as is (hence no schema migration is applied).
+func stripBackupKey(name string, dataBytes []byte) ([]byte, error) {
+	data := make(map[string]json.RawMessage)
+	err := json.Unmarshal(dataBytes, &data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal entry data '%s' (cause: %w)", name, err)
+	}
+	_, hasKey := data["key"]
+	if !hasKey {
+		return dataBytes, nil
+	}
+	data["key"] = json.RawMessage(`""`)
+	strippedBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal entry data '%s' (cause: %w)", name, err)
+	}
+	return strippedBytes, nil
+}
+
+func backupAuditLogs(logReader storage.LogReaderBackend, manifest *backupManifest, files map[string][]byte) error {
+	logs := map[string]string{
+		storeAuditName:            backupAuditFile,
+		storeAuditCheckpointsName: backupAuditCheckpointsFile,
+	}
+	for logName, file := range logs {
+		log, err := logReader.ReadLog(logName)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		addBackupFile(manifest, files, file, log)
+	}
+	return nil
+}
+
+func addBackupFile(manifest *backupManifest, files map[string][]byte, file string, data []byte) {
+	files[file] = data
+	manifest.Checksums[file] = backupChecksum(data)
+}
+
+func backupChecksum(data []byte) string {
+	checksum := sha256.Sum256(data)
+	return hex.EncodeToString(checksum[:])
+}
+
+func writeBackupPayload(manifest *backupManifest, files map[string][]byte) ([]byte, error) {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal backup manifest (cause: %w)", err)
+	}
+	fileNames := make([]string, 0, len(files))
+	for file := range files {
+		fileNames = append(fileNames, file)
+	}
+	sort.Strings(fileNames)
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = writeBackupFile(tarWriter, backupManifestFile, manifestBytes, manifest.Created)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range fileNames {
+		err = writeBackupFile(tarWriter, file, files[file], manifest.Created)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close backup archive (cause: %w)", err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress backup archive (cause: %w)", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeBackupFile(tarWriter *tar.Writer, file string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file,
+		Size:     int64(len(data)),
+		Mode:     0600,
+		ModTime:  modTime,
+	}
+	err := tarWriter.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to write backup archive header '%s' (cause: %w)", file, err)
+	}
+	_, err = tarWriter.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write backup archive file '%s' (cause: %w)", file, err)
+	}
+	return nil
+}
+
+func newBackupUnlock(passphrase string) *secretUnlock {
+	return &secretUnlock{
+		kdf:    secretKDFArgon2id,
+		source: "backup passphrase",
+		load: func() ([]byte, error) {
+			return []byte(passphrase), nil
+		},
+	}
+}
+
+func encryptBackupPayload(payload []byte, passphrase string) (*storeSecretProtection, []byte, error) {
+	unlock := newBackupUnlock(passphrase)
+	protection, err := unlock.newProtection()
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := unlock.newGCM(protection)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce (cause: %w)", err)
+	}
+	return protection, gcm.Seal(nonce, nonce, payload, []byte(backupFormat)), nil
+}
+
+func decryptBackupPayload(payload []byte, protection *storeSecretProtection, passphrase string) ([]byte, error) {
+	if protection.KDF != secretKDFArgon2id {
+		return nil, fmt.Errorf("%w (unsupported key derivation function '%s')", ErrInvalidBackup, protection.KDF)
+	}
+	gcm, err := newBackupUnlock(passphrase).newGCM(protection)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(payload) < nonceSize {
+		return nil, fmt.Errorf("%w (truncated payload)", ErrInvalidBackup)
+	}
+	decrypted, err := gcm.Open(nil, payload[:nonceSize], payload[nonceSize:], []byte(backupFormat))
+	if err != nil {
+		return nil, fmt.Errorf("%w (invalid passphrase or corrupted payload)", ErrInvalidBackup)
+	}
+	return decrypted, nil
+}
+
+// RestoreStore restores a backup archive created via [Registry.Backup] into the given storage backend.
+//
+// The submitted passphrase is required, if the archive is encrypted. The archive is read and verified completely
+// (decryption and checksums) before anything is written to the backend. Corrupted or incomplete archives are
+// rejected with [ErrInvalidBackup]. The backend must be empty ([ErrStoreNotEmpty] is returned otherwise).
+//
+// The retained versions of each entry are restored in order, but are renumbered starting with version 1. The times
+// the versions have been written are retained. Deleted entries are restored into the backend's history (retaining
+// the deletion time). All entries, logs and the store settings are written via a
+// single commit (see [storage.TransactionalBackend]); hence a failed restore leaves the backend empty. If the
+// backend does not implement [storage.TransactionalBackend], [errors.ErrUnsupported] is returned.
+//
+// As the store settings are restored as is, the restored store is opened with the same unlock options as the
+// original store (see [NewStore]). The plain secrets omitted from an unencrypted archive are replaced by new
+// ones. The audit records chained with the replaced audit key remain part of the audit log, but are only checked
+// for continuity by [Registry.VerifyAudit].
+func RestoreStore(in io.Reader, backend storage.Backend, passphrase string) error {
+	manifest, files, err := readBackupArchive(in, passphrase)
+	if err != nil {
+		return err
+	}
+	transactional, ok := backend.(storage.TransactionalBackend)
+	if !ok {
+		return fmt.Errorf("%w (backend '%s' does not support transactions)", errors.ErrUnsupported, backend.URI())
+	}
+	err = checkRestoreBackend(backend)
+	if err != nil {
+		return err
+	}
+	operations := make([]storage.Operation, 0)
+	for index, entry := range manifest.Entries {
+		operations = appendRestoreEntryOperations(operations, &entry, index, files)
+	}
+	operations = appendRestoreLogOperations(operations, storeAuditName, files[backupAuditFile])
+	operations = appendRestoreLogOperations(operations, storeAuditCheckpointsName, files[backupAuditCheckpointsFile])
+	settingsBytes, err := restoreBackupSecrets(files[backupSettingsFile], files[backupAuditFile])
+	if err != nil {
+		return err
+	}
+	operations = append(operations, storage.Operation{Kind: storage.OperationCreate, Name: storeSettingsName, Data: settingsBytes})
+	err = transactional.Commit(operations)
+	if err != nil {
+		return fmt.Errorf("failed to restore store '%s' (cause: %w)", backend.URI(), err)
+	}
+	return nil
+}
+
+func readBackupArchive(in io.Reader, passphrase string) (*backupManifest, map[string][]byte, error) {
+	reader := bufio.NewReader(in)
+	headerBytes, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w (failed to read header: %w)", ErrInvalidBackup, err)
+	}
+	header := &backupHeader{}
+	err = json.Unmarshal(headerBytes, header)
+	if err != nil || header.Format != backupFormat {
+		return nil, nil, fmt.Errorf("%w (unrecognized header)", ErrInvalidBackup)
+	}
+	if header.Version != backupFormatVersion {
+		return nil, nil, fmt.Errorf("%w (unsupported format version %d)", ErrInvalidBackup, header.Version)
+	}
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup payload (cause: %w)", err)
+	}
+	if header.Protection != nil {
+		if passphrase == "" {
+			return nil, nil, fmt.Errorf("%w (backup is encrypted)", ErrPassphraseRequired)
+		}
+		payload, err = decryptBackupPayload(payload, header.Protection, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if header.Checksum != backupChecksum(payload) {
+		return nil, nil, fmt.Errorf("%w (payload checksum mismatch)", ErrInvalidBackup)
+	}
+	files, err := readBackupPayload(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &backupManifest{}
+	err = json.Unmarshal(files[backupManifestFile], manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w (invalid manifest: %w)", ErrInvalidBackup, err)
+	}
+	err = verifyBackupFiles(manifest, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, files, nil
+}
+
+func readBackupPayload(payload []byte) (map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("%w (failed to decompress payload: %w)", ErrInvalidBackup, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	files := make(map[string][]byte)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w (failed to read payload: %w)", ErrInvalidBackup, err)
+		}
+		data, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("%w (failed to read file '%s': %w)", ErrInvalidBackup, header.Name, err)
+		}
+		files[header.Name] = data
+	}
+	return files, nil
+}
+
+func verifyBackupFiles(manifest *backupManifest, files map[string][]byte) error {
+	required := []string{backupSettingsFile}
+	for index, entry := range manifest.Entries {
+		if len(entry.Versions) == 0 {
+			return fmt.Errorf("%w (no versions for entry '%s')", ErrInvalidBackup, entry.Name)
+		}
+		for _, version := range entry.Versions {
+			required = append(required, entry.versionFile(index, version))
+		}
+	}
+	for _, file := range required {
+		_, listed := manifest.Checksums[file]
+		if !listed {
+			return fmt.Errorf("%w (missing checksum for file '%s')", ErrInvalidBackup, file)
+		}
+	}
+	for file, checksum := range manifest.Checksums {
+		data, found := files[file]
+		if !found {
+			return fmt.Errorf("%w (missing file '%s')", ErrInvalidBackup, file)
+		}
+		if checksum != backupChecksum(data) {
+			return fmt.Errorf("%w (checksum mismatch for file '%s')", ErrInvalidBackup, file)
+		}
+	}
+	return nil
+}
+
+func checkRestoreBackend(backend storage.Backend) error {
+	names, err := listAllEntries(backend)
+	if err != nil {
+		return err
+	}
+	if names.Next() != "" {
+		return fmt.Errorf("%w ('%s')", ErrStoreNotEmpty, backend.URI())
+	}
+	logReader, ok := backend.(storage.LogReaderBackend)
+	if ok {
+		for _, name := range []string{storeAuditName, storeAuditCheckpointsName} {
+			_, err = logReader.ReadLog(name)
+			if err == nil {
+				return fmt.Errorf("%w ('%s')", ErrStoreNotEmpty, backend.URI())
+			} else if !errors.Is(err, storage.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	_, err = backend.Get(storeSettingsName)
+	if err == nil {
+		return fmt.Errorf("%w ('%s')", ErrStoreNotEmpty, backend.URI())
+	} else if !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func appendRestoreEntryOperations(operations []storage.Operation, entry *backupEntry, index int, files map[string][]byte) []storage.Operation {
+	for versionIndex, version := range entry.Versions {
+		data := files[entry.versionFile(index, version)]
+		if versionIndex == 0 {
+			operations = append(operations, storage.Operation{Kind: storage.OperationCreate, Name: entry.Name, Data: data, Time: entry.versionTime(versionIndex)})
+		} else {
+			operations = append(operations, storage.Operation{Kind: storage.OperationUpdate, Name: entry.Name, Data: data, Expected: storage.Version(versionIndex), Time: entry.versionTime(versionIndex)})
+		}
+	}
+	if entry.Deleted {
+		operations = append(operations, storage.Operation{Kind: storage.OperationDelete, Name: entry.Name, Expected: storage.Version(len(entry.Versions)), Time: entry.deletedTime()})
+	}
+	return operations
+}
+
+func appendRestoreLogOperations(operations []storage.Operation, name string, log []byte) []storage.Operation {
+	for _, line := range bytes.Split(log, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		operations = append(operations, storage.Operation{Kind: storage.OperationLog, Name: name, Data: line})
+	}
+	return operations
+}
+
+// restoreBackupSecrets replaces the plain secrets omitted from an unencrypted archive by new ones.
+func restoreBackupSecrets(settingsBytes []byte, auditLog []byte) ([]byte, error) {
+	settings := make(map[string]json.RawMessage)
+	err := json.Unmarshal(settingsBytes, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("%w (invalid store settings: %w)", ErrInvalidBackup, err)
+	}
+	_, hasSecret := settings["secret"]
+	_, hasProtection := settings["protection"]
+	if !hasSecret && !hasProtection {
+		err = setRestoredSecret(settings, "secret")
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, hasAuditKey := settings["audit_key"]
+	_, hasAuditKeyProtection := settings["audit_key_protection"]
+	if !hasAuditKey && !hasAuditKeyProtection {
+		err = setRestoredSecret(settings, "audit_key")
+		if err != nil {
+			return nil, err
+		}
+		log := bytes.TrimRight(auditLog, "\n")
+		rekeyed, _, err := parseAuditChainHead(log[bytes.LastIndexByte(log, '\n')+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w (invalid audit log: %w)", ErrInvalidBackup, err)
+		}
+		if rekeyed > 0 {
+			settings["audit_rekeyed"] = json.RawMessage(strconv.FormatUint(rekeyed, 10))
+		}
+	}
+	restoredBytes, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	return restoredBytes, nil
+}
+
+func setRestoredSecret(settings map[string]json.RawMessage, attribute string) error {
+	secret, err := newStoreSecret()
+	if err != nil {
+		return err
+	}
+	secretBytes, err := json.Marshal(secret)
+	if err != nil {
+		return fmt.Errorf("failed to marshal store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	settings[attribute] = secretBytes
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestBackup*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry, err := certstore.NewStore(newTestFSBackend(t, path), testCacheTTL)
+	require.NoError(t, err)
+	user := "TestBackupUser"
+	populateTestStore(t, registry, user, 1)
+	root, err := registry.Entry("root1")
+	require.NoError(t, err)
+	err = root.SetAttributes(map[string]string{"Key": "Value"})
+	require.NoError(t, err)
+	deletedName, err := registry.CreateCertificate("deleted", newTestRootCertificateFactory("deleted"), user)
+	require.NoError(t, err)
+	err = registry.Delete(deletedName, user)
+	require.NoError(t, err)
+	// keys require passphrase
+	err = registry.Backup(&bytes.Buffer{}, &certstore.BackupOptions{IncludeKeys: true}, user)
+	require.ErrorIs(t, err, certstore.ErrPassphraseRequired)
+	// backup and restore including keys
+	archive := &bytes.Buffer{}
+	err = registry.Backup(archive, &certstore.BackupOptions{IncludeKeys: true, Passphrase: "secret"}, user)
+	require.NoError(t, err)
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), storage.NewMemoryStorage(testVersionLimit), "")
+	require.ErrorIs(t, err, certstore.ErrPassphraseRequired)
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), storage.NewMemoryStorage(testVersionLimit), "wrong")
+	require.ErrorIs(t, err, certstore.ErrInvalidBackup)
+	tampered := bytes.Clone(archive.Bytes())
+	tampered[len(tampered)-1] ^= 0xff
+	err = certstore.RestoreStore(bytes.NewReader(tampered), storage.NewMemoryStorage(testVersionLimit), "secret")
+	require.ErrorIs(t, err, certstore.ErrInvalidBackup)
+	restoredBackend := storage.NewMemoryStorage(testVersionLimit)
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), restoredBackend, "secret")
+	require.NoError(t, err)
+	restored, err := certstore.NewStore(restoredBackend, testCacheTTL)
+	require.NoError(t, err)
+	checkStoreEntries(t, restored, 4, 1)
+	restoredRoot, err := restored.Entry("root1")
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(2), restoredRoot.Version())
+	require.Equal(t, "Value", restoredRoot.Attributes()["Key"])
+	require.True(t, restoredRoot.HasKey())
+	require.Equal(t, root.Key(user), restoredRoot.Key(user))
+	// version and deletion times are retained
+	for _, name := range []string{"root1", deletedName} {
+		history, err := newTestFSBackend(t, path).(storage.HistoryBackend).GetHistory(name)
+		require.NoError(t, err)
+		restoredHistory, err := restoredBackend.(storage.HistoryBackend).GetHistory(name)
+		require.NoError(t, err)
+		require.Equal(t, len(history.Versions), len(restoredHistory.Versions))
+		for index := range history.Versions {
+			require.True(t, history.Versions[index].Time.Equal(restoredHistory.Versions[index].Time))
+		}
+		require.True(t, history.Deleted.Equal(restoredHistory.Deleted))
+	}
+	history, err := restoredBackend.(storage.HistoryBackend).GetHistory(deletedName)
+	require.NoError(t, err)
+	require.False(t, history.Deleted.IsZero())
+	verification, err := restored.VerifyAudit()
+	require.NoError(t, err)
+	require.Zero(t, verification.Broken)
+	events, err := restored.AuditLog(&certstore.AuditFilter{Operation: certstore.AuditOperationBackup})
+	require.NoError(t, err)
+	// the archive only contains the failed backup attempt (but not its own record)
+	event, err := events.Next()
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	require.Equal(t, certstore.AuditOutcomeFailure, event.Outcome)
+	require.Equal(t, "true", event.Details[certstore.AuditDetailKeys])
+	event, err = events.Next()
+	require.NoError(t, err)
+	require.Nil(t, event)
+	backupEvents := readAuditEvents(t, registry, &certstore.AuditFilter{Operation: certstore.AuditOperationBackup})
+	require.Equal(t, 2, len(backupEvents))
+	require.Equal(t, certstore.AuditOutcomeSuccess, backupEvents[1].Outcome)
+	// failing to write the archive is recorded as failure only
+	err = registry.Backup(&failingWriter{}, nil, user)
+	require.Error(t, err)
+	backupEvents = readAuditEvents(t, registry, &certstore.AuditFilter{Operation: certstore.AuditOperationBackup})
+	require.Equal(t, 3, len(backupEvents))
+	require.Equal(t, certstore.AuditOutcomeFailure, backupEvents[2].Outcome)
+	// restore refuses non-empty backend
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), restoredBackend, "secret")
+	require.ErrorIs(t, err, certstore.ErrStoreNotEmpty)
+	// unencrypted backup without keys (default options)
+	archive.Reset()
+	err = registry.Backup(archive, nil, user)
+	require.NoError(t, err)
+	tampered = bytes.Clone(archive.Bytes())
+	tampered[len(tampered)-1] ^= 0xff
+	err = certstore.RestoreStore(bytes.NewReader(tampered), storage.NewMemoryStorage(testVersionLimit), "")
+	require.ErrorIs(t, err, certstore.ErrInvalidBackup)
+	restoredPath, err := os.MkdirTemp("", "TestBackupRestored*")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoredPath)
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), newTestFSBackend(t, restoredPath), "")
+	require.NoError(t, err)
+	restored, err = certstore.NewStore(newTestFSBackend(t, restoredPath), testCacheTTL)
+	require.NoError(t, err)
+	checkStoreEntries(t, restored, 4, 1)
+	restoredRoot, err = restored.Entry("root1")
+	require.NoError(t, err)
+	require.True(t, restoredRoot.HasCertificate())
+	require.False(t, restoredRoot.HasKey())
+	// plain secrets are not restored from unencrypted archives (but replaced by new ones)
+	settings := readTestEntryData(t, newTestFSBackend(t, path), ".store")
+	restoredSettings := readTestEntryData(t, newTestFSBackend(t, restoredPath), ".store")
+	require.NotEmpty(t, restoredSettings["secret"])
+	require.NotEqual(t, settings["secret"], restoredSettings["secret"])
+	require.NotEmpty(t, restoredSettings["audit_key"])
+	require.NotEqual(t, settings["audit_key"], restoredSettings["audit_key"])
+	createdName, err := restored.CreateCertificate("restored", newTestRootCertificateFactory("restored"), user)
+	require.NoError(t, err)
+	created, err := restored.Entry(createdName)
+	require.NoError(t, err)
+	require.True(t, created.HasKey())
+	verification, err = restored.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func TestRestoreStoreFailure(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), testCacheTTL)
+	require.NoError(t, err)
+	user := "TestRestoreStoreFailureUser"
+	populateTestStore(t, registry, user, 1)
+	archive := &bytes.Buffer{}
+	err = registry.Backup(archive, &certstore.BackupOptions{IncludeKeys: true, Passphrase: "secret"}, user)
+	require.NoError(t, err)
+	// failed restore leaves the backend empty
+	backend := &failingCommitBackend{TransactionalBackend: storage.NewMemoryStorage(testVersionLimit).(storage.TransactionalBackend)}
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), backend, "secret")
+	require.Error(t, err)
+	names, err := backend.List()
+	require.NoError(t, err)
+	require.Empty(t, names.Next())
+	_, err = backend.Get(".store")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	_, err = backend.TransactionalBackend.(storage.LogReaderBackend).ReadLog(".audit")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	// restore requires transactional backend
+	err = certstore.RestoreStore(bytes.NewReader(archive.Bytes()), &nonTransactionalBackend{Backend: storage.NewMemoryStorage(testVersionLimit)}, "secret")
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+// failingWriter simulates an I/O error while writing.
+type failingWriter struct{}
+
+func (writer *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failure")
+}
+
+// failingCommitBackend simulates a storage error while committing.
+type failingCommitBackend struct {
+	storage.TransactionalBackend
+}
+
+func (backend *failingCommitBackend) Commit(operations []storage.Operation) error {
+	return errors.New("simulated commit error")
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/http01"
@@ -65,6 +66,17 @@ func (factory *acmeCertificateFactory) New() (crypto.PrivateKey, *x509.Certifica
 	return obtainedKey, obtainedCertificate, nil
 }
 
+// ACMEProviderName determines the ACME provider name from the name of a certificate factory created via [NewACMECertificateFactory].
+//
+// If the submitted factory name does not denote an ACME certificate factory, false is returned.
+func ACMEProviderName(factoryName string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(acmeFactoryNamePattern, "%s")
+	if !strings.HasPrefix(factoryName, prefix) || !strings.HasSuffix(factoryName, suffix) || len(factoryName) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	return factoryName[len(prefix) : len(factoryName)-len(suffix)], true
+}
+
 // NewACMECertificateFactory creates a new certificate factory for ACME based certificates.
 func NewACMECertificateFactory(certificateRequest *acme.CertificateRequest, keyPairFactory keys.KeyPairFactory) CertificateFactory {
 	name := fmt.Sprintf(acmeFactoryNamePattern, certificateRequest.Provider.Name)
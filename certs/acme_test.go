@@ -69,3 +69,11 @@ func loadAndPrepareACMEConfig(t *testing.T, configPath string, tempDir string) *
 	os.Setenv("LEGO_CA_CERTIFICATES", strings.Join(certificateFiles, string(os.PathListSeparator)))
 	return config
 }
+
+func TestACMEProviderName(t *testing.T) {
+	providerName, ok := certs.ACMEProviderName("ACME[Test1]")
+	require.True(t, ok)
+	require.Equal(t, "Test1", providerName)
+	_, ok = certs.ACMEProviderName("Local")
+	require.False(t, ok)
+}
@@ -12,9 +12,6 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"fmt"
-	"math/big"
-	"sync"
-	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
@@ -103,19 +100,3 @@ func parseLdapRDNType(ldapRDNType string) (asn1.ObjectIdentifier, error) {
 	}
 	return nil, fmt.Errorf("unrecognized RDN type '%s'", ldapRDNType)
 }
-
-var serialNumberLock sync.Mutex = sync.Mutex{}
-
-func nextSerialNumber() *big.Int {
-	// lock to avoid double numbers via multiple goroutines
-	serialNumberLock.Lock()
-	defer serialNumberLock.Unlock()
-	// wait at least one update, to ensure this functions never returns the same result twice
-	current := time.Now().UnixMilli()
-	for {
-		next := time.Now().UnixMilli()
-		if next != current {
-			return big.NewInt(next)
-		}
-	}
-}
@@ -67,6 +67,16 @@ func KeyUsageString(keyUsage x509.KeyUsage) string {
 	return builder.String()
 }
 
+// KeyUsageFromString determines a key usage flag from its name (as returned by [KeyUsageString]).
+func KeyUsageFromString(name string) (x509.KeyUsage, error) {
+	for keyUsage, keyUsageString := range keyUsageStrings {
+		if keyUsageString == name {
+			return keyUsage, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized key usage '%s'", name)
+}
+
 const ExtKeyUsageExtensionName = "ExtKeyUsage"
 const ExtKeyUsageExtensionOID = "2.5.29.37"
 
@@ -128,6 +138,16 @@ func ExtKeyUsageString(extKeyUsage []x509.ExtKeyUsage, unknownExtKeyUsage []asn1
 	return builder.String()
 }
 
+// ExtKeyUsageFromString determines an extended key usage from its name (as returned by [ExtKeyUsageString]).
+func ExtKeyUsageFromString(name string) (x509.ExtKeyUsage, error) {
+	for extKeyUsage, extKeyUsageString := range extKeyUsageStrings {
+		if extKeyUsageString == name {
+			return extKeyUsage, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized extended key usage '%s'", name)
+}
+
 const BasicConstraintsExtensionName = "BasicConstraints"
 const BasicConstraintsExtensionOID = "2.5.29.19"
 
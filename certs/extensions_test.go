@@ -25,6 +25,22 @@ func TestExtKeyUsageString(t *testing.T) {
 	require.Equal(t, "any, 1.2.3.4", certs.ExtKeyUsageString([]x509.ExtKeyUsage{x509.ExtKeyUsageAny}, []asn1.ObjectIdentifier{asn1.ObjectIdentifier([]int{1, 2, 3, 4})}))
 }
 
+func TestKeyUsageFromString(t *testing.T) {
+	keyUsage, err := certs.KeyUsageFromString("keyCertSign")
+	require.NoError(t, err)
+	require.Equal(t, x509.KeyUsageCertSign, keyUsage)
+	_, err = certs.KeyUsageFromString("unknown")
+	require.Error(t, err)
+}
+
+func TestExtKeyUsageFromString(t *testing.T) {
+	extKeyUsage, err := certs.ExtKeyUsageFromString("serverAuth")
+	require.NoError(t, err)
+	require.Equal(t, x509.ExtKeyUsageServerAuth, extKeyUsage)
+	_, err = certs.ExtKeyUsageFromString("unknown")
+	require.Error(t, err)
+}
+
 const basicConstraintsNoCA = "CA: no"
 const basicConstratinsCAWithoutPathLenConstraint = "CA: yes"
 const basicConstratinsCAWithPathLenConstraint = "CA: yes, pathLenConstraint: 2"
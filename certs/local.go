@@ -10,7 +10,6 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"fmt"
-	"math/big"
 
 	"github.com/hdecarne-github/go-certstore/keys"
 	"github.com/hdecarne-github/go-log"
@@ -24,6 +23,7 @@ type localCertificateFactory struct {
 	keyPairFactory keys.KeyPairFactory
 	parent         *x509.Certificate
 	signer         crypto.PrivateKey
+	serialNumbers  SerialNumberGenerator
 	logger         *zerolog.Logger
 }
 
@@ -37,16 +37,18 @@ func (factory *localCertificateFactory) New() (crypto.PrivateKey, *x509.Certific
 		return nil, nil, err
 	}
 	createTemplate := factory.template
+	createTemplate.SerialNumber, err = nextSerialNumber(factory.serialNumbers, factory.parent)
+	if err != nil {
+		return nil, nil, err
+	}
 	var certificateBytes []byte
 	if factory.parent != nil {
 		// parent signed
 		factory.logger.Info().Msg("creating signed local X.509 certificate...")
-		createTemplate.SerialNumber = nextSerialNumber()
 		certificateBytes, err = x509.CreateCertificate(rand.Reader, createTemplate, factory.parent, keyPair.Public(), factory.signer)
 	} else {
 		// self-signed
 		factory.logger.Info().Msg("creating self-signed local X.509 certificate...")
-		createTemplate.SerialNumber = big.NewInt(1)
 		certificateBytes, err = x509.CreateCertificate(rand.Reader, createTemplate, createTemplate, keyPair.Public(), keyPair.Private())
 	}
 	if err != nil {
@@ -60,13 +62,24 @@ func (factory *localCertificateFactory) New() (crypto.PrivateKey, *x509.Certific
 }
 
 // NewLocalCertificateFactory creates a new certificate factory for locally issued certificates.
+//
+// The serial number of the created certificate is generated using [DefaultSerialNumberGenerator].
 func NewLocalCertificateFactory(template *x509.Certificate, keyPairFactory keys.KeyPairFactory, parent *x509.Certificate, signer crypto.PrivateKey) CertificateFactory {
+	return NewLocalCertificateFactoryWithSerialNumbers(template, keyPairFactory, parent, signer, nil)
+}
+
+// NewLocalCertificateFactoryWithSerialNumbers creates a new certificate factory for locally issued certificates
+// using the submitted [SerialNumberGenerator].
+//
+// If the submitted [SerialNumberGenerator] is nil, [DefaultSerialNumberGenerator] is used.
+func NewLocalCertificateFactoryWithSerialNumbers(template *x509.Certificate, keyPairFactory keys.KeyPairFactory, parent *x509.Certificate, signer crypto.PrivateKey, serialNumbers SerialNumberGenerator) CertificateFactory {
 	logger := log.RootLogger().With().Str("Factory", localFactoryName).Logger()
 	return &localCertificateFactory{
 		template:       template,
 		keyPairFactory: keyPairFactory,
 		parent:         parent,
 		signer:         signer,
+		serialNumbers:  serialNumbers,
 		logger:         &logger,
 	}
 }
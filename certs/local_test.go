@@ -29,7 +29,8 @@ func TestLocalCertificateFactory(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, privateKey1)
 	require.NotNil(t, cert1)
-	require.Equal(t, big.NewInt(1), cert1.SerialNumber)
+	require.Equal(t, 1, cert1.SerialNumber.Sign())
+	require.LessOrEqual(t, cert1.SerialNumber.BitLen(), 128)
 	require.Equal(t, template1.Subject.Organization, cert1.Subject.Organization)
 	// signed
 	template2 := newLocalTestCertificateTemplate("Test2")
@@ -0,0 +1,282 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+// Package profile provides certificate profiles for repeatable issuance of X.509 certificates.
+package profile
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	_ "embed"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"gopkg.in/yaml.v3"
+)
+
+// A Config defines a set of named certificate profiles.
+//
+//	profiles:
+//	  "tls-server":
+//	    validity_days: 397
+//	    key_algorithm: "ECDSA256"
+//	    key_usage: ["digitalSignature", "keyEncipherment"]
+//	    ext_key_usage: ["serverAuth"]
+//	    policies: ["2.23.140.1.2.1"]
+//	    crl_distribution_points: ["http://pki.example.org/crl/ca.crl"]
+//	    ocsp_servers: ["http://pki.example.org/ocsp"]
+//	    issuing_certificate_urls: ["http://pki.example.org/ca/ca.crt"]
+//	    subject_alt_names:
+//	      required: true
+//	      copy_common_name: true
+//	      dns: true
+//	      ip: true
+//	  "intermediate-ca":
+//	    validity_days: 1825
+//	    key_algorithm: "ECDSA384"
+//	    key_usage: ["keyCertSign", "cRLSign"]
+//	    basic_constraints:
+//	      ca: true
+//	      path_len: 0
+type Config struct {
+	// Profiles lists the available profiles in this configuration.
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Profile looks up the profile with the given name.
+func (config *Config) Profile(name string) (*Profile, error) {
+	profile, found := config.Profiles[name]
+	if !found {
+		return nil, fmt.Errorf("unknown profile '%s'", name)
+	}
+	return &profile, nil
+}
+
+// A Profile defines the parameters of a certificate to issue.
+type Profile struct {
+	// Name defines the name of this profile.
+	Name string `yaml:"-"`
+	// ValidityDays defines the number of days issued certificates are valid.
+	ValidityDays int `yaml:"validity_days"`
+	// KeyAlgorithm defines the key algorithm to use for new keys (see [keys.AlgorithmFromString]).
+	KeyAlgorithm string `yaml:"key_algorithm"`
+	// KeyUsage lists the key usages to set (see [certs.KeyUsageString]).
+	KeyUsage []string `yaml:"key_usage"`
+	// ExtKeyUsage lists the extended key usages to set (see [certs.ExtKeyUsageString]).
+	ExtKeyUsage []string `yaml:"ext_key_usage"`
+	// BasicConstraints configures the BasicConstraints extension.
+	BasicConstraints BasicConstraintsConfig `yaml:"basic_constraints"`
+	// Policies lists the certificate policy OIDs to set.
+	Policies []string `yaml:"policies"`
+	// CRLDistributionPoints lists the CRL distribution point URLs to set.
+	CRLDistributionPoints []string `yaml:"crl_distribution_points"`
+	// OCSPServers lists the OCSP server URLs to set (Authority Information Access extension).
+	OCSPServers []string `yaml:"ocsp_servers"`
+	// IssuingCertificateURLs lists the CA issuers URLs to set (Authority Information Access extension).
+	IssuingCertificateURLs []string `yaml:"issuing_certificate_urls"`
+	// SubjectAltNames defines the rules for subject alternative names.
+	SubjectAltNames SubjectAltNamesConfig `yaml:"subject_alt_names"`
+}
+
+// A BasicConstraintsConfig configures the BasicConstraints extension of a profile.
+type BasicConstraintsConfig struct {
+	// CA defines whether issued certificates are CA certificates (true) or not (false).
+	CA bool `yaml:"ca"`
+	// PathLen defines the path length constraint of issued CA certificates (optional).
+	PathLen *int `yaml:"path_len"`
+}
+
+// A SubjectAltNamesConfig defines the rules for subject alternative names of a profile.
+type SubjectAltNamesConfig struct {
+	// Required defines whether at least one subject alternative name is required (true) or not (false).
+	Required bool `yaml:"required"`
+	// CopyCommonName defines whether the subject's common name is added as a DNS name (true) or not (false).
+	CopyCommonName bool `yaml:"copy_common_name"`
+	// DNS defines whether DNS names are allowed (true) or not (false).
+	DNS bool `yaml:"dns"`
+	// IP defines whether IP addresses are allowed (true) or not (false).
+	IP bool `yaml:"ip"`
+	// Email defines whether email addresses are allowed (true) or not (false).
+	Email bool `yaml:"email"`
+	// URI defines whether URIs are allowed (true) or not (false).
+	URI bool `yaml:"uri"`
+}
+
+// Render renders the certificate template and the [keys.KeyPairFactory] for the given subject and subject alternative names.
+//
+// Subject alternative names are classified as IP address, email address (containing '@'), URI (containing "://")
+// or DNS name and checked against the profile's rules.
+func (profile *Profile) Render(subject pkix.Name, subjectAltNames []string) (*x509.Certificate, keys.KeyPairFactory, error) {
+	template, alg, err := profile.template()
+	if err != nil {
+		return nil, nil, err
+	}
+	template.Subject = subject
+	err = profile.applySubjectAltNames(template, subject, subjectAltNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template.NotBefore = now
+	template.NotAfter = now.AddDate(0, 0, profile.ValidityDays)
+	return template, alg.NewKeyPairFactory(), nil
+}
+
+func (profile *Profile) template() (*x509.Certificate, keys.Algorithm, error) {
+	if profile.ValidityDays <= 0 {
+		return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid validity days %d in profile '%s'", profile.ValidityDays, profile.Name)
+	}
+	alg, err := keys.AlgorithmFromString(profile.KeyAlgorithm)
+	if err != nil {
+		return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid key algorithm in profile '%s' (cause: %w)", profile.Name, err)
+	}
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  profile.BasicConstraints.CA,
+		MaxPathLen:            -1,
+		CRLDistributionPoints: profile.CRLDistributionPoints,
+		OCSPServer:            profile.OCSPServers,
+		IssuingCertificateURL: profile.IssuingCertificateURLs,
+	}
+	if profile.BasicConstraints.PathLen != nil {
+		if !profile.BasicConstraints.CA {
+			return nil, keys.UnknownAlgorithm, fmt.Errorf("path length constraint requires CA in profile '%s'", profile.Name)
+		}
+		template.MaxPathLen = *profile.BasicConstraints.PathLen
+		template.MaxPathLenZero = template.MaxPathLen == 0
+	}
+	for _, keyUsageName := range profile.KeyUsage {
+		keyUsage, err := certs.KeyUsageFromString(keyUsageName)
+		if err != nil {
+			return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid key usage in profile '%s' (cause: %w)", profile.Name, err)
+		}
+		template.KeyUsage |= keyUsage
+	}
+	for _, extKeyUsageName := range profile.ExtKeyUsage {
+		extKeyUsage, err := certs.ExtKeyUsageFromString(extKeyUsageName)
+		if err != nil {
+			return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid extended key usage in profile '%s' (cause: %w)", profile.Name, err)
+		}
+		template.ExtKeyUsage = append(template.ExtKeyUsage, extKeyUsage)
+	}
+	for _, policy := range profile.Policies {
+		oid, err := x509.ParseOID(policy)
+		if err != nil {
+			return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid policy '%s' in profile '%s' (cause: %w)", policy, profile.Name, err)
+		}
+		template.Policies = append(template.Policies, oid)
+		policyIdentifier, err := parseObjectIdentifier(policy)
+		if err != nil {
+			return nil, keys.UnknownAlgorithm, fmt.Errorf("invalid policy '%s' in profile '%s' (cause: %w)", policy, profile.Name, err)
+		}
+		template.PolicyIdentifiers = append(template.PolicyIdentifiers, policyIdentifier)
+	}
+	return template, alg, nil
+}
+
+func parseObjectIdentifier(oid string) (asn1.ObjectIdentifier, error) {
+	var parsed asn1.ObjectIdentifier
+	for _, component := range strings.Split(oid, ".") {
+		value, err := strconv.Atoi(component)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, value)
+	}
+	return parsed, nil
+}
+
+func (profile *Profile) applySubjectAltNames(template *x509.Certificate, subject pkix.Name, subjectAltNames []string) error {
+	rules := &profile.SubjectAltNames
+	names := subjectAltNames
+	if rules.CopyCommonName && subject.CommonName != "" {
+		names = append([]string{subject.CommonName}, names...)
+	}
+	for _, name := range names {
+		ip := net.ParseIP(name)
+		switch {
+		case ip != nil:
+			if !rules.IP {
+				return fmt.Errorf("IP address '%s' not allowed by profile '%s'", name, profile.Name)
+			}
+			template.IPAddresses = append(template.IPAddresses, ip)
+		case strings.Contains(name, "://"):
+			if !rules.URI {
+				return fmt.Errorf("URI '%s' not allowed by profile '%s'", name, profile.Name)
+			}
+			uri, err := url.Parse(name)
+			if err != nil {
+				return fmt.Errorf("invalid URI '%s' (cause: %w)", name, err)
+			}
+			template.URIs = append(template.URIs, uri)
+		case strings.Contains(name, "@"):
+			if !rules.Email {
+				return fmt.Errorf("email address '%s' not allowed by profile '%s'", name, profile.Name)
+			}
+			template.EmailAddresses = append(template.EmailAddresses, name)
+		default:
+			if !rules.DNS {
+				return fmt.Errorf("DNS name '%s' not allowed by profile '%s'", name, profile.Name)
+			}
+			if !slices.Contains(template.DNSNames, name) {
+				template.DNSNames = append(template.DNSNames, name)
+			}
+		}
+	}
+	if rules.Required && len(template.DNSNames)+len(template.IPAddresses)+len(template.EmailAddresses)+len(template.URIs) == 0 {
+		return fmt.Errorf("profile '%s' requires at least one subject alternative name", profile.Name)
+	}
+	return nil
+}
+
+//go:embed defaults.yaml
+var defaultsYAML []byte
+
+// DefaultConfig gets the configuration containing the default profiles ("root-ca", "intermediate-ca", "tls-server" and "client").
+func DefaultConfig() (*Config, error) {
+	return parseConfig(defaultsYAML, "defaults")
+}
+
+// LoadConfig loads a configuration from the given file.
+func LoadConfig(path string) (*Config, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine absolute path for configuration file '%s' (cause: %w)", path, err)
+	}
+	configBytes, err := os.ReadFile(absolutePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file '%s' (cause: %w)", path, err)
+	}
+	return parseConfig(configBytes, path)
+}
+
+func parseConfig(configBytes []byte, source string) (*Config, error) {
+	config := &Config{
+		Profiles: make(map[string]Profile, 0),
+	}
+	err := yaml.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal configuration '%s' (cause: %w)", source, err)
+	}
+	for name, profile := range config.Profiles {
+		profile.Name = name
+		_, _, err = profile.template()
+		if err != nil {
+			return nil, err
+		}
+		config.Profiles[name] = profile
+	}
+	return config, nil
+}
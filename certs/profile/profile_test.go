@@ -0,0 +1,80 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package profile_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/certs/profile"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config, err := profile.LoadConfig("./testdata/profiles-test.yaml")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(config.Profiles))
+	profile1, err := config.Profile("Test1")
+	require.NoError(t, err)
+	require.Equal(t, "Test1", profile1.Name)
+	template1, keyPairFactory1, err := profile1.Render(pkix.Name{CommonName: "localhost"}, []string{"www.localhost"})
+	require.NoError(t, err)
+	require.Equal(t, keys.RSA2048, keyPairFactory1.Alg())
+	require.Equal(t, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, template1.KeyUsage)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, template1.ExtKeyUsage)
+	require.Equal(t, []string{"localhost", "www.localhost"}, template1.DNSNames)
+	require.Equal(t, 1, len(template1.PolicyIdentifiers))
+	require.Equal(t, []string{"http://localhost/crl/test.crl"}, template1.CRLDistributionPoints)
+	require.Equal(t, []string{"http://localhost/ocsp"}, template1.OCSPServer)
+	require.Equal(t, []string{"http://localhost/ca/test.crt"}, template1.IssuingCertificateURL)
+	require.False(t, template1.IsCA)
+	_, _, err = profile1.Render(pkix.Name{CommonName: "localhost"}, []string{"127.0.0.1"})
+	require.Error(t, err)
+	_, _, err = profile1.Render(pkix.Name{}, nil)
+	require.Error(t, err)
+	profile2, err := config.Profile("Test2")
+	require.NoError(t, err)
+	template2, _, err := profile2.Render(pkix.Name{CommonName: "CA"}, nil)
+	require.NoError(t, err)
+	require.True(t, template2.IsCA)
+	require.Equal(t, 1, template2.MaxPathLen)
+	_, err = config.Profile("Unknown")
+	require.Error(t, err)
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config, err := profile.DefaultConfig()
+	require.NoError(t, err)
+	for _, name := range []string{"root-ca", "intermediate-ca", "tls-server", "client"} {
+		_, err := config.Profile(name)
+		require.NoError(t, err)
+	}
+	rootProfile, err := config.Profile("root-ca")
+	require.NoError(t, err)
+	rootTemplate, rootKeyPairFactory, err := rootProfile.Render(pkix.Name{CommonName: "root"}, nil)
+	require.NoError(t, err)
+	rootKey, root, err := certs.NewLocalCertificateFactory(rootTemplate, rootKeyPairFactory, nil, nil).New()
+	require.NoError(t, err)
+	require.True(t, root.IsCA)
+	intermediateProfile, err := config.Profile("intermediate-ca")
+	require.NoError(t, err)
+	intermediateTemplate, intermediateKeyPairFactory, err := intermediateProfile.Render(pkix.Name{CommonName: "intermediate"}, nil)
+	require.NoError(t, err)
+	intermediateKey, intermediate, err := certs.NewLocalCertificateFactory(intermediateTemplate, intermediateKeyPairFactory, root, rootKey).New()
+	require.NoError(t, err)
+	require.True(t, intermediate.MaxPathLenZero)
+	serverProfile, err := config.Profile("tls-server")
+	require.NoError(t, err)
+	serverTemplate, serverKeyPairFactory, err := serverProfile.Render(pkix.Name{CommonName: "localhost"}, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	_, server, err := certs.NewLocalCertificateFactory(serverTemplate, serverKeyPairFactory, intermediate, intermediateKey).New()
+	require.NoError(t, err)
+	require.Equal(t, []string{"localhost"}, server.DNSNames)
+	require.Equal(t, 1, len(server.IPAddresses))
+}
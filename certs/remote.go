@@ -19,11 +19,12 @@ import (
 const remoteFactoryName = "Remote"
 
 type remoteCertificateFactory struct {
-	template *x509.Certificate
-	request  *x509.CertificateRequest
-	parent   *x509.Certificate
-	signer   crypto.PrivateKey
-	logger   *zerolog.Logger
+	template      *x509.Certificate
+	request       *x509.CertificateRequest
+	parent        *x509.Certificate
+	signer        crypto.PrivateKey
+	serialNumbers SerialNumberGenerator
+	logger        *zerolog.Logger
 }
 
 func (factory *remoteCertificateFactory) Name() string {
@@ -33,7 +34,11 @@ func (factory *remoteCertificateFactory) Name() string {
 func (factory *remoteCertificateFactory) New() (crypto.PrivateKey, *x509.Certificate, error) {
 	createTemplate := factory.template
 	factory.logger.Info().Msg("creating X.509 certificate from remote request...")
-	createTemplate.SerialNumber = nextSerialNumber()
+	serialNumber, err := nextSerialNumber(factory.serialNumbers, factory.parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	createTemplate.SerialNumber = serialNumber
 	certificateBytes, err := x509.CreateCertificate(rand.Reader, createTemplate, factory.parent, factory.request.PublicKey, factory.signer)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create certificate (cause: %w)", err)
@@ -46,14 +51,25 @@ func (factory *remoteCertificateFactory) New() (crypto.PrivateKey, *x509.Certifi
 }
 
 // NewRemoteCertificateFactory creates a new certificate factory for request based certificates.
+//
+// The serial number of the created certificate is generated using [DefaultSerialNumberGenerator].
 func NewRemoteCertificateFactory(template *x509.Certificate, request *x509.CertificateRequest, parent *x509.Certificate, signer crypto.PrivateKey) CertificateFactory {
+	return NewRemoteCertificateFactoryWithSerialNumbers(template, request, parent, signer, nil)
+}
+
+// NewRemoteCertificateFactoryWithSerialNumbers creates a new certificate factory for request based certificates
+// using the submitted [SerialNumberGenerator].
+//
+// If the submitted [SerialNumberGenerator] is nil, [DefaultSerialNumberGenerator] is used.
+func NewRemoteCertificateFactoryWithSerialNumbers(template *x509.Certificate, request *x509.CertificateRequest, parent *x509.Certificate, signer crypto.PrivateKey, serialNumbers SerialNumberGenerator) CertificateFactory {
 	logger := log.RootLogger().With().Str("Factory", remoteFactoryName).Logger()
 	return &remoteCertificateFactory{
-		template: template,
-		request:  request,
-		parent:   parent,
-		signer:   signer,
-		logger:   &logger,
+		template:      template,
+		request:       request,
+		parent:        parent,
+		signer:        signer,
+		serialNumbers: serialNumbers,
+		logger:        &logger,
 	}
 }
 
@@ -0,0 +1,66 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+)
+
+// SerialNumberGenerator interface provides a unified way to generate X.509 certificate serial numbers.
+type SerialNumberGenerator interface {
+	// Next generates the serial number for a new certificate issued by the given issuer certificate.
+	//
+	// For self-signed certificates issuer is nil.
+	Next(issuer *x509.Certificate) (*big.Int, error)
+}
+
+const randomSerialNumberBits = 128
+
+type randomSerialNumberGenerator struct{}
+
+func (generator *randomSerialNumberGenerator) Next(issuer *x509.Certificate) (*big.Int, error) {
+	return RandomSerialNumber()
+}
+
+// NewRandomSerialNumberGenerator creates a new [SerialNumberGenerator] generating 128 bit random serial numbers
+// using a cryptographically secure random number generator.
+func NewRandomSerialNumberGenerator() SerialNumberGenerator {
+	return &randomSerialNumberGenerator{}
+}
+
+// DefaultSerialNumberGenerator is the [SerialNumberGenerator] used if none is submitted explicitly.
+var DefaultSerialNumberGenerator SerialNumberGenerator = NewRandomSerialNumberGenerator()
+
+// RandomSerialNumber generates a positive 128 bit random serial number.
+func RandomSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), randomSerialNumberBits)
+	for {
+		serialNumber, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random serial number (cause: %w)", err)
+		}
+		if serialNumber.Sign() > 0 {
+			return serialNumber, nil
+		}
+	}
+}
+
+func nextSerialNumber(generator SerialNumberGenerator, issuer *x509.Certificate) (*big.Int, error) {
+	if generator == nil {
+		generator = DefaultSerialNumberGenerator
+	}
+	serialNumber, err := generator.Next(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if serialNumber == nil || serialNumber.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid serial number generated")
+	}
+	return serialNumber, nil
+}
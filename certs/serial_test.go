@@ -0,0 +1,52 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certs_test
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomSerialNumberGenerator(t *testing.T) {
+	generator := certs.NewRandomSerialNumberGenerator()
+	serialNumbers := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		serialNumber, err := generator.Next(nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, serialNumber.Sign())
+		require.LessOrEqual(t, serialNumber.BitLen(), 128)
+		require.False(t, serialNumbers[serialNumber.String()])
+		serialNumbers[serialNumber.String()] = true
+	}
+}
+
+type testSerialNumberGenerator struct {
+	next int64
+}
+
+func (generator *testSerialNumberGenerator) Next(issuer *x509.Certificate) (*big.Int, error) {
+	generator.next++
+	return big.NewInt(generator.next), nil
+}
+
+func TestCustomSerialNumberGenerator(t *testing.T) {
+	generator := &testSerialNumberGenerator{}
+	template1 := newLocalTestCertificateTemplate("Test1")
+	template1.IsCA = true
+	template1.KeyUsage = template1.KeyUsage | x509.KeyUsageCertSign
+	privateKey1, cert1, err := certs.NewLocalCertificateFactoryWithSerialNumbers(template1, keys.ECDSA224.NewKeyPairFactory(), nil, nil, generator).New()
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(1), cert1.SerialNumber)
+	template2 := newLocalTestCertificateTemplate("Test2")
+	_, cert2, err := certs.NewLocalCertificateFactoryWithSerialNumbers(template2, keys.ECDSA224.NewKeyPairFactory(), cert1, privateKey1, generator).New()
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(2), cert2.SerialNumber)
+}
@@ -0,0 +1,347 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+// CheckIssueKind defines the kind of a [CheckIssue].
+type CheckIssueKind int
+
+const (
+	// CheckIssueUnreadable reports entry data which cannot be read (e.g. invalid JSON).
+	CheckIssueUnreadable CheckIssueKind = iota + 1
+	// CheckIssueMalformed reports an entry attribute which cannot be decoded (e.g. invalid base64 or DER data).
+	CheckIssueMalformed
+	// CheckIssueKeyUndecryptable reports an entry key which can neither be decrypted nor resolved.
+	CheckIssueKeyUndecryptable
+	// CheckIssueKeyMismatch reports an entry key not matching the entry's certificate or certificate request.
+	CheckIssueKeyMismatch
+	// CheckIssueRevocationListSignature reports a revocation list not signed by the entry's certificate.
+	CheckIssueRevocationListSignature
+	// CheckIssueVersionGap reports missing versions between the retained versions of an entry.
+	CheckIssueVersionGap
+	// CheckIssueOrphan reports an artifact left behind by an interrupted write (see [storage.CheckableBackend]).
+	CheckIssueOrphan
+)
+
+func (kind CheckIssueKind) String() string {
+	switch kind {
+	case CheckIssueUnreadable:
+		return "unreadable"
+	case CheckIssueMalformed:
+		return "malformed"
+	case CheckIssueKeyUndecryptable:
+		return "key undecryptable"
+	case CheckIssueKeyMismatch:
+		return "key mismatch"
+	case CheckIssueRevocationListSignature:
+		return "revocation list signature"
+	case CheckIssueVersionGap:
+		return "version gap"
+	case CheckIssueOrphan:
+		return "orphan"
+	}
+	return fmt.Sprintf("CheckIssueKind(%d)", int(kind))
+}
+
+// A CheckIssue describes a single issue detected by [Registry.Check].
+type CheckIssue struct {
+	// Kind is the kind of issue.
+	Kind CheckIssueKind
+	// Name is the name of the affected store entry (or the orphan in case of [CheckIssueOrphan]).
+	Name string
+	// Version is the affected entry version (0, if the issue is not related to a specific version).
+	Version storage.Version
+	// Message describes the issue.
+	Message string
+}
+
+func (issue *CheckIssue) String() string {
+	return fmt.Sprintf("%s: '%s' (version: %d) %s", issue.Kind, issue.Name, issue.Version, issue.Message)
+}
+
+// CheckRepairAction defines the action taken by a [CheckRepair].
+type CheckRepairAction int
+
+const (
+	// CheckRepairRollback rolls back a broken entry to its latest good version.
+	CheckRepairRollback CheckRepairAction = iota + 1
+	// CheckRepairQuarantine deletes a broken entry without good version. The entry's versions are retained in the store's history.
+	// Hence entries are only quarantined, if the store's backend records history (see [storage.HistoryBackend]).
+	CheckRepairQuarantine
+	// CheckRepairRemove removes an orphan.
+	CheckRepairRemove
+)
+
+func (action CheckRepairAction) String() string {
+	switch action {
+	case CheckRepairRollback:
+		return "rollback"
+	case CheckRepairQuarantine:
+		return "quarantine"
+	case CheckRepairRemove:
+		return "remove"
+	}
+	return fmt.Sprintf("CheckRepairAction(%d)", int(action))
+}
+
+// A CheckRepair describes a single repair performed by [Registry.Check].
+type CheckRepair struct {
+	// Action is the repair action taken.
+	Action CheckRepairAction
+	// Name is the name of the repaired store entry (or the orphan in case of [CheckRepairRemove]).
+	Name string
+	// Version is the version rolled back to ([CheckRepairRollback] only).
+	Version storage.Version
+}
+
+// CheckOptions defines the options used by [Registry.Check].
+type CheckOptions struct {
+	// Repair enables repairing the detected issues.
+	//
+	// Entries whose latest version is unparsable or malformed are rolled back to their latest good version. If there
+	// is no good version, the entry is quarantined (see [CheckRepairQuarantine]). Orphans are removed. Entries updated
+	// concurrently while being repaired are not repaired and fail the check with [storage.ErrConflict]. Issues affecting
+	// older versions only, undecryptable keys and version gaps as well as entries which cannot be read due to storage
+	// errors are reported but not repaired.
+	Repair bool
+}
+
+// CheckReport contains the results of [Registry.Check].
+type CheckReport struct {
+	// Entries is the number of checked store entries.
+	Entries int
+	// Versions is the number of checked entry versions.
+	Versions int
+	// Issues lists the detected issues.
+	Issues []*CheckIssue
+	// Repairs lists the performed repairs.
+	Repairs []*CheckRepair
+}
+
+// OK reports whether no issues have been detected.
+func (report *CheckReport) OK() bool {
+	return len(report.Issues) == 0
+}
+
+func (report *CheckReport) addIssue(kind CheckIssueKind, name string, version storage.Version, message string) {
+	report.Issues = append(report.Issues, &CheckIssue{Kind: kind, Name: name, Version: version, Message: message})
+}
+
+// Check checks the integrity of all store entries and all of their retained versions.
+//
+// Each version is checked for readable entry data, decodable attributes, a decryptable (or resolvable) key
+// matching the entry's certificate or certificate request and a revocation list signed by the entry's certificate.
+// Furthermore gaps in the retained versions and artifacts left behind by interrupted writes are reported.
+// See [CheckOptions] for the available repair options.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name (repairs only).
+func (registry *Registry) Check(options *CheckOptions, user string) (*CheckReport, error) {
+	report := &CheckReport{Issues: make([]*CheckIssue, 0), Repairs: make([]*CheckRepair, 0)}
+	names, err := registry.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		name := names.Next()
+		if name == "" {
+			break
+		}
+		if !registry.isValidEntryName(name) {
+			continue
+		}
+		err = registry.checkEntry(report, name, options.Repair, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+	checkable, ok := registry.backend.(storage.CheckableBackend)
+	if ok {
+		err = registry.checkOrphans(report, checkable, options.Repair)
+		if err != nil {
+			return nil, err
+		}
+	}
+	registry.logger.Info().Msgf("checked %d entries (%d versions); %d issue(s), %d repair(s)", report.Entries, report.Versions, len(report.Issues), len(report.Repairs))
+	return report, nil
+}
+
+func (registry *Registry) checkEntry(report *CheckReport, name string, repair bool, user string) error {
+	report.Entries++
+	versions, err := registry.backend.GetVersions(name)
+	if err != nil {
+		// read errors may be transient; hence they are reported but never repaired
+		report.addIssue(CheckIssueUnreadable, name, 0, err.Error())
+		return nil
+	}
+	for versionIndex := 1; versionIndex < len(versions); versionIndex++ {
+		if versions[versionIndex-1]-versions[versionIndex] != 1 {
+			report.addIssue(CheckIssueVersionGap, name, versions[versionIndex-1], fmt.Sprintf("previous version is %d", versions[versionIndex]))
+		}
+	}
+	readFailed := false
+	latestBroken := false
+	var good storage.Version
+	var goodBytes []byte
+	for _, version := range versions {
+		report.Versions++
+		dataBytes, err := registry.backend.GetVersion(name, version)
+		if err != nil {
+			report.addIssue(CheckIssueUnreadable, name, version, err.Error())
+			readFailed = true
+			continue
+		}
+		broken := registry.checkEntryVersion(report, name, version, dataBytes)
+		if broken {
+			latestBroken = latestBroken || version == versions[0]
+		} else if goodBytes == nil {
+			good = version
+			goodBytes = dataBytes
+		}
+	}
+	if !repair || !latestBroken {
+		return nil
+	}
+	if readFailed {
+		registry.logger.Warn().Msgf("not repairing entry '%s' due to read errors", name)
+		return nil
+	}
+	if goodBytes == nil {
+		return registry.quarantineEntry(report, name, versions[0], user)
+	}
+	registry.logger.Warn().Msgf("rolling back entry '%s' to version %d...", name, good)
+	rolledBackVersion, err := storage.UpdateIf(registry.backend, name, goodBytes, versions[0])
+	if err != nil {
+		return err
+	}
+	if registry.entryCache != nil {
+		registry.entryCache.Delete(name)
+	}
+	registry.notify(ChangeUpdated, name, rolledBackVersion)
+	report.Repairs = append(report.Repairs, &CheckRepair{Action: CheckRepairRollback, Name: name, Version: good})
+	return registry.audit(auditRestore, name, user, auditVersion(good))
+}
+
+// checkEntryVersion checks the submitted entry version and reports whether the version is broken. An entry
+// version is broken, if it has issues other than an undecryptable key (which may be caused by a missing or
+// outdated store secret rather than by the entry itself).
+func (registry *Registry) checkEntryVersion(report *CheckReport, name string, version storage.Version, dataBytes []byte) bool {
+	data, err := registry.decodeEntryData(dataBytes)
+	if err != nil {
+		report.addIssue(CheckIssueUnreadable, name, version, err.Error())
+		return true
+	}
+	var key crypto.PrivateKey
+	if data.KeyRef != "" {
+		key, err = registry.resolveKeyRef(data.KeyRef)
+	} else {
+		key, err = registry.getEntryKey(data)
+	}
+	if err != nil {
+		report.addIssue(CheckIssueKeyUndecryptable, name, version, err.Error())
+	}
+	issueCount := len(report.Issues)
+	certificate, err := data.getCertificate()
+	if err != nil {
+		report.addIssue(CheckIssueMalformed, name, version, err.Error())
+	}
+	certificateRequest, err := data.getCertificateRequest()
+	if err != nil {
+		report.addIssue(CheckIssueMalformed, name, version, err.Error())
+	}
+	revocationList, err := data.getRevocationList()
+	if err != nil {
+		report.addIssue(CheckIssueMalformed, name, version, err.Error())
+	}
+	_, err = data.getRevocations()
+	if err != nil {
+		report.addIssue(CheckIssueMalformed, name, version, err.Error())
+	}
+	_, err = data.getSerialNumber()
+	if err != nil {
+		report.addIssue(CheckIssueMalformed, name, version, err.Error())
+	}
+	if key != nil {
+		if certificate != nil && !keys.PublicsEqual(certificate.PublicKey, keys.PublicFromPrivate(key)) {
+			report.addIssue(CheckIssueKeyMismatch, name, version, "key does not match certificate")
+		} else if certificate == nil && certificateRequest != nil && !keys.PublicsEqual(certificateRequest.PublicKey, keys.PublicFromPrivate(key)) {
+			report.addIssue(CheckIssueKeyMismatch, name, version, "key does not match certificate request")
+		}
+	}
+	if revocationList != nil && certificate != nil {
+		err = revocationList.CheckSignatureFrom(certificate)
+		if err != nil {
+			report.addIssue(CheckIssueRevocationListSignature, name, version, err.Error())
+		}
+	}
+	return len(report.Issues) > issueCount
+}
+
+// quarantineEntry deletes the submitted entry, if it has not been updated since the submitted version has been checked.
+// Entries are only quarantined, if their versions are retained in the store's history.
+func (registry *Registry) quarantineEntry(report *CheckReport, name string, version storage.Version, user string) error {
+	_, ok := registry.backend.(storage.HistoryBackend)
+	if !ok {
+		registry.logger.Warn().Msgf("not quarantining entry '%s' as backend '%s' does not record history", name, registry.backend.URI())
+		return nil
+	}
+	registry.logger.Warn().Msgf("quarantining entry '%s'...", name)
+	err := deleteIf(registry.backend, name, version)
+	if err != nil {
+		return err
+	}
+	if registry.entryCache != nil {
+		registry.entryCache.Delete(name)
+	}
+	registry.notify(ChangeDeleted, name, 0)
+	report.Repairs = append(report.Repairs, &CheckRepair{Action: CheckRepairQuarantine, Name: name})
+	return registry.audit(auditDelete, name, user)
+}
+
+// deleteIf deletes the submitted entry only, if its current version equals the expected one. Otherwise a
+// [storage.ConflictError] is returned. If the submitted backend implements [storage.TransactionalBackend], check
+// and delete are atomic. Otherwise the version is checked prior to deleting the entry.
+func deleteIf(backend storage.Backend, name string, expected storage.Version) error {
+	transactional, ok := backend.(storage.TransactionalBackend)
+	if ok {
+		return transactional.Commit([]storage.Operation{{Kind: storage.OperationDelete, Name: name, Expected: expected}})
+	}
+	versions, err := backend.GetVersions(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return storage.ErrNotExist
+	}
+	if versions[0] != expected {
+		return &storage.ConflictError{Name: name, Expected: expected, Current: versions[0]}
+	}
+	return backend.Delete(name)
+}
+
+func (registry *Registry) checkOrphans(report *CheckReport, backend storage.CheckableBackend, repair bool) error {
+	orphans, err := backend.Orphans()
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphans {
+		report.addIssue(CheckIssueOrphan, orphan, 0, "left over by interrupted write")
+		if repair {
+			err = backend.RemoveOrphan(orphan)
+			if err != nil {
+				return err
+			}
+			report.Repairs = append(report.Repairs, &CheckRepair{Action: CheckRepairRemove, Name: orphan})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestCheck*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, 10)
+	require.NoError(t, err)
+	registry, err := certstore.NewStore(backend, testCacheTTL)
+	require.NoError(t, err)
+	user := "TestCheckUser"
+	populateTestStore(t, registry, user, 1)
+	report, err := registry.Check(&certstore.CheckOptions{}, user)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, 4, report.Entries)
+	otherName, err := registry.CreateCertificate("other", newTestRootCertificateFactory("other"), user)
+	require.NoError(t, err)
+	other, err := registry.Entry(otherName)
+	require.NoError(t, err)
+	_, err = other.ResetRevocationList(newTestRevocationListFactory(), user)
+	require.NoError(t, err)
+	goodVersions := make(map[string]storage.Version)
+	for _, name := range []string{"root1", "root1_intermediate1_leaf1", "request1"} {
+		versions, err := backend.GetVersions(name)
+		require.NoError(t, err)
+		goodVersions[name] = versions[0]
+	}
+	// unreadable latest version
+	_, err = backend.Update("root1_intermediate1_leaf1", []byte("{"))
+	require.NoError(t, err)
+	// key mismatch (keys are bound to their certificate's public key and hence become undecryptable; not repaired)
+	rootData := readTestEntryData(t, backend, "root1")
+	intermediateData := readTestEntryData(t, backend, "root1_intermediate1")
+	mismatchData := readTestEntryData(t, backend, "root1_intermediate1")
+	mismatchData["crt"] = rootData["crt"]
+	writeTestEntryData(t, backend, "root1_intermediate1", mismatchData)
+	// malformed certificate request
+	requestData := readTestEntryData(t, backend, "request1")
+	requestData["csr"] = "not base64"
+	writeTestEntryData(t, backend, "request1", requestData)
+	// revocation list not signed by certificate
+	rootData["crl"] = readTestEntryData(t, backend, otherName)["crl"]
+	writeTestEntryData(t, backend, "root1", rootData)
+	// entry without good version
+	_, err = backend.Create("broken", []byte("}"))
+	require.NoError(t, err)
+	// version gap
+	gapName, err := registry.CreateCertificate("gap", newTestRootCertificateFactory("gap"), user)
+	require.NoError(t, err)
+	gap, err := registry.Entry(gapName)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = gap.SetAttributes(map[string]string{"Update": string(rune('0' + i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.Remove(filepath.Join(path, gapName, "2")))
+	// orphan
+	require.NoError(t, os.WriteFile(filepath.Join(path, gapName, "4.tmp"), []byte{}, 0600))
+	// check
+	report, err = registry.Check(&certstore.CheckOptions{}, user)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Empty(t, report.Repairs)
+	checkIssue(t, report, certstore.CheckIssueUnreadable, "root1_intermediate1_leaf1")
+	checkIssue(t, report, certstore.CheckIssueKeyUndecryptable, "root1_intermediate1")
+	checkIssue(t, report, certstore.CheckIssueMalformed, "request1")
+	checkIssue(t, report, certstore.CheckIssueRevocationListSignature, "root1")
+	checkIssue(t, report, certstore.CheckIssueUnreadable, "broken")
+	checkIssue(t, report, certstore.CheckIssueVersionGap, gapName)
+	checkIssue(t, report, certstore.CheckIssueOrphan, filepath.Join(gapName, "4.tmp"))
+	_, err = registry.Entry("root1_intermediate1_leaf1")
+	require.Error(t, err)
+	// repair
+	report, err = registry.Check(&certstore.CheckOptions{Repair: true}, user)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	for name, goodVersion := range goodVersions {
+		checkRepair(t, report, certstore.CheckRepairRollback, name, goodVersion)
+	}
+	checkRepair(t, report, certstore.CheckRepairQuarantine, "broken", 0)
+	checkRepair(t, report, certstore.CheckRepairRemove, filepath.Join(gapName, "4.tmp"), 0)
+	checkNoRepair(t, report, "root1_intermediate1")
+	writeTestEntryData(t, backend, "root1_intermediate1", intermediateData)
+	_, err = registry.Entry("root1_intermediate1_leaf1")
+	require.NoError(t, err)
+	_, err = registry.Entry("broken")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	checkStoreEntries(t, registry, 6, 3)
+	// remaining issues affect older versions only (or are version gaps)
+	report, err = registry.Check(&certstore.CheckOptions{Repair: true}, user)
+	require.NoError(t, err)
+	require.Empty(t, report.Repairs)
+	for _, issue := range report.Issues {
+		if issue.Kind == certstore.CheckIssueVersionGap {
+			continue
+		}
+		entry, err := registry.Entry(issue.Name)
+		require.NoError(t, err)
+		require.Less(t, issue.Version, entry.Version())
+	}
+}
+
+func TestCheckReadError(t *testing.T) {
+	backend := &failingVersionsBackend{Backend: storage.NewMemoryStorage(testVersionLimit)}
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	user := "TestCheckReadErrorUser"
+	populateTestStore(t, registry, user, 1)
+	// read errors are reported but not repaired
+	backend.failing = "root1"
+	report, err := registry.Check(&certstore.CheckOptions{Repair: true}, user)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	checkIssue(t, report, certstore.CheckIssueUnreadable, "root1")
+	require.Empty(t, report.Repairs)
+	backend.failing = ""
+	_, err = registry.Entry("root1")
+	require.NoError(t, err)
+}
+
+func TestCheckQuarantine(t *testing.T) {
+	user := "TestCheckQuarantineUser"
+	// backends without history do not quarantine
+	basicBackend := &nonTransactionalBackend{Backend: storage.NewMemoryStorage(testVersionLimit)}
+	registry, err := certstore.NewStore(basicBackend, 0)
+	require.NoError(t, err)
+	_, err = basicBackend.Create("broken", []byte("}"))
+	require.NoError(t, err)
+	report, err := registry.Check(&certstore.CheckOptions{Repair: true}, user)
+	require.NoError(t, err)
+	checkIssue(t, report, certstore.CheckIssueUnreadable, "broken")
+	require.Empty(t, report.Repairs)
+	_, err = basicBackend.GetVersions("broken")
+	require.NoError(t, err)
+	// entries updated concurrently are not quarantined
+	updatingBackend := &updatingVersionBackend{historyTransactionalBackend: storage.NewMemoryStorage(testVersionLimit).(historyTransactionalBackend)}
+	registry, err = certstore.NewStore(updatingBackend, 0)
+	require.NoError(t, err)
+	_, err = updatingBackend.Create("broken", []byte("}"))
+	require.NoError(t, err)
+	updatingBackend.updating = "broken"
+	_, err = registry.Check(&certstore.CheckOptions{Repair: true}, user)
+	require.ErrorIs(t, err, storage.ErrConflict)
+	_, err = updatingBackend.GetVersions("broken")
+	require.NoError(t, err)
+}
+
+type historyTransactionalBackend interface {
+	storage.HistoryBackend
+	storage.TransactionalBackend
+}
+
+// updatingVersionBackend simulates a concurrent update of an entry right after it has been read.
+type updatingVersionBackend struct {
+	historyTransactionalBackend
+	updating string
+}
+
+func (backend *updatingVersionBackend) GetVersion(name string, version storage.Version) ([]byte, error) {
+	data, err := backend.historyTransactionalBackend.GetVersion(name, version)
+	if err == nil && name == backend.updating {
+		backend.updating = ""
+		_, err = backend.historyTransactionalBackend.Update(name, []byte("{"))
+	}
+	return data, err
+}
+
+// failingVersionsBackend simulates a storage error while listing the versions of an entry.
+type failingVersionsBackend struct {
+	storage.Backend
+	failing string
+}
+
+func (backend *failingVersionsBackend) GetVersions(name string) ([]storage.Version, error) {
+	if name == backend.failing {
+		return nil, errors.New("simulated read error")
+	}
+	return backend.Backend.GetVersions(name)
+}
+
+func checkNoRepair(t *testing.T, report *certstore.CheckReport, name string) {
+	for _, repair := range report.Repairs {
+		require.NotEqual(t, name, repair.Name)
+	}
+}
+
+func checkIssue(t *testing.T, report *certstore.CheckReport, kind certstore.CheckIssueKind, name string) {
+	for _, issue := range report.Issues {
+		if issue.Kind == kind && issue.Name == name {
+			return
+		}
+	}
+	require.Fail(t, "missing issue", "%s '%s'", kind, name)
+}
+
+func checkRepair(t *testing.T, report *certstore.CheckReport, action certstore.CheckRepairAction, name string, version storage.Version) {
+	for _, repair := range report.Repairs {
+		if repair.Action == action && repair.Name == name {
+			require.Equal(t, version, repair.Version)
+			return
+		}
+	}
+	require.Fail(t, "missing repair", "%s '%s'", action, name)
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+// Package distribution provides an HTTP endpoint for distributing CA certificates and revocation lists of a certificate store.
+package distribution
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-log"
+	"github.com/rs/zerolog"
+)
+
+const certificatePathPrefix = "/ca/"
+const revocationListPathPrefix = "/crl/"
+
+const certificateDERSuffix = ".crt"
+const revocationListDERSuffix = ".crl"
+const pemSuffix = ".pem"
+
+const certificateDERContentType = "application/pkix-cert"
+const revocationListDERContentType = "application/pkix-crl"
+const pemContentType = "application/x-pem-file"
+
+const certificateMaxAge = 24 * time.Hour
+
+// CertificatePath gets the URL path (relative to the handler's root) the submitted entry's certificate is served at in DER format.
+//
+// Use [PEMPath] to derive the path of the PEM encoded variant.
+func CertificatePath(entry *certstore.RegistryEntry) string {
+	return certificatePathPrefix + entryID(entry) + certificateDERSuffix
+}
+
+// RevocationListPath gets the URL path (relative to the handler's root) the submitted entry's revocation list is served at in DER format.
+func RevocationListPath(entry *certstore.RegistryEntry) string {
+	return revocationListPathPrefix + entryID(entry) + revocationListDERSuffix
+}
+
+// PEMPath derives the URL path of the PEM encoded variant from a DER path as returned by [CertificatePath] or [RevocationListPath].
+func PEMPath(derPath string) string {
+	return strings.TrimSuffix(derPath, path.Ext(derPath)) + pemSuffix
+}
+
+func entryID(entry *certstore.RegistryEntry) string {
+	if entry.HasCertificate() && len(entry.Certificate().SubjectKeyId) > 0 {
+		return hex.EncodeToString(entry.Certificate().SubjectKeyId)
+	}
+	return url.PathEscape(entry.Name())
+}
+
+type distributionHandler struct {
+	registry *certstore.Registry
+	logger   *zerolog.Logger
+}
+
+// NewHandler creates a new [http.Handler] serving the CA certificates and revocation lists of the submitted [certstore.Registry].
+//
+// The following URL paths are served:
+//
+//  1. /ca/<id>.crt and /ca/<id>.pem: The certificate of a CA entry (DER and PEM encoded)
+//  2. /crl/<id>.crl and /crl/<id>.pem: The revocation list of a CA entry (DER and PEM encoded)
+//
+// <id> is either the hex encoded subject key identifier of the entry's certificate or the entry name.
+// See [CertificatePath] and [RevocationListPath] for deriving these paths from an entry.
+func NewHandler(registry *certstore.Registry) http.Handler {
+	logger := log.RootLogger().With().Str("Distribution", registry.Name()).Logger()
+	return &distributionHandler{
+		registry: registry,
+		logger:   &logger,
+	}
+}
+
+func (handler *distributionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	requestPath := r.URL.Path
+	var err error
+	switch {
+	case strings.HasPrefix(requestPath, certificatePathPrefix):
+		err = handler.serveCertificate(w, r, strings.TrimPrefix(requestPath, certificatePathPrefix))
+	case strings.HasPrefix(requestPath, revocationListPathPrefix):
+		err = handler.serveRevocationList(w, r, strings.TrimPrefix(requestPath, revocationListPathPrefix))
+	default:
+		http.NotFound(w, r)
+	}
+	if err != nil {
+		handler.logger.Error().Err(err).Msgf("failed to serve '%s'", requestPath)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (handler *distributionHandler) serveCertificate(w http.ResponseWriter, r *http.Request, file string) error {
+	id, pemEncoded, ok := splitFile(file, certificateDERSuffix)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	entry, err := handler.findEntry(id, func(entry *certstore.RegistryEntry) bool { return entry.IsCA() })
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	certificate := entry.Certificate()
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(certificateMaxAge.Seconds())))
+	if pemEncoded {
+		return handler.serveContent(w, r, entry, certificate.NotBefore, "CERTIFICATE", certificate.Raw, pemContentType)
+	}
+	return handler.serveContent(w, r, entry, certificate.NotBefore, "", certificate.Raw, certificateDERContentType)
+}
+
+func (handler *distributionHandler) serveRevocationList(w http.ResponseWriter, r *http.Request, file string) error {
+	id, pemEncoded, ok := splitFile(file, revocationListDERSuffix)
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	entry, err := handler.findEntry(id, func(entry *certstore.RegistryEntry) bool { return entry.IsCA() && entry.HasRevocationList() })
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	revocationList := entry.RevocationList()
+	maxAge := time.Until(revocationList.NextUpdate)
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds())))
+		w.Header().Set("Expires", revocationList.NextUpdate.UTC().Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if pemEncoded {
+		return handler.serveContent(w, r, entry, revocationList.ThisUpdate, "X509 CRL", revocationList.Raw, pemContentType)
+	}
+	return handler.serveContent(w, r, entry, revocationList.ThisUpdate, "", revocationList.Raw, revocationListDERContentType)
+}
+
+func splitFile(file string, derSuffix string) (string, bool, bool) {
+	if strings.HasSuffix(file, derSuffix) {
+		return strings.TrimSuffix(file, derSuffix), false, true
+	}
+	if strings.HasSuffix(file, pemSuffix) {
+		return strings.TrimSuffix(file, pemSuffix), true, true
+	}
+	return "", false, false
+}
+
+func (handler *distributionHandler) findEntry(id string, match func(entry *certstore.RegistryEntry) bool) (*certstore.RegistryEntry, error) {
+	entries, err := handler.registry.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return entries.Find(func(entry *certstore.RegistryEntry) bool {
+		if !match(entry) {
+			return false
+		}
+		return entry.Name() == id || hex.EncodeToString(entry.Certificate().SubjectKeyId) == strings.ToLower(id)
+	})
+}
+
+func (handler *distributionHandler) serveContent(w http.ResponseWriter, r *http.Request, entry *certstore.RegistryEntry, issued time.Time, pemType string, der []byte, contentType string) error {
+	// Last-Modified reflects the time the served storage version has been written. If the backend does not
+	// record it, the time the served content has been issued is used instead.
+	modTime, err := entry.Modified()
+	if err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		modTime = issued
+	}
+	content := der
+	if pemType != "" {
+		content = pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%d-%08x\"", entry.Version(), crc32.ChecksumIEEE(content)))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+	return nil
+}
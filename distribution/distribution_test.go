@@ -0,0 +1,126 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package distribution_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/distribution"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	user := "TestHandlerUser"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(2), 0)
+	require.NoError(t, err)
+	entry := newTestCAEntry(t, registry, "root", user)
+	server := httptest.NewServer(distribution.NewHandler(registry))
+	defer server.Close()
+	// certificate
+	certificatePath := distribution.CertificatePath(entry)
+	body, response := getTest(t, server.URL+certificatePath, http.StatusOK)
+	require.Equal(t, "application/pkix-cert", response.Header.Get("Content-Type"))
+	require.Equal(t, entry.Certificate().Raw, body)
+	body, response = getTest(t, server.URL+distribution.PEMPath(certificatePath), http.StatusOK)
+	require.Equal(t, "application/x-pem-file", response.Header.Get("Content-Type"))
+	block, _ := pem.Decode(body)
+	require.NotNil(t, block)
+	require.Equal(t, entry.Certificate().Raw, block.Bytes)
+	_, _ = getTest(t, server.URL+"/ca/root.crt", http.StatusOK)
+	// revocation list
+	revocationListPath := distribution.RevocationListPath(entry)
+	body, response = getTest(t, server.URL+revocationListPath, http.StatusOK)
+	require.Equal(t, "application/pkix-crl", response.Header.Get("Content-Type"))
+	require.Equal(t, entry.RevocationList().Raw, body)
+	require.NotEmpty(t, response.Header.Get("Expires"))
+	current, err := registry.Entry(entry.Name())
+	require.NoError(t, err)
+	modified, err := current.Modified()
+	require.NoError(t, err)
+	require.False(t, modified.IsZero())
+	require.Equal(t, modified.UTC().Format(http.TimeFormat), response.Header.Get("Last-Modified"))
+	etag := response.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	request, err := http.NewRequest(http.MethodGet, server.URL+revocationListPath, nil)
+	require.NoError(t, err)
+	request.Header.Set("If-None-Match", etag)
+	conditionalResponse, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	conditionalResponse.Body.Close()
+	require.Equal(t, http.StatusNotModified, conditionalResponse.StatusCode)
+	_, _ = getTest(t, server.URL+distribution.PEMPath(revocationListPath), http.StatusOK)
+	// not found
+	_, _ = getTest(t, server.URL+"/crl/unknown.crl", http.StatusNotFound)
+	_, _ = getTest(t, server.URL+"/unknown", http.StatusNotFound)
+}
+
+func TestHandlerWithoutHistory(t *testing.T) {
+	user := "TestHandlerWithoutHistoryUser"
+	registry, err := certstore.NewStore(&basicBackend{Backend: storage.NewMemoryStorage(2)}, 0)
+	require.NoError(t, err)
+	entry := newTestCAEntry(t, registry, "root", user)
+	server := httptest.NewServer(distribution.NewHandler(registry))
+	defer server.Close()
+	_, response := getTest(t, server.URL+distribution.CertificatePath(entry), http.StatusOK)
+	require.Equal(t, entry.Certificate().NotBefore.UTC().Format(http.TimeFormat), response.Header.Get("Last-Modified"))
+	_, response = getTest(t, server.URL+distribution.RevocationListPath(entry), http.StatusOK)
+	require.Equal(t, entry.RevocationList().ThisUpdate.UTC().Format(http.TimeFormat), response.Header.Get("Last-Modified"))
+}
+
+// basicBackend hides all optional interfaces (e.g. [storage.HistoryBackend]) of the wrapped backend.
+type basicBackend struct {
+	storage.Backend
+}
+
+func getTest(t *testing.T, url string, expectedStatus int) ([]byte, *http.Response) {
+	response, err := http.Get(url)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, expectedStatus, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return body, response
+}
+
+func newTestCAEntry(t *testing.T, registry *certstore.Registry, name string, user string) *certstore.RegistryEntry {
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+	factory := certs.NewLocalCertificateFactory(template, keys.ECDSA256.NewKeyPairFactory(), nil, nil)
+	createdName, err := registry.CreateCertificate(name, factory, user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	revocationListTemplate := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.AddDate(0, 1, 0),
+	}
+	_, err = entry.ResetRevocationList(certs.NewLocalRevocationListFactory(revocationListTemplate), user)
+	require.NoError(t, err)
+	entry, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	return entry
+}
@@ -42,7 +42,7 @@ type Key interface {
 	Verify(signature []byte, digest []byte, opts crypto.SignerOpts) bool
 }
 
-// KeyFromPrivate wraps the given private key into a Key interface.
+// KeyFromPrivate wraps the given private key (which may also be a [StoredKey]) into a Key interface.
 func KeyFromPrivate(privateKey crypto.PrivateKey) Key {
 	rsaKey, ok := privateKey.(*rsa.PrivateKey)
 	if ok {
@@ -56,6 +56,10 @@ func KeyFromPrivate(privateKey crypto.PrivateKey) Key {
 	if ok {
 		return wrapED25519Key(ed25519Key)
 	}
+	storedKey, ok := privateKey.(StoredKey)
+	if ok {
+		return wrapStoredKey(storedKey)
+	}
 	panic("unexpected private key type")
 }
 
@@ -13,6 +13,8 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -142,3 +144,43 @@ func TestAlgs(t *testing.T) {
 		require.Equal(t, alg, algFromKey)
 	}
 }
+
+func TestSoftwareKeyStore(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestSoftwareKeyStore*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	_, err = keys.NewSoftwareKeyStore("software", path, nil)
+	require.Error(t, err)
+	protectionKey := make([]byte, 32)
+	_, err = rand.Read(protectionKey)
+	require.NoError(t, err)
+	keyStore, err := keys.NewSoftwareKeyStore("software", path, protectionKey)
+	require.NoError(t, err)
+	require.Equal(t, "software", keyStore.Name())
+	kpf, err := keyStore.NewKeyPairFactory(keys.ECDSA256)
+	require.NoError(t, err)
+	require.Equal(t, keys.ECDSA256, kpf.Alg())
+	keypair, err := kpf.New()
+	require.NoError(t, err)
+	storedKey, ok := keypair.Private().(keys.StoredKey)
+	require.True(t, ok)
+	require.True(t, keys.PublicsEqual(keypair.Public(), storedKey.Public()))
+	checkKey(t, keys.KeyFromPrivate(storedKey), keypair.Public(), crypto.SHA256)
+	loadedKey, err := keyStore.Key(storedKey.ID())
+	require.NoError(t, err)
+	require.True(t, keys.PrivatesEqual(storedKey, loadedKey))
+	require.True(t, keys.PublicsEqual(storedKey.Public(), keys.PublicFromPrivate(loadedKey)))
+	_, err = keyStore.Key("unknown")
+	require.ErrorIs(t, err, keys.ErrUnknownKey)
+	// key files are encrypted
+	keyPEM, err := os.ReadFile(filepath.Join(path, storedKey.ID()+".pem"))
+	require.NoError(t, err)
+	require.NotContains(t, string(keyPEM), "BEGIN PRIVATE KEY")
+	otherProtectionKey := make([]byte, 32)
+	_, err = rand.Read(otherProtectionKey)
+	require.NoError(t, err)
+	otherKeyStore, err := keys.NewSoftwareKeyStore("software", path, otherProtectionKey)
+	require.NoError(t, err)
+	_, err = otherKeyStore.Key(storedKey.ID())
+	require.Error(t, err)
+}
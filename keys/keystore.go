@@ -0,0 +1,71 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"io"
+)
+
+// ErrUnknownKey indicates a lookup of a key not held by the [KeyStore].
+var ErrUnknownKey = errors.New("unknown key")
+
+// KeyStore interface provides access to keys held by a key provider which does not expose the key material.
+//
+// The private key of a [KeyPair] created by one of the key store's [KeyPairFactory]s is a [StoredKey].
+type KeyStore interface {
+	// Name returns the name of this [KeyStore].
+	Name() string
+	// NewKeyPairFactory gets the [KeyPairFactory] for creating key pairs of the given algorithm inside this [KeyStore].
+	NewKeyPairFactory(alg Algorithm) (KeyPairFactory, error)
+	// Key gets the key with the given id. If the key does not exist, [ErrUnknownKey] is returned.
+	Key(id string) (StoredKey, error)
+}
+
+// StoredKey interface represents a private key held by a [KeyStore].
+//
+// The key is only usable via the [crypto.Signer] interface. The key material itself cannot be accessed.
+type StoredKey interface {
+	crypto.Signer
+	// KeyStore returns the [KeyStore] holding this key.
+	KeyStore() KeyStore
+	// ID returns the id identifying this key within its [KeyStore].
+	ID() string
+	// Equal reports whether this key and the given private key are the same key.
+	Equal(x crypto.PrivateKey) bool
+}
+
+type storedKey struct {
+	key StoredKey
+}
+
+func (wrapped *storedKey) Public() crypto.PublicKey {
+	return wrapped.key.Public()
+}
+
+func (wrapped *storedKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return wrapped.key.Sign(rand, digest, opts)
+}
+
+func (wrapped *storedKey) Verify(signature []byte, digest []byte, opts crypto.SignerOpts) bool {
+	switch publicKey := wrapped.key.Public().(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, opts.HashFunc(), digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(publicKey, digest, signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, digest, signature)
+	}
+	return false
+}
+
+func wrapStoredKey(key StoredKey) Key {
+	return &storedKey{key: key}
+}
@@ -0,0 +1,517 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+// Package pkcs11 provides a [keys.KeyStore] for keys held by a PKCS#11 token (e.g. a HSM).
+//
+// Key pairs are generated inside the token and marked as sensitive and non-extractable. Hence the private key
+// of a generated [keys.KeyPair] is a [keys.StoredKey], which is only usable as a [crypto.Signer].
+// The algorithms [keys.RSA2048], [keys.RSA3072], [keys.RSA4096], [keys.RSA8192], [keys.ECDSA224], [keys.ECDSA256],
+// [keys.ECDSA384] and [keys.ECDSA521] are supported.
+//
+// This package requires cgo.
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-log"
+	p11 "github.com/miekg/pkcs11"
+	"github.com/rs/zerolog"
+)
+
+// ErrUnsupportedAlgorithm indicates an algorithm not supported by the PKCS#11 [KeyStore].
+var ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+// An Option configures the access to the PKCS#11 token during [NewKeyStore].
+type Option func(options *keyStoreOptions)
+
+type keyStoreOptions struct {
+	slot       *uint
+	tokenLabel string
+	pin        string
+}
+
+// WithSlot selects the token by the submitted slot id.
+func WithSlot(slot uint) Option {
+	return func(options *keyStoreOptions) {
+		options.slot = &slot
+	}
+}
+
+// WithTokenLabel selects the token by the submitted token label.
+func WithTokenLabel(label string) Option {
+	return func(options *keyStoreOptions) {
+		options.tokenLabel = label
+	}
+}
+
+// WithPIN sets the user PIN used to log in to the token.
+func WithPIN(pin string) Option {
+	return func(options *keyStoreOptions) {
+		options.pin = pin
+	}
+}
+
+// KeyStore provides access to the keys held by a PKCS#11 token.
+type KeyStore struct {
+	name        string
+	ctx         *p11.Ctx
+	initialized bool
+	session     p11.SessionHandle
+	mutex       sync.Mutex
+	logger      *zerolog.Logger
+}
+
+// NewKeyStore opens the PKCS#11 token accessible via the submitted module.
+//
+// If neither [WithSlot] nor [WithTokenLabel] is submitted, the first slot with a token present is used.
+// The returned [KeyStore] must be closed via [KeyStore.Close] to release the token session.
+func NewKeyStore(name string, module string, options ...Option) (*KeyStore, error) {
+	keyStoreOptions := &keyStoreOptions{}
+	for _, option := range options {
+		option(keyStoreOptions)
+	}
+	logger := log.RootLogger().With().Str("KeyStore", name).Logger()
+	ctx := p11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module '%s'", module)
+	}
+	keyStore := &KeyStore{name: name, ctx: ctx, logger: &logger}
+	err := ctx.Initialize()
+	if err == nil {
+		keyStore.initialized = true
+	} else if !errors.Is(err, p11.Error(p11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module '%s' (cause: %w)", module, err)
+	}
+	err = keyStore.open(keyStoreOptions)
+	if err != nil {
+		keyStore.release()
+		return nil, err
+	}
+	return keyStore, nil
+}
+
+func (keyStore *KeyStore) open(options *keyStoreOptions) error {
+	slot, err := keyStore.selectSlot(options)
+	if err != nil {
+		return err
+	}
+	keyStore.logger.Info().Msgf("opening PKCS#11 token in slot %d...", slot)
+	session, err := keyStore.ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session (cause: %w)", err)
+	}
+	keyStore.session = session
+	if options.pin != "" {
+		err = keyStore.ctx.Login(session, p11.CKU_USER, options.pin)
+		if err != nil && !errors.Is(err, p11.Error(p11.CKR_USER_ALREADY_LOGGED_IN)) {
+			keyStore.ctx.CloseSession(session)
+			return fmt.Errorf("failed to log in to PKCS#11 token (cause: %w)", err)
+		}
+	}
+	return nil
+}
+
+func (keyStore *KeyStore) selectSlot(options *keyStoreOptions) (uint, error) {
+	slots, err := keyStore.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get PKCS#11 slots (cause: %w)", err)
+	}
+	if options.slot != nil {
+		if !slices.Contains(slots, *options.slot) {
+			return 0, fmt.Errorf("no PKCS#11 token in slot %d", *options.slot)
+		}
+		return *options.slot, nil
+	}
+	if options.tokenLabel != "" {
+		for _, slot := range slots {
+			tokenInfo, err := keyStore.ctx.GetTokenInfo(slot)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get PKCS#11 token info (cause: %w)", err)
+			}
+			if strings.TrimRight(tokenInfo.Label, " \x00") == options.tokenLabel {
+				return slot, nil
+			}
+		}
+		return 0, fmt.Errorf("no PKCS#11 token with label '%s'", options.tokenLabel)
+	}
+	if len(slots) == 0 {
+		return 0, fmt.Errorf("no PKCS#11 token present")
+	}
+	return slots[0], nil
+}
+
+// Close closes the token session and releases the PKCS#11 module.
+func (keyStore *KeyStore) Close() error {
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	err := keyStore.ctx.CloseSession(keyStore.session)
+	keyStore.release()
+	if err != nil {
+		return fmt.Errorf("failed to close PKCS#11 session (cause: %w)", err)
+	}
+	return nil
+}
+
+func (keyStore *KeyStore) release() {
+	if keyStore.initialized {
+		keyStore.ctx.Finalize()
+	}
+	keyStore.ctx.Destroy()
+}
+
+// Name returns the name of this [KeyStore].
+func (keyStore *KeyStore) Name() string {
+	return keyStore.name
+}
+
+// NewKeyPairFactory gets the [keys.KeyPairFactory] for creating key pairs of the given algorithm inside the token.
+//
+// If the algorithm is not supported, [ErrUnsupportedAlgorithm] is returned.
+func (keyStore *KeyStore) NewKeyPairFactory(alg keys.Algorithm) (keys.KeyPairFactory, error) {
+	logger := keyStore.logger.With().Str("Algorithm", alg.String()).Logger()
+	factory := &keyPairFactory{keyStore: keyStore, alg: alg, logger: &logger}
+	switch alg {
+	case keys.RSA2048:
+		factory.bits = 2048
+	case keys.RSA3072:
+		factory.bits = 3072
+	case keys.RSA4096:
+		factory.bits = 4096
+	case keys.RSA8192:
+		factory.bits = 8192
+	case keys.ECDSA224:
+		factory.curve = elliptic.P224()
+	case keys.ECDSA256:
+		factory.curve = elliptic.P256()
+	case keys.ECDSA384:
+		factory.curve = elliptic.P384()
+	case keys.ECDSA521:
+		factory.curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+	return factory, nil
+}
+
+// Key gets the key with the given id. If the key does not exist, [keys.ErrUnknownKey] is returned.
+func (keyStore *KeyStore) Key(id string) (keys.StoredKey, error) {
+	idBytes, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s'", keys.ErrUnknownKey, id)
+	}
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	privateHandle, err := keyStore.findObject(p11.CKO_PRIVATE_KEY, idBytes)
+	if err != nil {
+		return nil, err
+	}
+	publicHandle, err := keyStore.findObject(p11.CKO_PUBLIC_KEY, idBytes)
+	if err != nil {
+		return nil, err
+	}
+	public, err := keyStore.publicKey(publicHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &storedKey{keyStore: keyStore, id: id, handle: privateHandle, public: public}, nil
+}
+
+func (keyStore *KeyStore) findObject(class uint, id []byte) (p11.ObjectHandle, error) {
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, class),
+		p11.NewAttribute(p11.CKA_ID, id),
+	}
+	err := keyStore.ctx.FindObjectsInit(keyStore.session, template)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find PKCS#11 object (cause: %w)", err)
+	}
+	handles, _, err := keyStore.ctx.FindObjects(keyStore.session, 1)
+	finalErr := keyStore.ctx.FindObjectsFinal(keyStore.session)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find PKCS#11 object (cause: %w)", err)
+	}
+	if finalErr != nil {
+		return 0, fmt.Errorf("failed to find PKCS#11 object (cause: %w)", finalErr)
+	}
+	if len(handles) == 0 {
+		return 0, fmt.Errorf("%w '%s'", keys.ErrUnknownKey, hex.EncodeToString(id))
+	}
+	return handles[0], nil
+}
+
+func (keyStore *KeyStore) publicKey(handle p11.ObjectHandle) (crypto.PublicKey, error) {
+	attributes, err := keyStore.ctx.GetAttributeValue(keyStore.session, handle, []*p11.Attribute{p11.NewAttribute(p11.CKA_KEY_TYPE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PKCS#11 key type (cause: %w)", err)
+	}
+	switch decodeULong(attributes[0].Value) {
+	case p11.CKK_RSA:
+		return keyStore.rsaPublicKey(handle)
+	case p11.CKK_EC:
+		return keyStore.ecdsaPublicKey(handle)
+	}
+	return nil, fmt.Errorf("unexpected PKCS#11 key type: %d", decodeULong(attributes[0].Value))
+}
+
+func (keyStore *KeyStore) rsaPublicKey(handle p11.ObjectHandle) (crypto.PublicKey, error) {
+	attributes, err := keyStore.ctx.GetAttributeValue(keyStore.session, handle, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS, nil),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PKCS#11 RSA public key (cause: %w)", err)
+	}
+	modulus := new(big.Int).SetBytes(attributes[0].Value)
+	exponent := new(big.Int).SetBytes(attributes[1].Value)
+	return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+}
+
+func (keyStore *KeyStore) ecdsaPublicKey(handle p11.ObjectHandle) (crypto.PublicKey, error) {
+	attributes, err := keyStore.ctx.GetAttributeValue(keyStore.session, handle, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_EC_PARAMS, nil),
+		p11.NewAttribute(p11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PKCS#11 EC public key (cause: %w)", err)
+	}
+	curve, err := curveFromParams(attributes[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	// EC point is DER encoded as OCTET STRING
+	var point []byte
+	_, err = asn1.Unmarshal(attributes[1].Value, &point)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PKCS#11 EC point (cause: %w)", err)
+	}
+	coordinateLen := (curve.Params().BitSize + 7) / 8
+	if len(point) != 1+2*coordinateLen || point[0] != 4 {
+		return nil, fmt.Errorf("unexpected PKCS#11 EC point format")
+	}
+	x := new(big.Int).SetBytes(point[1 : 1+coordinateLen])
+	y := new(big.Int).SetBytes(point[1+coordinateLen:])
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (keyStore *KeyStore) sign(handle p11.ObjectHandle, mechanism uint, data []byte) ([]byte, error) {
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	err := keyStore.ctx.SignInit(keyStore.session, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, handle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize PKCS#11 signature (cause: %w)", err)
+	}
+	signature, err := keyStore.ctx.Sign(keyStore.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PKCS#11 signature (cause: %w)", err)
+	}
+	return signature, nil
+}
+
+type keyPairFactory struct {
+	keyStore *KeyStore
+	alg      keys.Algorithm
+	bits     int
+	curve    elliptic.Curve
+	logger   *zerolog.Logger
+}
+
+func (factory *keyPairFactory) Alg() keys.Algorithm {
+	return factory.alg
+}
+
+func (factory *keyPairFactory) New() (keys.KeyPair, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key id (cause: %w)", err)
+	}
+	id := hex.EncodeToString(idBytes)
+	publicTemplate := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PUBLIC_KEY),
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_VERIFY, true),
+		p11.NewAttribute(p11.CKA_ID, idBytes),
+		p11.NewAttribute(p11.CKA_LABEL, id),
+	}
+	privateTemplate := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY),
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_PRIVATE, true),
+		p11.NewAttribute(p11.CKA_SENSITIVE, true),
+		p11.NewAttribute(p11.CKA_EXTRACTABLE, false),
+		p11.NewAttribute(p11.CKA_SIGN, true),
+		p11.NewAttribute(p11.CKA_ID, idBytes),
+		p11.NewAttribute(p11.CKA_LABEL, id),
+	}
+	var mechanism uint
+	if factory.curve != nil {
+		factory.logger.Info().Msg("generating new ECDSA key pair inside PKCS#11 token...")
+		params, err := paramsFromCurve(factory.curve)
+		if err != nil {
+			return nil, err
+		}
+		mechanism = p11.CKM_EC_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate,
+			p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_EC),
+			p11.NewAttribute(p11.CKA_EC_PARAMS, params))
+		privateTemplate = append(privateTemplate, p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_EC))
+	} else {
+		factory.logger.Info().Msg("generating new RSA key pair inside PKCS#11 token...")
+		mechanism = p11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicTemplate = append(publicTemplate,
+			p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_RSA),
+			p11.NewAttribute(p11.CKA_MODULUS_BITS, factory.bits),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+		privateTemplate = append(privateTemplate, p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_RSA))
+	}
+	keyStore := factory.keyStore
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+	publicHandle, privateHandle, err := keyStore.ctx.GenerateKeyPair(keyStore.session, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, publicTemplate, privateTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate PKCS#11 key pair (cause: %w)", err)
+	}
+	public, err := keyStore.publicKey(publicHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{alg: factory.alg, key: &storedKey{keyStore: keyStore, id: id, handle: privateHandle, public: public}}, nil
+}
+
+type keyPair struct {
+	alg keys.Algorithm
+	key *storedKey
+}
+
+func (keypair *keyPair) Alg() keys.Algorithm {
+	return keypair.alg
+}
+
+func (keypair *keyPair) Public() crypto.PublicKey {
+	return keypair.key.public
+}
+
+func (keypair *keyPair) Private() crypto.PrivateKey {
+	return keypair.key
+}
+
+type storedKey struct {
+	keyStore *KeyStore
+	id       string
+	handle   p11.ObjectHandle
+	public   crypto.PublicKey
+}
+
+func (key *storedKey) Public() crypto.PublicKey {
+	return key.public
+}
+
+func (key *storedKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		_, pss := opts.(*rsa.PSSOptions)
+		if pss {
+			return nil, fmt.Errorf("RSA-PSS signatures not supported")
+		}
+		prefix, ok := rsaDigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function: %s", opts.HashFunc())
+		}
+		return key.keyStore.sign(key.handle, p11.CKM_RSA_PKCS, append(slices.Clone(prefix), digest...))
+	case *ecdsa.PublicKey:
+		signature, err := key.keyStore.sign(key.handle, p11.CKM_ECDSA, digest)
+		if err != nil {
+			return nil, err
+		}
+		// PKCS#11 ECDSA signatures are the raw concatenation of r and s
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(signature[:len(signature)/2]),
+			S: new(big.Int).SetBytes(signature[len(signature)/2:]),
+		})
+	}
+	return nil, fmt.Errorf("unexpected key type %T", key.public)
+}
+
+func (key *storedKey) KeyStore() keys.KeyStore {
+	return key.keyStore
+}
+
+func (key *storedKey) ID() string {
+	return key.id
+}
+
+func (key *storedKey) Equal(x crypto.PrivateKey) bool {
+	other, ok := x.(keys.StoredKey)
+	return ok && other.KeyStore().Name() == key.keyStore.name && other.ID() == key.id
+}
+
+var rsaDigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var curveOIDs = map[string]asn1.ObjectIdentifier{
+	"P-224": {1, 3, 132, 0, 33},
+	"P-256": {1, 2, 840, 10045, 3, 1, 7},
+	"P-384": {1, 3, 132, 0, 34},
+	"P-521": {1, 3, 132, 0, 35},
+}
+
+func paramsFromCurve(curve elliptic.Curve) ([]byte, error) {
+	oid, ok := curveOIDs[curve.Params().Name]
+	if !ok {
+		return nil, fmt.Errorf("unexpected curve: '%s'", curve.Params().Name)
+	}
+	params, err := asn1.Marshal(oid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode curve parameters (cause: %w)", err)
+	}
+	return params, nil
+}
+
+func curveFromParams(params []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(params, &oid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode curve parameters (cause: %w)", err)
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if oid.Equal(curveOIDs[curve.Params().Name]) {
+			return curve, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected curve: %s", oid)
+}
+
+// decodeULong decodes a CK_ULONG attribute value (which is stored in native byte order).
+func decodeULong(value []byte) uint {
+	switch len(value) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(value))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(value))
+	}
+	return 0
+}
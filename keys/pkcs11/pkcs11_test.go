@@ -0,0 +1,160 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package pkcs11_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/keys/pkcs11"
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// Tests run against SoftHSMv2. The module is looked up via the environment variable SOFTHSM2_MODULE
+// or in the default installation locations. Tests are skipped if SoftHSMv2 is not available.
+var testSoftHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+const testTokenLabel = "certstore"
+const testSOPIN = "5678"
+const testPIN = "1234"
+
+func TestKeyPairFactory(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	defer keyStore.Close()
+	for _, alg := range []keys.Algorithm{keys.RSA2048, keys.ECDSA256, keys.ECDSA384} {
+		kpf, err := keyStore.NewKeyPairFactory(alg)
+		require.NoError(t, err)
+		require.Equal(t, alg, kpf.Alg())
+		keypair, err := kpf.New()
+		require.NoError(t, err)
+		require.Equal(t, alg, keypair.Alg())
+		algFromKey, err := keys.AlgorithmFromKey(keypair.Public())
+		require.NoError(t, err)
+		require.Equal(t, alg, algFromKey)
+		storedKey, ok := keypair.Private().(keys.StoredKey)
+		require.True(t, ok)
+		checkSigner(t, keys.KeyFromPrivate(storedKey))
+		loadedKey, err := keyStore.Key(storedKey.ID())
+		require.NoError(t, err)
+		require.True(t, keys.PrivatesEqual(storedKey, loadedKey))
+		require.True(t, keys.PublicsEqual(keypair.Public(), loadedKey.Public()))
+		checkSigner(t, keys.KeyFromPrivate(loadedKey))
+	}
+	_, err := keyStore.NewKeyPairFactory(keys.ED25519)
+	require.ErrorIs(t, err, pkcs11.ErrUnsupportedAlgorithm)
+	_, err = keyStore.Key("00")
+	require.ErrorIs(t, err, keys.ErrUnknownKey)
+}
+
+func TestLocalCertificateFactory(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	defer keyStore.Close()
+	kpf, err := keyStore.NewKeyPairFactory(keys.ECDSA256)
+	require.NoError(t, err)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "TestLocalCertificateFactory"},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+	key, certificate, err := certs.NewLocalCertificateFactory(template, kpf, nil, nil).New()
+	require.NoError(t, err)
+	require.True(t, certs.IsRoot(certificate))
+	_, ok := key.(keys.StoredKey)
+	require.True(t, ok)
+}
+
+func checkSigner(t *testing.T, key keys.Key) {
+	digest := crypto.SHA256.New().Sum([]byte("secret message"))[:crypto.SHA256.Size()]
+	signature, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(t, err)
+	require.True(t, key.Verify(signature, digest, crypto.SHA256))
+}
+
+func newTestKeyStore(t *testing.T) *pkcs11.KeyStore {
+	module := lookupSoftHSMModule(t)
+	tokenDir := filepath.Join(t.TempDir(), "tokens")
+	err := os.Mkdir(tokenDir, 0700)
+	require.NoError(t, err)
+	conf := filepath.Join(t.TempDir(), "softhsm2.conf")
+	err = os.WriteFile(conf, []byte("directories.tokendir = "+tokenDir+"\nobjectstore.backend = file\n"), 0600)
+	require.NoError(t, err)
+	t.Setenv("SOFTHSM2_CONF", conf)
+	initTestToken(t, module)
+	keyStore, err := pkcs11.NewKeyStore("softhsm", module, pkcs11.WithTokenLabel(testTokenLabel), pkcs11.WithPIN(testPIN))
+	require.NoError(t, err)
+	return keyStore
+}
+
+func lookupSoftHSMModule(t *testing.T) string {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module != "" {
+		return module
+	}
+	for _, module := range testSoftHSMModules {
+		_, err := os.Stat(module)
+		if err == nil {
+			return module
+		}
+	}
+	t.Skip("SoftHSMv2 not available")
+	return ""
+}
+
+func initTestToken(t *testing.T, module string) {
+	ctx := p11.New(module)
+	require.NotNil(t, ctx)
+	defer ctx.Destroy()
+	err := ctx.Initialize()
+	require.NoError(t, err)
+	defer ctx.Finalize()
+	slots, err := ctx.GetSlotList(false)
+	require.NoError(t, err)
+	require.NotEmpty(t, slots)
+	err = ctx.InitToken(slots[0], testSOPIN, testTokenLabel)
+	require.NoError(t, err)
+	slots, err = ctx.GetSlotList(true)
+	require.NoError(t, err)
+	for _, slot := range slots {
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		require.NoError(t, err)
+		if strings.TrimRight(tokenInfo.Label, " \x00") != testTokenLabel {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+		require.NoError(t, err)
+		defer ctx.CloseSession(session)
+		err = ctx.Login(session, p11.CKU_SO, testSOPIN)
+		require.NoError(t, err)
+		err = ctx.InitPIN(session, testPIN)
+		require.NoError(t, err)
+		err = ctx.Logout(session)
+		require.NoError(t, err)
+		return
+	}
+	require.Fail(t, "initialized token not found")
+}
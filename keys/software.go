@@ -0,0 +1,247 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package keys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hdecarne-github/go-log"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SoftwareKeyStoreProtectionKeyMinLength defines the minimum length of the protection key required by
+// [NewSoftwareKeyStore].
+const SoftwareKeyStoreProtectionKeyMinLength = 16
+
+const softwareKeyPEMType = "CERTSTORE ENCRYPTED PRIVATE KEY"
+const softwareKeyInfo = "certstore software key"
+
+type softwareKeyStore struct {
+	name          string
+	path          string
+	protectionKey []byte
+	logger        *zerolog.Logger
+}
+
+func (keyStore *softwareKeyStore) Name() string {
+	return keyStore.name
+}
+
+func (keyStore *softwareKeyStore) NewKeyPairFactory(alg Algorithm) (KeyPairFactory, error) {
+	logger := keyStore.logger.With().Str("Algorithm", alg.String()).Logger()
+	return &softwareKeyPairFactory{keyStore: keyStore, factory: alg.NewKeyPairFactory(), logger: &logger}, nil
+}
+
+var softwareKeyIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (keyStore *softwareKeyStore) Key(id string) (StoredKey, error) {
+	if !softwareKeyIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownKey, id)
+	}
+	keyPEM, err := os.ReadFile(keyStore.keyFile(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownKey, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key file (cause: %w)", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != softwareKeyPEMType {
+		return nil, fmt.Errorf("failed to decode key file '%s'", keyStore.keyFile(id))
+	}
+	keyBytes, err := keyStore.decryptKey(id, block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key file '%s' (cause: %w)", keyStore.keyFile(id), err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file '%s' (cause: %w)", keyStore.keyFile(id), err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unexpected key type %T", key)
+	}
+	return &softwareKey{keyStore: keyStore, id: id, signer: signer}, nil
+}
+
+func (keyStore *softwareKeyStore) storeKey(key crypto.PrivateKey) (string, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal private key (cause: %w)", err)
+	}
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key id (cause: %w)", err)
+	}
+	id := hex.EncodeToString(idBytes)
+	encryptedKeyBytes, err := keyStore.encryptKey(id, keyBytes)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(keyStore.keyFile(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create key file (cause: %w)", err)
+	}
+	defer file.Close()
+	err = pem.Encode(file, &pem.Block{Type: softwareKeyPEMType, Bytes: encryptedKeyBytes})
+	if err != nil {
+		return "", fmt.Errorf("failed to write key file '%s' (cause: %w)", file.Name(), err)
+	}
+	return id, nil
+}
+
+func (keyStore *softwareKeyStore) encryptKey(id string, keyBytes []byte) ([]byte, error) {
+	gcm, err := keyStore.newGCM(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce (cause: %w)", err)
+	}
+	return gcm.Seal(nonce, nonce, keyBytes, []byte(id)), nil
+}
+
+func (keyStore *softwareKeyStore) decryptKey(id string, encryptedKeyBytes []byte) ([]byte, error) {
+	gcm, err := keyStore.newGCM(id)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(encryptedKeyBytes) < nonceSize {
+		return nil, fmt.Errorf("invalid encrypted key")
+	}
+	keyBytes, err := gcm.Open(nil, encryptedKeyBytes[:nonceSize], encryptedKeyBytes[nonceSize:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key (cause: %w)", err)
+	}
+	return keyBytes, nil
+}
+
+// newGCM creates the cipher for encrypting the key with the given id (using a key derived from the key store's
+// protection key and the key id).
+func (keyStore *softwareKeyStore) newGCM(id string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, keyStore.protectionKey, []byte(id), []byte(softwareKeyInfo)), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key encryption key (cause: %w)", err)
+	}
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher (cause: %w)", err)
+	}
+	gcm, err := cipher.NewGCM(aes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create block cipher (cause: %w)", err)
+	}
+	return gcm, nil
+}
+
+func (keyStore *softwareKeyStore) keyFile(id string) string {
+	return filepath.Join(keyStore.path, id+".pem")
+}
+
+// NewSoftwareKeyStore creates a [KeyStore] holding its keys as files in the submitted directory.
+//
+// The key files are encrypted using the submitted protection key, which must be a random key of at least
+// [SoftwareKeyStoreProtectionKeyMinLength] bytes. This [KeyStore] is intended for setups not requiring hardware
+// backed keys as well as for testing.
+func NewSoftwareKeyStore(name string, path string, protectionKey []byte) (KeyStore, error) {
+	if len(protectionKey) < SoftwareKeyStoreProtectionKeyMinLength {
+		return nil, fmt.Errorf("insufficient protection key for key store '%s' (%d bytes required)", name, SoftwareKeyStoreProtectionKeyMinLength)
+	}
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key store directory '%s' (cause: %w)", path, err)
+	}
+	logger := log.RootLogger().With().Str("KeyStore", name).Logger()
+	return &softwareKeyStore{name: name, path: path, protectionKey: bytes.Clone(protectionKey), logger: &logger}, nil
+}
+
+type softwareKeyPairFactory struct {
+	keyStore *softwareKeyStore
+	factory  KeyPairFactory
+	logger   *zerolog.Logger
+}
+
+func (factory *softwareKeyPairFactory) Alg() Algorithm {
+	return factory.factory.Alg()
+}
+
+func (factory *softwareKeyPairFactory) New() (KeyPair, error) {
+	keyPair, err := factory.factory.New()
+	if err != nil {
+		return nil, err
+	}
+	id, err := factory.keyStore.storeKey(keyPair.Private())
+	if err != nil {
+		return nil, err
+	}
+	factory.logger.Info().Msgf("stored new key pair '%s'", id)
+	signer := keyPair.Private().(crypto.Signer)
+	return &softwareKeyPair{alg: keyPair.Alg(), key: &softwareKey{keyStore: factory.keyStore, id: id, signer: signer}}, nil
+}
+
+type softwareKeyPair struct {
+	alg Algorithm
+	key *softwareKey
+}
+
+func (keypair *softwareKeyPair) Alg() Algorithm {
+	return keypair.alg
+}
+
+func (keypair *softwareKeyPair) Public() crypto.PublicKey {
+	return keypair.key.Public()
+}
+
+func (keypair *softwareKeyPair) Private() crypto.PrivateKey {
+	return keypair.key
+}
+
+type softwareKey struct {
+	keyStore *softwareKeyStore
+	id       string
+	signer   crypto.Signer
+}
+
+func (key *softwareKey) Public() crypto.PublicKey {
+	return key.signer.Public()
+}
+
+func (key *softwareKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return key.signer.Sign(rand, digest, opts)
+}
+
+func (key *softwareKey) KeyStore() KeyStore {
+	return key.keyStore
+}
+
+func (key *softwareKey) ID() string {
+	return key.id
+}
+
+func (key *softwareKey) Equal(x crypto.PrivateKey) bool {
+	other, ok := x.(StoredKey)
+	return ok && other.KeyStore().Name() == key.keyStore.name && other.ID() == key.id
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hdecarne-github/go-certstore/keys"
+)
+
+// ErrKeyNotExportable indicates an attempt to export a key held by a [keys.KeyStore].
+var ErrKeyNotExportable = errors.New("key not exportable")
+
+// WithKeyStores makes the submitted [keys.KeyStore]s available to the store.
+//
+// Entries created with a key held by a [keys.KeyStore] (see [keys.StoredKey]) only record a reference to the key.
+// Such entries can only be opened, if the referenced [keys.KeyStore] has been made available via this option.
+func WithKeyStores(keyStores ...keys.KeyStore) StoreOption {
+	return func(options *storeOptions) {
+		options.keyStores = append(options.keyStores, keyStores...)
+	}
+}
+
+func isStoredKey(key crypto.PrivateKey) bool {
+	_, ok := key.(keys.StoredKey)
+	return ok
+}
+
+func encodeKeyRef(key keys.StoredKey) string {
+	return key.KeyStore().Name() + ":" + key.ID()
+}
+
+func (registry *Registry) resolveKeyRef(keyRef string) (keys.StoredKey, error) {
+	keyStoreName, id, ok := strings.Cut(keyRef, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid key reference '%s'", keyRef)
+	}
+	keyStore := registry.keyStores[keyStoreName]
+	if keyStore == nil {
+		return nil, fmt.Errorf("failed to resolve key reference '%s' (unknown key store)", keyRef)
+	}
+	key, err := keyStore.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve key reference '%s' (cause: %w)", keyRef, err)
+	}
+	return key, nil
+}
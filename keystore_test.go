@@ -0,0 +1,130 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoredKeys(t *testing.T) {
+	name := "TestStoredKeys"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	protectionKey := make([]byte, 32)
+	_, err = rand.Read(protectionKey)
+	require.NoError(t, err)
+	keyStore, err := keys.NewSoftwareKeyStore("software", filepath.Join(path, "keys"), protectionKey)
+	require.NoError(t, err)
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0, certstore.WithKeyStores(keyStore))
+	require.NoError(t, err)
+	// create root with stored key
+	keyPairFactory, err := keyStore.NewKeyPairFactory(testKeyAlg)
+	require.NoError(t, err)
+	rootName, err := registry.CreateCertificate(name+"Root", newTestStoredKeyRootCertificateFactory(name+"Root", keyPairFactory), user)
+	require.NoError(t, err)
+	rootData := readTestEntryData(t, backend, rootName)
+	require.Empty(t, rootData["key"])
+	require.NotEmpty(t, rootData["key_ref"])
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	require.True(t, root.HasKey())
+	rootKey, ok := root.Key(user).(keys.StoredKey)
+	require.True(t, ok)
+	require.Equal(t, keyStore.Name(), rootKey.KeyStore().Name())
+	// local issuance
+	leafName, err := registry.CreateCertificate(name+"Leaf", newTestLeafCertificateFactory(name+"Leaf", root.Certificate(), rootKey), user)
+	require.NoError(t, err)
+	leaf, err := registry.Entry(leafName)
+	require.NoError(t, err)
+	require.True(t, certs.IsIssuedBy(leaf.Certificate(), root.Certificate()))
+	// revocation list
+	revocationList, err := root.ResetRevocationList(newTestRevocationListFactory(), user)
+	require.NoError(t, err)
+	require.NoError(t, revocationList.CheckSignatureFrom(root.Certificate()))
+	// signer
+	signer := keys.KeyFromPrivate(rootKey)
+	digest := crypto.SHA256.New().Sum([]byte(name))[:crypto.SHA256.Size()]
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	require.NoError(t, err)
+	require.True(t, signer.Verify(signature, digest, crypto.SHA256))
+	// export
+	var buffer bytes.Buffer
+	err = root.Export(&buffer, certstore.ExportFormatPEM, certstore.ExportOptionDefault, testPassword, user)
+	require.ErrorIs(t, err, certstore.ErrKeyNotExportable)
+	err = root.Export(&buffer, certstore.ExportFormatPEM, certstore.ExportOptionChain, testPassword, user)
+	require.NoError(t, err)
+	// re-key stays inside the key store
+	leafKeyPairFactory, err := keyStore.NewKeyPairFactory(testKeyAlg)
+	require.NoError(t, err)
+	storedLeafName, err := registry.CreateCertificate(name+"StoredLeaf", newTestStoredKeyLeafCertificateFactory(name+"StoredLeaf", leafKeyPairFactory, root.Certificate(), rootKey), user)
+	require.NoError(t, err)
+	storedLeaf, err := registry.Entry(storedLeafName)
+	require.NoError(t, err)
+	storedLeafKey, ok := storedLeaf.Key(user).(keys.StoredKey)
+	require.True(t, ok)
+	_, err = registry.Renew(storedLeafName, &certstore.RenewOptions{}, user)
+	require.NoError(t, err)
+	storedLeaf, err = registry.Entry(storedLeafName)
+	require.NoError(t, err)
+	renewedKey, ok := storedLeaf.Key(user).(keys.StoredKey)
+	require.True(t, ok)
+	require.Equal(t, keyStore.Name(), renewedKey.KeyStore().Name())
+	require.NotEqual(t, storedLeafKey.ID(), renewedKey.ID())
+	// key store not available
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	_, err = registry.Entry(rootName)
+	require.Error(t, err)
+	_, err = registry.Entry(leafName)
+	require.NoError(t, err)
+}
+
+func newTestStoredKeyRootCertificateFactory(cn string, keyPairFactory keys.KeyPairFactory) certs.CertificateFactory {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            2,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+	return certs.NewLocalCertificateFactory(template, keyPairFactory, nil, nil)
+}
+
+func newTestStoredKeyLeafCertificateFactory(cn string, keyPairFactory keys.KeyPairFactory, parent *x509.Certificate, signer crypto.PrivateKey) certs.CertificateFactory {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		MaxPathLen:            -1,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+	return certs.NewLocalCertificateFactory(template, keyPairFactory, parent, signer)
+}
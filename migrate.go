@@ -0,0 +1,200 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+// ErrNewerSchema indicates that a store or store entry has been written by a newer version of this package.
+var ErrNewerSchema = errors.New("unsupported schema (written by a newer version)")
+
+// Schema history of the store settings:
+//
+//	0: unversioned settings (audit key possibly derived from the initial store secret; replaced while migrating)
+//	1: dedicated audit key, secret ids
+//	2: anchored audit chain (number of unchained audit records, mandatory checkpoints)
+const (
+	storeSettingsSchemaV2      = 2
+	storeSettingsSchemaCurrent = storeSettingsSchemaV2
+)
+
+// storeSettingsMigrations[i] migrates the store settings from schema i to schema i+1.
+var storeSettingsMigrations = []func(settings *storeSettings, backend storage.Backend) error{
+	migrateStoreSettingsV0,
+	migrateStoreSettingsV1,
+}
+
+// Schema history of the entry data:
+//
+//	0: unversioned entry data (keys encrypted with the store secret directly)
+//	1: entry ids, keys encrypted with an entry specific key (key format 2)
+//	2: references to keys held by a key store
+//	3: keys bound to the entry's id and public key (key format 3), public key of key-only entries
+const entryDataSchemaCurrent = 3
+
+// entryDataMigrations[i] migrates the entry data from schema i to schema i+1.
+var entryDataMigrations = []func(registry *Registry, data *registryEntryData, entryID *string) error{
+	migrateEntryDataV0,
+	migrateEntryDataV1,
+	migrateEntryDataV2,
+}
+
+func (settings *storeSettings) migrate(backend storage.Backend) error {
+	for schema := settings.Schema; schema < storeSettingsSchemaCurrent; schema++ {
+		err := storeSettingsMigrations[schema](settings, backend)
+		if err != nil {
+			return fmt.Errorf("failed to migrate store settings to schema %d (cause: %w)", schema+1, err)
+		}
+	}
+	return nil
+}
+
+func migrateStoreSettingsV0(settings *storeSettings, backend storage.Backend) error {
+	if settings.auditKeyValue != "" {
+		return nil
+	}
+	// the audit key has been derived from the initial secret so far; replace it by a dedicated one and record
+	// the records chained with the previous key (these remain part of the chain, but are no longer verifiable)
+	auditKey, err := newStoreSecret()
+	if err != nil {
+		return err
+	}
+	settings.AuditRekeyed, err = lastAuditSequence(backend)
+	if err != nil {
+		return err
+	}
+	settings.auditKeyValue = auditKey
+	// the generated key must be persisted right away
+	settings.persist = true
+	return nil
+}
+
+func migrateStoreSettingsV1(settings *storeSettings, backend storage.Backend) error {
+	// records written so far without chaining remain unverifiable; any further unchained record is reported
+	var err error
+	settings.AuditUnchained, err = countUnchainedAuditRecords(backend)
+	return err
+}
+
+func (registry *Registry) decodeEntryData(dataBytes []byte) (*registryEntryData, error) {
+	data := &registryEntryData{Attributes: make(map[string]string, 0)}
+	err := json.Unmarshal(dataBytes, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal entry data (cause: %w)", err)
+	}
+	if data.Schema > entryDataSchemaCurrent {
+		return nil, fmt.Errorf("%w (entry data schema %d)", ErrNewerSchema, data.Schema)
+	}
+	return data, nil
+}
+
+// migrateEntryData migrates the submitted entry data to the current schema. If the entry data has no id yet,
+// the id referenced by entryID is assigned (which itself is generated if empty) and previous key formats are
+// upgraded. If entryID is nil (entry data is only read), neither an id is assigned nor the key is upgraded.
+// Returns true, if the entry data has been changed.
+func (registry *Registry) migrateEntryData(data *registryEntryData, entryID *string) (bool, error) {
+	schema := data.Schema
+	for ; schema < entryDataSchemaCurrent; schema++ {
+		err := entryDataMigrations[schema](registry, data, entryID)
+		if err != nil {
+			return false, fmt.Errorf("failed to migrate entry data to schema %d (cause: %w)", schema+1, err)
+		}
+	}
+	migrated := data.Schema != schema
+	data.Schema = schema
+	return migrated, nil
+}
+
+func migrateEntryDataV0(registry *Registry, data *registryEntryData, entryID *string) error {
+	if entryID == nil {
+		// legacy keys remain readable; id and key are updated as soon as the entry data is rewritten
+		return nil
+	}
+	err := data.assignID(entryID)
+	if err != nil {
+		return err
+	}
+	_, err = registry.upgradeKey(data, entryID)
+	return err
+}
+
+func migrateEntryDataV1(registry *Registry, data *registryEntryData, entryID *string) error {
+	// key references are optional; nothing to migrate
+	return nil
+}
+
+func migrateEntryDataV2(registry *Registry, data *registryEntryData, entryID *string) error {
+	// format 2 keys remain readable (see Registry.UpgradeKeys); nothing to migrate
+	return nil
+}
+
+// assignID assigns an id to entry data without an id. If entryID is nil, a new id is generated. Otherwise the id
+// referenced by entryID (which itself is generated if empty) is assigned. This way all versions of an entry
+// rewritten at once share the same id.
+func (data *registryEntryData) assignID(entryID *string) error {
+	if data.ID != "" {
+		return nil
+	}
+	if entryID == nil {
+		id, err := newEntryID()
+		if err != nil {
+			return err
+		}
+		data.ID = id
+		return nil
+	}
+	if *entryID == "" {
+		id, err := newEntryID()
+		if err != nil {
+			return err
+		}
+		*entryID = id
+	}
+	data.ID = *entryID
+	return nil
+}
+
+// Migrate upgrades the store settings as well as all store entries (including all retained versions
+// and the history of deleted entries) to the current schema.
+//
+// Entries written by a previous schema are readable without migration (they are migrated on read and
+// written using the current schema on their next update). Stores and entries written by a newer schema
+// are rejected with [ErrNewerSchema].
+//
+// If the store's backend does not implement [storage.RewritableBackend], [errors.ErrUnsupported] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) Migrate(user string) error {
+	rewritable, err := rewritableBackend(registry.backend)
+	if err != nil {
+		return registry.auditFailure(auditMigrate, storeSettingsName, user, err)
+	}
+	settings := registry.settings
+	settings.rotation.Lock()
+	defer settings.rotation.Unlock()
+	if settings.Schema != storeSettingsSchemaCurrent {
+		registry.logger.Info().Msgf("migrating store settings from schema %d...", settings.Schema)
+		settings.mutex.Lock()
+		err = settings.write(registry.backend)
+		settings.mutex.Unlock()
+		if err != nil {
+			return registry.auditFailure(auditMigrate, storeSettingsName, user, err)
+		}
+	}
+	registry.logger.Info().Msg("migrating store entries...")
+	err = registry.rewriteAllEntries(rewritable, func(data *registryEntryData, entryID *string) (bool, error) {
+		return false, nil
+	})
+	if err != nil {
+		return registry.auditFailure(auditMigrate, storeSettingsName, user, err)
+	}
+	return registry.audit(auditMigrate, storeSettingsName, user)
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateSchemaV0(t *testing.T) {
+	name := "TestMigrateSchemaV0"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	secret := writeTestV0Settings(t, backend)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	key := entry.Key(user)
+	downgradeTestEntryKey(t, backend, createdName, key, secret, "")
+	// v0 fixtures are readable (migrated on read)
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	checkTestEntryKey(t, registry, createdName, key, user)
+	// settings are migrated on open (dedicated audit key)
+	settings := readTestEntryData(t, backend, ".store")
+	require.Equal(t, float64(2), settings["schema"])
+	require.NotEqual(t, settings["secret"], settings["audit_key"])
+	require.NotContains(t, readTestEntryData(t, backend, createdName), "schema")
+	// reading neither assigns an id nor upgrades the key
+	require.NotContains(t, readTestEntryData(t, backend, createdName), "id")
+	// migrate
+	err = registry.Migrate(user)
+	require.NoError(t, err)
+	require.Equal(t, float64(2), readTestEntryData(t, backend, ".store")["schema"])
+	forEachTestEntryVersion(t, backend, func(name string, versionInfo storage.VersionInfo) {
+		data := readTestEntryVersionData(t, backend, name, versionInfo.Version)
+		require.Equal(t, float64(3), data["schema"])
+		require.NotEmpty(t, data["id"])
+	})
+	checkEncryptedKeys(t, backend, "v3:k0:")
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	checkTestEntryKey(t, registry, createdName, key, user)
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	events := readAuditEvents(t, registry, &certstore.AuditFilter{Operation: certstore.AuditOperationMigrate})
+	require.Len(t, events, 1)
+}
+
+func TestMigrateSchemaV1(t *testing.T) {
+	name := "TestMigrateSchemaV1"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	key := entry.Key(user)
+	data := readTestEntryData(t, backend, createdName)
+	data["schema"] = 1
+	writeTestEntryData(t, backend, createdName, data)
+	// v1 fixtures are readable (migrated on read)
+	checkTestEntryKey(t, registry, createdName, key, user)
+	// migrate
+	err = registry.Migrate(user)
+	require.NoError(t, err)
+	forEachTestEntryVersion(t, backend, func(name string, versionInfo storage.VersionInfo) {
+		data := readTestEntryVersionData(t, backend, name, versionInfo.Version)
+		require.Equal(t, float64(3), data["schema"])
+		require.Equal(t, readTestEntryData(t, backend, createdName)["id"], data["id"])
+	})
+	checkEncryptedKeys(t, backend, "v3:k0:")
+	checkTestEntryKey(t, registry, createdName, key, user)
+}
+
+func TestMigrateEntryOnUpdate(t *testing.T) {
+	name := "TestMigrateEntryOnUpdate"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	secret := writeTestV0Settings(t, backend)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	key := entry.Key(user)
+	downgradeTestEntryKey(t, backend, createdName, key, secret, "")
+	// the first update persists a new id, further updates keep it
+	entry, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	err = entry.SetAttributes(map[string]string{"Update": "1"})
+	require.NoError(t, err)
+	entryID := readTestEntryData(t, backend, createdName)["id"]
+	require.NotEmpty(t, entryID)
+	err = entry.SetAttributes(map[string]string{"Update": "2"})
+	require.NoError(t, err)
+	require.Equal(t, entryID, readTestEntryData(t, backend, createdName)["id"])
+	checkTestEntryKey(t, registry, createdName, key, user)
+}
+
+func TestMigrateSettingsSchemaV1(t *testing.T) {
+	name := "TestMigrateSettingsSchemaV1"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend := newTestFSBackend(t, path)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	// v1 settings without checkpoints
+	settings := readTestEntryData(t, backend, ".store")
+	settings["schema"] = 1
+	delete(settings, "audit_unchained")
+	writeTestEntryData(t, backend, ".store", settings)
+	err = os.RemoveAll(filepath.Join(path, ".audit.checkpoints"))
+	require.NoError(t, err)
+	// opening anchors the existing chain
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	_, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	err = registry.Migrate(user)
+	require.NoError(t, err)
+	require.Equal(t, float64(2), readTestEntryData(t, backend, ".store")["schema"])
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func TestMigrateSettingsSchemaV0AuditKey(t *testing.T) {
+	name := "TestMigrateSettingsSchemaV0AuditKey"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	// audit records chained with the audit key derived from the store secret
+	settings := readTestEntryData(t, backend, ".store")
+	secret := settings["secret"]
+	writeTestEntryData(t, backend, ".store", map[string]any{"schema": 1, "secret": secret, "audit_key": secret})
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	_, err = registry.CreateCertificate(name+"1", newTestRootCertificateFactory(name+"1"), user)
+	require.NoError(t, err)
+	// v0 settings
+	writeTestEntryData(t, backend, ".store", map[string]any{"secret": secret})
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	settings = readTestEntryData(t, backend, ".store")
+	require.NotEmpty(t, settings["audit_key"])
+	require.NotEqual(t, secret, settings["audit_key"])
+	require.NotZero(t, settings["audit_rekeyed"])
+	// the audit key is generated once
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	require.Equal(t, settings["audit_key"], readTestEntryData(t, backend, ".store")["audit_key"])
+	_, err = registry.CreateCertificate(name+"2", newTestRootCertificateFactory(name+"2"), user)
+	require.NoError(t, err)
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, int(settings["audit_rekeyed"].(float64)), verification.Unverified)
+	// records chained with the dedicated audit key are verified
+	events := readAuditEvents(t, registry, nil)
+	lastEvent := events[len(events)-1]
+	require.Greater(t, lastEvent.Sequence, uint64(settings["audit_rekeyed"].(float64)))
+}
+
+func TestMigrateSchemaCurrent(t *testing.T) {
+	name := "TestMigrateSchemaCurrent"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	require.Equal(t, float64(2), readTestEntryData(t, backend, ".store")["schema"])
+	require.Equal(t, float64(3), readTestEntryData(t, backend, createdName)["schema"])
+	history, err := backend.(storage.HistoryBackend).GetHistory(createdName)
+	require.NoError(t, err)
+	// entries of the current schema are left untouched
+	err = registry.Migrate(user)
+	require.NoError(t, err)
+	migratedHistory, err := backend.(storage.HistoryBackend).GetHistory(createdName)
+	require.NoError(t, err)
+	require.Equal(t, history, migratedHistory)
+	checkEncryptedKeys(t, backend, "v3:k0:")
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	name := "TestMigrateNewerSchema"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	// newer entry data schema
+	data := readTestEntryData(t, backend, createdName)
+	data["schema"] = 99
+	writeTestEntryData(t, backend, createdName, data)
+	_, err = registry.Entry(createdName)
+	require.ErrorIs(t, err, certstore.ErrNewerSchema)
+	err = registry.Migrate(user)
+	require.ErrorIs(t, err, certstore.ErrNewerSchema)
+	// newer store settings schema
+	settings := readTestEntryData(t, backend, ".store")
+	settings["schema"] = 99
+	writeTestEntryData(t, backend, ".store", settings)
+	_, err = certstore.NewStore(backend, 0)
+	require.ErrorIs(t, err, certstore.ErrNewerSchema)
+}
+
+// writeTestV0Settings writes store settings as written by schema 0 (unversioned settings consisting of the store secret only).
+func writeTestV0Settings(t *testing.T, backend storage.Backend) []byte {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	settings, err := json.Marshal(map[string]any{"secret": base64.StdEncoding.EncodeToString(secret)})
+	require.NoError(t, err)
+	_, err = backend.Create(".store", settings)
+	require.NoError(t, err)
+	return secret
+}
+
+func readTestEntryVersionData(t *testing.T, backend storage.Backend, name string, version storage.Version) map[string]any {
+	dataBytes, err := backend.(storage.HistoryBackend).GetHistoryVersion(name, version)
+	require.NoError(t, err)
+	data := make(map[string]any)
+	err = json.Unmarshal(dataBytes, &data)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,393 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+// Package ocsp provides an OCSP responder (RFC 6960) backed by a certificate store.
+package ocsp
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/hdecarne-github/go-log"
+	"github.com/rs/zerolog"
+	xocsp "golang.org/x/crypto/ocsp"
+)
+
+const requestContentType = "application/ocsp-request"
+const responseContentType = "application/ocsp-response"
+
+const maxRequestSize = 4096
+
+const defaultResponseLifetime = time.Hour
+
+type ocspHandler struct {
+	registry         *certstore.Registry
+	user             string
+	responseLifetime time.Duration
+	signers          map[string]*ocspSigner
+	signersMutex     sync.Mutex
+	changes          <-chan *certstore.ChangeEvent
+	index            *ocspIndex
+	indexMutex       sync.Mutex
+	logger           *zerolog.Logger
+}
+
+// ocspSigner caches the signing key of a responder entry (per entry version). Hence the key access is
+// resolved (and recorded in the audit log) only once and not for every request.
+type ocspSigner struct {
+	version storage.Version
+	signer  crypto.Signer
+}
+
+// ocspIndex holds the CA entries of the store together with the certificates issued and revoked by them.
+// The index is built on demand and discarded as soon as a store change is reported (see [certstore.Registry.Watch]).
+type ocspIndex struct {
+	issuers []*ocspIssuer
+	// hashes maps the issuer name and key hashes (per hash algorithm) to the issuer
+	hashes map[crypto.Hash]map[string]*ocspIssuer
+}
+
+type ocspIssuer struct {
+	entry *certstore.RegistryEntry
+	// responders holds the entries possibly entitled to sign responses on behalf of the issuer
+	responders []*certstore.RegistryEntry
+	// issued holds the serial numbers of the certificates issued by the issuer
+	issued map[string]struct{}
+	// revoked holds the revocations recorded for the issuer as well as the entries of its revocation list
+	revoked map[string]x509.RevocationListEntry
+}
+
+// NewHandler creates a new [http.Handler] answering OCSP requests for the CAs held in the submitted [certstore.Registry].
+//
+// Both GET (base64 encoded request appended to the URL path) and POST requests are supported.
+// Like for the distribution handler, URL paths are interpreted relative to the handler's root. Hence the
+// handler has to be mounted via [http.StripPrefix], if it is not serving the root path.
+// Responses are signed either by a delegated OCSP signing entry (a store entry issued by the requested CA,
+// containing a key and having the [x509.ExtKeyUsageOCSPSigning] extended key usage) or by the CA entry itself.
+// A certificate is reported as revoked, if its revocation has been recorded via [certstore.Registry.Revoke]
+// or if it is listed in the CA entry's revocation list.
+// The submitted user name is used for recording the key access in the store's audit log. The key access is
+// recorded once per responder entry version (and not per request).
+// The submitted response lifetime defines the next update time of the generated responses. If it is 0, a default
+// of one hour is used.
+//
+// The store entries are indexed once and re-indexed only after a change has been reported via
+// [certstore.Registry.Watch]. The handler watches the submitted registry until the submitted context is done.
+// Hence the context should be canceled as soon as the handler is no longer used (a handler used afterwards
+// re-indexes the store entries for every request).
+func NewHandler(ctx context.Context, registry *certstore.Registry, user string, responseLifetime time.Duration) http.Handler {
+	logger := log.RootLogger().With().Str("Responder", registry.Name()).Logger()
+	if responseLifetime <= 0 {
+		responseLifetime = defaultResponseLifetime
+	}
+	return &ocspHandler{
+		registry:         registry,
+		user:             user,
+		responseLifetime: responseLifetime,
+		signers:          make(map[string]*ocspSigner),
+		changes:          registry.Watch(ctx),
+		logger:           &logger,
+	}
+}
+
+func (handler *ocspHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestBytes, err := handler.readRequest(r)
+	if err != nil {
+		handler.logger.Warn().Err(err).Msg("received malformed OCSP request")
+		handler.writeResponse(w, xocsp.MalformedRequestErrorResponse)
+		return
+	}
+	request, err := xocsp.ParseRequest(requestBytes)
+	if err != nil {
+		handler.logger.Warn().Err(err).Msg("failed to parse OCSP request")
+		handler.writeResponse(w, xocsp.MalformedRequestErrorResponse)
+		return
+	}
+	response, err := handler.respond(request)
+	if err != nil {
+		handler.logger.Error().Err(err).Msg("failed to create OCSP response")
+		handler.writeResponse(w, xocsp.InternalErrorErrorResponse)
+		return
+	}
+	handler.writeResponse(w, response)
+}
+
+func (handler *ocspHandler) readRequest(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodGet:
+		// the standard base64 alphabet contains '/'; hence the complete path (not only its last segment) is decoded
+		encoded := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+		unescaped, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request path '%s' (cause: %w)", encoded, err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(unescaped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode request '%s' (cause: %w)", unescaped, err)
+		}
+		return decoded, nil
+	case http.MethodPost:
+		contentType := r.Header.Get("Content-Type")
+		if contentType != requestContentType {
+			return nil, fmt.Errorf("unexpected content type '%s'", contentType)
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body (cause: %w)", err)
+		}
+		return body, nil
+	}
+	return nil, fmt.Errorf("unsupported method '%s'", r.Method)
+}
+
+func (handler *ocspHandler) writeResponse(w http.ResponseWriter, response []byte) {
+	w.Header().Set("Content-Type", responseContentType)
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(response)
+	if err != nil {
+		handler.logger.Error().Err(err).Msg("failed to write OCSP response")
+	}
+}
+
+func (handler *ocspHandler) respond(request *xocsp.Request) ([]byte, error) {
+	if !request.HashAlgorithm.Available() {
+		return nil, fmt.Errorf("unsupported hash algorithm %v", request.HashAlgorithm)
+	}
+	issuer, err := handler.findIssuer(request)
+	if err != nil {
+		return nil, err
+	}
+	if issuer == nil {
+		handler.logger.Warn().Msgf("no CA found for OCSP request (serial: %s)", request.SerialNumber.Text(16))
+		return xocsp.UnauthorizedErrorResponse, nil
+	}
+	responder := issuer.findResponder()
+	if responder == nil {
+		handler.logger.Warn().Msgf("no OCSP signer available for CA '%s'", issuer.entry.Name())
+		return xocsp.UnauthorizedErrorResponse, nil
+	}
+	now := time.Now()
+	template := xocsp.Response{
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(handler.responseLifetime),
+		IssuerHash:   request.HashAlgorithm,
+	}
+	issuer.resolveStatus(request.SerialNumber, &template)
+	if responder != issuer.entry {
+		template.Certificate = responder.Certificate()
+	}
+	handler.logger.Debug().Msgf("responding status %d for serial %s of CA '%s'", template.Status, request.SerialNumber.Text(16), issuer.entry.Name())
+	signer, err := handler.resolveSigner(responder)
+	if err != nil {
+		return nil, err
+	}
+	return xocsp.CreateResponse(issuer.entry.Certificate(), responder.Certificate(), template, signer)
+}
+
+// findIssuer looks up the CA addressed by the submitted request in the (possibly re-built) index.
+func (handler *ocspHandler) findIssuer(request *xocsp.Request) (*ocspIssuer, error) {
+	handler.indexMutex.Lock()
+	defer handler.indexMutex.Unlock()
+	if handler.drainChanges() {
+		handler.index = nil
+	}
+	if handler.index == nil {
+		index, err := handler.buildIndex()
+		if err != nil {
+			return nil, err
+		}
+		handler.index = index
+	}
+	return handler.index.findIssuer(request), nil
+}
+
+// drainChanges consumes the change events reported since the last invocation and determines whether the index
+// is outdated (true) or not (false).
+func (handler *ocspHandler) drainChanges() bool {
+	// a full buffer may have caused events to be dropped
+	outdated := len(handler.changes) == cap(handler.changes)
+	for {
+		select {
+		case event, ok := <-handler.changes:
+			if !ok {
+				return true
+			}
+			if event.Kind != certstore.ChangeKeyAccessed {
+				outdated = true
+			}
+		default:
+			return outdated
+		}
+	}
+}
+
+// buildIndex loads all store entries and indexes them by issuer.
+func (handler *ocspHandler) buildIndex() (*ocspIndex, error) {
+	handler.logger.Debug().Msg("indexing store entries...")
+	entries, err := handler.registry.Entries()
+	if err != nil {
+		return nil, err
+	}
+	loaded := make([]*certstore.RegistryEntry, 0)
+	for {
+		entry, err := entries.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		loaded = append(loaded, entry)
+	}
+	index := &ocspIndex{
+		issuers: make([]*ocspIssuer, 0),
+		hashes:  make(map[crypto.Hash]map[string]*ocspIssuer),
+	}
+	for _, entry := range loaded {
+		if entry.IsCA() {
+			index.issuers = append(index.issuers, newOCSPIssuer(entry))
+		}
+	}
+	for _, entry := range loaded {
+		if !entry.HasCertificate() {
+			continue
+		}
+		certificate := entry.Certificate()
+		for _, issuer := range index.issuers {
+			if entry.Name() == issuer.entry.Name() || !certs.IsIssuedBy(certificate, issuer.entry.Certificate()) {
+				continue
+			}
+			issuer.issued[serialKey(certificate.SerialNumber)] = struct{}{}
+			if entry.HasKey() && hasOCSPSigning(certificate) {
+				issuer.responders = append(issuer.responders, entry)
+			}
+		}
+	}
+	return index, nil
+}
+
+func newOCSPIssuer(entry *certstore.RegistryEntry) *ocspIssuer {
+	issuer := &ocspIssuer{
+		entry:   entry,
+		issued:  make(map[string]struct{}),
+		revoked: make(map[string]x509.RevocationListEntry),
+	}
+	if entry.HasRevocationList() {
+		for _, revocation := range entry.RevocationList().RevokedCertificateEntries {
+			issuer.revoked[serialKey(revocation.SerialNumber)] = revocation
+		}
+	}
+	// recorded revocations take precedence over the (possibly outdated) revocation list
+	for _, revocation := range entry.Revocations() {
+		issuer.revoked[serialKey(revocation.SerialNumber)] = revocation
+	}
+	return issuer
+}
+
+func serialKey(serialNumber *big.Int) string {
+	return serialNumber.String()
+}
+
+func (handler *ocspHandler) resolveSigner(responder *certstore.RegistryEntry) (crypto.Signer, error) {
+	handler.signersMutex.Lock()
+	defer handler.signersMutex.Unlock()
+	cached := handler.signers[responder.Name()]
+	if cached != nil && cached.version == responder.Version() {
+		return cached.signer, nil
+	}
+	key, err := responder.AccessKey(handler.user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access key of OCSP signer '%s' (cause: %w)", responder.Name(), err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("failed to access key of OCSP signer '%s'", responder.Name())
+	}
+	signer := keys.KeyFromPrivate(key)
+	handler.signers[responder.Name()] = &ocspSigner{version: responder.Version(), signer: signer}
+	return signer, nil
+}
+
+func (index *ocspIndex) findIssuer(request *xocsp.Request) *ocspIssuer {
+	hashes := index.hashes[request.HashAlgorithm]
+	if hashes == nil {
+		hashes = make(map[string]*ocspIssuer)
+		for _, issuer := range index.issuers {
+			issuerHash, err := issuerHash(issuer.entry.Certificate(), request.HashAlgorithm)
+			if err != nil {
+				continue
+			}
+			hashes[issuerHash] = issuer
+		}
+		index.hashes[request.HashAlgorithm] = hashes
+	}
+	return hashes[string(request.IssuerNameHash)+string(request.IssuerKeyHash)]
+}
+
+// issuerHash gets the concatenated issuer name and key hashes identifying the submitted CA certificate in OCSP requests.
+func issuerHash(certificate *x509.Certificate, hashAlgorithm crypto.Hash) (string, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(certificate.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return "", err
+	}
+	nameHash := hashAlgorithm.New()
+	nameHash.Write(certificate.RawSubject)
+	keyHash := hashAlgorithm.New()
+	keyHash.Write(publicKeyInfo.PublicKey.RightAlign())
+	return string(nameHash.Sum(nil)) + string(keyHash.Sum(nil)), nil
+}
+
+func (issuer *ocspIssuer) findResponder() *certstore.RegistryEntry {
+	now := time.Now()
+	for _, responder := range issuer.responders {
+		certificate := responder.Certificate()
+		if now.After(certificate.NotBefore) && now.Before(certificate.NotAfter) {
+			return responder
+		}
+	}
+	if issuer.entry.HasKey() {
+		return issuer.entry
+	}
+	return nil
+}
+
+func hasOCSPSigning(certificate *x509.Certificate) bool {
+	return slices.Contains(certificate.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning)
+}
+
+func (issuer *ocspIssuer) resolveStatus(serialNumber *big.Int, template *xocsp.Response) {
+	revocation, revoked := issuer.revoked[serialKey(serialNumber)]
+	if revoked {
+		template.Status = xocsp.Revoked
+		template.RevokedAt = revocation.RevocationTime
+		template.RevocationReason = revocation.ReasonCode
+		return
+	}
+	template.Status = xocsp.Unknown
+	if _, issued := issuer.issued[serialKey(serialNumber)]; issued {
+		template.Status = xocsp.Good
+	}
+}
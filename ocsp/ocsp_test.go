@@ -0,0 +1,285 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package ocsp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/keys"
+	"github.com/hdecarne-github/go-certstore/ocsp"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+	xocsp "golang.org/x/crypto/ocsp"
+)
+
+const testKeyAlg = keys.ECDSA256
+
+func TestHandler(t *testing.T) {
+	user := "TestHandlerUser"
+	registry := newTestRegistry(t)
+	createTestCertificate(t, registry, "root", newTestCATemplate("root"), "", user)
+	createTestCertificate(t, registry, "leaf1", newTestLeafTemplate("leaf1"), "root", user)
+	createTestCertificate(t, registry, "leaf2", newTestLeafTemplate("leaf2"), "root", user)
+	err := registry.Revoke("leaf2", certstore.RevocationReasonKeyCompromise, user)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, user, 0))
+	defer server.Close()
+	root := getTestCertificate(t, registry, "root")
+	leaf1 := getTestCertificate(t, registry, "leaf1")
+	leaf2 := getTestCertificate(t, registry, "leaf2")
+	// good
+	response := postTestRequest(t, server.URL, leaf1, root)
+	require.Equal(t, xocsp.Good, response.Status)
+	require.Nil(t, response.Certificate)
+	response = getTestRequest(t, server.URL, leaf1, root)
+	require.Equal(t, xocsp.Good, response.Status)
+	// revoked
+	response = postTestRequest(t, server.URL, leaf2, root)
+	require.Equal(t, xocsp.Revoked, response.Status)
+	require.Equal(t, xocsp.KeyCompromise, response.RevocationReason)
+	// unknown
+	unknown := *leaf1
+	unknown.SerialNumber = big.NewInt(4711)
+	response = postTestRequest(t, server.URL, &unknown, root)
+	require.Equal(t, xocsp.Unknown, response.Status)
+}
+
+func TestHandlerDelegated(t *testing.T) {
+	user := "TestHandlerDelegatedUser"
+	registry := newTestRegistry(t)
+	createTestCertificate(t, registry, "root", newTestCATemplate("root"), "", user)
+	createTestCertificate(t, registry, "leaf", newTestLeafTemplate("leaf"), "root", user)
+	responderTemplate := newTestLeafTemplate("responder")
+	responderTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	createTestCertificate(t, registry, "responder", responderTemplate, "root", user)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, user, time.Minute))
+	defer server.Close()
+	root := getTestCertificate(t, registry, "root")
+	leaf := getTestCertificate(t, registry, "leaf")
+	responder := getTestCertificate(t, registry, "responder")
+	response := postTestRequest(t, server.URL, leaf, root)
+	require.Equal(t, xocsp.Good, response.Status)
+	require.NotNil(t, response.Certificate)
+	require.Equal(t, responder.Raw, response.Certificate.Raw)
+	// key access is recorded once per responder
+	for i := 0; i < 2; i++ {
+		response = postTestRequest(t, server.URL, leaf, root)
+		require.Equal(t, xocsp.Good, response.Status)
+	}
+	events, err := registry.AuditLog(&certstore.AuditFilter{Name: "responder", Operation: certstore.AuditOperationAccess})
+	require.NoError(t, err)
+	accessCount := 0
+	for {
+		event, err := events.Next()
+		require.NoError(t, err)
+		if event == nil {
+			break
+		}
+		accessCount++
+	}
+	require.Equal(t, 1, accessCount)
+}
+
+func TestHandlerChanges(t *testing.T) {
+	user := "TestHandlerChangesUser"
+	registry := newTestRegistry(t)
+	createTestCertificate(t, registry, "root", newTestCATemplate("root"), "", user)
+	createTestCertificate(t, registry, "leaf1", newTestLeafTemplate("leaf1"), "root", user)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, user, 0))
+	defer server.Close()
+	root := getTestCertificate(t, registry, "root")
+	leaf1 := getTestCertificate(t, registry, "leaf1")
+	response := postTestRequest(t, server.URL, leaf1, root)
+	require.Equal(t, xocsp.Good, response.Status)
+	// created after indexing
+	createTestCertificate(t, registry, "leaf2", newTestLeafTemplate("leaf2"), "root", user)
+	leaf2 := getTestCertificate(t, registry, "leaf2")
+	response = postTestRequest(t, server.URL, leaf2, root)
+	require.Equal(t, xocsp.Good, response.Status)
+	// revoked after indexing
+	err := registry.Revoke("leaf1", certstore.RevocationReasonSuperseded, user)
+	require.NoError(t, err)
+	response = postTestRequest(t, server.URL, leaf1, root)
+	require.Equal(t, xocsp.Revoked, response.Status)
+	require.Equal(t, xocsp.Superseded, response.RevocationReason)
+}
+
+func TestHandlerRevocationList(t *testing.T) {
+	user := "TestHandlerRevocationListUser"
+	registry := newTestRegistry(t)
+	createTestCertificate(t, registry, "root", newTestCATemplate("root"), "", user)
+	createTestCertificate(t, registry, "leaf", newTestLeafTemplate("leaf"), "root", user)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, user, 0))
+	defer server.Close()
+	root := getTestCertificate(t, registry, "root")
+	leaf := getTestCertificate(t, registry, "leaf")
+	rootEntry, err := registry.Entry("root")
+	require.NoError(t, err)
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: leaf.SerialNumber, RevocationTime: now, ReasonCode: int(certstore.RevocationReasonKeyCompromise)},
+		},
+	}
+	_, err = rootEntry.ResetRevocationList(certs.NewLocalRevocationListFactory(template), user)
+	require.NoError(t, err)
+	response := getTestRequest(t, server.URL, leaf, root)
+	require.Equal(t, xocsp.Revoked, response.Status)
+	require.Equal(t, xocsp.KeyCompromise, response.RevocationReason)
+}
+
+func TestHandlerGetSlash(t *testing.T) {
+	user := "TestHandlerGetSlashUser"
+	registry := newTestRegistry(t)
+	createTestCertificate(t, registry, "root", newTestCATemplate("root"), "", user)
+	createTestCertificate(t, registry, "leaf", newTestLeafTemplate("leaf"), "root", user)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, user, 0))
+	defer server.Close()
+	root := getTestCertificate(t, registry, "root")
+	leaf := *getTestCertificate(t, registry, "leaf")
+	// look for a serial number causing a '/' within the encoded request
+	for serial := int64(1); ; serial++ {
+		leaf.SerialNumber = big.NewInt(serial)
+		requestBytes, err := xocsp.CreateRequest(&leaf, root, &xocsp.RequestOptions{Hash: crypto.SHA256})
+		require.NoError(t, err)
+		if strings.Contains(base64.StdEncoding.EncodeToString(requestBytes), "/") {
+			break
+		}
+	}
+	for _, escape := range []bool{false, true} {
+		response := getTestRequestEscaped(t, server.URL, &leaf, root, escape)
+		require.Equal(t, xocsp.Unknown, response.Status)
+	}
+}
+
+func TestHandlerMalformed(t *testing.T) {
+	registry := newTestRegistry(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(ocsp.NewHandler(ctx, registry, "TestHandlerMalformedUser", 0))
+	defer server.Close()
+	httpResponse, err := http.Post(server.URL, "application/ocsp-request", bytes.NewReader([]byte("malformed")))
+	require.NoError(t, err)
+	defer httpResponse.Body.Close()
+	responseBytes, err := io.ReadAll(httpResponse.Body)
+	require.NoError(t, err)
+	require.Equal(t, xocsp.MalformedRequestErrorResponse, responseBytes)
+}
+
+func postTestRequest(t *testing.T, serverURL string, certificate *x509.Certificate, issuer *x509.Certificate) *xocsp.Response {
+	requestBytes, err := xocsp.CreateRequest(certificate, issuer, nil)
+	require.NoError(t, err)
+	httpResponse, err := http.Post(serverURL, "application/ocsp-request", bytes.NewReader(requestBytes))
+	require.NoError(t, err)
+	return parseTestResponse(t, httpResponse, certificate, issuer)
+}
+
+func getTestRequest(t *testing.T, serverURL string, certificate *x509.Certificate, issuer *x509.Certificate) *xocsp.Response {
+	return getTestRequestEscaped(t, serverURL, certificate, issuer, true)
+}
+
+func getTestRequestEscaped(t *testing.T, serverURL string, certificate *x509.Certificate, issuer *x509.Certificate, escape bool) *xocsp.Response {
+	requestBytes, err := xocsp.CreateRequest(certificate, issuer, &xocsp.RequestOptions{Hash: crypto.SHA256})
+	require.NoError(t, err)
+	encodedRequest := base64.StdEncoding.EncodeToString(requestBytes)
+	if escape {
+		encodedRequest = url.PathEscape(encodedRequest)
+	}
+	httpResponse, err := http.Get(serverURL + "/" + encodedRequest)
+	require.NoError(t, err)
+	return parseTestResponse(t, httpResponse, certificate, issuer)
+}
+
+func parseTestResponse(t *testing.T, httpResponse *http.Response, certificate *x509.Certificate, issuer *x509.Certificate) *xocsp.Response {
+	defer httpResponse.Body.Close()
+	require.Equal(t, http.StatusOK, httpResponse.StatusCode)
+	require.Equal(t, "application/ocsp-response", httpResponse.Header.Get("Content-Type"))
+	responseBytes, err := io.ReadAll(httpResponse.Body)
+	require.NoError(t, err)
+	response, err := xocsp.ParseResponseForCert(responseBytes, certificate, issuer)
+	require.NoError(t, err)
+	require.Equal(t, 0, certificate.SerialNumber.Cmp(response.SerialNumber))
+	return response
+}
+
+func newTestRegistry(t *testing.T) *certstore.Registry {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(2), 0)
+	require.NoError(t, err)
+	return registry
+}
+
+func createTestCertificate(t *testing.T, registry *certstore.Registry, name string, template *x509.Certificate, issuerName string, user string) {
+	var factory certs.CertificateFactory
+	if issuerName == "" {
+		factory = certs.NewLocalCertificateFactory(template, testKeyAlg.NewKeyPairFactory(), nil, nil)
+	} else {
+		issuer, err := registry.Entry(issuerName)
+		require.NoError(t, err)
+		factory = certs.NewLocalCertificateFactory(template, testKeyAlg.NewKeyPairFactory(), issuer.Certificate(), issuer.Key(user))
+	}
+	createdName, err := registry.CreateCertificate(name, factory, user)
+	require.NoError(t, err)
+	require.Equal(t, name, createdName)
+}
+
+func getTestCertificate(t *testing.T, registry *certstore.Registry, name string) *x509.Certificate {
+	entry, err := registry.Entry(name)
+	require.NoError(t, err)
+	return entry.Certificate()
+}
+
+func newTestCATemplate(cn string) *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+}
+
+func newTestLeafTemplate(cn string) *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		MaxPathLen:            -1,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.AddDate(0, 0, 1),
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/certs/acme"
+	"github.com/hdecarne-github/go-certstore/keys"
+)
+
+// ErrNoACMEConfig indicates a renewal of an ACME issued certificate without an ACME configuration.
+var ErrNoACMEConfig = errors.New("no ACME configuration")
+
+// ErrCARekey indicates a renewal of a CA certificate requesting a new key.
+var ErrCARekey = errors.New("re-keying a CA entry is not supported")
+
+// RenewOptions defines how a certificate is renewed via [Registry.Renew].
+type RenewOptions struct {
+	// ReuseKey defines whether the existing key is reused (true) or a new key of the same algorithm is generated (false).
+	ReuseKey bool
+	// Validity defines the validity period of the renewed certificate. If 0, the validity period of the existing certificate is used.
+	Validity time.Duration
+	// ACMEConfig defines the ACME configuration used for renewing certificates originally obtained from an ACME provider.
+	ACMEConfig *acme.Config
+}
+
+// Renew reissues the certificate of the given entry and stores it as a new version of the same entry.
+//
+// The certificate is reissued by the entry's own issuer. For certificates originally obtained from an ACME provider,
+// the same provider is used (which requires [RenewOptions.ACMEConfig] to be set). Otherwise the issuing CA entry of
+// the store (or the entry itself, in case of a self-signed certificate) is used.
+// Subject, subject alternative names and extensions are copied from the existing certificate.
+// If the entry does not contain a certificate, [ErrNoCertificate] is returned.
+// If the issuing CA entry is not available, [ErrInvalidIssuer] is returned.
+// If a new key is requested, but the entry does not contain a key, [ErrNoKey] is returned.
+// If a new key is requested for a CA entry, [ErrCARekey] is returned. Replacing the key of a CA entry would render the
+// certificates issued so far unverifiable and unrevocable. Create a new CA entry instead.
+// If options is nil, the default options (new key, same validity period) are used. For CA entries the default
+// options keep the existing key instead.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) Renew(name string, options *RenewOptions, user string) (*x509.Certificate, error) {
+	entry, err := registry.Entry(name)
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	if !entry.HasCertificate() {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, ErrNoCertificate)
+	}
+	if options == nil {
+		options = &RenewOptions{ReuseKey: entry.IsCA()}
+	}
+	data, err := registry.getEntryData(name)
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	certificate := entry.Certificate()
+	template := newRenewTemplate(certificate, options.Validity, options.ReuseKey)
+	var keyPairFactory keys.KeyPairFactory
+	if options.ReuseKey {
+		if entry.HasKey() {
+			var key crypto.PrivateKey
+			key, err = entry.AccessKey(user)
+			if err == nil {
+				keyPairFactory, err = newExistingKeyPairFactory(key)
+			}
+		}
+	} else {
+		if !entry.HasKey() {
+			return nil, registry.auditFailure(auditRenewCertificate, name, user, ErrNoKey)
+		}
+		if entry.IsCA() {
+			return nil, registry.auditFailure(auditRenewCertificate, name, user, ErrCARekey)
+		}
+		var alg keys.Algorithm
+		alg, err = keys.AlgorithmFromKey(certificate.PublicKey)
+		if err == nil {
+			keyPairFactory, err = newRenewKeyPairFactory(entry, alg)
+		}
+	}
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	factory, err := registry.newRenewFactory(entry, data, template, keyPairFactory, options, user)
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	key, renewed, err := factory.New()
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	rekeyed := key != nil && !options.ReuseKey
+	_, _, err = registry.modifyEntryData(name, func(data *registryEntryData) error {
+		if rekeyed {
+			err := registry.setEntryKey(data, key)
+			if err != nil {
+				return err
+			}
+			data.EncodedCertificateRequest = ""
+		}
+		data.setCertificate(renewed)
+		return nil
+	})
+	if err != nil {
+		return nil, registry.auditFailure(auditRenewCertificate, name, user, err)
+	}
+	err = registry.audit(auditRenewCertificate, name, user, auditSerial(renewed.SerialNumber))
+	return renewed, err
+}
+
+// newRenewKeyPairFactory gets the factory for the renewed key. Keys held by a key store are renewed within the same key store.
+func newRenewKeyPairFactory(entry *RegistryEntry, alg keys.Algorithm) (keys.KeyPairFactory, error) {
+	storedKey, ok := entry.key.(keys.StoredKey)
+	if ok {
+		return storedKey.KeyStore().NewKeyPairFactory(alg)
+	}
+	return alg.NewKeyPairFactory(), nil
+}
+
+func (registry *Registry) newRenewFactory(entry *RegistryEntry, data *registryEntryData, template *x509.Certificate, keyPairFactory keys.KeyPairFactory, options *RenewOptions, user string) (certs.CertificateFactory, error) {
+	providerName, isACME := certs.ACMEProviderName(data.Factory)
+	if isACME {
+		if options.ACMEConfig == nil {
+			return nil, ErrNoACMEConfig
+		}
+		if keyPairFactory == nil {
+			return nil, ErrNoKey
+		}
+		certificateRequest, err := options.ACMEConfig.ResolveCertificateRequest(template.DNSNames, providerName)
+		if err != nil {
+			return nil, err
+		}
+		return certs.NewACMECertificateFactory(certificateRequest, keyPairFactory), nil
+	}
+	certificate := entry.Certificate()
+	if certs.IsRoot(certificate) {
+		if keyPairFactory == nil {
+			return nil, ErrNoKey
+		}
+		return certs.NewLocalCertificateFactoryWithSerialNumbers(template, keyPairFactory, nil, nil, registry.NewSerialNumberGenerator(false)), nil
+	}
+	issuer, err := registry.findIssuer(certificate, x509.KeyUsageCertSign)
+	if err != nil {
+		return nil, err
+	}
+	if issuer == nil {
+		return nil, ErrInvalidIssuer
+	}
+	issuerKey, err := issuer.AccessKey(user)
+	if err != nil {
+		return nil, err
+	}
+	serialNumbers := registry.NewSerialNumberGenerator(false)
+	if keyPairFactory == nil {
+		// no key available; re-sign the existing public key
+		request := &x509.CertificateRequest{PublicKey: certificate.PublicKey}
+		return certs.NewRemoteCertificateFactoryWithSerialNumbers(template, request, issuer.Certificate(), issuerKey, serialNumbers), nil
+	}
+	return certs.NewLocalCertificateFactoryWithSerialNumbers(template, keyPairFactory, issuer.Certificate(), issuerKey, serialNumbers), nil
+}
+
+var renewHandledExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14},                     // Subject Key Identifier
+	{2, 5, 29, 15},                     // Key Usage
+	{2, 5, 29, 17},                     // Subject Alternative Name
+	{2, 5, 29, 19},                     // Basic Constraints
+	{2, 5, 29, 30},                     // Name Constraints
+	{2, 5, 29, 31},                     // CRL Distribution Points
+	{2, 5, 29, 32},                     // Certificate Policies
+	{2, 5, 29, 35},                     // Authority Key Identifier
+	{2, 5, 29, 37},                     // Extended Key Usage
+	{1, 3, 6, 1, 5, 5, 7, 1, 1},        // Authority Information Access
+	{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, // SCT list
+}
+
+// newRenewTemplate gets the template for renewing the submitted certificate. If the key is reused, the subject key id
+// is kept as well. This way certificates chaining up via the authority key id stay verifiable.
+func newRenewTemplate(certificate *x509.Certificate, validity time.Duration, reuseKey bool) *x509.Certificate {
+	if validity <= 0 {
+		validity = certificate.NotAfter.Sub(certificate.NotBefore)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		RawSubject:                  certificate.RawSubject,
+		Subject:                     certificate.Subject,
+		NotBefore:                   now,
+		NotAfter:                    now.Add(validity),
+		KeyUsage:                    certificate.KeyUsage,
+		ExtKeyUsage:                 slices.Clone(certificate.ExtKeyUsage),
+		UnknownExtKeyUsage:          slices.Clone(certificate.UnknownExtKeyUsage),
+		BasicConstraintsValid:       certificate.BasicConstraintsValid,
+		IsCA:                        certificate.IsCA,
+		MaxPathLen:                  certificate.MaxPathLen,
+		MaxPathLenZero:              certificate.MaxPathLenZero,
+		OCSPServer:                  slices.Clone(certificate.OCSPServer),
+		IssuingCertificateURL:       slices.Clone(certificate.IssuingCertificateURL),
+		DNSNames:                    slices.Clone(certificate.DNSNames),
+		EmailAddresses:              slices.Clone(certificate.EmailAddresses),
+		IPAddresses:                 slices.Clone(certificate.IPAddresses),
+		URIs:                        slices.Clone(certificate.URIs),
+		PermittedDNSDomainsCritical: certificate.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         slices.Clone(certificate.PermittedDNSDomains),
+		ExcludedDNSDomains:          slices.Clone(certificate.ExcludedDNSDomains),
+		PermittedIPRanges:           slices.Clone(certificate.PermittedIPRanges),
+		ExcludedIPRanges:            slices.Clone(certificate.ExcludedIPRanges),
+		PermittedEmailAddresses:     slices.Clone(certificate.PermittedEmailAddresses),
+		ExcludedEmailAddresses:      slices.Clone(certificate.ExcludedEmailAddresses),
+		PermittedURIDomains:         slices.Clone(certificate.PermittedURIDomains),
+		ExcludedURIDomains:          slices.Clone(certificate.ExcludedURIDomains),
+		CRLDistributionPoints:       slices.Clone(certificate.CRLDistributionPoints),
+		PolicyIdentifiers:           slices.Clone(certificate.PolicyIdentifiers),
+		Policies:                    slices.Clone(certificate.Policies),
+	}
+	if reuseKey {
+		template.SubjectKeyId = slices.Clone(certificate.SubjectKeyId)
+	}
+	for _, extension := range certificate.Extensions {
+		if !slices.ContainsFunc(renewHandledExtensions, extension.Id.Equal) {
+			template.ExtraExtensions = append(template.ExtraExtensions, extension)
+		}
+	}
+	return template
+}
+
+type existingKeyPairFactory struct {
+	alg keys.Algorithm
+	key crypto.PrivateKey
+}
+
+func newExistingKeyPairFactory(key crypto.PrivateKey) (keys.KeyPairFactory, error) {
+	alg, err := keys.AlgorithmFromKey(keys.PublicFromPrivate(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine key algorithm (cause: %w)", err)
+	}
+	return &existingKeyPairFactory{alg: alg, key: key}, nil
+}
+
+func (factory *existingKeyPairFactory) Alg() keys.Algorithm {
+	return factory.alg
+}
+
+func (factory *existingKeyPairFactory) New() (keys.KeyPair, error) {
+	return factory, nil
+}
+
+func (factory *existingKeyPairFactory) Private() crypto.PrivateKey {
+	return factory.key
+}
+
+func (factory *existingKeyPairFactory) Public() crypto.PublicKey {
+	return keys.PublicFromPrivate(factory.key)
+}
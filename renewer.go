@@ -0,0 +1,255 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/hdecarne-github/go-log"
+	"github.com/rs/zerolog"
+)
+
+// AutoRenewAttribute is the entry attribute used to opt into automatic renewal by a [Renewer].
+//
+// Automatic renewal is enabled, if the attribute is set to "true".
+const AutoRenewAttribute = "auto-renew"
+
+const defaultRenewerInterval = time.Hour
+const defaultRenewerMinBackoff = time.Minute
+const defaultRenewerMaxBackoff = 24 * time.Hour
+
+// A Clock provides the current time as well as timers to a [Renewer].
+type Clock interface {
+	// Now gets the current time.
+	Now() time.Time
+	// After waits for the given duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (clock systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (clock systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SystemClock is the [Clock] based on the system time.
+var SystemClock Clock = systemClock{}
+
+// RenewEvent describes the outcome of an automatic renewal attempt.
+type RenewEvent struct {
+	// Name is the name of the renewed store entry.
+	Name string
+	// Certificate is the renewed certificate (nil in case of a failure).
+	Certificate *x509.Certificate
+	// Err is the error causing the renewal to fail (nil in case of success).
+	Err error
+	// Failures is the number of consecutive failed renewal attempts (0 in case of success).
+	Failures int
+	// NextAttempt is the earliest time the next renewal attempt is made in case of a failure.
+	NextAttempt time.Time
+}
+
+// RenewerOptions defines the behaviour of a [Renewer].
+type RenewerOptions struct {
+	// Interval defines the time between two scans of the store. If 0, a default of one hour is used.
+	Interval time.Duration
+	// Jitter defines the maximum random delay added to each scan interval.
+	Jitter time.Duration
+	// Threshold defines the remaining lifetime below which a certificate is renewed.
+	// If 0, a certificate is renewed as soon as less than one third of its validity period remains.
+	Threshold time.Duration
+	// MinBackoff defines the initial delay before retrying a failed renewal. If 0, a default of one minute is used.
+	MinBackoff time.Duration
+	// MaxBackoff defines the maximum delay before retrying a failed renewal. If 0, a default of one day is used.
+	MaxBackoff time.Duration
+	// Renew defines the options used for renewing a certificate (see [Registry.Renew]).
+	// CA entries are always renewed reusing their key (see [ErrCARekey]).
+	Renew RenewOptions
+	// Clock defines the clock to use. If nil, [SystemClock] is used.
+	Clock Clock
+	// OnRenewed is invoked after a certificate has been renewed successfully (optional).
+	OnRenewed func(event *RenewEvent)
+	// OnFailed is invoked after a certificate renewal has failed (optional).
+	OnFailed func(event *RenewEvent)
+}
+
+type renewerState struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+// A Renewer periodically scans a store for certificates about to expire and renews them.
+//
+// Only entries opting into automatic renewal via the [AutoRenewAttribute] are considered.
+type Renewer struct {
+	registry *Registry
+	options  RenewerOptions
+	user     string
+	clock    Clock
+	mutex    sync.Mutex
+	states   map[string]*renewerState
+	logger   *zerolog.Logger
+}
+
+// NewRenewer creates a new [Renewer] for the submitted [Registry].
+//
+// If options is nil, the default options are used.
+// The submitted user name is used for recording the renewals in the store's audit log.
+func NewRenewer(registry *Registry, options *RenewerOptions, user string) *Renewer {
+	if options == nil {
+		options = &RenewerOptions{}
+	}
+	logger := log.RootLogger().With().Str("Renewer", registry.Name()).Logger()
+	renewer := &Renewer{
+		registry: registry,
+		options:  *options,
+		user:     user,
+		clock:    options.Clock,
+		states:   make(map[string]*renewerState),
+		logger:   &logger,
+	}
+	if renewer.options.Interval <= 0 {
+		renewer.options.Interval = defaultRenewerInterval
+	}
+	if renewer.options.MinBackoff <= 0 {
+		renewer.options.MinBackoff = defaultRenewerMinBackoff
+	}
+	if renewer.options.MaxBackoff <= 0 {
+		renewer.options.MaxBackoff = defaultRenewerMaxBackoff
+	}
+	if renewer.clock == nil {
+		renewer.clock = SystemClock
+	}
+	return renewer
+}
+
+// Run scans the store periodically until the submitted context is done.
+//
+// The context's error is returned when the renewer stops.
+func (renewer *Renewer) Run(ctx context.Context) error {
+	renewer.logger.Info().Msg("starting renewer...")
+	for {
+		err := renewer.Scan()
+		if err != nil {
+			renewer.logger.Error().Err(err).Msg("failed to scan store")
+		}
+		delay := renewer.options.Interval
+		if renewer.options.Jitter > 0 {
+			delay += rand.N(renewer.options.Jitter)
+		}
+		select {
+		case <-ctx.Done():
+			renewer.logger.Info().Msg("renewer stopped")
+			return ctx.Err()
+		case <-renewer.clock.After(delay):
+		}
+	}
+}
+
+// Scan scans the store once and renews all due certificates.
+//
+// Failed renewals are reported via [RenewerOptions.OnFailed] and retried during later scans
+// using an exponential backoff. Only errors accessing the store itself are returned. Entries failing to load are
+// skipped and reported via the returned error after the remaining entries have been scanned.
+func (renewer *Renewer) Scan() error {
+	renewer.mutex.Lock()
+	defer renewer.mutex.Unlock()
+	entries, err := renewer.registry.Entries()
+	if err != nil {
+		return err
+	}
+	now := renewer.clock.Now()
+	due := make([]*RegistryEntry, 0)
+	var loadErrs []error
+	for {
+		entry, err := entries.Next()
+		if err != nil {
+			renewer.logger.Error().Err(err).Msgf("failed to load entry '%s'", entries.name)
+			loadErrs = append(loadErrs, fmt.Errorf("failed to load entry '%s' (cause: %w)", entries.name, err))
+			continue
+		}
+		if entry == nil {
+			break
+		}
+		if renewer.isDue(entry, now) {
+			due = append(due, entry)
+		}
+	}
+	for _, entry := range due {
+		renewer.renew(entry, now)
+	}
+	return errors.Join(loadErrs...)
+}
+
+// Remaining gets the remaining lifetime of the submitted entry's certificate as seen by this renewer.
+func (renewer *Renewer) Remaining(entry *RegistryEntry) time.Duration {
+	if !entry.HasCertificate() {
+		return 0
+	}
+	return entry.Certificate().NotAfter.Sub(renewer.clock.Now())
+}
+
+func (renewer *Renewer) isDue(entry *RegistryEntry, now time.Time) bool {
+	if !entry.HasCertificate() || entry.Attributes()[AutoRenewAttribute] != "true" {
+		return false
+	}
+	state := renewer.states[entry.Name()]
+	if state != nil && now.Before(state.nextAttempt) {
+		return false
+	}
+	certificate := entry.Certificate()
+	threshold := renewer.options.Threshold
+	if threshold <= 0 {
+		threshold = certificate.NotAfter.Sub(certificate.NotBefore) / 3
+	}
+	return certificate.NotAfter.Sub(now) < threshold
+}
+
+func (renewer *Renewer) renew(entry *RegistryEntry, now time.Time) {
+	name := entry.Name()
+	renewer.logger.Info().Msgf("renewing certificate '%s'...", name)
+	options := renewer.options.Renew
+	if entry.IsCA() {
+		options.ReuseKey = true
+	}
+	certificate, err := renewer.registry.Renew(name, &options, renewer.user)
+	if err != nil {
+		state := renewer.states[name]
+		if state == nil {
+			state = &renewerState{}
+			renewer.states[name] = state
+		}
+		state.failures++
+		state.nextAttempt = now.Add(renewer.backoff(state.failures))
+		renewer.logger.Error().Err(err).Msgf("failed to renew certificate '%s' (attempt: %d; next attempt: %s)", name, state.failures, state.nextAttempt)
+		if renewer.options.OnFailed != nil {
+			renewer.options.OnFailed(&RenewEvent{Name: name, Err: err, Failures: state.failures, NextAttempt: state.nextAttempt})
+		}
+		return
+	}
+	delete(renewer.states, name)
+	if renewer.options.OnRenewed != nil {
+		renewer.options.OnRenewed(&RenewEvent{Name: name, Certificate: certificate})
+	}
+}
+
+func (renewer *Renewer) backoff(failures int) time.Duration {
+	backoff := renewer.options.MinBackoff
+	for attempt := 1; attempt < failures && backoff < renewer.options.MaxBackoff; attempt++ {
+		backoff *= 2
+	}
+	return min(backoff, renewer.options.MaxBackoff)
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *testClock) After(d time.Duration) <-chan time.Time {
+	return nil
+}
+
+func TestRenewerScan(t *testing.T) {
+	name := "TestRenewerScan"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	root := createTestRenewerEntry(t, registry, name+"Root", nil, user, true)
+	createTestRenewerEntry(t, registry, name+"Leaf1", root, user, true)
+	createTestRenewerEntry(t, registry, name+"Leaf2", root, user, false)
+	orphanRoot := createTestRenewerEntry(t, registry, name+"OrphanRoot", nil, user, false)
+	createTestRenewerEntry(t, registry, name+"Orphan", orphanRoot, user, true)
+	err = registry.Delete(orphanRoot.Name(), user)
+	require.NoError(t, err)
+	clock := &testClock{now: time.Now()}
+	renewed := make([]string, 0)
+	failed := make([]*certstore.RenewEvent, 0)
+	renewer := certstore.NewRenewer(registry, &certstore.RenewerOptions{
+		Renew:      certstore.RenewOptions{ReuseKey: true, Validity: 48 * time.Hour},
+		MinBackoff: time.Minute,
+		Clock:      clock,
+		OnRenewed:  func(event *certstore.RenewEvent) { renewed = append(renewed, event.Name) },
+		OnFailed:   func(event *certstore.RenewEvent) { failed = append(failed, event) },
+	}, user)
+	// nothing due
+	err = renewer.Scan()
+	require.NoError(t, err)
+	require.Empty(t, renewed)
+	require.Empty(t, failed)
+	// all due
+	clock.now = clock.now.Add(20 * time.Hour)
+	err = renewer.Scan()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{name + "Root", name + "Leaf1"}, renewed)
+	require.Len(t, failed, 1)
+	require.Equal(t, name+"Orphan", failed[0].Name)
+	require.ErrorIs(t, failed[0].Err, certstore.ErrInvalidIssuer)
+	require.Equal(t, 1, failed[0].Failures)
+	require.Equal(t, clock.now.Add(time.Minute), failed[0].NextAttempt)
+	// backoff
+	err = renewer.Scan()
+	require.NoError(t, err)
+	require.Len(t, renewed, 2)
+	require.Len(t, failed, 1)
+	clock.now = clock.now.Add(time.Minute)
+	err = renewer.Scan()
+	require.NoError(t, err)
+	require.Len(t, renewed, 2)
+	require.Len(t, failed, 2)
+	require.Equal(t, 2, failed[1].Failures)
+	require.Equal(t, clock.now.Add(2*time.Minute), failed[1].NextAttempt)
+}
+
+func TestRenewerScanLoadFailure(t *testing.T) {
+	name := "TestRenewerScanLoadFailure"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	_, err = backend.Create(name+"Broken", []byte("{"))
+	require.NoError(t, err)
+	createTestRenewerEntry(t, registry, name, nil, user, true)
+	// default options
+	err = certstore.NewRenewer(registry, nil, user).Scan()
+	require.ErrorContains(t, err, name+"Broken")
+	// remaining entries are renewed
+	renewed := make([]string, 0)
+	renewer := certstore.NewRenewer(registry, &certstore.RenewerOptions{
+		Threshold: 48 * time.Hour,
+		OnRenewed: func(event *certstore.RenewEvent) { renewed = append(renewed, event.Name) },
+	}, user)
+	err = renewer.Scan()
+	require.ErrorContains(t, err, name+"Broken")
+	require.Equal(t, []string{name}, renewed)
+}
+
+func TestRenewerRun(t *testing.T) {
+	name := "TestRenewerRun"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	createTestRenewerEntry(t, registry, name, nil, user, true)
+	renewed := make(chan string, 1)
+	renewer := certstore.NewRenewer(registry, &certstore.RenewerOptions{
+		Interval:  time.Millisecond,
+		Jitter:    time.Millisecond,
+		Threshold: 48 * time.Hour,
+		OnRenewed: func(event *certstore.RenewEvent) { renewed <- event.Name },
+	}, user)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- renewer.Run(ctx)
+	}()
+	require.Equal(t, name, <-renewed)
+	cancel()
+	for {
+		select {
+		case <-renewed:
+			continue
+		case err = <-stopped:
+		}
+		break
+	}
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func createTestRenewerEntry(t *testing.T, registry *certstore.Registry, name string, issuer *certstore.RegistryEntry, user string, autoRenew bool) *certstore.RegistryEntry {
+	var createdName string
+	var err error
+	if issuer == nil {
+		createdName, err = registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	} else {
+		createdName, err = registry.CreateCertificate(name, newTestLeafCertificateFactory(name, issuer.Certificate(), issuer.Key(user)), user)
+	}
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	if autoRenew {
+		err = entry.SetAttributes(map[string]string{certstore.AutoRenewAttribute: "true"})
+		require.NoError(t, err)
+	}
+	return entry
+}
@@ -0,0 +1,276 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+const rewritePassLimit = 3
+
+// RotateSecret replaces the store secret with a newly generated one and re-encrypts the keys of all store entries.
+//
+// Re-encryption covers all retained versions of an entry (including the history of deleted entries).
+// The previous secret is retired but kept until no retained entry version references it any longer. Each encrypted
+// key records the id of the secret used for its encryption. Hence, if rotation is interrupted, the store remains
+// readable and invoking this function again completes the rotation. Other store instances sharing the same backend
+// reload the store settings as soon as they encounter an unknown secret or the store settings have been updated.
+// Keys written by other store instances while the rotation is in progress are re-encrypted by the writing instance
+// after writing, if the store settings have been updated in the meantime. Hence dropping a retired secret does not
+// render keys unreadable, which have been encrypted with it after the entries have been scanned.
+// If the store secret is protected (see [WithPassphrase]), the new secret is protected the same way.
+//
+// If the store's backend does not implement [storage.RewritableBackend] and [storage.PrunableBackend],
+// [errors.ErrUnsupported] is returned. Pruning is required to remove the retired secrets from the store settings' history.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) RotateSecret(user string) error {
+	rewritable, err := rewritableBackend(registry.backend)
+	if err == nil {
+		_, err = prunableBackend(registry.backend)
+	}
+	if err != nil {
+		return registry.auditFailure(auditRotateSecret, storeSettingsName, user, err)
+	}
+	settings := registry.settings
+	settings.rotation.Lock()
+	defer settings.rotation.Unlock()
+	secretID, err := settings.beginRotation(registry.backend)
+	if err != nil {
+		return registry.auditFailure(auditRotateSecret, storeSettingsName, user, err)
+	}
+	registry.logger.Info().Msgf("re-encrypting keys using store secret %d...", secretID)
+	err = registry.rewriteAllEntries(rewritable, registry.reencryptKey)
+	if err != nil {
+		return registry.auditFailure(auditRotateSecret, storeSettingsName, user, err)
+	}
+	referenced, err := registry.referencedSecrets(rewritable)
+	if err != nil {
+		return registry.auditFailure(auditRotateSecret, storeSettingsName, user, err)
+	}
+	retained, err := settings.completeRotation(registry.backend, referenced)
+	if err != nil {
+		return registry.auditFailure(auditRotateSecret, storeSettingsName, user, err)
+	}
+	for _, retainedID := range retained {
+		registry.logger.Warn().Msgf("retired store secret %d is still in use (rotate again to drop it)", retainedID)
+	}
+	return registry.audit(auditRotateSecret, storeSettingsName, user, auditSecret(secretID))
+}
+
+// UpgradeKeys re-encrypts all keys stored in a previous encryption format using the current format.
+//
+// Keys stored in the current format are encrypted with a key derived from the store secret and the entry's
+// public key. The encrypted key is bound to the entry's id and public key via associated data. Keys stored in a previous
+// format remain readable, but are not (or only via the entry's id) bound to their entry. Like [Registry.RotateSecret]
+// this function covers all retained versions of an entry. As the current key format is part of the current entry data schema, this function
+// also migrates the entries to the current schema (see [Registry.Migrate]).
+//
+// If the store's backend does not implement [storage.RewritableBackend], [errors.ErrUnsupported] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) UpgradeKeys(user string) error {
+	rewritable, err := rewritableBackend(registry.backend)
+	if err != nil {
+		return registry.auditFailure(auditUpgradeKeys, storeSettingsName, user, err)
+	}
+	registry.settings.rotation.Lock()
+	defer registry.settings.rotation.Unlock()
+	registry.logger.Info().Msg("upgrading keys...")
+	err = registry.rewriteAllEntries(rewritable, registry.upgradeKey)
+	if err != nil {
+		return registry.auditFailure(auditUpgradeKeys, storeSettingsName, user, err)
+	}
+	return registry.audit(auditUpgradeKeys, storeSettingsName, user)
+}
+
+// entryRewriter updates the submitted (already migrated) entry data and returns true, if the entry data has been changed.
+type entryRewriter func(data *registryEntryData, entryID *string) (bool, error)
+
+// rewriteAllEntries migrates and rewrites all retained versions of all store entries.
+func (registry *Registry) rewriteAllEntries(rewritable storage.RewritableBackend, rewriter entryRewriter) error {
+	for pass := 1; ; pass++ {
+		rewritten, err := registry.rewriteEntries(rewritable, rewriter)
+		if err != nil {
+			return err
+		}
+		// repeat, if entries have been rewritten as entries may have been modified concurrently
+		if rewritten == 0 {
+			return nil
+		}
+		if pass == rewritePassLimit {
+			return fmt.Errorf("failed to rewrite entries (entries modified concurrently)")
+		}
+	}
+}
+
+func (registry *Registry) rewriteEntries(rewritable storage.RewritableBackend, rewriter entryRewriter) (int, error) {
+	names, err := listAllEntries(rewritable)
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for name := names.Next(); name != ""; name = names.Next() {
+		if !registry.isValidEntryName(name) {
+			continue
+		}
+		// entry versions written before entry ids have been introduced share a common id
+		entryID := ""
+		err = rewritable.Rewrite(name, func(version storage.Version, dataBytes []byte) ([]byte, error) {
+			data, err := registry.decodeEntryData(dataBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewrite entry '%s' version %d (cause: %w)", name, version, err)
+			}
+			migrated, err := registry.migrateEntryData(data, &entryID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewrite entry '%s' version %d (cause: %w)", name, version, err)
+			}
+			changed, err := rewriter(data, &entryID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewrite entry '%s' version %d (cause: %w)", name, version, err)
+			}
+			if !migrated && !changed {
+				return nil, nil
+			}
+			rewritten++
+			return registry.marshalEntryData(data)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rewritten, nil
+}
+
+func (registry *Registry) reencryptKey(data *registryEntryData, entryID *string) (bool, error) {
+	if data.EncodedKey == "" {
+		return false, nil
+	}
+	_, secretID, _, err := decodeEncryptedKey(data.EncodedKey)
+	if err != nil {
+		return false, err
+	}
+	currentSecretID, _ := registry.settings.currentSecret()
+	if secretID == currentSecretID {
+		return false, nil
+	}
+	key, err := data.getKey(registry.settings)
+	if err != nil {
+		return false, err
+	}
+	return true, data.setKey(key, registry.settings)
+}
+
+func (registry *Registry) upgradeKey(data *registryEntryData, entryID *string) (bool, error) {
+	if data.EncodedKey == "" {
+		return false, nil
+	}
+	format, _, _, err := decodeEncryptedKey(data.EncodedKey)
+	if err != nil {
+		return false, err
+	}
+	if format == encryptedKeyFormatCurrent {
+		return false, nil
+	}
+	key, err := data.getKey(registry.settings)
+	if err != nil {
+		return false, err
+	}
+	err = data.assignID(entryID)
+	if err != nil {
+		return false, err
+	}
+	return true, data.setKey(key, registry.settings)
+}
+
+// referencedSecrets collects the ids of the secrets used by the encrypted keys of all retained entry versions.
+func (registry *Registry) referencedSecrets(rewritable storage.RewritableBackend) (map[uint32]bool, error) {
+	names, err := listAllEntries(rewritable)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[uint32]bool)
+	for name := names.Next(); name != ""; name = names.Next() {
+		if !registry.isValidEntryName(name) {
+			continue
+		}
+		err = rewritable.Rewrite(name, func(version storage.Version, dataBytes []byte) ([]byte, error) {
+			data, err := registry.decodeEntryData(dataBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan entry '%s' version %d (cause: %w)", name, version, err)
+			}
+			if data.EncodedKey == "" {
+				return nil, nil
+			}
+			_, secretID, _, err := decodeEncryptedKey(data.EncodedKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan entry '%s' version %d (cause: %w)", name, version, err)
+			}
+			referenced[secretID] = true
+			return nil, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
+
+// beginRotation generates and activates a new secret. The previous secret is retired. The store settings are
+// reloaded first to include the secrets introduced by other store instances.
+func (settings *storeSettings) beginRotation(backend storage.Backend) (uint32, error) {
+	secret, err := newStoreSecret()
+	if err != nil {
+		return 0, err
+	}
+	err = settings.reload()
+	if err != nil {
+		return 0, err
+	}
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	secretID := settings.SecretID
+	for id := range settings.secrets {
+		secretID = max(secretID, id)
+	}
+	secretID++
+	previousSecretID := settings.SecretID
+	settings.secrets[secretID] = secret
+	settings.SecretID = secretID
+	err = settings.write(backend)
+	if err != nil {
+		delete(settings.secrets, secretID)
+		settings.SecretID = previousSecretID
+		return 0, err
+	}
+	return secretID, nil
+}
+
+// completeRotation drops the retired secrets no longer referenced by any entry and returns the ids of the
+// retired secrets which are still referenced (and hence retained).
+func (settings *storeSettings) completeRotation(backend storage.Backend, referenced map[uint32]bool) ([]uint32, error) {
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	retired := settings.secrets
+	settings.secrets = map[uint32]string{settings.SecretID: retired[settings.SecretID]}
+	retained := make([]uint32, 0)
+	for secretID, secret := range retired {
+		if secretID != settings.SecretID && referenced[secretID] {
+			settings.secrets[secretID] = secret
+			retained = append(retained, secretID)
+		}
+	}
+	slices.Sort(retained)
+	err := settings.write(backend)
+	if err != nil {
+		settings.secrets = retired
+		return nil, err
+	}
+	return retained, nil
+}
@@ -0,0 +1,457 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateSecret(t *testing.T) {
+	name := "TestRotateSecret"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, testCacheTTL)
+	require.NoError(t, err)
+	rootName, err := registry.CreateCertificate(name+"Root", newTestRootCertificateFactory(name+"Root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	leafName, err := registry.CreateCertificate(name+"Leaf", newTestLeafCertificateFactory(name+"Leaf", root.Certificate(), root.Key(user)), user)
+	require.NoError(t, err)
+	_, err = registry.Renew(leafName, &certstore.RenewOptions{}, user)
+	require.NoError(t, err)
+	deletedName, err := registry.CreateCertificate(name+"Deleted", newTestRootCertificateFactory(name+"Deleted"), user)
+	require.NoError(t, err)
+	err = registry.Delete(deletedName, user)
+	require.NoError(t, err)
+	keys := collectTestKeys(t, backend, user)
+	require.Len(t, keys, 4)
+	checkEncryptedKeys(t, backend, "v3:k0:")
+	// first rotation
+	err = registry.RotateSecret(user)
+	require.NoError(t, err)
+	require.Equal(t, keys, collectTestKeys(t, backend, user))
+	checkEncryptedKeys(t, backend, "v3:k1:")
+	// second rotation
+	err = registry.RotateSecret(user)
+	require.NoError(t, err)
+	require.Equal(t, keys, collectTestKeys(t, backend, user))
+	checkEncryptedKeys(t, backend, "v3:k2:")
+	// new keys use the current secret
+	_, err = registry.Renew(leafName, &certstore.RenewOptions{}, user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k2:")
+	events := readAuditEvents(t, registry, &certstore.AuditFilter{Operation: certstore.AuditOperationRotate})
+	require.Len(t, events, 2)
+	require.Equal(t, certstore.AuditObjectSecret, events[1].Object)
+	require.Equal(t, "2", events[1].Details[certstore.AuditDetailSecret])
+}
+
+func TestRotateLegacySecret(t *testing.T) {
+	name := "TestRotateLegacySecret"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	// legacy settings (no audit key, no secret id)
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(path, ".store"), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(path, ".store", "1"), []byte(`{"secret":"`+base64.StdEncoding.EncodeToString(secret)+`"}`), 0600)
+	require.NoError(t, err)
+	registry := openTestFSStore(t, path)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	err = registry.RotateSecret(user)
+	require.NoError(t, err)
+	registry = openTestFSStore(t, path)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(user))
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func TestRotateProtectedSecret(t *testing.T) {
+	name := "TestRotateProtectedSecret"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	createdName := createProtectedTestEntry(t, path, name, certstore.WithPassphrase("secret"))
+	registry, err := openProtectedTestStore(path, certstore.WithPassphrase("secret"))
+	require.NoError(t, err)
+	err = registry.RotateSecret(name + "User")
+	require.NoError(t, err)
+	checkProtectedStore(t, path)
+	checkProtectedTestEntry(t, path, createdName, certstore.WithPassphrase("secret"))
+}
+
+func TestRotateSecretConcurrentStores(t *testing.T) {
+	name := "TestRotateSecretConcurrentStores"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry1, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	registry2, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName1, err := registry1.CreateCertificate(name+"1", newTestRootCertificateFactory(name+"1"), user)
+	require.NoError(t, err)
+	err = registry1.RotateSecret(user)
+	require.NoError(t, err)
+	// the stale store instance picks up the rotated secret for reading as well as for writing
+	entry1, err := registry2.Entry(createdName1)
+	require.NoError(t, err)
+	require.NotNil(t, entry1.Key(user))
+	createdName2, err := registry2.CreateCertificate(name+"2", newTestRootCertificateFactory(name+"2"), user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k1:")
+	entry2, err := registry1.Entry(createdName2)
+	require.NoError(t, err)
+	require.NotNil(t, entry2.Key(user))
+}
+
+func TestRotateSecretConcurrentWrite(t *testing.T) {
+	name := "TestRotateSecretConcurrentWrite"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry1, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	// the entry is written after the rotation has scanned the entries and dropped the secret used for encryption
+	rotatingBackend := &rotatingCreateBackend{Backend: backend, rotate: func() {
+		err := registry1.RotateSecret(user)
+		require.NoError(t, err)
+	}}
+	registry2, err := certstore.NewStore(rotatingBackend, 0)
+	require.NoError(t, err)
+	createdName, err := registry2.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k1:")
+	entry, err := registry1.Entry(createdName)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(user))
+}
+
+type rotatingCreateBackend struct {
+	storage.Backend
+	rotate func()
+}
+
+func (backend *rotatingCreateBackend) Create(name string, data []byte) (string, error) {
+	if !strings.HasPrefix(name, ".") && backend.rotate != nil {
+		backend.rotate()
+		backend.rotate = nil
+	}
+	return backend.Backend.Create(name, data)
+}
+
+func (backend *rotatingCreateBackend) Rewrite(name string, rewrite storage.RewriteFunc) error {
+	return backend.Backend.(storage.RewritableBackend).Rewrite(name, rewrite)
+}
+
+func TestRotateSecretRetainsReferencedSecrets(t *testing.T) {
+	name := "TestRotateSecretRetainsReferencedSecrets"
+	user := name + "User"
+	backend := &staleWritingBackend{testBackend: storage.NewMemoryStorage(testVersionLimit).(testBackend)}
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	// a concurrent store instance writes a key using the retired secret after the keys have been re-encrypted
+	backend.stale = createdName
+	backend.staleData, err = backend.Get(createdName)
+	require.NoError(t, err)
+	err = registry.RotateSecret(user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k0:", "v3:k1:")
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(user))
+	// the retired secret is dropped as soon as it is no longer referenced
+	backend.stale = ""
+	err = registry.RotateSecret(user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k2:")
+	registry, err = certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	entry, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(user))
+}
+
+// staleWritingBackend re-writes the submitted stale entry data prior to the third rewrite of the entry. During
+// rotation of a store with a single entry, this is the final scan following the re-encryption passes.
+type staleWritingBackend struct {
+	testBackend
+	stale     string
+	staleData []byte
+	rewrites  int
+}
+
+func (backend *staleWritingBackend) Rewrite(name string, rewrite storage.RewriteFunc) error {
+	if name == backend.stale {
+		backend.rewrites++
+		if backend.rewrites == 3 {
+			_, err := backend.testBackend.Update(name, backend.staleData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return backend.testBackend.Rewrite(name, rewrite)
+}
+
+func TestRotateSecretNonPrunable(t *testing.T) {
+	name := "TestRotateSecretNonPrunable"
+	backend := &nonPrunableBackend{RewritableBackend: storage.NewMemoryStorage(testVersionLimit).(storage.RewritableBackend)}
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	err = registry.RotateSecret(name + "User")
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+	// the unprotected store cannot be protected either
+	_, err = certstore.NewStore(backend, 0, certstore.WithPassphrase("secret"))
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+// nonPrunableBackend hides the [storage.PrunableBackend] interface of the wrapped backend.
+type nonPrunableBackend struct {
+	storage.RewritableBackend
+}
+
+func TestRotateSecretInterrupted(t *testing.T) {
+	name := "TestRotateSecretInterrupted"
+	user := name + "User"
+	backend := &interruptingBackend{testBackend: storage.NewMemoryStorage(testVersionLimit).(testBackend)}
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	for index := range 3 {
+		entryName := name + string(rune('A'+index))
+		_, err = registry.CreateCertificate(entryName, newTestRootCertificateFactory(entryName), user)
+		require.NoError(t, err)
+	}
+	keys := collectTestKeys(t, backend, user)
+	backend.rewriteLimit = 1
+	err = registry.RotateSecret(user)
+	require.Error(t, err)
+	// old and new secret coexist
+	reopened, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	require.Equal(t, keys, collectTestKeys(t, backend, user))
+	checkEncryptedKeys(t, backend, "v3:k0:", "v3:k1:")
+	// complete rotation
+	backend.rewriteLimit = 0
+	err = reopened.RotateSecret(user)
+	require.NoError(t, err)
+	require.Equal(t, keys, collectTestKeys(t, backend, user))
+	checkEncryptedKeys(t, backend, "v3:k2:")
+}
+
+type interruptingBackend struct {
+	testBackend
+	rewriteLimit int
+	rewrites     int
+}
+
+func (backend *interruptingBackend) Rewrite(name string, rewrite storage.RewriteFunc) error {
+	if backend.rewriteLimit > 0 {
+		if backend.rewrites >= backend.rewriteLimit {
+			return errors.New("interrupted")
+		}
+		backend.rewrites++
+	}
+	return backend.testBackend.Rewrite(name, rewrite)
+}
+
+// collectTestKeys loads the keys of all retained entry versions (including deleted entries) via a freshly opened store.
+func collectTestKeys(t *testing.T, backend storage.Backend, user string) map[string]string {
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	keys := make(map[string]string)
+	forEachTestEntryVersion(t, backend, func(name string, versionInfo storage.VersionInfo) {
+		entry, err := registry.AsOf(versionInfo.Time).Entry(name)
+		require.NoError(t, err)
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(entry.Key(user))
+		require.NoError(t, err)
+		keys[fmt.Sprintf("%s@%d", name, versionInfo.Version)] = hex.EncodeToString(keyBytes)
+	})
+	return keys
+}
+
+// checkEncryptedKeys checks whether the keys of all retained entry versions are encrypted with one of the submitted secrets.
+func checkEncryptedKeys(t *testing.T, backend storage.Backend, secretIDPrefixes ...string) {
+	forEachTestEntryVersion(t, backend, func(name string, versionInfo storage.VersionInfo) {
+		dataBytes, err := backend.(storage.HistoryBackend).GetHistoryVersion(name, versionInfo.Version)
+		require.NoError(t, err)
+		data := make(map[string]any)
+		err = json.Unmarshal(dataBytes, &data)
+		require.NoError(t, err)
+		encodedKey := data["key"].(string)
+		require.True(t, slices.ContainsFunc(secretIDPrefixes, func(prefix string) bool { return strings.HasPrefix(encodedKey, prefix) }), encodedKey)
+	})
+}
+
+func forEachTestEntryVersion(t *testing.T, backend storage.Backend, f func(name string, versionInfo storage.VersionInfo)) {
+	historyBackend := backend.(storage.HistoryBackend)
+	names, err := historyBackend.ListHistory()
+	require.NoError(t, err)
+	for name := names.Next(); name != ""; name = names.Next() {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		history, err := historyBackend.GetHistory(name)
+		require.NoError(t, err)
+		for _, versionInfo := range history.Versions {
+			f(name, versionInfo)
+		}
+	}
+}
+
+func TestKeyBinding(t *testing.T) {
+	name := "TestKeyBinding"
+	user := name + "User"
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	name1, err := registry.CreateCertificate(name+"1", newTestRootCertificateFactory(name+"1"), user)
+	require.NoError(t, err)
+	name2, err := registry.CreateCertificate(name+"2", newTestRootCertificateFactory(name+"2"), user)
+	require.NoError(t, err)
+	// copy key of entry 1 into entry 2
+	data1 := readTestEntryData(t, backend, name1)
+	data2 := readTestEntryData(t, backend, name2)
+	data2["key"] = data1["key"]
+	writeTestEntryData(t, backend, name2, data2)
+	_, err = registry.Entry(name2)
+	require.Error(t, err)
+	// copying the entry id does not help
+	data2["id"] = data1["id"]
+	writeTestEntryData(t, backend, name2, data2)
+	_, err = registry.Entry(name2)
+	require.Error(t, err)
+	// copying the certificate as well (means copying the entry as a whole) does
+	data2["crt"] = data1["crt"]
+	writeTestEntryData(t, backend, name2, data2)
+	entry2, err := registry.Entry(name2)
+	require.NoError(t, err)
+	require.NotNil(t, entry2.Key(user))
+	// copy key (and public key) of key-only entry 3 into key-only entry 4
+	key3, err := testKeyAlg.NewKeyPairFactory().New()
+	require.NoError(t, err)
+	name3, _, err := registry.MergeKey(name+"3", key3.Private(), user)
+	require.NoError(t, err)
+	key4, err := testKeyAlg.NewKeyPairFactory().New()
+	require.NoError(t, err)
+	name4, _, err := registry.MergeKey(name+"4", key4.Private(), user)
+	require.NoError(t, err)
+	data3 := readTestEntryData(t, backend, name3)
+	data4 := readTestEntryData(t, backend, name4)
+	data4["key"] = data3["key"]
+	data4["key_pub"] = data3["key_pub"]
+	writeTestEntryData(t, backend, name4, data4)
+	_, err = registry.Entry(name4)
+	require.Error(t, err)
+}
+
+func TestUpgradeKeys(t *testing.T) {
+	name := "TestUpgradeKeys"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry := openTestFSStore(t, path)
+	legacyName, err := registry.CreateCertificate(name+"Legacy", newTestRootCertificateFactory(name+"Legacy"), user)
+	require.NoError(t, err)
+	v1Name, err := registry.CreateCertificate(name+"V1", newTestRootCertificateFactory(name+"V1"), user)
+	require.NoError(t, err)
+	legacyEntry, err := registry.Entry(legacyName)
+	require.NoError(t, err)
+	v1Entry, err := registry.Entry(v1Name)
+	require.NoError(t, err)
+	// downgrade key encryption
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	settings := readTestEntryData(t, backend, ".store")
+	secret, err := base64.StdEncoding.DecodeString(settings["secret"].(string))
+	require.NoError(t, err)
+	downgradeTestEntryKey(t, backend, legacyName, legacyEntry.Key(user), secret, "")
+	downgradeTestEntryKey(t, backend, v1Name, v1Entry.Key(user), secret, "k0:")
+	// legacy keys remain readable
+	registry = openTestFSStore(t, path)
+	checkTestEntryKey(t, registry, legacyName, legacyEntry.Key(user), user)
+	checkTestEntryKey(t, registry, v1Name, v1Entry.Key(user), user)
+	// upgrade
+	err = registry.UpgradeKeys(user)
+	require.NoError(t, err)
+	checkEncryptedKeys(t, backend, "v3:k0:")
+	registry = openTestFSStore(t, path)
+	checkTestEntryKey(t, registry, legacyName, legacyEntry.Key(user), user)
+	checkTestEntryKey(t, registry, v1Name, v1Entry.Key(user), user)
+	require.NotEmpty(t, readTestEntryData(t, backend, legacyName)["id"])
+	events := readAuditEvents(t, registry, &certstore.AuditFilter{Operation: certstore.AuditOperationUpgrade})
+	require.Len(t, events, 1)
+}
+
+func downgradeTestEntryKey(t *testing.T, backend storage.Backend, name string, key crypto.PrivateKey, secret []byte, prefix string) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(secret)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	data := readTestEntryData(t, backend, name)
+	data["key"] = prefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, keyBytes, nil))
+	// legacy key formats predate entry ids and entry data schema versions
+	delete(data, "id")
+	delete(data, "schema")
+	writeTestEntryData(t, backend, name, data)
+}
+
+func checkTestEntryKey(t *testing.T, registry *certstore.Registry, name string, expected crypto.PrivateKey, user string) {
+	entry, err := registry.Entry(name)
+	require.NoError(t, err)
+	require.Equal(t, expected, entry.Key(user))
+}
+
+func readTestEntryData(t *testing.T, backend storage.Backend, name string) map[string]any {
+	dataBytes, err := backend.Get(name)
+	require.NoError(t, err)
+	data := make(map[string]any)
+	err = json.Unmarshal(dataBytes, &data)
+	require.NoError(t, err)
+	return data
+}
+
+func writeTestEntryData(t *testing.T, backend storage.Backend, name string, data map[string]any) {
+	dataBytes, err := json.Marshal(data)
+	require.NoError(t, err)
+	_, err = backend.Update(name, dataBytes)
+	require.NoError(t, err)
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrStoreLocked indicates that a store with a protected secret has been opened without unlock option
+// (see [WithPassphrase], [WithPassphraseEnv] and [WithKeyFile]).
+var ErrStoreLocked = errors.New("store secret is protected")
+
+// ErrUnlockFailed indicates that the submitted passphrase or key file does not match the store's protected secret.
+var ErrUnlockFailed = errors.New("failed to unlock store secret")
+
+const (
+	secretKDFArgon2id   = "argon2id"
+	secretKDFHKDFSHA256 = "hkdf-sha256"
+)
+
+// Argon2id parameters as recommended by RFC 9106 (second recommended option).
+const (
+	secretArgon2idTime    = 3
+	secretArgon2idMemory  = 64 * 1024
+	secretArgon2idThreads = 4
+)
+
+const secretSaltSize = 16
+const secretKeyFileInfo = "certstore secret"
+
+// storeSecretProtection holds the wrapped store secret as well as the parameters required
+// to derive the wrapping key.
+type storeSecretProtection struct {
+	KDF     string `json:"kdf"`
+	Salt    string `json:"salt"`
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+	Secret  string `json:"secret"`
+}
+
+// secretUnlock provides the key material used to protect (and unlock) the store secret.
+type secretUnlock struct {
+	kdf    string
+	source string
+	load   func() ([]byte, error)
+}
+
+// WithPassphrase protects the store secret with a key derived from the submitted passphrase (using Argon2id).
+//
+// The same passphrase is required to open the store again. If an existing unprotected store is opened
+// with this option, its secret is protected as part of opening the store. As the unprotected secret must be removed
+// from the store settings' history, this requires a backend implementing [storage.PrunableBackend].
+func WithPassphrase(passphrase string) StoreOption {
+	return func(options *storeOptions) {
+		options.unlock = &secretUnlock{
+			kdf:    secretKDFArgon2id,
+			source: "passphrase",
+			load: func() ([]byte, error) {
+				return []byte(passphrase), nil
+			},
+		}
+	}
+}
+
+// WithPassphraseEnv protects the store secret like [WithPassphrase] using the passphrase contained in the
+// submitted environment variable.
+func WithPassphraseEnv(name string) StoreOption {
+	return func(options *storeOptions) {
+		options.unlock = &secretUnlock{
+			kdf:    secretKDFArgon2id,
+			source: "environment variable '" + name + "'",
+			load: func() ([]byte, error) {
+				passphrase, found := os.LookupEnv(name)
+				if !found || passphrase == "" {
+					return nil, fmt.Errorf("passphrase environment variable '%s' not set", name)
+				}
+				return []byte(passphrase), nil
+			},
+		}
+	}
+}
+
+// WithKeyFile protects the store secret with a key derived from the content of the submitted key file (using HKDF-SHA256).
+//
+// The key file is expected to contain high-entropy key material (at least 32 bytes, e.g. as generated
+// by "openssl rand -out <key file> 32"). The same key file is required to open the store again.
+// If an existing unprotected store is opened with this option, its secret is protected as part of opening the store.
+func WithKeyFile(path string) StoreOption {
+	return func(options *storeOptions) {
+		options.unlock = &secretUnlock{
+			kdf:    secretKDFHKDFSHA256,
+			source: "key file '" + path + "'",
+			load: func() ([]byte, error) {
+				keyMaterial, err := os.ReadFile(path)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read key file '%s' (cause: %w)", path, err)
+				}
+				if len(keyMaterial) < 32 {
+					return nil, fmt.Errorf("insufficient key material in key file '%s'", path)
+				}
+				return keyMaterial, nil
+			},
+		}
+	}
+}
+
+func (unlock *secretUnlock) protect(secret string) (*storeSecretProtection, error) {
+	protection, err := unlock.newProtection()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := unlock.newGCM(protection)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce (cause: %w)", err)
+	}
+	protection.Secret = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil))
+	return protection, nil
+}
+
+// newProtection generates a random salt and sets up the key derivation parameters (without wrapped secret).
+func (unlock *secretUnlock) newProtection() (*storeSecretProtection, error) {
+	salt := make([]byte, secretSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate random salt (cause: %w)", err)
+	}
+	protection := &storeSecretProtection{
+		KDF:  unlock.kdf,
+		Salt: base64.StdEncoding.EncodeToString(salt),
+	}
+	if unlock.kdf == secretKDFArgon2id {
+		protection.Time = secretArgon2idTime
+		protection.Memory = secretArgon2idMemory
+		protection.Threads = secretArgon2idThreads
+	}
+	return protection, nil
+}
+
+func (unlock *secretUnlock) unprotect(protection *storeSecretProtection) (string, error) {
+	if unlock.kdf != protection.KDF {
+		return "", fmt.Errorf("%w (store secret not protected by %s)", ErrUnlockFailed, unlock.source)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(protection.Secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode protected store secret (cause: %w)", err)
+	}
+	gcm, err := unlock.newGCM(protection)
+	if err != nil {
+		return "", err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(wrapped) < nonceSize {
+		return "", fmt.Errorf("invalid protected store secret")
+	}
+	secret, err := gcm.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w (invalid %s)", ErrUnlockFailed, unlock.source)
+	}
+	return string(secret), nil
+}
+
+func (unlock *secretUnlock) newGCM(protection *storeSecretProtection) (cipher.AEAD, error) {
+	keyMaterial, err := unlock.load()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(protection.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode salt (cause: %w)", err)
+	}
+	var key []byte
+	switch protection.KDF {
+	case secretKDFArgon2id:
+		key = argon2.IDKey(keyMaterial, salt, protection.Time, protection.Memory, protection.Threads, 32)
+	case secretKDFHKDFSHA256:
+		key = make([]byte, 32)
+		_, err = io.ReadFull(hkdf.New(sha256.New, keyMaterial, salt, []byte(secretKeyFileInfo)), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key (cause: %w)", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", protection.KDF)
+	}
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher (cause: %w)", err)
+	}
+	gcm, err := cipher.NewGCM(aes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create block cipher (cause: %w)", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassphraseProtection(t *testing.T) {
+	name := "TestPassphraseProtection"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	createdName := createProtectedTestEntry(t, path, name, certstore.WithPassphrase("secret"))
+	checkProtectedStore(t, path)
+	checkProtectedTestEntry(t, path, createdName, certstore.WithPassphrase("secret"))
+	_, err = openProtectedTestStore(path, certstore.WithPassphrase("wrong"))
+	require.ErrorIs(t, err, certstore.ErrUnlockFailed)
+	t.Setenv(name, "secret")
+	checkProtectedTestEntry(t, path, createdName, certstore.WithPassphraseEnv(name))
+	_, err = openProtectedTestStore(path, certstore.WithPassphraseEnv(name+"Unset"))
+	require.Error(t, err)
+}
+
+func TestKeyFileProtection(t *testing.T) {
+	name := "TestKeyFileProtection"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	keyFile := filepath.Join(path, "key")
+	writeTestKeyFile(t, keyFile)
+	createdName := createProtectedTestEntry(t, path, name, certstore.WithKeyFile(keyFile))
+	checkProtectedStore(t, path)
+	checkProtectedTestEntry(t, path, createdName, certstore.WithKeyFile(keyFile))
+	_, err = openProtectedTestStore(path, certstore.WithPassphrase("secret"))
+	require.ErrorIs(t, err, certstore.ErrUnlockFailed)
+	writeTestKeyFile(t, keyFile)
+	_, err = openProtectedTestStore(path, certstore.WithKeyFile(keyFile))
+	require.ErrorIs(t, err, certstore.ErrUnlockFailed)
+	// binary key material is used as is (even if consisting of whitespace bytes)
+	binaryPath := filepath.Join(path, "binary")
+	binaryKeyFile := filepath.Join(path, "binary.key")
+	err = os.WriteFile(binaryKeyFile, []byte(strings.Repeat(" \t\r\n", 8)), 0600)
+	require.NoError(t, err)
+	binaryName := createProtectedTestEntry(t, binaryPath, name, certstore.WithKeyFile(binaryKeyFile))
+	checkProtectedTestEntry(t, binaryPath, binaryName, certstore.WithKeyFile(binaryKeyFile))
+	// insufficient key material
+	err = os.WriteFile(binaryKeyFile, make([]byte, 31), 0600)
+	require.NoError(t, err)
+	_, err = openProtectedTestStore(binaryPath, certstore.WithKeyFile(binaryKeyFile))
+	require.ErrorContains(t, err, "insufficient key material")
+}
+
+func TestProtectionMigration(t *testing.T) {
+	name := "TestProtectionMigration"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	createdName := createProtectedTestEntry(t, path, name)
+	checkProtectedTestEntry(t, path, createdName)
+	checkProtectedTestEntry(t, path, createdName, certstore.WithPassphrase("secret"))
+	checkProtectedStore(t, path)
+	checkProtectedTestEntry(t, path, createdName, certstore.WithPassphrase("secret"))
+}
+
+func TestProtectedStoreURI(t *testing.T) {
+	name := "TestProtectedStoreURI"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	writeTestKeyFile(t, filepath.Join(path, "key"))
+	_, err = certstore.NewStoreFromURI("fs://store?key_file=key", path)
+	require.NoError(t, err)
+	_, err = certstore.NewStoreFromURI("fs://store", path)
+	require.ErrorIs(t, err, certstore.ErrStoreLocked)
+	_, err = certstore.NewStoreFromURI("fs://store?key_file=key&passphrase_env="+name, path)
+	require.Error(t, err)
+}
+
+func createProtectedTestEntry(t *testing.T, path string, name string, options ...certstore.StoreOption) string {
+	registry, err := openProtectedTestStore(path, options...)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), name+"User")
+	require.NoError(t, err)
+	return createdName
+}
+
+func checkProtectedTestEntry(t *testing.T, path string, name string, options ...certstore.StoreOption) {
+	registry, err := openProtectedTestStore(path, options...)
+	require.NoError(t, err)
+	entry, err := registry.Entry(name)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(name+"User"))
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func checkProtectedStore(t *testing.T, path string) {
+	_, err := openProtectedTestStore(path)
+	require.ErrorIs(t, err, certstore.ErrStoreLocked)
+	settingsFiles, err := os.ReadDir(filepath.Join(path, ".store"))
+	require.NoError(t, err)
+	settingsVersions := slices.DeleteFunc(settingsFiles, func(file os.DirEntry) bool { return strings.HasSuffix(file.Name(), ".time") })
+	require.Len(t, settingsVersions, 1)
+	settings, err := os.ReadFile(filepath.Join(path, ".store", settingsVersions[0].Name()))
+	require.NoError(t, err)
+	decoded := make(map[string]any)
+	err = json.Unmarshal(settings, &decoded)
+	require.NoError(t, err)
+	require.NotContains(t, decoded, "secret")
+	require.Contains(t, decoded, "protection")
+}
+
+func openProtectedTestStore(path string, options ...certstore.StoreOption) (*certstore.Registry, error) {
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	if err != nil {
+		return nil, err
+	}
+	return certstore.NewStore(backend, testCacheTTL, options...)
+}
+
+func writeTestKeyFile(t *testing.T, path string) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	err = os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600)
+	require.NoError(t, err)
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+const maxSerialNumberAttempts = 16
+
+// serialIndexPrefix prefixes the names of the per-issuer serial number indexes. Like the store settings,
+// the indexes are not listed as store entries.
+const serialIndexPrefix = ".serial."
+
+type registrySerialNumberGenerator struct {
+	registry *Registry
+	counter  bool
+}
+
+// NewSerialNumberGenerator creates a [certs.SerialNumberGenerator] generating serial numbers which are unique
+// among the certificates issued by the same CA within this store.
+//
+// If counter is false, 128 bit random serial numbers are generated (see [certs.RandomSerialNumber]).
+// If counter is true, serial numbers are derived from a per-issuer counter.
+// Counter as well as the serial numbers already used by an issuer are tracked in a per-issuer serial number index,
+// which is kept separate from the issuer's store entry. The index is built from the certificates and revocations
+// known for the issuer on first use and is kept up to date whenever a certificate is issued or an entry is written.
+func (registry *Registry) NewSerialNumberGenerator(counter bool) certs.SerialNumberGenerator {
+	return &registrySerialNumberGenerator{
+		registry: registry,
+		counter:  counter,
+	}
+}
+
+func (generator *registrySerialNumberGenerator) Next(issuer *x509.Certificate) (*big.Int, error) {
+	if issuer == nil {
+		return certs.RandomSerialNumber()
+	}
+	var serialNumber *big.Int
+	build := func() (*serialIndex, error) {
+		return generator.registry.buildSerialIndex(issuer)
+	}
+	err := generator.registry.modifySerialIndex(issuerSerialIndexName(issuer), build, func(index *serialIndex) (bool, error) {
+		var err error
+		if generator.counter {
+			serialNumber, err = generator.nextCounter(index)
+		} else {
+			serialNumber, err = generator.nextRandom(index)
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serialNumber, nil
+}
+
+func (generator *registrySerialNumberGenerator) nextCounter(index *serialIndex) (*big.Int, error) {
+	serialNumber, err := index.getCounter()
+	if err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	serialNumber.Add(serialNumber, one)
+	for index.isUsed(serialNumber) {
+		serialNumber.Add(serialNumber, one)
+	}
+	index.setCounter(serialNumber)
+	index.use(serialNumber)
+	return serialNumber, nil
+}
+
+func (generator *registrySerialNumberGenerator) nextRandom(index *serialIndex) (*big.Int, error) {
+	for attempt := 0; attempt < maxSerialNumberAttempts; attempt++ {
+		serialNumber, err := certs.RandomSerialNumber()
+		if err != nil {
+			return nil, err
+		}
+		if !index.isUsed(serialNumber) {
+			index.use(serialNumber)
+			return serialNumber, nil
+		}
+		generator.registry.logger.Warn().Msgf("discarding duplicate serial number %s", serialNumber.Text(16))
+	}
+	return nil, fmt.Errorf("failed to generate unique serial number")
+}
+
+type serialIndex struct {
+	Counter string   `json:"counter,omitempty"`
+	Issued  []string `json:"issued"`
+}
+
+func (index *serialIndex) getCounter() (*big.Int, error) {
+	if index.Counter == "" {
+		return big.NewInt(0), nil
+	}
+	counter, ok := new(big.Int).SetString(index.Counter, 16)
+	if !ok {
+		return nil, fmt.Errorf("failed to decode serial number counter '%s'", index.Counter)
+	}
+	return counter, nil
+}
+
+func (index *serialIndex) setCounter(counter *big.Int) {
+	index.Counter = counter.Text(16)
+}
+
+func (index *serialIndex) isUsed(serialNumber *big.Int) bool {
+	_, found := slices.BinarySearch(index.Issued, serialNumber.Text(16))
+	return found
+}
+
+func (index *serialIndex) use(serialNumber *big.Int) bool {
+	encoded := serialNumber.Text(16)
+	position, found := slices.BinarySearch(index.Issued, encoded)
+	if found {
+		return false
+	}
+	index.Issued = slices.Insert(index.Issued, position, encoded)
+	return true
+}
+
+// serialIndexName gets the name of the serial number index for the issuer identified by the submitted subject
+// and key id. Using subject and key id (instead of the issuer's entry name) enables recording the serial number
+// of any issued certificate without having to look up its issuer.
+func serialIndexName(subject []byte, keyID []byte) string {
+	digest := sha256.New()
+	digest.Write(subject)
+	digest.Write(keyID)
+	return serialIndexPrefix + hex.EncodeToString(digest.Sum(nil))
+}
+
+func issuerSerialIndexName(issuer *x509.Certificate) string {
+	return serialIndexName(issuer.RawSubject, issuer.SubjectKeyId)
+}
+
+func issuedSerialIndexName(certificate *x509.Certificate) string {
+	return serialIndexName(certificate.RawIssuer, certificate.AuthorityKeyId)
+}
+
+// modifySerialIndex reads the latest version of the submitted serial number index, applies the submitted
+// modification and writes it back if modified. If the index does not yet exist, it is built by invoking build.
+// A nil build function skips the modification of a not yet existing index. Like [Registry.modifyEntryData],
+// concurrent updates are retried up to [entryUpdateRetryLimit] times.
+func (registry *Registry) modifySerialIndex(name string, build func() (*serialIndex, error), modify func(index *serialIndex) (bool, error)) error {
+	var err error
+	for attempt := 1; attempt <= entryUpdateRetryLimit; attempt++ {
+		var version storage.Version
+		var index *serialIndex
+		version, index, err = registry.getSerialIndex(name)
+		if errors.Is(err, storage.ErrNotExist) {
+			if build == nil {
+				return nil
+			}
+			index, err = build()
+		}
+		if err != nil {
+			return err
+		}
+		var modified bool
+		modified, err = modify(index)
+		if err != nil {
+			return err
+		}
+		if !modified && version != 0 {
+			return nil
+		}
+		err = registry.putSerialIndex(name, version, index)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, storage.ErrConflict) {
+			return err
+		}
+		registry.logger.Debug().Err(err).Msgf("retrying update of serial number index '%s' (attempt %d)...", name, attempt)
+	}
+	return fmt.Errorf("failed to update serial number index '%s' (cause: %w)", name, err)
+}
+
+func (registry *Registry) getSerialIndex(name string) (storage.Version, *serialIndex, error) {
+	versions, err := registry.backend.GetVersions(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(versions) == 0 {
+		return 0, nil, fmt.Errorf("%w (no version of serial number index '%s')", storage.ErrNotExist, name)
+	}
+	indexBytes, err := registry.backend.GetVersion(name, versions[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	index := &serialIndex{}
+	err = json.Unmarshal(indexBytes, index)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to unmarshal serial number index '%s' (cause: %w)", name, err)
+	}
+	slices.Sort(index.Issued)
+	return versions[0], index, nil
+}
+
+// putSerialIndex writes the submitted serial number index. A version of 0 creates the index, failing with
+// [storage.ErrConflict] if it has been created concurrently. As an index grows with every issued certificate,
+// previous versions are pruned if the backend supports it.
+func (registry *Registry) putSerialIndex(name string, version storage.Version, index *serialIndex) error {
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal serial number index '%s' (cause: %w)", name, err)
+	}
+	if version == 0 {
+		createdName, err := registry.backend.Create(name, indexBytes)
+		if err != nil {
+			return err
+		}
+		if createdName != name {
+			err = registry.backend.Delete(createdName)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w (serial number index '%s' created concurrently)", storage.ErrConflict, name)
+		}
+		return nil
+	}
+	_, err = storage.UpdateIf(registry.backend, name, indexBytes, version)
+	if err != nil {
+		return err
+	}
+	prunable, ok := registry.backend.(storage.PrunableBackend)
+	if ok {
+		err = prunable.Prune(name)
+		if err != nil {
+			registry.logger.Warn().Err(err).Msgf("failed to prune serial number index '%s'", name)
+		}
+	}
+	return nil
+}
+
+// buildSerialIndex builds the serial number index for the submitted issuer by scanning the store's entries.
+// A serial number counter persisted in the issuer's entry by a previous release is carried over.
+func (registry *Registry) buildSerialIndex(issuer *x509.Certificate) (*serialIndex, error) {
+	index := &serialIndex{Issued: make([]string, 0)}
+	entries, err := registry.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		entry, err := entries.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if !entry.HasCertificate() {
+			continue
+		}
+		certificate := entry.Certificate()
+		if bytes.Equal(certificate.Raw, issuer.Raw) {
+			for _, revocation := range entry.Revocations() {
+				index.use(revocation.SerialNumber)
+			}
+			_, data, err := registry.getLatestEntryData(entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			counter, err := data.getSerialNumber()
+			if err != nil {
+				return nil, err
+			}
+			if counter.Sign() > 0 {
+				index.setCounter(counter)
+			}
+		}
+		if !certs.IsRoot(certificate) && certs.IsIssuedBy(certificate, issuer) {
+			index.use(certificate.SerialNumber)
+		}
+	}
+	return index, nil
+}
+
+// recordSerialNumbers records the serial numbers of the submitted entry data in the affected serial number
+// indexes. This covers certificates as well as revocations not issued via a [Registry.NewSerialNumberGenerator]
+// generator. Indexes not yet built are left alone, as they will pick up the entry while being built.
+func (registry *Registry) recordSerialNumbers(data *registryEntryData) error {
+	certificate, err := data.getCertificate()
+	if err != nil || certificate == nil {
+		return err
+	}
+	if !certs.IsRoot(certificate) {
+		err = registry.modifySerialIndex(issuedSerialIndexName(certificate), nil, func(index *serialIndex) (bool, error) {
+			return index.use(certificate.SerialNumber), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(data.Revocations) == 0 {
+		return nil
+	}
+	revocations, err := data.getRevocations()
+	if err != nil {
+		return err
+	}
+	return registry.modifySerialIndex(issuerSerialIndexName(certificate), nil, func(index *serialIndex) (bool, error) {
+		modified := false
+		for _, revocation := range revocations {
+			if index.use(revocation.SerialNumber) {
+				modified = true
+			}
+		}
+		return modified, nil
+	})
+}
@@ -0,0 +1,451 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// An AuditSink receives the events recorded in a store's audit log.
+//
+// The store's own audit log is always written first. Additional sinks are configured via [WithAuditSinks]
+// and receive the events afterwards (including the chaining information set by the store's audit log).
+// Only failures of the store's own audit log are handled according to the store's [AuditFailurePolicy].
+// Additional sinks are written asynchronously from a background goroutine per sink; hence slow or unreachable
+// sinks do not delay the audited operation. Events failing to be written are buffered and retried as soon as the
+// next event is submitted. Such failures are logged, but never fail the audited operation. If a sink's buffer
+// exceeds [AuditRetryBufferLimit], the oldest buffered event is dropped. Buffered events are flushed on [Registry.Close].
+type AuditSink interface {
+	// Name gets the name of this sink.
+	Name() string
+	// Write writes the submitted event to this sink.
+	Write(event *AuditEvent) error
+	// Close releases any resources held by this sink.
+	Close() error
+}
+
+// AuditFailurePolicy defines how a store reacts in case an audit event cannot be written to the store's own audit log.
+type AuditFailurePolicy int
+
+const (
+	// AuditFailureExit logs the failure and terminates the process (default).
+	AuditFailureExit AuditFailurePolicy = iota
+	// AuditFailureError fails the audited operation with an error wrapping [ErrAuditFailed]. If the operation
+	// has already been applied when the failure occurs, the operation's result is returned along with the error.
+	// Hence the operation must not be retried in this case.
+	AuditFailureError
+	// AuditFailureRetry buffers the failed event and retries writing it prior to writing the next event.
+	// The audited operation only fails if the buffer limit (see [AuditRetryBufferLimit]) is exceeded.
+	AuditFailureRetry
+)
+
+func (policy AuditFailurePolicy) String() string {
+	switch policy {
+	case AuditFailureExit:
+		return "exit"
+	case AuditFailureError:
+		return "error"
+	case AuditFailureRetry:
+		return "retry"
+	}
+	return fmt.Sprintf("AuditFailurePolicy(%d)", int(policy))
+}
+
+// AuditRetryBufferLimit is the maximum number of events buffered per sink in case of [AuditFailureRetry]
+// as well as for additional sinks.
+const AuditRetryBufferLimit = 1000
+
+// ErrAuditBufferOverflow indicates that an audit sink has been failing for too long to buffer further events.
+var ErrAuditBufferOverflow = errors.New("audit buffer overflow")
+
+// ErrAuditFailed indicates that an operation could not be recorded in the store's audit log.
+var ErrAuditFailed = errors.New("audit failed")
+
+type fanOutAuditSink struct {
+	sinks []AuditSink
+}
+
+// NewFanOutAuditSink creates an [AuditSink] forwarding each event to all of the submitted sinks.
+//
+// Sinks are written in the submitted order. A failing sink does not prevent the remaining sinks
+// from being written. The errors of all failing sinks are combined in the returned error.
+func NewFanOutAuditSink(sinks ...AuditSink) AuditSink {
+	return &fanOutAuditSink{sinks: sinks}
+}
+
+func (sink *fanOutAuditSink) Name() string {
+	return "fan-out"
+}
+
+func (sink *fanOutAuditSink) Write(event *AuditEvent) error {
+	var errs []error
+	for _, target := range sink.sinks {
+		err := target.Write(event)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to write audit sink '%s' (cause: %w)", target.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (sink *fanOutAuditSink) Close() error {
+	var errs []error
+	for _, target := range sink.sinks {
+		err := target.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to close audit sink '%s' (cause: %w)", target.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// retryAuditSink buffers failed events and retries them prior to writing the next event. If the buffer limit
+// is exceeded, either the current event is rejected or (if dropOldest is set) the oldest buffered event is dropped.
+// In both cases [ErrAuditBufferOverflow] is returned.
+//
+// An asynchronous retryAuditSink (see newAsyncRetryAuditSink) only buffers the submitted events and delivers
+// them from a background goroutine.
+type retryAuditSink struct {
+	sink       AuditSink
+	limit      int
+	dropOldest bool
+	logger     *zerolog.Logger
+	mutex      sync.Mutex
+	buffer     []*AuditEvent
+	closed     bool
+	pending    chan struct{}
+	stopped    chan struct{}
+}
+
+func newRetryAuditSink(sink AuditSink, limit int, dropOldest bool) *retryAuditSink {
+	return &retryAuditSink{sink: sink, limit: limit, dropOldest: dropOldest}
+}
+
+// newAsyncRetryAuditSink creates a retryAuditSink delivering the submitted events from a background goroutine.
+// This way slow or unreachable sinks do not delay the audited operation. Delivery failures are logged and the
+// failed events are retried as soon as the next event is submitted. On overflow the oldest buffered event is dropped.
+func newAsyncRetryAuditSink(sink AuditSink, limit int, logger *zerolog.Logger) *retryAuditSink {
+	retrySink := &retryAuditSink{
+		sink:       sink,
+		limit:      limit,
+		dropOldest: true,
+		logger:     logger,
+		pending:    make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+	go retrySink.run()
+	return retrySink
+}
+
+func (sink *retryAuditSink) Name() string {
+	return sink.sink.Name()
+}
+
+func (sink *retryAuditSink) Write(event *AuditEvent) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.pending != nil {
+		overflow := sink.bufferEvent(event, nil)
+		if !sink.closed {
+			select {
+			case sink.pending <- struct{}{}:
+			default:
+			}
+		}
+		return overflow
+	}
+	var err error
+	for len(sink.buffer) > 0 && err == nil {
+		err = sink.sink.Write(sink.buffer[0])
+		if err == nil {
+			sink.buffer[0] = nil
+			sink.buffer = sink.buffer[1:]
+		}
+	}
+	if err == nil {
+		err = sink.sink.Write(event)
+		if err == nil {
+			return nil
+		}
+	}
+	if len(sink.buffer) >= sink.limit && !sink.dropOldest {
+		return fmt.Errorf("%w (cause: %w)", ErrAuditBufferOverflow, err)
+	}
+	return sink.bufferEvent(event, err)
+}
+
+func (sink *retryAuditSink) bufferEvent(event *AuditEvent, cause error) error {
+	var overflow error
+	if len(sink.buffer) >= sink.limit {
+		if cause != nil {
+			overflow = fmt.Errorf("%w (dropped event '%s'; cause: %w)", ErrAuditBufferOverflow, sink.buffer[0], cause)
+		} else {
+			overflow = fmt.Errorf("%w (dropped event '%s')", ErrAuditBufferOverflow, sink.buffer[0])
+		}
+		sink.buffer[0] = nil
+		sink.buffer = sink.buffer[1:]
+	}
+	buffered := *event
+	sink.buffer = append(sink.buffer, &buffered)
+	return overflow
+}
+
+func (sink *retryAuditSink) run() {
+	defer close(sink.stopped)
+	for range sink.pending {
+		err := sink.deliver()
+		if err != nil {
+			sink.logger.Error().Err(err).Msgf("failed to forward audit log to '%s'", sink.sink.Name())
+		}
+	}
+}
+
+// deliver writes the buffered events until the buffer is empty or the first write fails. The mutex is only held
+// while accessing the buffer, so events may be submitted (or dropped) while an event is being delivered.
+func (sink *retryAuditSink) deliver() error {
+	for {
+		sink.mutex.Lock()
+		if len(sink.buffer) == 0 {
+			sink.mutex.Unlock()
+			return nil
+		}
+		event := sink.buffer[0]
+		sink.mutex.Unlock()
+		err := sink.sink.Write(event)
+		if err != nil {
+			return err
+		}
+		sink.mutex.Lock()
+		if len(sink.buffer) > 0 && sink.buffer[0] == event {
+			sink.buffer[0] = nil
+			sink.buffer = sink.buffer[1:]
+		}
+		sink.mutex.Unlock()
+	}
+}
+
+// Close stops the background goroutine of an asynchronous sink (making a final attempt to deliver the
+// buffered events) and closes the wrapped sink.
+func (sink *retryAuditSink) Close() error {
+	if sink.pending != nil {
+		sink.mutex.Lock()
+		closed := sink.closed
+		if !closed {
+			sink.closed = true
+			close(sink.pending)
+		}
+		sink.mutex.Unlock()
+		if closed {
+			return nil
+		}
+		<-sink.stopped
+		err := sink.deliver()
+		if err != nil {
+			sink.logger.Error().Err(err).Msgf("failed to forward audit log to '%s'", sink.sink.Name())
+		}
+	}
+	return sink.sink.Close()
+}
+
+const syslogAuditSinkPriority = 10<<3 | 5 // facility authpriv, severity notice
+
+var syslogAuditSinkSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+type syslogAuditSink struct {
+	network  string
+	address  string
+	hostname string
+	mutex    sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogAuditSink creates an [AuditSink] sending events in RFC 5424 format to the local syslog daemon.
+//
+// The submitted address is the path of the syslog socket. If address is empty, the well-known socket
+// locations are probed. The connection is established lazily and re-established on write failures.
+func NewSyslogAuditSink(address string) AuditSink {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &syslogAuditSink{address: address, hostname: hostname}
+}
+
+func (sink *syslogAuditSink) Name() string {
+	if sink.address == "" {
+		return "syslog"
+	}
+	return "syslog:" + sink.address
+}
+
+func (sink *syslogAuditSink) Write(event *AuditEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event (cause: %w)", err)
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	record := fmt.Sprintf("<%d>1 %s %s certstore %d %s - %s", syslogAuditSinkPriority, event.Time.UTC().Format(time.RFC3339Nano), sink.hostname, os.Getpid(), event.Operation, message)
+	if sink.conn != nil {
+		err = sink.writeRecord(record)
+		if err == nil {
+			return nil
+		}
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	err = sink.connect()
+	if err != nil {
+		return err
+	}
+	return sink.writeRecord(record)
+}
+
+func (sink *syslogAuditSink) writeRecord(record string) error {
+	if sink.network == "unix" {
+		// stream sockets require framing (see RFC 6587)
+		record = record + "\n"
+	}
+	_, err := sink.conn.Write([]byte(record))
+	return err
+}
+
+func (sink *syslogAuditSink) connect() error {
+	addresses := syslogAuditSinkSockets
+	if sink.address != "" {
+		addresses = []string{sink.address}
+	}
+	for _, address := range addresses {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				sink.network = network
+				sink.conn = conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("failed to connect to syslog socket %v", addresses)
+}
+
+func (sink *syslogAuditSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
+
+type fileAuditSink struct {
+	logger *lumberjack.Logger
+}
+
+// NewFileAuditSink creates an [AuditSink] writing events as JSON lines to a rotating file.
+//
+// The file is rotated as soon as it exceeds maxSize megabytes. Up to maxBackups rotated files are retained
+// (0 retains all rotated files).
+func NewFileAuditSink(path string, maxSize int, maxBackups int) AuditSink {
+	return &fileAuditSink{
+		logger: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+		},
+	}
+}
+
+func (sink *fileAuditSink) Name() string {
+	return "file:" + sink.logger.Filename
+}
+
+func (sink *fileAuditSink) Write(event *AuditEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event (cause: %w)", err)
+	}
+	_, err = sink.logger.Write(append(message, '\n'))
+	return err
+}
+
+func (sink *fileAuditSink) Close() error {
+	return sink.logger.Close()
+}
+
+const webhookAuditSinkTimeout = 10 * time.Second
+
+type webhookAuditSink struct {
+	url    string
+	name   string
+	client *http.Client
+}
+
+// NewWebhookAuditSink creates an [AuditSink] posting each event as JSON document to the submitted URL.
+//
+// Any response status other than 2xx is considered a failure. If client is nil, a default client
+// with a timeout of 10s is used. As the URL may carry credentials, the sink's name as well as its errors
+// only report the URL without user info and query.
+func NewWebhookAuditSink(webhookURL string, client *http.Client) AuditSink {
+	if client == nil {
+		client = &http.Client{Timeout: webhookAuditSinkTimeout}
+	}
+	return &webhookAuditSink{url: webhookURL, name: redactWebhookURL(webhookURL), client: client}
+}
+
+func redactWebhookURL(webhookURL string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return "webhook"
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.ForceQuery = false
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	return parsed.String()
+}
+
+func (sink *webhookAuditSink) Name() string {
+	return sink.name
+}
+
+func (sink *webhookAuditSink) Write(event *AuditEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event (cause: %w)", err)
+	}
+	rsp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(message))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = sink.name
+		}
+		return fmt.Errorf("failed to post audit event to '%s' (cause: %w)", sink.name, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("failed to post audit event to '%s' (status: %s)", sink.name, rsp.Status)
+	}
+	return nil
+}
+
+func (sink *webhookAuditSink) Close() error {
+	return nil
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	name := "TestFileAuditSink"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	sinkPath := filepath.Join(path, "audit.log")
+	sink := certstore.NewFileAuditSink(sinkPath, 1, 1)
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0, certstore.WithAuditSinks(sink))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	err = registry.Close()
+	require.NoError(t, err)
+	file, err := os.Open(sinkPath)
+	require.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	require.True(t, scanner.Scan())
+	event := &certstore.AuditEvent{}
+	err = json.Unmarshal(scanner.Bytes(), event)
+	require.NoError(t, err)
+	require.Equal(t, certstore.AuditOperationCreate, event.Operation)
+	require.Equal(t, createdName, event.Name)
+	require.Equal(t, uint64(1), event.Sequence)
+	require.NotEmpty(t, event.MAC)
+	require.False(t, scanner.Scan())
+}
+
+func TestSyslogAuditSink(t *testing.T) {
+	name := "TestSyslogAuditSink"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	socketPath := filepath.Join(path, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	sink := certstore.NewSyslogAuditSink(socketPath)
+	defer sink.Close()
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0, certstore.WithAuditSinks(sink))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	record := string(buffer[:n])
+	require.True(t, strings.HasPrefix(record, "<85>1 "), record)
+	fields := strings.SplitN(record, " ", 8)
+	require.Len(t, fields, 8)
+	require.Equal(t, "certstore", fields[3])
+	require.Equal(t, string(certstore.AuditOperationCreate), fields[5])
+	require.Equal(t, "-", fields[6])
+	event := &certstore.AuditEvent{}
+	err = json.Unmarshal([]byte(fields[7]), event)
+	require.NoError(t, err)
+	require.Equal(t, createdName, event.Name)
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	name := "TestWebhookAuditSink"
+	user := name + "User"
+	var mutex sync.Mutex
+	events := make([]*certstore.AuditEvent, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &certstore.AuditEvent{}
+		err := json.NewDecoder(r.Body).Decode(event)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	}))
+	defer server.Close()
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0, certstore.WithAuditSinks(certstore.NewWebhookAuditSink(server.URL, nil)))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	err = registry.Delete(createdName, user)
+	require.NoError(t, err)
+	// events are delivered asynchronously and flushed on close
+	err = registry.Close()
+	require.NoError(t, err)
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, events, 2)
+	require.Equal(t, certstore.AuditOperationDelete, events[1].Operation)
+	// failing webhook
+	sink := certstore.NewWebhookAuditSink(server.URL+"/missing", &http.Client{Transport: failingTransport{}})
+	err = sink.Write(events[0])
+	require.Error(t, err)
+	// credentials are not reported
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	serverURL.User = url.UserPassword("user", "secret")
+	serverURL.Path = "/missing"
+	serverURL.RawQuery = "token=secret"
+	sink = certstore.NewWebhookAuditSink(serverURL.String(), &http.Client{Transport: failingTransport{}})
+	require.Equal(t, server.URL+"/missing", sink.Name())
+	err = sink.Write(events[0])
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func TestSlowWebhookAuditSink(t *testing.T) {
+	name := "TestSlowWebhookAuditSink"
+	user := name + "User"
+	release := make(chan struct{})
+	var received sync.WaitGroup
+	received.Add(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received.Done()
+	}))
+	defer server.Close()
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0, certstore.WithAuditSinks(certstore.NewWebhookAuditSink(server.URL, nil)))
+	require.NoError(t, err)
+	// the operation completes although the webhook is still blocked
+	_, err = registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	close(release)
+	received.Wait()
+	err = registry.Close()
+	require.NoError(t, err)
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("failing transport")
+}
+
+func TestAuditFailureError(t *testing.T) {
+	name := "TestAuditFailureError"
+	user := name + "User"
+	backend := &failingLogBackend{testBackend: storage.NewMemoryStorage(testVersionLimit).(testBackend), fail: true}
+	registry, err := certstore.NewStore(backend, 0, certstore.WithAuditFailurePolicy(certstore.AuditFailureError))
+	require.NoError(t, err)
+	// the operation has been applied and its result is returned along with the error
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.ErrorIs(t, err, certstore.ErrAuditFailed)
+	require.Equal(t, name, createdName)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	require.True(t, entry.HasKey())
+	key, err := entry.AccessKey(user)
+	require.ErrorIs(t, err, certstore.ErrAuditFailed)
+	require.Nil(t, key)
+	require.Nil(t, entry.Key(user))
+	backend.fail = false
+	key, err = entry.AccessKey(user)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	events := readAuditEvents(t, registry, nil)
+	require.Len(t, events, 1)
+	require.Equal(t, certstore.AuditOperationAccess, events[0].Operation)
+}
+
+func TestAuditFailureRetry(t *testing.T) {
+	name := "TestAuditFailureRetry"
+	user := name + "User"
+	backend := &failingLogBackend{testBackend: storage.NewMemoryStorage(testVersionLimit).(testBackend), fail: true}
+	registry, err := certstore.NewStore(backend, 0, certstore.WithAuditFailurePolicy(certstore.AuditFailureRetry))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	for range certstore.AuditRetryBufferLimit - 1 {
+		require.NotNil(t, entry.Key(user))
+	}
+	// buffer exhausted
+	_, err = entry.AccessKey(user)
+	require.ErrorIs(t, err, certstore.ErrAuditFailed)
+	require.ErrorIs(t, err, certstore.ErrAuditBufferOverflow)
+	// buffered events are flushed on recovery
+	backend.fail = false
+	require.NotNil(t, entry.Key(user))
+	events := readAuditEvents(t, registry, nil)
+	require.Len(t, events, certstore.AuditRetryBufferLimit+1)
+	require.Equal(t, certstore.AuditOperationCreate, events[0].Operation)
+	require.Equal(t, uint64(1), events[0].Sequence)
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+}
+
+func TestAuditSinkFailure(t *testing.T) {
+	name := "TestAuditSinkFailure"
+	user := name + "User"
+	sink := &testAuditSink{failing: true}
+	// failing sinks neither fail the audited operation nor terminate the process (default policy)
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0, certstore.WithAuditSinks(sink))
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	key, err := entry.AccessKey(user)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	require.Empty(t, sink.written())
+	// buffered events are delivered on recovery
+	sink.setFailing(false)
+	require.NotNil(t, entry.Key(user))
+	require.Eventually(t, func() bool { return len(sink.written()) == 3 }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, certstore.AuditOperationCreate, sink.written()[0].Operation)
+	// exhausted buffer drops the oldest events
+	sink.setFailing(true)
+	for range certstore.AuditRetryBufferLimit + 1 {
+		require.NotNil(t, entry.Key(user))
+	}
+	sink.setFailing(false)
+	require.NotNil(t, entry.Key(user))
+	lastSequence := uint64(certstore.AuditRetryBufferLimit + 5)
+	require.Eventually(t, func() bool {
+		events := sink.written()
+		return len(events) > 0 && events[len(events)-1].Sequence == lastSequence
+	}, 10*time.Second, 10*time.Millisecond)
+	// depending on the delivery in progress while recovering, one more event may have been dropped
+	events := sink.written()
+	require.GreaterOrEqual(t, len(events), certstore.AuditRetryBufferLimit)
+	require.LessOrEqual(t, len(events), certstore.AuditRetryBufferLimit+1)
+	require.GreaterOrEqual(t, events[len(events)-certstore.AuditRetryBufferLimit].Sequence, uint64(5))
+}
+
+// failingLogBackend simulates a failing store audit log.
+type failingLogBackend struct {
+	testBackend
+	fail bool
+}
+
+func (backend *failingLogBackend) Log(name string, message string) error {
+	if backend.fail {
+		return errors.New("log failure")
+	}
+	return backend.testBackend.Log(name, message)
+}
+
+func (backend *failingLogBackend) AppendLog(name string, appendFunc storage.LogAppendFunc) error {
+	if backend.fail {
+		return errors.New("log failure")
+	}
+	return backend.testBackend.AppendLog(name, appendFunc)
+}
+
+type testAuditSink struct {
+	mutex   sync.Mutex
+	failing bool
+	events  []*certstore.AuditEvent
+}
+
+// setFailing switches the sink's failure mode and discards the events written so far (atomically with respect
+// to the sink's asynchronous writer).
+func (sink *testAuditSink) setFailing(failing bool) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.failing = failing
+	sink.events = nil
+}
+
+func (sink *testAuditSink) written() []*certstore.AuditEvent {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return append([]*certstore.AuditEvent(nil), sink.events...)
+}
+
+func (sink *testAuditSink) Name() string {
+	return "test"
+}
+
+func (sink *testAuditSink) Write(event *certstore.AuditEvent) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.failing {
+		return errors.New("audit sink failure")
+	}
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *testAuditSink) Close() error {
+	return nil
+}
@@ -6,12 +6,16 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hdecarne-github/go-log"
 	"github.com/rs/zerolog"
@@ -19,6 +23,12 @@ import (
 
 const fsBackendURIPattern = "fs://%s"
 
+const fsBackendHistoryDir = ".history"
+const fsBackendDeletedFile = "deleted"
+const fsBackendLogFile = "log"
+const fsBackendTempSuffix = ".tmp"
+const fsBackendTimeSuffix = ".time"
+
 const fsBackendDirPerm = 0700
 const fsBackendFilePerm = 0600
 
@@ -34,6 +44,11 @@ func (backend *fsBackend) URI() string {
 }
 
 func (backend *fsBackend) Create(name string, data []byte) (string, error) {
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return "", err
+	}
+	defer lock.release()
 	backend.logger.Debug().Msgf("creating entry '%s*'...", name)
 	nextName := name
 	nextSuffix := 1
@@ -51,10 +66,9 @@ func (backend *fsBackend) Create(name string, data []byte) (string, error) {
 			nextName = fmt.Sprintf("%s (%d)", name, nextSuffix)
 			continue
 		}
-		versionFile := backend.resolveEntryVersionFile(entryPath, 1)
-		err = os.WriteFile(versionFile, data, fsBackendFilePerm)
+		err = backend.writeEntryVersion(entryPath, 1, data, time.Now())
 		if err != nil {
-			return nextName, fmt.Errorf("failed to write entry version '%s' (cause: %w)", versionFile, err)
+			return nextName, err
 		}
 		backend.logger.Debug().Msgf("created entry '%s'", nextName)
 		return nextName, nil
@@ -62,7 +76,15 @@ func (backend *fsBackend) Create(name string, data []byte) (string, error) {
 }
 
 func (backend *fsBackend) Update(name string, data []byte) (Version, error) {
-	lock, err := backend.lock(syscall.LOCK_EX)
+	return backend.update(name, data, nil)
+}
+
+func (backend *fsBackend) UpdateIf(name string, data []byte, expected Version) (Version, error) {
+	return backend.update(name, data, &expected)
+}
+
+func (backend *fsBackend) update(name string, data []byte, expected *Version) (Version, error) {
+	lock, err := backend.lockExclusive()
 	if err != nil {
 		return 0, err
 	}
@@ -76,30 +98,25 @@ func (backend *fsBackend) Update(name string, data []byte) (Version, error) {
 	if err != nil {
 		return 0, err
 	}
-	versionCount := len(versions)
+	if expected != nil && versions[0] != *expected {
+		return 0, &ConflictError{Name: name, Expected: *expected, Current: versions[0]}
+	}
+	// write the new version first, to not lose any data in case of failure
 	nextVersion := versions[0] + 1
-	for {
-		if VersionLimit(versionCount) < backend.versionLimit {
-			break
-		}
-		removeFile := backend.resolveEntryVersionFile(entryPath, versions[versionCount-1])
-		err = os.Remove(removeFile)
-		if err != nil {
-			return 0, fmt.Errorf("failed to remove entry version '%s' (cause: %w)", removeFile, err)
-		}
-		versionCount--
+	err = backend.writeEntryVersion(entryPath, nextVersion, data, time.Now())
+	if err != nil {
+		return 0, err
 	}
-	nextVersionFile := backend.resolveEntryVersionFile(entryPath, nextVersion)
-	err = os.WriteFile(nextVersionFile, data, fsBackendFilePerm)
+	err = backend.pruneEntryVersions(entryPath, append([]Version{nextVersion}, versions...))
 	if err != nil {
-		return 0, fmt.Errorf("failed to write entry version '%s' (cause: %w)", nextVersionFile, err)
+		return 0, err
 	}
 	backend.logger.Debug().Msgf("updated entry '%s' to version %d", name, nextVersion)
 	return nextVersion, nil
 }
 
 func (backend *fsBackend) Delete(name string) error {
-	lock, err := backend.lock(syscall.LOCK_EX)
+	lock, err := backend.lockExclusive()
 	if err != nil {
 		return err
 	}
@@ -109,16 +126,113 @@ func (backend *fsBackend) Delete(name string) error {
 	if err != nil {
 		return err
 	}
-	err = os.RemoveAll(entryPath)
+	err = backend.deleteEntry(name, entryPath, time.Now())
 	if err != nil {
-		return fmt.Errorf("failed to delete entry '%s' (cause: %w)", name, err)
+		return err
 	}
 	backend.logger.Debug().Msgf("entry '%s' deleted", name)
 	return nil
 }
 
+func (backend *fsBackend) deleteEntry(name string, entryPath string, deleted time.Time) error {
+	historyPath := filepath.Join(backend.path, fsBackendHistoryDir)
+	err := os.MkdirAll(historyPath, fsBackendDirPerm)
+	if err != nil {
+		return fmt.Errorf("failed to create history path '%s' (cause: %w)", historyPath, err)
+	}
+	entryHistoryPath := filepath.Join(historyPath, name)
+	err = os.RemoveAll(entryHistoryPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove previous history of entry '%s' (cause: %w)", name, err)
+	}
+	err = os.Rename(entryPath, entryHistoryPath)
+	if err != nil {
+		return fmt.Errorf("failed to delete entry '%s' (cause: %w)", name, err)
+	}
+	return backend.writeTimeFile(filepath.Join(entryHistoryPath, fsBackendDeletedFile), deleted)
+}
+
+func (backend *fsBackend) Prune(name string) error {
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	backend.logger.Debug().Msgf("pruning entry '%s'...", name)
+	entryPath, err := backend.checkEntryPath(name, false)
+	if err != nil {
+		return err
+	}
+	versions, err := backend.readEntryVersions(entryPath, false)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions[1:] {
+		err = backend.removeEntryVersion(entryPath, version)
+		if err != nil {
+			return err
+		}
+	}
+	backend.logger.Debug().Msgf("entry '%s' pruned to version %d", name, versions[0])
+	return nil
+}
+
+func (backend *fsBackend) Rewrite(name string, rewrite RewriteFunc) error {
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	backend.logger.Debug().Msgf("rewriting entry '%s'...", name)
+	found := false
+	for _, entryPath := range []string{filepath.Join(backend.path, name), filepath.Join(backend.path, fsBackendHistoryDir, name)} {
+		pathInfo, err := os.Stat(entryPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to stat entry path '%s' (cause: %w)", entryPath, err)
+		} else if !pathInfo.IsDir() {
+			return fmt.Errorf("entry path '%s' is not a directory", entryPath)
+		}
+		found = true
+		versions, err := backend.readEntryVersions(entryPath, true)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			err = backend.rewriteEntryVersion(entryPath, version, rewrite)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return ErrNotExist
+	}
+	backend.logger.Debug().Msgf("entry '%s' rewritten", name)
+	return nil
+}
+
+func (backend *fsBackend) rewriteEntryVersion(entryPath string, version Version, rewrite RewriteFunc) error {
+	versionFile := backend.resolveEntryVersionFile(entryPath, version)
+	data, err := os.ReadFile(versionFile)
+	if err != nil {
+		return fmt.Errorf("failed to read entry version '%s' (cause: %w)", versionFile, err)
+	}
+	rewritten, err := rewrite(version, data)
+	if err != nil || rewritten == nil {
+		return err
+	}
+	// preserve the version time (versions written by previous versions only record it as the file's modification time)
+	versionTime, err := backend.readEntryVersionTime(entryPath, version)
+	if err != nil {
+		return err
+	}
+	return backend.writeEntryVersion(entryPath, version, rewritten, versionTime)
+}
+
 func (backend *fsBackend) List() (Names, error) {
-	lock, err := backend.lock(syscall.LOCK_SH)
+	lock, err := backend.lockShared()
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +243,7 @@ func (backend *fsBackend) List() (Names, error) {
 	}
 	names := make([]string, 0, len(dirEntries))
 	for _, dirEntry := range dirEntries {
-		if !dirEntry.IsDir() {
+		if !dirEntry.IsDir() || dirEntry.Name() == fsBackendHistoryDir {
 			continue
 		}
 		names = append(names, dirEntry.Name())
@@ -151,8 +265,81 @@ func (names *fsBackendNames) Next() string {
 	return name
 }
 
+func (backend *fsBackend) Snapshot() (map[string]Version, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	dirEntries, err := os.ReadDir(backend.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage path '%s' (cause: %w)", backend.path, err)
+	}
+	snapshot := make(map[string]Version, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || dirEntry.Name() == fsBackendHistoryDir {
+			continue
+		}
+		versions, err := backend.readEntryVersions(filepath.Join(backend.path, dirEntry.Name()), true)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) != 0 {
+			snapshot[dirEntry.Name()] = versions[0]
+		}
+	}
+	return snapshot, nil
+}
+
+func (backend *fsBackend) Orphans() ([]string, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	// temporary files are only present while holding the exclusive lock
+	orphans := make([]string, 0)
+	err = filepath.WalkDir(backend.path, func(path string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dirEntry.Type().IsRegular() && strings.HasSuffix(path, fsBackendTempSuffix) {
+			orphan, err := filepath.Rel(backend.path, path)
+			if err != nil {
+				return err
+			}
+			orphans = append(orphans, orphan)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan storage path '%s' (cause: %w)", backend.path, err)
+	}
+	return orphans, nil
+}
+
+func (backend *fsBackend) RemoveOrphan(orphan string) error {
+	if !filepath.IsLocal(orphan) || !strings.HasSuffix(orphan, fsBackendTempSuffix) {
+		return fmt.Errorf("invalid orphan '%s'", orphan)
+	}
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	orphanPath := filepath.Join(backend.path, orphan)
+	err = os.Remove(orphanPath)
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	} else if err != nil {
+		return fmt.Errorf("failed to remove orphan '%s' (cause: %w)", orphanPath, err)
+	}
+	backend.logger.Info().Msgf("removed orphan '%s'", orphanPath)
+	return nil
+}
+
 func (backend *fsBackend) Get(name string) ([]byte, error) {
-	lock, err := backend.lock(syscall.LOCK_SH)
+	lock, err := backend.lockShared()
 	if err != nil {
 		return nil, err
 	}
@@ -174,7 +361,7 @@ func (backend *fsBackend) Get(name string) ([]byte, error) {
 }
 
 func (backend *fsBackend) GetVersions(name string) ([]Version, error) {
-	lock, err := backend.lock(syscall.LOCK_SH)
+	lock, err := backend.lockShared()
 	if err != nil {
 		return nil, err
 	}
@@ -191,7 +378,7 @@ func (backend *fsBackend) GetVersions(name string) ([]Version, error) {
 }
 
 func (backend *fsBackend) GetVersion(name string, version Version) ([]byte, error) {
-	lock, err := backend.lock(syscall.LOCK_SH)
+	lock, err := backend.lockShared()
 	if err != nil {
 		return nil, err
 	}
@@ -210,29 +397,252 @@ func (backend *fsBackend) GetVersion(name string, version Version) ([]byte, erro
 	return data, nil
 }
 
+func (backend *fsBackend) ListHistory() (Names, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	names := make([]string, 0)
+	for _, path := range []string{backend.path, filepath.Join(backend.path, fsBackendHistoryDir)} {
+		dirEntries, err := os.ReadDir(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read storage path '%s' (cause: %w)", path, err)
+		}
+		for _, dirEntry := range dirEntries {
+			if !dirEntry.IsDir() || dirEntry.Name() == fsBackendHistoryDir || slices.Contains(names, dirEntry.Name()) {
+				continue
+			}
+			names = append(names, dirEntry.Name())
+		}
+	}
+	return &fsBackendNames{names: names}, nil
+}
+
+func (backend *fsBackend) GetHistory(name string) (*History, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	entryPath, deleted, err := backend.checkHistoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := backend.readEntryVersions(entryPath, false)
+	if err != nil {
+		return nil, err
+	}
+	history := &History{
+		Versions: make([]VersionInfo, 0, len(versions)),
+	}
+	for _, version := range versions {
+		versionTime, err := backend.readEntryVersionTime(entryPath, version)
+		if err != nil {
+			return nil, err
+		}
+		history.Versions = append(history.Versions, VersionInfo{Version: version, Time: versionTime})
+	}
+	if deleted {
+		history.Deleted, err = backend.readTimeFile(filepath.Join(entryPath, fsBackendDeletedFile), "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+func (backend *fsBackend) GetHistoryVersion(name string, version Version) ([]byte, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	entryPath, _, err := backend.checkHistoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	versionFile := backend.resolveEntryVersionFile(entryPath, version)
+	data, err := os.ReadFile(versionFile)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read entry version '%s' (cause: %w)", versionFile, err)
+	}
+	return data, nil
+}
+
+func (backend *fsBackend) checkHistoryPath(name string) (string, bool, error) {
+	entryPath, err := backend.checkEntryPath(name, false)
+	if err == nil {
+		return entryPath, false, nil
+	} else if err != ErrNotExist {
+		return "", false, err
+	}
+	entryHistoryPath := filepath.Join(backend.path, fsBackendHistoryDir, name)
+	pathInfo, err := os.Stat(entryHistoryPath)
+	if os.IsNotExist(err) {
+		return "", false, ErrNotExist
+	} else if err != nil {
+		return "", false, fmt.Errorf("failed to stat entry history path '%s' (cause: %w)", entryHistoryPath, err)
+	} else if !pathInfo.IsDir() {
+		return "", false, fmt.Errorf("entry history path '%s' is not a directory", entryHistoryPath)
+	}
+	return entryHistoryPath, true, nil
+}
+
 func (backend *fsBackend) Log(name string, message string) error {
-	lock, err := backend.lock(syscall.LOCK_EX)
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	return backend.appendLog(name, message)
+}
+
+func (backend *fsBackend) AppendLog(name string, appendFunc LogAppendFunc) error {
+	lock, err := backend.lockExclusive()
 	if err != nil {
 		return err
 	}
 	defer lock.release()
+	last, err := backend.readLastLogLine(name)
+	if err != nil {
+		return err
+	}
+	message, followUps, err := appendFunc(last)
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		err = backend.appendLog(name, message)
+		if err != nil {
+			return err
+		}
+	}
+	for _, followUp := range followUps {
+		err = backend.appendLog(followUp.Name, followUp.Message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (backend *fsBackend) readLastLogLine(name string) ([]byte, error) {
+	entryPath, err := backend.checkEntryPath(name, true)
+	if err != nil {
+		return nil, err
+	}
+	logPath := filepath.Join(entryPath, fsBackendLogFile)
+	logFile, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open log file '%s' (cause: %w)", logPath, err)
+	}
+	defer logFile.Close()
+	last, err := backend.lastLogLine(logFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log file '%s' (cause: %w)", logPath, err)
+	}
+	return last, nil
+}
+
+// appendLog appends the submitted message to the log with the submitted name. The caller has to hold the exclusive lock.
+func (backend *fsBackend) appendLog(name string, message string) error {
 	entryPath, err := backend.checkEntryPath(name, true)
 	if err != nil {
 		return err
 	}
-	logPath := filepath.Join(entryPath, "log")
-	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fsBackendFilePerm)
+	logPath := filepath.Join(entryPath, fsBackendLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, fsBackendFilePerm)
 	if err != nil {
 		return fmt.Errorf("failed to open log file '%s' (cause: %w)", logPath, err)
 	}
 	defer logFile.Close()
-	_, err = logFile.WriteString(message)
+	line, err := backend.logLine(logFile, message)
+	if err != nil {
+		return fmt.Errorf("failed to read log file '%s' (cause: %w)", logPath, err)
+	}
+	_, err = logFile.WriteString(line)
 	if err != nil {
 		return fmt.Errorf("failed to write log file '%s' (cause: %w)", logPath, err)
 	}
 	return nil
 }
 
+const fsBackendLogChunkSize = 4096
+
+// lastLogLine reads the last (non-empty) line of the submitted log file by reading it backwards in chunks.
+func (backend *fsBackend) lastLogLine(logFile *os.File) ([]byte, error) {
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tail := make([]byte, 0)
+	offset := logInfo.Size()
+	for offset > 0 {
+		chunkSize := min(fsBackendLogChunkSize, offset)
+		offset -= chunkSize
+		chunk := make([]byte, chunkSize)
+		_, err = logFile.ReadAt(chunk, offset)
+		if err != nil {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		separator := bytes.LastIndexByte(trimmed, '\n')
+		if separator >= 0 {
+			return trimmed[separator+1:], nil
+		}
+	}
+	trimmed := bytes.TrimRight(tail, "\n")
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	return trimmed, nil
+}
+
+// logLine terminates the submitted message with a newline and also prepends one, if the log file
+// does not end with a newline (as written by previous versions).
+func (backend *fsBackend) logLine(logFile *os.File, message string) (string, error) {
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		return "", err
+	}
+	line := message + "\n"
+	if logInfo.Size() > 0 {
+		last := make([]byte, 1)
+		_, err = logFile.ReadAt(last, logInfo.Size()-1)
+		if err != nil {
+			return "", err
+		}
+		if last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	return line, nil
+}
+
+func (backend *fsBackend) ReadLog(name string) ([]byte, error) {
+	lock, err := backend.lockShared()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	logPath := filepath.Join(backend.path, name, fsBackendLogFile)
+	data, err := os.ReadFile(logPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read log file '%s' (cause: %w)", logPath, err)
+	}
+	return data, nil
+}
+
 func (backend *fsBackend) checkEntryPath(name string, create bool) (string, error) {
 	entryPath := filepath.Join(backend.path, name)
 	pathInfo, err := os.Stat(entryPath)
@@ -256,9 +666,6 @@ func (backend *fsBackend) readEntryVersions(entryPath string, ignoreEmpty bool)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read entry path '%s' (cause: %w)", entryPath, err)
 	}
-	if !ignoreEmpty && len(dirEntries) == 0 {
-		return nil, fmt.Errorf("invalid entry path '%s'", entryPath)
-	}
 	versions := make([]Version, 0)
 	for _, dirEntry := range dirEntries {
 		parsedVersion, err := strconv.ParseUint(dirEntry.Name(), 10, 64)
@@ -267,10 +674,118 @@ func (backend *fsBackend) readEntryVersions(entryPath string, ignoreEmpty bool)
 		}
 		versions = append(versions, Version(parsedVersion))
 	}
+	if !ignoreEmpty && len(versions) == 0 {
+		return nil, fmt.Errorf("invalid entry path '%s'", entryPath)
+	}
 	slices.SortFunc(versions, func(a Version, b Version) int { return int(b - a) })
 	return versions, nil
 }
 
+// pruneEntryVersions removes the versions exceeding the version limit (versions are expected to be sorted newest first).
+func (backend *fsBackend) pruneEntryVersions(entryPath string, versions []Version) error {
+	if VersionLimit(len(versions)) <= backend.versionLimit {
+		return nil
+	}
+	for _, version := range versions[backend.versionLimit:] {
+		err := backend.removeEntryVersion(entryPath, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntryVersion writes the submitted entry version together with the time it has been written. The time is
+// recorded in a separate file (written first), as a file's modification time does not survive copying the storage path.
+func (backend *fsBackend) writeEntryVersion(entryPath string, version Version, data []byte, written time.Time) error {
+	versionFile := backend.resolveEntryVersionFile(entryPath, version)
+	err := backend.writeTimeFile(versionFile+fsBackendTimeSuffix, written)
+	if err != nil {
+		return err
+	}
+	return backend.writeFile(versionFile, data)
+}
+
+// readEntryVersionTime reads the time the submitted entry version has been written. For versions written by previous
+// versions (not recording the time separately) the version file's modification time is used.
+func (backend *fsBackend) readEntryVersionTime(entryPath string, version Version) (time.Time, error) {
+	versionFile := backend.resolveEntryVersionFile(entryPath, version)
+	return backend.readTimeFile(versionFile+fsBackendTimeSuffix, versionFile)
+}
+
+func (backend *fsBackend) removeEntryVersion(entryPath string, version Version) error {
+	versionFile := backend.resolveEntryVersionFile(entryPath, version)
+	for _, removeFile := range []string{versionFile, versionFile + fsBackendTimeSuffix} {
+		err := os.Remove(removeFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove entry version '%s' (cause: %w)", removeFile, err)
+		}
+	}
+	return nil
+}
+
+func (backend *fsBackend) writeTimeFile(file string, t time.Time) error {
+	timeBytes, err := t.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to marshal time '%s' (cause: %w)", file, err)
+	}
+	return backend.writeFile(file, timeBytes)
+}
+
+// readTimeFile reads the time recorded in the submitted file. If the file does not exist or is empty (as written by
+// previous versions), the modification time of the submitted fallback file (or the file itself, if empty) is used.
+func (backend *fsBackend) readTimeFile(file string, fallbackFile string) (time.Time, error) {
+	timeBytes, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return time.Time{}, fmt.Errorf("failed to read time '%s' (cause: %w)", file, err)
+	}
+	if len(timeBytes) == 0 {
+		if fallbackFile == "" {
+			fallbackFile = file
+		}
+		fallbackInfo, err := os.Stat(fallbackFile)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat file '%s' (cause: %w)", fallbackFile, err)
+		}
+		return fallbackInfo.ModTime(), nil
+	}
+	var t time.Time
+	err = t.UnmarshalText(timeBytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to unmarshal time '%s' (cause: %w)", file, err)
+	}
+	return t, nil
+}
+
+// writeFile writes the submitted file atomically. The data is written to a temporary file first, which is
+// renamed to the final file name afterwards. Hence readers (including other processes) either see the
+// previous or the complete new file content.
+func (backend *fsBackend) writeFile(file string, data []byte) error {
+	tempFile := file + fsBackendTempSuffix
+	writer, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fsBackendFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create file '%s' (cause: %w)", tempFile, err)
+	}
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Sync()
+	}
+	closeErr := writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to write file '%s' (cause: %w)", tempFile, err)
+	}
+	err = os.Rename(tempFile, file)
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to replace file '%s' (cause: %w)", file, err)
+	}
+	return nil
+}
+
 func (backend *fsBackend) resolveEntryVersionFile(entryPath string, version Version) string {
 	return filepath.Join(entryPath, strconv.FormatUint(uint64(version), 10))
 }
@@ -285,6 +800,10 @@ func (lock *fsLock) release() {
 	if err != nil {
 		lock.logger.Error().Err(err).Msg("failed to release file lock")
 	}
+	err = lock.file.Close()
+	if err != nil {
+		lock.logger.Error().Err(err).Msg("failed to close lock file")
+	}
 }
 
 func (backend *fsBackend) lock(how int) (*fsLock, error) {
@@ -308,12 +827,19 @@ func NewFSStorage(path string, versionLimit VersionLimit) (Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &fsBackend{
+	backend := &fsBackend{
 		versionLimit: versionLimit.normalize(),
 		uri:          uri,
 		path:         checkedPath,
 		logger:       &logger,
-	}, nil
+	}
+	// recover any journal left behind by an interrupted commit
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return nil, err
+	}
+	lock.release()
+	return backend, nil
 }
 
 func checkFSStoragePath(path string, logger *zerolog.Logger) (string, error) {
@@ -0,0 +1,349 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const fsBackendJournalFile = ".journal"
+
+// fsJournal records the modifications of a commit before they are applied (write-ahead). A commit is done as
+// soon as its journal has been written. A journal left behind by an interrupted or failed commit is re-applied
+// during the next access to the storage path.
+type fsJournal struct {
+	Operations []fsJournalOperation `json:"operations"`
+}
+
+// fsJournalOperation describes a single journaled modification. Journaled modifications refer to concrete
+// versions and hence can be re-applied safely.
+type fsJournalOperation struct {
+	Name string `json:"name"`
+	// Version is the entry version to write (0, if the entry is to be deleted).
+	Version Version `json:"version,omitempty"`
+	// Log is set, if the operation appends to a log (Data is the appended content).
+	Log bool `json:"log,omitempty"`
+	// Offset is the size of the log prior to appending (log operations only).
+	Offset int64  `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	// Time is the time the operation has been committed (recorded as the version respectively deletion time).
+	Time time.Time `json:"time,omitempty"`
+}
+
+func (backend *fsBackend) Commit(operations []Operation) error {
+	lock, err := backend.lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	backend.logger.Debug().Msgf("committing %d operation(s)...", len(operations))
+	journal, err := backend.prepareJournal(operations)
+	if err != nil {
+		return err
+	}
+	err = backend.writeJournal(journal)
+	if err != nil {
+		return err
+	}
+	// the durably written journal marks the commit as done; any failure from here on is recovered by
+	// re-applying the retained journal during the next access
+	err = backend.applyJournal(journal)
+	if err == nil {
+		err = backend.removeJournal()
+	}
+	if err != nil {
+		backend.logger.Warn().Err(err).Msg("failed to apply journal; journal will be re-applied during next access")
+		return fmt.Errorf("%w (cause: %w)", ErrCommitPending, err)
+	}
+	backend.logger.Debug().Msgf("committed %d operation(s)", len(operations))
+	return nil
+}
+
+// lockExclusive aquires the exclusive storage lock and recovers any pending journal.
+func (backend *fsBackend) lockExclusive() (*fsLock, error) {
+	lock, err := backend.lock(syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	err = backend.recoverJournal()
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// lockShared aquires the shared storage lock. If a pending journal exists, the exclusive storage lock is aquired
+// instead to recover the journal first (readers never see a partially applied commit).
+func (backend *fsBackend) lockShared() (*fsLock, error) {
+	lock, err := backend.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	journalPath := filepath.Join(backend.path, fsBackendJournalFile)
+	_, err = os.Stat(journalPath)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	lock.release()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat journal '%s' (cause: %w)", journalPath, err)
+	}
+	return backend.lockExclusive()
+}
+
+func (backend *fsBackend) prepareJournal(operations []Operation) (*fsJournal, error) {
+	journal := &fsJournal{Operations: make([]fsJournalOperation, 0, len(operations))}
+	now := time.Now()
+	// current tracks the versions resulting from the operations prepared so far (0, if the entry does not exist)
+	current := make(map[string]Version)
+	logNames := make([]string, 0)
+	logs := make(map[string]*fsJournalOperation)
+	for _, operation := range operations {
+		if operation.Kind == OperationLog {
+			err := backend.prepareJournalLog(logs, operation.Name, operation.Data)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(logNames, operation.Name) {
+				logNames = append(logNames, operation.Name)
+			}
+			continue
+		}
+		currentVersion, tracked := current[operation.Name]
+		if !tracked {
+			var err error
+			currentVersion, err = backend.currentEntryVersion(operation.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var version Version
+		switch operation.Kind {
+		case OperationCreate:
+			if currentVersion != 0 {
+				return nil, &ConflictError{Name: operation.Name, Current: currentVersion}
+			}
+			version = 1
+		case OperationUpdate, OperationDelete:
+			if currentVersion == 0 {
+				return nil, ErrNotExist
+			}
+			if currentVersion != operation.Expected {
+				return nil, &ConflictError{Name: operation.Name, Expected: operation.Expected, Current: currentVersion}
+			}
+			if operation.Kind == OperationUpdate {
+				version = currentVersion + 1
+			}
+		default:
+			return nil, fmt.Errorf("unexpected operation kind %d", operation.Kind)
+		}
+		current[operation.Name] = version
+		journal.Operations = append(journal.Operations, fsJournalOperation{Name: operation.Name, Version: version, Data: operation.Data, Time: operation.commitTime(now)})
+	}
+	for _, name := range logNames {
+		journal.Operations = append(journal.Operations, *logs[name])
+	}
+	return journal, nil
+}
+
+// currentEntryVersion gets the current version of an entry (0, if the entry does not exist).
+func (backend *fsBackend) currentEntryVersion(name string) (Version, error) {
+	entryPath := filepath.Join(backend.path, name)
+	_, err := os.Stat(entryPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to stat entry path '%s' (cause: %w)", entryPath, err)
+	}
+	versions, err := backend.readEntryVersions(entryPath, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[0], nil
+}
+
+// prepareJournalLog adds the submitted message to the journaled log operation of the submitted log. Log operations
+// are journaled with the log's size prior to appending and the appended lines. Re-applying a journaled log operation
+// truncates the log to its previous size first and hence does not duplicate messages.
+func (backend *fsBackend) prepareJournalLog(logs map[string]*fsJournalOperation, name string, message []byte) error {
+	operation := logs[name]
+	if operation == nil {
+		operation = &fsJournalOperation{Name: name, Log: true}
+		logPath := filepath.Join(backend.path, name, fsBackendLogFile)
+		logFile, err := os.Open(logPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to open log file '%s' (cause: %w)", logPath, err)
+		}
+		if err == nil {
+			defer logFile.Close()
+			line, err := backend.logLine(logFile, "")
+			if err != nil {
+				return fmt.Errorf("failed to read log file '%s' (cause: %w)", logPath, err)
+			}
+			logInfo, err := logFile.Stat()
+			if err != nil {
+				return fmt.Errorf("failed to stat log file '%s' (cause: %w)", logPath, err)
+			}
+			operation.Offset = logInfo.Size()
+			// an incomplete last line is terminated first
+			operation.Data = []byte(line[:len(line)-1])
+		}
+		logs[name] = operation
+	}
+	operation.Data = append(operation.Data, message...)
+	operation.Data = append(operation.Data, '\n')
+	return nil
+}
+
+func (backend *fsBackend) writeJournal(journal *fsJournal) error {
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal (cause: %w)", err)
+	}
+	return backend.writeFile(filepath.Join(backend.path, fsBackendJournalFile), journalBytes)
+}
+
+func (backend *fsBackend) removeJournal() error {
+	journalPath := filepath.Join(backend.path, fsBackendJournalFile)
+	err := os.Remove(journalPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove journal '%s' (cause: %w)", journalPath, err)
+	}
+	return nil
+}
+
+func (backend *fsBackend) recoverJournal() error {
+	journalPath := filepath.Join(backend.path, fsBackendJournalFile)
+	journalBytes, err := os.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		// a left over temporary journal belongs to a commit which has not been started
+		_ = os.Remove(journalPath + fsBackendTempSuffix)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read journal '%s' (cause: %w)", journalPath, err)
+	}
+	backend.logger.Warn().Msgf("recovering pending journal '%s'...", journalPath)
+	journal := &fsJournal{}
+	err = json.Unmarshal(journalBytes, journal)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal journal '%s' (cause: %w)", journalPath, err)
+	}
+	err = backend.applyJournal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to recover journal '%s' (cause: %w)", journalPath, err)
+	}
+	return backend.removeJournal()
+}
+
+func (backend *fsBackend) applyJournal(journal *fsJournal) error {
+	for _, operation := range journal.Operations {
+		var err error
+		if operation.Log {
+			err = backend.applyJournalLog(operation.Name, operation.Offset, operation.Data)
+		} else if operation.Version != 0 {
+			err = backend.applyJournalWrite(operation.Name, operation.Version, operation.Data, operation.journalTime())
+		} else {
+			err = backend.applyJournalDelete(operation.Name, operation.journalTime())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalTime gets the time to record for the operation. Journals written by previous versions do not record
+// any time; hence the time of recovery is used for them.
+func (operation *fsJournalOperation) journalTime() time.Time {
+	if operation.Time.IsZero() {
+		return time.Now()
+	}
+	return operation.Time
+}
+
+func (backend *fsBackend) applyJournalWrite(name string, version Version, data []byte, written time.Time) error {
+	entryPath, err := backend.checkEntryPath(name, true)
+	if err != nil {
+		return err
+	}
+	err = backend.writeEntryVersion(entryPath, version, data, written)
+	if err != nil {
+		return err
+	}
+	versions, err := backend.readEntryVersions(entryPath, false)
+	if err != nil {
+		return err
+	}
+	return backend.pruneEntryVersions(entryPath, versions)
+}
+
+// applyJournalLog truncates the submitted log to its size prior to appending and appends the journaled lines.
+// Journals written by previous versions record the log's resulting content at offset 0.
+func (backend *fsBackend) applyJournalLog(name string, offset int64, data []byte) error {
+	entryPath, err := backend.checkEntryPath(name, true)
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(entryPath, fsBackendLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_RDWR, fsBackendFilePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open log file '%s' (cause: %w)", logPath, err)
+	}
+	defer logFile.Close()
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat log file '%s' (cause: %w)", logPath, err)
+	}
+	if logInfo.Size() < offset {
+		return fmt.Errorf("failed to append log file '%s' (size %d below journaled size %d)", logPath, logInfo.Size(), offset)
+	}
+	err = logFile.Truncate(offset)
+	if err == nil {
+		_, err = logFile.WriteAt(data, offset)
+	}
+	if err == nil {
+		err = logFile.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write log file '%s' (cause: %w)", logPath, err)
+	}
+	return nil
+}
+
+func (backend *fsBackend) applyJournalDelete(name string, deleted time.Time) error {
+	entryPath, err := backend.checkEntryPath(name, false)
+	if err == nil {
+		return backend.deleteEntry(name, entryPath, deleted)
+	} else if err != ErrNotExist {
+		return err
+	}
+	// entry already moved to history; make sure the deletion marker has been written
+	entryHistoryPath := filepath.Join(backend.path, fsBackendHistoryDir, name)
+	_, err = os.Stat(entryHistoryPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat entry history path '%s' (cause: %w)", entryHistoryPath, err)
+	}
+	deletedFile := filepath.Join(entryHistoryPath, fsBackendDeletedFile)
+	_, err = os.Stat(deletedFile)
+	if os.IsNotExist(err) {
+		return backend.writeTimeFile(deletedFile, deleted)
+	} else if err != nil {
+		return fmt.Errorf("failed to stat deletion marker '%s' (cause: %w)", deletedFile, err)
+	}
+	return nil
+}
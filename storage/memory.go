@@ -6,10 +6,13 @@
 package storage
 
 import (
+	"bytes"
+	"cmp"
 	"container/heap"
 	"fmt"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/hdecarne-github/go-log"
 	"github.com/rs/zerolog"
@@ -17,6 +20,7 @@ import (
 
 type entryVersion struct {
 	version   Version
+	time      time.Time
 	data      []byte
 	heapIndex int
 }
@@ -56,10 +60,17 @@ func (versions *entryVersions) Pop() any {
 
 const memoryBackendURI = "memory://"
 
+type deletedEntry struct {
+	versions entryVersions
+	time     time.Time
+}
+
 type memoryBackend struct {
 	versionLimit VersionLimit
 	lock         sync.RWMutex
 	entries      map[string]entryVersions
+	deleted      map[string]*deletedEntry
+	logs         map[string][]byte
 	logger       *zerolog.Logger
 }
 
@@ -74,26 +85,39 @@ func (backend *memoryBackend) Create(name string, data []byte) (string, error) {
 	nextName := name
 	nextSuffix := 1
 	for {
-		versions, exists := backend.entries[nextName]
+		_, exists := backend.entries[nextName]
 		if exists {
 			nextSuffix++
 			nextName = fmt.Sprintf("%s (%d)", name, nextSuffix)
 			continue
 		}
-		entry := &entryVersion{
-			version:   1,
-			data:      data,
-			heapIndex: 0,
-		}
-		versions = entryVersions{entry}
-		heap.Init(&versions)
-		backend.entries[nextName] = versions
+		backend.createEntry(nextName, data, time.Now())
 		backend.logger.Debug().Msgf("created entry '%s'", nextName)
 		return nextName, nil
 	}
 }
 
+func (backend *memoryBackend) createEntry(name string, data []byte, written time.Time) {
+	entry := &entryVersion{
+		version:   1,
+		time:      written,
+		data:      data,
+		heapIndex: 0,
+	}
+	versions := entryVersions{entry}
+	heap.Init(&versions)
+	backend.entries[name] = versions
+}
+
 func (backend *memoryBackend) Update(name string, data []byte) (Version, error) {
+	return backend.update(name, data, nil)
+}
+
+func (backend *memoryBackend) UpdateIf(name string, data []byte, expected Version) (Version, error) {
+	return backend.update(name, data, &expected)
+}
+
+func (backend *memoryBackend) update(name string, data []byte, expected *Version) (Version, error) {
 	backend.lock.Lock()
 	defer backend.lock.Unlock()
 	backend.logger.Debug().Msgf("updating entry '%s'...", name)
@@ -101,6 +125,16 @@ func (backend *memoryBackend) Update(name string, data []byte) (Version, error)
 	if !update {
 		return 0, ErrNotExist
 	}
+	currentVersion := versions[len(versions)-1].version
+	if expected != nil && currentVersion != *expected {
+		return 0, &ConflictError{Name: name, Expected: *expected, Current: currentVersion}
+	}
+	nextVersion := backend.updateEntry(name, versions, data, time.Now())
+	backend.logger.Debug().Msgf("updated entry '%s' to version %d", name, nextVersion)
+	return nextVersion, nil
+}
+
+func (backend *memoryBackend) updateEntry(name string, versions entryVersions, data []byte, written time.Time) Version {
 	versionCount := len(versions)
 	nextVersion := versions[versionCount-1].version + 1
 	if VersionLimit(versionCount)+1 > backend.versionLimit {
@@ -108,27 +142,138 @@ func (backend *memoryBackend) Update(name string, data []byte) (Version, error)
 	}
 	entry := &entryVersion{
 		version: nextVersion,
+		time:    written,
 		data:    data,
 	}
 	heap.Push(&versions, entry)
 	backend.entries[name] = versions
-	backend.logger.Debug().Msgf("updated entry '%s' to version %d", name, entry.version)
-	return entry.version, nil
+	return nextVersion
 }
 
 func (backend *memoryBackend) Delete(name string) error {
 	backend.lock.Lock()
 	defer backend.lock.Unlock()
 	backend.logger.Debug().Msgf("deleting entry '%s'...", name)
-	_, exists := backend.entries[name]
+	versions, exists := backend.entries[name]
 	if !exists {
 		return ErrNotExist
 	}
-	delete(backend.entries, name)
+	backend.deleteEntry(name, versions, time.Now())
 	backend.logger.Debug().Msgf("entry '%s' deleted", name)
 	return nil
 }
 
+func (backend *memoryBackend) deleteEntry(name string, versions entryVersions, deleted time.Time) {
+	delete(backend.entries, name)
+	backend.deleted[name] = &deletedEntry{versions: versions, time: deleted}
+}
+
+func (backend *memoryBackend) Commit(operations []Operation) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.logger.Debug().Msgf("committing %d operation(s)...", len(operations))
+	// validate all operations first, to either apply all or none of them (current tracks the versions resulting from
+	// the operations validated so far; 0 if the entry does not exist)
+	current := make(map[string]Version)
+	for _, operation := range operations {
+		if operation.Kind == OperationLog {
+			continue
+		}
+		currentVersion, tracked := current[operation.Name]
+		if !tracked {
+			versions, exists := backend.entries[operation.Name]
+			if exists {
+				currentVersion = versions[len(versions)-1].version
+			}
+		}
+		switch operation.Kind {
+		case OperationCreate:
+			if currentVersion != 0 {
+				return &ConflictError{Name: operation.Name, Current: currentVersion}
+			}
+			current[operation.Name] = 1
+		case OperationUpdate, OperationDelete:
+			if currentVersion == 0 {
+				return ErrNotExist
+			}
+			if currentVersion != operation.Expected {
+				return &ConflictError{Name: operation.Name, Expected: operation.Expected, Current: currentVersion}
+			}
+			if operation.Kind == OperationUpdate {
+				current[operation.Name] = currentVersion + 1
+			} else {
+				current[operation.Name] = 0
+			}
+		default:
+			return fmt.Errorf("unexpected operation kind %d", operation.Kind)
+		}
+	}
+	now := time.Now()
+	for _, operation := range operations {
+		switch operation.Kind {
+		case OperationCreate:
+			backend.createEntry(operation.Name, operation.Data, operation.commitTime(now))
+		case OperationUpdate:
+			backend.updateEntry(operation.Name, backend.entries[operation.Name], operation.Data, operation.commitTime(now))
+		case OperationDelete:
+			backend.deleteEntry(operation.Name, backend.entries[operation.Name], operation.commitTime(now))
+		case OperationLog:
+			backend.appendLog(operation.Name, string(operation.Data))
+		}
+	}
+	backend.logger.Debug().Msgf("committed %d operation(s)", len(operations))
+	return nil
+}
+
+func (backend *memoryBackend) Prune(name string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.logger.Debug().Msgf("pruning entry '%s'...", name)
+	versions, exists := backend.entries[name]
+	if !exists {
+		return ErrNotExist
+	}
+	latest := versions[0]
+	for _, version := range versions[1:] {
+		if version.version > latest.version {
+			latest = version
+		}
+	}
+	latest.heapIndex = 0
+	backend.entries[name] = entryVersions{latest}
+	backend.logger.Debug().Msgf("entry '%s' pruned to version %d", name, latest.version)
+	return nil
+}
+
+func (backend *memoryBackend) Rewrite(name string, rewrite RewriteFunc) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.logger.Debug().Msgf("rewriting entry '%s'...", name)
+	versionsList := make([]entryVersions, 0, 2)
+	if versions, exists := backend.entries[name]; exists {
+		versionsList = append(versionsList, versions)
+	}
+	if deleted, exists := backend.deleted[name]; exists {
+		versionsList = append(versionsList, deleted.versions)
+	}
+	if len(versionsList) == 0 {
+		return ErrNotExist
+	}
+	for _, versions := range versionsList {
+		for _, entry := range versions {
+			rewritten, err := rewrite(entry.version, entry.data)
+			if err != nil {
+				return err
+			}
+			if rewritten != nil {
+				entry.data = rewritten
+			}
+		}
+	}
+	backend.logger.Debug().Msgf("entry '%s' rewritten", name)
+	return nil
+}
+
 func (backend *memoryBackend) List() (Names, error) {
 	backend.lock.RLock()
 	defer backend.lock.RUnlock()
@@ -194,16 +339,112 @@ func (backend *memoryBackend) GetVersion(name string, version Version) ([]byte,
 	return nil, ErrNotExist
 }
 
+func (backend *memoryBackend) ListHistory() (Names, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	names := make([]string, 0, len(backend.entries)+len(backend.deleted))
+	for name := range backend.entries {
+		names = append(names, name)
+	}
+	for name := range backend.deleted {
+		if _, exists := backend.entries[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return &memoryBackendNames{names: names}, nil
+}
+
+func (backend *memoryBackend) GetHistory(name string) (*History, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	history := &History{}
+	versions, exists := backend.entries[name]
+	if !exists {
+		deleted, exists := backend.deleted[name]
+		if !exists {
+			return nil, ErrNotExist
+		}
+		versions = deleted.versions
+		history.Deleted = deleted.time
+	}
+	history.Versions = make([]VersionInfo, 0, len(versions))
+	for _, entry := range versions {
+		history.Versions = append(history.Versions, VersionInfo{Version: entry.version, Time: entry.time})
+	}
+	slices.SortFunc(history.Versions, func(a VersionInfo, b VersionInfo) int { return cmp.Compare(b.Version, a.Version) })
+	return history, nil
+}
+
+func (backend *memoryBackend) GetHistoryVersion(name string, version Version) ([]byte, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	versions, exists := backend.entries[name]
+	if !exists {
+		deleted, exists := backend.deleted[name]
+		if !exists {
+			return nil, ErrNotExist
+		}
+		versions = deleted.versions
+	}
+	for _, entry := range versions {
+		if entry.version == version {
+			return entry.data, nil
+		}
+	}
+	return nil, ErrNotExist
+}
+
 func (backend *memoryBackend) Log(name string, message string) error {
-	backend.logger.Info().Msgf("log: %s", message)
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.appendLog(name, message)
 	return nil
 }
 
+func (backend *memoryBackend) AppendLog(name string, appendFunc LogAppendFunc) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	log := bytes.TrimRight(backend.logs[name], "\n")
+	var last []byte
+	if len(log) > 0 {
+		last = slices.Clone(log[bytes.LastIndexByte(log, '\n')+1:])
+	}
+	message, followUps, err := appendFunc(last)
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		backend.appendLog(name, message)
+	}
+	for _, followUp := range followUps {
+		backend.appendLog(followUp.Name, followUp.Message)
+	}
+	return nil
+}
+
+func (backend *memoryBackend) appendLog(name string, message string) {
+	backend.logger.Info().Msgf("log: %s", message)
+	backend.logs[name] = append(backend.logs[name], []byte(message+"\n")...)
+}
+
+func (backend *memoryBackend) ReadLog(name string) ([]byte, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	log, exists := backend.logs[name]
+	if !exists {
+		return nil, ErrNotExist
+	}
+	return slices.Clone(log), nil
+}
+
 func NewMemoryStorage(versionLimit VersionLimit) Backend {
 	logger := log.RootLogger().With().Str("Backend", memoryBackendURI).Logger()
 	return &memoryBackend{
 		versionLimit: versionLimit.normalize(),
 		entries:      make(map[string]entryVersions),
+		deleted:      make(map[string]*deletedEntry),
+		logs:         make(map[string][]byte),
 		logger:       &logger,
 	}
 }
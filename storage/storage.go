@@ -6,7 +6,14 @@
 // Package storage provides different backends for versioned data storage.
 package storage
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hdecarne-github/go-log"
+)
 
 type VersionLimit uint64
 
@@ -21,10 +28,32 @@ func (limit VersionLimit) normalize() VersionLimit {
 
 type Version uint64
 
+// VersionInfo describes a single version of a storage entry.
+type VersionInfo struct {
+	// Version is the version number.
+	Version Version
+	// Time is the time the version has been written.
+	Time time.Time
+}
+
+// History describes the retained versions of a storage entry.
+//
+// The history of an entry is retained after the entry has been deleted (until an entry with the same name is deleted again).
+type History struct {
+	// Versions lists the retained versions (newest first).
+	Versions []VersionInfo
+	// Deleted is the time the entry has been deleted (zero, if the entry has not been deleted).
+	Deleted time.Time
+}
+
 type Names interface {
 	Next() string
 }
 
+// RewriteFunc is invoked by [RewritableBackend.Rewrite] for each retained version of an entry. It returns the rewritten
+// version data or nil, if the version is to be left unchanged.
+type RewriteFunc func(version Version, data []byte) ([]byte, error)
+
 type Backend interface {
 	URI() string
 	Create(name string, data []byte) (string, error)
@@ -37,4 +66,137 @@ type Backend interface {
 	Log(name string, message string) error
 }
 
+// ConditionalBackend is implemented by backends supporting compare-and-swap updates.
+type ConditionalBackend interface {
+	Backend
+	// UpdateIf updates the entry only, if its current version equals the expected one. Otherwise a [ConflictError] is returned.
+	UpdateIf(name string, data []byte, expected Version) (Version, error)
+}
+
+var nonAtomicUpdateIfWarnings sync.Map
+
+// UpdateIf updates the submitted entry only, if its current version equals the expected one.
+//
+// WARNING: If the submitted backend does not implement [ConditionalBackend], the version check is performed
+// prior to the update. In this case check and update are NOT atomic and a concurrent update taking place in
+// between is silently overwritten. Such backends must not be shared by concurrent writers. A warning is logged
+// the first time the fallback is used for a backend.
+func UpdateIf(backend Backend, name string, data []byte, expected Version) (Version, error) {
+	conditional, ok := backend.(ConditionalBackend)
+	if ok {
+		return conditional.UpdateIf(name, data, expected)
+	}
+	uri := backend.URI()
+	_, warned := nonAtomicUpdateIfWarnings.LoadOrStore(uri, true)
+	if !warned {
+		log.RootLogger().Warn().Str("Backend", uri).Msg("backend does not support conditional updates; concurrent updates may get lost")
+	}
+	versions, err := backend.GetVersions(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, ErrNotExist
+	}
+	if versions[0] != expected {
+		return 0, &ConflictError{Name: name, Expected: expected, Current: versions[0]}
+	}
+	return backend.Update(name, data)
+}
+
+// HistoryBackend is implemented by backends recording the time each version has been written and
+// retaining the versions of deleted entries.
+type HistoryBackend interface {
+	Backend
+	// ListHistory lists the names of all existing as well as deleted entries.
+	ListHistory() (Names, error)
+	// GetHistory gets the retained versions of an existing or deleted entry.
+	GetHistory(name string) (*History, error)
+	// GetHistoryVersion gets the data of a retained version of an existing or deleted entry.
+	GetHistoryVersion(name string, version Version) ([]byte, error)
+}
+
+// LogReaderBackend is implemented by backends capable of reading back the logs written via [Backend.Log].
+type LogReaderBackend interface {
+	Backend
+	// ReadLog reads the complete log with the given name.
+	ReadLog(name string) ([]byte, error)
+}
+
+// LogMessage is a message to append to the log with the given name.
+type LogMessage struct {
+	// Name is the name of the log to append to.
+	Name string
+	// Message is the message to append.
+	Message string
+}
+
+// LogAppendFunc is invoked by [LogAppenderBackend.AppendLog] with the last line of the log (nil, if the log is empty
+// or does not exist yet). It returns the message to append (nothing is appended, if it is empty) as well as any
+// follow-up messages to append to other logs afterwards.
+type LogAppendFunc func(last []byte) (string, []LogMessage, error)
+
+// LogAppenderBackend is implemented by backends capable of appending to a log depending on the log's last line.
+type LogAppenderBackend interface {
+	LogReaderBackend
+	// AppendLog invokes the submitted [LogAppendFunc] and appends the returned messages while holding exclusive access
+	// to the log. Hence concurrent writers (including other processes sharing the storage) are serialized.
+	AppendLog(name string, appendFunc LogAppendFunc) error
+}
+
+// PrunableBackend is implemented by backends capable of removing all but the latest version of an entry.
+type PrunableBackend interface {
+	Backend
+	// Prune removes all but the latest version of the given entry.
+	Prune(name string) error
+}
+
+// RewritableBackend is implemented by backends capable of rewriting the retained versions of an entry in place.
+type RewritableBackend interface {
+	Backend
+	// Rewrite invokes the submitted [RewriteFunc] for each retained version of the given entry (including the
+	// history of a deleted entry) and replaces the version's data with the rewritten one.
+	Rewrite(name string, rewrite RewriteFunc) error
+}
+
+// WatchableBackend is implemented by backends which may be modified by other processes. Such modifications
+// are detected by comparing subsequent snapshots.
+type WatchableBackend interface {
+	Backend
+	// Snapshot gets the current version of all entries.
+	Snapshot() (map[string]Version, error)
+}
+
+// CheckableBackend is implemented by backends which may leave artifacts behind, in case they are interrupted
+// while writing (e.g. temporary files).
+type CheckableBackend interface {
+	Backend
+	// Orphans lists the left over artifacts.
+	Orphans() ([]string, error)
+	// RemoveOrphan removes a left over artifact reported by Orphans.
+	RemoveOrphan(orphan string) error
+}
+
 var ErrNotExist = errors.New("storage item does not exist")
+
+// ErrConflict indicates a conditional update of a storage item which has been updated concurrently (see [ConflictError]).
+var ErrConflict = errors.New("storage item has been updated concurrently")
+
+// ConflictError is returned by [ConditionalBackend.UpdateIf], if the current version of the updated entry does not match
+// the expected one. A ConflictError matches [ErrConflict] via [errors.Is].
+type ConflictError struct {
+	// Name is the name of the updated entry.
+	Name string
+	// Expected is the version expected by the update.
+	Expected Version
+	// Current is the current version of the entry.
+	Current Version
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("%s (entry: '%s' expected version: %d current version: %d)", ErrConflict, err.Name, err.Expected, err.Current)
+}
+
+func (err *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
@@ -6,9 +6,15 @@
 package storage_test
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hdecarne-github/go-certstore/storage"
 	"github.com/stretchr/testify/require"
@@ -23,6 +29,46 @@ func TestMemoryStorageCreateUpdateDelete(t *testing.T) {
 	checkCreateUpdateDelete(t, storage.NewMemoryStorage(testVersionLimit))
 }
 
+func TestMemoryStorageUpdateIf(t *testing.T) {
+	checkUpdateIf(t, storage.NewMemoryStorage(testVersionLimit))
+}
+
+func TestMemoryStorageUpdateIfFallback(t *testing.T) {
+	checkUpdateIf(t, &basicBackend{Backend: storage.NewMemoryStorage(testVersionLimit)})
+}
+
+// basicBackend hides all optional interfaces of the wrapped backend.
+type basicBackend struct {
+	storage.Backend
+}
+
+func TestMemoryStorageTransaction(t *testing.T) {
+	backend := storage.NewMemoryStorage(testVersionLimit)
+	checkTransaction(t, backend)
+	checkCommit(t, backend)
+}
+
+func TestTransactionEmptyVersions(t *testing.T) {
+	backend := &emptyVersionsBackend{TransactionalBackend: storage.NewMemoryStorage(testVersionLimit).(storage.TransactionalBackend)}
+	_, err := backend.Create("entry", []byte("data"))
+	require.NoError(t, err)
+	tx, err := storage.Begin(backend)
+	require.NoError(t, err)
+	_, err = tx.Update("entry", []byte("updated"))
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	err = tx.Delete("entry")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+// emptyVersionsBackend reports no versions for any entry.
+type emptyVersionsBackend struct {
+	storage.TransactionalBackend
+}
+
+func (backend *emptyVersionsBackend) GetVersions(name string) ([]storage.Version, error) {
+	return []storage.Version{}, nil
+}
+
 func TestMemoryStorageGetX(t *testing.T) {
 	checkGetX(t, storage.NewMemoryStorage(testVersionLimit))
 }
@@ -31,6 +77,14 @@ func TestMemoryStorageVersions(t *testing.T) {
 	checkVersions(t, storage.NewMemoryStorage(testVersionLimit))
 }
 
+func TestMemoryStorageHistory(t *testing.T) {
+	checkHistory(t, storage.NewMemoryStorage(testVersionLimit))
+}
+
+func TestMemoryStorageLog(t *testing.T) {
+	checkLog(t, storage.NewMemoryStorage(testVersionLimit))
+}
+
 func TestFSStorageNew(t *testing.T) {
 	path, err := os.MkdirTemp("", "TestFSStorageNew*")
 	require.NoError(t, err)
@@ -49,6 +103,136 @@ func TestFSStorageCreateUpdateDelete(t *testing.T) {
 	checkCreateUpdateDelete(t, backend)
 }
 
+func TestFSStorageUpdateIf(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageUpdateIf*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	checkUpdateIf(t, backend)
+}
+
+func TestFSStorageTransaction(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageTransaction*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	checkTransaction(t, backend)
+	checkCommit(t, backend)
+}
+
+func TestFSStorageJournalRecovery(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageJournalRecovery*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	_, err = backend.Create("updated", []byte{byte(1)})
+	require.NoError(t, err)
+	_, err = backend.Create("deleted", []byte{byte(1)})
+	require.NoError(t, err)
+	// simulate a commit interrupted after writing the journal
+	journal := `{"operations":[{"name":"created","version":1,"data":"AQ=="},{"name":"updated","version":2,"data":"Ag=="},{"name":"deleted"}]}`
+	err = os.WriteFile(filepath.Join(path, ".journal"), []byte(journal), 0600)
+	require.NoError(t, err)
+	backend, err = storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(path, ".journal"))
+	require.True(t, os.IsNotExist(err))
+	data, err := backend.Get("created")
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(1)}, data)
+	versions, err := backend.GetVersions("updated")
+	require.NoError(t, err)
+	require.Equal(t, []storage.Version{2, 1}, versions)
+	_, err = backend.Get("deleted")
+	require.Equal(t, storage.ErrNotExist, err)
+	history, err := backend.(storage.HistoryBackend).GetHistory("deleted")
+	require.NoError(t, err)
+	require.False(t, history.Deleted.IsZero())
+	// simulate a commit failed after writing the journal (readers recover the journal first)
+	journal = `{"operations":[{"name":"updated","version":3,"data":"Aw=="},{"name":"journaled","log":true,"data":"bWVzc2FnZQo="}]}`
+	err = os.WriteFile(filepath.Join(path, ".journal"), []byte(journal), 0600)
+	require.NoError(t, err)
+	data, err = backend.Get("updated")
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(3)}, data)
+	_, err = os.Stat(filepath.Join(path, ".journal"))
+	require.True(t, os.IsNotExist(err))
+	log, err := backend.(storage.LogReaderBackend).ReadLog("journaled")
+	require.NoError(t, err)
+	require.Equal(t, "message\n", string(log))
+	// simulate a commit failed after partially appending a log (the log is truncated prior to re-appending)
+	err = os.WriteFile(filepath.Join(path, "journaled", "log"), []byte("message\nmess"), 0600)
+	require.NoError(t, err)
+	journal = `{"operations":[{"name":"journaled","log":true,"offset":8,"data":"bWVzc2FnZQo="}]}`
+	err = os.WriteFile(filepath.Join(path, ".journal"), []byte(journal), 0600)
+	require.NoError(t, err)
+	log, err = backend.(storage.LogReaderBackend).ReadLog("journaled")
+	require.NoError(t, err)
+	require.Equal(t, "message\nmessage\n", string(log))
+}
+
+func TestFSStorageSnapshot(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageSnapshot*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	watchable, ok := backend.(storage.WatchableBackend)
+	require.True(t, ok)
+	name1, err := backend.Create("entry", []byte{byte(1)})
+	require.NoError(t, err)
+	name2, err := backend.Create("entry", []byte{byte(1)})
+	require.NoError(t, err)
+	_, err = backend.Update(name1, []byte{byte(2)})
+	require.NoError(t, err)
+	snapshot, err := watchable.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, map[string]storage.Version{name1: 2, name2: 1}, snapshot)
+	err = backend.Delete(name2)
+	require.NoError(t, err)
+	snapshot, err = watchable.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, map[string]storage.Version{name1: 2}, snapshot)
+}
+
+func TestFSStorageConcurrentCreate(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageConcurrentCreate*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	const writers = 4
+	const creates = 10
+	var wg sync.WaitGroup
+	names := make(chan string, writers*creates)
+	for writer := 0; writer < writers; writer++ {
+		// each writer uses its own backend instance to simulate multiple processes
+		backend, err := storage.NewFSStorage(path, testVersionLimit)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for create := 0; create < creates; create++ {
+				name, err := backend.Create("entry", []byte{byte(create)})
+				require.NoError(t, err)
+				names <- name
+			}
+		}()
+	}
+	wg.Wait()
+	close(names)
+	unique := make(map[string]bool)
+	for name := range names {
+		require.False(t, unique[name])
+		unique[name] = true
+	}
+	require.Equal(t, writers*creates, len(unique))
+	tempFiles, err := filepath.Glob(filepath.Join(path, "*", "*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, tempFiles)
+}
+
 func TestFSStorageGetX(t *testing.T) {
 	path, err := os.MkdirTemp("", "TestFSStorageGetX*")
 	require.NoError(t, err)
@@ -103,6 +287,178 @@ func checkCreateUpdateDelete(t *testing.T, backend storage.Backend) {
 	checkList(t, backend, []string{createdName2})
 }
 
+func checkUpdateIf(t *testing.T, backend storage.Backend) {
+	name := "checkUpdateIf"
+	_, err := storage.UpdateIf(backend, name, []byte{byte(1)}, 1)
+	require.Equal(t, storage.ErrNotExist, err)
+	createdName, err := backend.Create(name, []byte{byte(1)})
+	require.NoError(t, err)
+	version2, err := storage.UpdateIf(backend, createdName, []byte{byte(2)}, 1)
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(2), version2)
+	// stale version
+	_, err = storage.UpdateIf(backend, createdName, []byte{byte(3)}, 1)
+	require.ErrorIs(t, err, storage.ErrConflict)
+	var conflict *storage.ConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, createdName, conflict.Name)
+	require.Equal(t, storage.Version(1), conflict.Expected)
+	require.Equal(t, storage.Version(2), conflict.Current)
+	data, err := backend.Get(createdName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(2)}, data)
+	// current version
+	version3, err := storage.UpdateIf(backend, createdName, []byte{byte(3)}, version2)
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(3), version3)
+}
+
+func checkTransaction(t *testing.T, backend storage.Backend) {
+	name := "checkTransaction"
+	updateName, err := backend.Create(name+"Update", []byte{byte(1)})
+	require.NoError(t, err)
+	deleteName, err := backend.Create(name+"Delete", []byte{byte(1)})
+	require.NoError(t, err)
+	// staged modifications are only visible within the transaction
+	tx, err := storage.Begin(backend)
+	require.NoError(t, err)
+	createName, err := tx.Create(name+"Update", []byte{byte(1)})
+	require.NoError(t, err)
+	require.Equal(t, updateName+" (2)", createName)
+	updatedVersion, err := tx.UpdateIf(updateName, []byte{byte(2)}, 1)
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(2), updatedVersion)
+	updatedVersion, err = tx.Update(updateName, []byte{byte(3)})
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(2), updatedVersion)
+	err = tx.Delete(deleteName)
+	require.NoError(t, err)
+	checkList(t, tx, []string{updateName, createName})
+	checkList(t, backend, []string{updateName, deleteName})
+	data, err := tx.Get(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(3)}, data)
+	versions, err := tx.GetVersions(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Version{2, 1}, versions)
+	data, err = backend.Get(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(1)}, data)
+	_, err = tx.Get(deleteName)
+	require.Equal(t, storage.ErrNotExist, err)
+	require.Equal(t, []string{createName, updateName, deleteName}, tx.Names())
+	// commit
+	err = tx.Commit()
+	require.NoError(t, err)
+	checkList(t, backend, []string{updateName, createName})
+	versions, err = backend.GetVersions(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Version{2, 1}, versions)
+	data, err = backend.Get(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(3)}, data)
+	err = tx.Commit()
+	require.ErrorIs(t, err, storage.ErrTransactionFinished)
+	// rollback
+	tx, err = storage.Begin(backend)
+	require.NoError(t, err)
+	err = tx.Delete(createName)
+	require.NoError(t, err)
+	tx.Rollback()
+	checkList(t, backend, []string{updateName, createName})
+	_, err = tx.Create(name, []byte{byte(1)})
+	require.ErrorIs(t, err, storage.ErrTransactionFinished)
+	// conflicting commit is rejected as a whole
+	tx, err = storage.Begin(backend)
+	require.NoError(t, err)
+	_, err = tx.Create(name, []byte{byte(1)})
+	require.NoError(t, err)
+	_, err = tx.Update(updateName, []byte{byte(4)})
+	require.NoError(t, err)
+	_, err = backend.Update(updateName, []byte{byte(5)})
+	require.NoError(t, err)
+	err = tx.Commit()
+	require.ErrorIs(t, err, storage.ErrConflict)
+	checkList(t, backend, []string{updateName, createName})
+	data, err = backend.Get(updateName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(5)}, data)
+	// log messages are buffered until commit
+	logName := name + "Log"
+	tx, err = storage.Begin(backend)
+	require.NoError(t, err)
+	err = tx.Log(logName, "committed")
+	require.NoError(t, err)
+	require.NotContains(t, readTransactionLog(t, backend, logName), "committed")
+	err = tx.Commit()
+	require.NoError(t, err)
+	require.Contains(t, readTransactionLog(t, backend, logName), "committed")
+	tx, err = storage.Begin(backend)
+	require.NoError(t, err)
+	err = tx.Log(logName, "rolled back")
+	require.NoError(t, err)
+	tx.Rollback()
+	require.NotContains(t, readTransactionLog(t, backend, logName), "rolled back")
+	tx, err = storage.Begin(backend)
+	require.NoError(t, err)
+	_, err = tx.Update(updateName, []byte{byte(6)})
+	require.NoError(t, err)
+	err = tx.Log(logName, "rejected")
+	require.NoError(t, err)
+	_, err = backend.Update(updateName, []byte{byte(7)})
+	require.NoError(t, err)
+	err = tx.Commit()
+	require.ErrorIs(t, err, storage.ErrConflict)
+	require.NotContains(t, readTransactionLog(t, backend, logName), "rejected")
+}
+
+func checkCommit(t *testing.T, backend storage.Backend) {
+	name := "checkCommit"
+	transactional := backend.(storage.TransactionalBackend)
+	err := backend.Log(name+"Log", "message1")
+	require.NoError(t, err)
+	// multiple operations on the same entry are applied in order
+	err = transactional.Commit([]storage.Operation{
+		{Kind: storage.OperationCreate, Name: name, Data: []byte{byte(1)}},
+		{Kind: storage.OperationUpdate, Name: name, Data: []byte{byte(2)}, Expected: 1},
+		{Kind: storage.OperationLog, Name: name + "Log", Data: []byte("message2")},
+		{Kind: storage.OperationUpdate, Name: name, Data: []byte{byte(3)}, Expected: 2},
+		{Kind: storage.OperationLog, Name: name + "Log", Data: []byte("message3")},
+		{Kind: storage.OperationCreate, Name: name + "Deleted", Data: []byte{byte(1)}},
+		{Kind: storage.OperationDelete, Name: name + "Deleted", Expected: 1},
+	})
+	require.NoError(t, err)
+	versions, err := backend.GetVersions(name)
+	require.NoError(t, err)
+	require.Equal(t, storage.Version(3), versions[0])
+	data, err := backend.Get(name)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(3)}, data)
+	_, err = backend.Get(name + "Deleted")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	require.Equal(t, "message1\nmessage2\nmessage3\n", readTransactionLog(t, backend, name+"Log"))
+	// operations are checked against the preceding ones
+	err = transactional.Commit([]storage.Operation{
+		{Kind: storage.OperationLog, Name: name + "Log", Data: []byte("message4")},
+		{Kind: storage.OperationUpdate, Name: name, Data: []byte{byte(4)}, Expected: 3},
+		{Kind: storage.OperationUpdate, Name: name, Data: []byte{byte(5)}, Expected: 3},
+	})
+	require.ErrorIs(t, err, storage.ErrConflict)
+	data, err = backend.Get(name)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(3)}, data)
+	require.Equal(t, "message1\nmessage2\nmessage3\n", readTransactionLog(t, backend, name+"Log"))
+}
+
+func readTransactionLog(t *testing.T, backend storage.Backend, name string) string {
+	log, err := backend.(storage.LogReaderBackend).ReadLog(name)
+	if errors.Is(err, storage.ErrNotExist) {
+		return ""
+	}
+	require.NoError(t, err)
+	return string(log)
+}
+
 func checkList(t *testing.T, backend storage.Backend, expected []string) {
 	names, err := backend.List()
 	require.NoError(t, err)
@@ -151,4 +507,189 @@ func checkVersions(t *testing.T, backend storage.Backend) {
 	versions, err := backend.GetVersions(name)
 	require.NoError(t, err)
 	require.Equal(t, []storage.Version{3, 2}, versions)
+	// prune
+	prunable := backend.(storage.PrunableBackend)
+	err = prunable.Prune(name)
+	require.NoError(t, err)
+	versions, err = backend.GetVersions(name)
+	require.NoError(t, err)
+	require.Equal(t, []storage.Version{3}, versions)
+	data, err := backend.Get(name)
+	require.NoError(t, err)
+	require.Equal(t, data3, data)
+	err = prunable.Prune(name + "X")
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func TestFSStorageHistory(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageHistory*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	checkHistory(t, backend)
+	// version and deletion times are not affected by file modification times
+	historyBackend := backend.(storage.HistoryBackend)
+	name, err := backend.Create("checkHistoryTime", []byte{byte(1)})
+	require.NoError(t, err)
+	history, err := historyBackend.GetHistory(name)
+	require.NoError(t, err)
+	modified := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = os.Chtimes(filepath.Join(path, name, "1"), modified, modified)
+	require.NoError(t, err)
+	err = backend.(storage.RewritableBackend).Rewrite(name, func(version storage.Version, data []byte) ([]byte, error) {
+		return []byte{byte(2)}, nil
+	})
+	require.NoError(t, err)
+	err = backend.Delete(name)
+	require.NoError(t, err)
+	err = os.Chtimes(filepath.Join(path, ".history", name, "deleted"), modified, modified)
+	require.NoError(t, err)
+	deletedHistory, err := historyBackend.GetHistory(name)
+	require.NoError(t, err)
+	require.True(t, history.Versions[0].Time.Equal(deletedHistory.Versions[0].Time))
+	require.False(t, deletedHistory.Deleted.Equal(modified))
+	// legacy versions without recorded time
+	legacyPath := filepath.Join(path, "checkHistoryLegacy")
+	err = os.MkdirAll(legacyPath, 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(legacyPath, "1"), []byte{byte(1)}, 0600)
+	require.NoError(t, err)
+	err = os.Chtimes(filepath.Join(legacyPath, "1"), modified, modified)
+	require.NoError(t, err)
+	legacyHistory, err := historyBackend.GetHistory("checkHistoryLegacy")
+	require.NoError(t, err)
+	require.True(t, legacyHistory.Versions[0].Time.Equal(modified))
+}
+
+func checkHistory(t *testing.T, backend storage.Backend) {
+	historyBackend := backend.(storage.HistoryBackend)
+	rewritable := backend.(storage.RewritableBackend)
+	name := "checkHistory"
+	start := time.Now()
+	_, err := historyBackend.GetHistory(name)
+	require.Equal(t, storage.ErrNotExist, err)
+	createdName, err := backend.Create(name, []byte{byte(1)})
+	require.NoError(t, err)
+	_, err = backend.Update(createdName, []byte{byte(2)})
+	require.NoError(t, err)
+	history, err := historyBackend.GetHistory(createdName)
+	require.NoError(t, err)
+	require.Len(t, history.Versions, 2)
+	require.Equal(t, storage.Version(2), history.Versions[0].Version)
+	require.Equal(t, storage.Version(1), history.Versions[1].Version)
+	require.False(t, history.Versions[1].Time.Before(start.Truncate(time.Second)))
+	require.True(t, history.Deleted.IsZero())
+	// deleted
+	err = backend.Delete(createdName)
+	require.NoError(t, err)
+	checkList(t, backend, []string{})
+	history, err = historyBackend.GetHistory(createdName)
+	require.NoError(t, err)
+	require.Len(t, history.Versions, 2)
+	require.False(t, history.Deleted.IsZero())
+	data, err := historyBackend.GetHistoryVersion(createdName, 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(1)}, data)
+	_, err = backend.GetVersion(createdName, 1)
+	require.Equal(t, storage.ErrNotExist, err)
+	names, err := historyBackend.ListHistory()
+	require.NoError(t, err)
+	require.Equal(t, createdName, names.Next())
+	require.Equal(t, "", names.Next())
+	// re-created and rewritten
+	_, err = backend.Create(createdName, []byte{byte(3)})
+	require.NoError(t, err)
+	err = rewritable.Rewrite(createdName, func(version storage.Version, data []byte) ([]byte, error) {
+		if data[0] == byte(2) {
+			return nil, nil
+		}
+		return []byte{data[0] + 10}, nil
+	})
+	require.NoError(t, err)
+	data, err = backend.Get(createdName)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(13)}, data)
+	err = backend.Delete(createdName)
+	require.NoError(t, err)
+	rewrittenHistory, err := historyBackend.GetHistory(createdName)
+	require.NoError(t, err)
+	require.Len(t, rewrittenHistory.Versions, 1)
+	err = rewritable.Rewrite(name+"X", func(version storage.Version, data []byte) ([]byte, error) { return nil, nil })
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func TestFSStorageLog(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestFSStorageLog*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	checkLog(t, backend)
+	// unterminated log (as written by previous versions)
+	name := "checkLegacyLog"
+	err = os.MkdirAll(filepath.Join(path, name), 0700)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(path, name, "log"), []byte("legacy1legacy2"), 0600)
+	require.NoError(t, err)
+	err = backend.Log(name, "message")
+	require.NoError(t, err)
+	log, err := backend.(storage.LogReaderBackend).ReadLog(name)
+	require.NoError(t, err)
+	require.Equal(t, "legacy1legacy2\nmessage\n", string(log))
+}
+
+func checkLog(t *testing.T, backend storage.Backend) {
+	logReader := backend.(storage.LogReaderBackend)
+	name := "checkLog"
+	_, err := logReader.ReadLog(name)
+	require.Equal(t, storage.ErrNotExist, err)
+	err = backend.Log(name, "message1")
+	require.NoError(t, err)
+	err = backend.Log(name, "message2")
+	require.NoError(t, err)
+	log, err := logReader.ReadLog(name)
+	require.NoError(t, err)
+	require.Equal(t, "message1\nmessage2\n", string(log))
+	// append depending on last line
+	appender := backend.(storage.LogAppenderBackend)
+	appendName := "checkAppendLog"
+	appendLast := func(last []byte) (string, []storage.LogMessage, error) {
+		return fmt.Sprintf("%s+", last), nil, nil
+	}
+	for range 3 {
+		err = appender.AppendLog(appendName, appendLast)
+		require.NoError(t, err)
+	}
+	log, err = logReader.ReadLog(appendName)
+	require.NoError(t, err)
+	require.Equal(t, "+\n++\n+++\n", string(log))
+	appendErr := errors.New("append failed")
+	err = appender.AppendLog(appendName, func(last []byte) (string, []storage.LogMessage, error) { return "", nil, appendErr })
+	require.ErrorIs(t, err, appendErr)
+	log, err = logReader.ReadLog(appendName)
+	require.NoError(t, err)
+	require.Equal(t, "+\n++\n+++\n", string(log))
+	// last line exceeding read chunk
+	longLine := strings.Repeat("x", 10000)
+	err = backend.Log(appendName, longLine)
+	require.NoError(t, err)
+	err = appender.AppendLog(appendName, func(last []byte) (string, []storage.LogMessage, error) {
+		require.Equal(t, longLine, string(last))
+		return "done", nil, nil
+	})
+	require.NoError(t, err)
+	// follow-up messages
+	followUpName := "checkAppendLogFollowUp"
+	err = appender.AppendLog(appendName, func(last []byte) (string, []storage.LogMessage, error) {
+		require.Equal(t, "done", string(last))
+		return "", []storage.LogMessage{{Name: followUpName, Message: "followUp"}}, nil
+	})
+	require.NoError(t, err)
+	log, err = logReader.ReadLog(followUpName)
+	require.NoError(t, err)
+	require.Equal(t, "followUp\n", string(log))
+	log, err = logReader.ReadLog(appendName)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(log), "done\n"))
 }
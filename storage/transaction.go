@@ -0,0 +1,395 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrTransactionFinished indicates the use of a [Transaction] which has already been committed or rolled back.
+var ErrTransactionFinished = errors.New("transaction already finished")
+
+// ErrCommitPending indicates a commit which has been recorded durably, but could not be applied completely
+// (see [TransactionalBackend.Commit]). The commit is completed during the next access of the backend.
+var ErrCommitPending = errors.New("commit recorded but not yet applied")
+
+// OperationKind defines the kind of an [Operation].
+type OperationKind int
+
+const (
+	// OperationCreate creates a new entry.
+	OperationCreate OperationKind = iota + 1
+	// OperationUpdate adds a new version to an existing entry.
+	OperationUpdate
+	// OperationDelete deletes an existing entry.
+	OperationDelete
+	// OperationLog writes a message to a log (see [Backend.Log]).
+	OperationLog
+)
+
+// Operation describes a single modification committed via [TransactionalBackend.Commit].
+type Operation struct {
+	// Kind is the kind of modification.
+	Kind OperationKind
+	// Name is the name of the modified entry (respectively log in case of [OperationLog]).
+	Name string
+	// Data is the data to write ([OperationCreate] and [OperationUpdate]) or the message to log ([OperationLog]).
+	Data []byte
+	// Expected is the current version of the entry the modification is based on ([OperationUpdate] and [OperationDelete] only).
+	Expected Version
+	// Time is the time to record as the version respectively deletion time ([OperationCreate], [OperationUpdate] and
+	// [OperationDelete] only). If zero, the time of the commit is recorded.
+	Time time.Time
+}
+
+// commitTime gets the time to record for the operation (the submitted commit time, if the operation does not define one).
+func (operation *Operation) commitTime(now time.Time) time.Time {
+	if operation.Time.IsZero() {
+		return now
+	}
+	return operation.Time
+}
+
+// TransactionalBackend is implemented by backends capable of applying multiple modifications atomically.
+type TransactionalBackend interface {
+	Backend
+	// Commit applies the submitted operations atomically. Means, either all or none of the operations are applied.
+	//
+	// The operations are applied in order. Multiple operations may refer to the same entry; each of them is checked
+	// against the entry state resulting from the preceding ones. The commit is rejected with a [ConflictError], if an entry to create already exists or if the current version
+	// of an entry to update or delete does not match the expected one. If an entry to update or delete does not
+	// exist, [ErrNotExist] is returned.
+	//
+	// An error wrapping [ErrCommitPending] indicates a commit which has been accepted and recorded durably, but not
+	// yet applied completely. Such a commit is completed during the next access and must not be repeated.
+	Commit(operations []Operation) error
+}
+
+type stagedEntry struct {
+	// base is the entry version the staged modification is based on (0, if the entry has been created within the transaction).
+	base Version
+	// data is the staged entry data (nil, if the entry has been deleted within the transaction).
+	data []byte
+}
+
+func (staged *stagedEntry) version() Version {
+	return staged.base + 1
+}
+
+// Transaction stages modifications of a [TransactionalBackend] until they are committed atomically.
+//
+// A Transaction implements the [Backend] interface itself. Reads via a Transaction reflect the modifications
+// staged so far. Modifications are only visible via the underlying backend after [Transaction.Commit]
+// has been invoked. Log messages written via [Transaction.Log] are staged, too, and committed together with the
+// staged modifications. History and log reads are passed to the underlying backend, if it implements
+// [HistoryBackend] respectively [LogReaderBackend]. Otherwise [errors.ErrUnsupported] is returned.
+type Transaction struct {
+	backend  TransactionalBackend
+	lock     sync.RWMutex
+	staged   map[string]*stagedEntry
+	names    []string
+	logs     []stagedLog
+	finished bool
+}
+
+type stagedLog struct {
+	name    string
+	message string
+}
+
+// Begin starts a new [Transaction] on the submitted backend.
+//
+// If the submitted backend is not a [TransactionalBackend], [errors.ErrUnsupported] is returned.
+func Begin(backend Backend) (*Transaction, error) {
+	transactional, ok := backend.(TransactionalBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w (backend '%s' does not support transactions)", errors.ErrUnsupported, backend.URI())
+	}
+	return &Transaction{
+		backend: transactional,
+		staged:  make(map[string]*stagedEntry),
+	}, nil
+}
+
+// Names gets the names of all entries modified within this transaction (in the order of their first modification).
+func (tx *Transaction) Names() []string {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	return slices.Clone(tx.names)
+}
+
+// Commit applies all staged modifications and log messages to the underlying backend.
+//
+// See [TransactionalBackend.Commit] for the possible reasons of a rejected commit. Whether the commit
+// succeeds or fails, the transaction is finished afterwards.
+func (tx *Transaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.finished {
+		return ErrTransactionFinished
+	}
+	tx.finished = true
+	operations := make([]Operation, 0, len(tx.names))
+	for _, name := range tx.names {
+		staged := tx.staged[name]
+		switch {
+		case staged.base == 0 && staged.data != nil:
+			operations = append(operations, Operation{Kind: OperationCreate, Name: name, Data: staged.data})
+		case staged.data != nil:
+			operations = append(operations, Operation{Kind: OperationUpdate, Name: name, Data: staged.data, Expected: staged.base})
+		case staged.base != 0:
+			operations = append(operations, Operation{Kind: OperationDelete, Name: name, Expected: staged.base})
+		}
+	}
+	for _, log := range tx.logs {
+		operations = append(operations, Operation{Kind: OperationLog, Name: log.name, Data: []byte(log.message)})
+	}
+	tx.staged = make(map[string]*stagedEntry)
+	tx.logs = nil
+	if len(operations) == 0 {
+		return nil
+	}
+	return tx.backend.Commit(operations)
+}
+
+// Rollback discards all staged modifications as well as the staged log messages and finishes the transaction.
+func (tx *Transaction) Rollback() {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.finished = true
+	tx.staged = make(map[string]*stagedEntry)
+	tx.logs = nil
+}
+
+func (tx *Transaction) URI() string {
+	return tx.backend.URI()
+}
+
+func (tx *Transaction) Create(name string, data []byte) (string, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.finished {
+		return "", ErrTransactionFinished
+	}
+	nextName := name
+	nextSuffix := 1
+	for {
+		current, err := tx.currentVersion(nextName)
+		if err == nil {
+			nextSuffix++
+			nextName = fmt.Sprintf("%s (%d)", name, nextSuffix)
+			continue
+		} else if !errors.Is(err, ErrNotExist) {
+			return "", err
+		}
+		staged := tx.staged[nextName]
+		if staged != nil {
+			// re-created after delete within the transaction
+			staged.data = data
+		} else {
+			tx.stage(nextName, &stagedEntry{base: current, data: data})
+		}
+		return nextName, nil
+	}
+}
+
+func (tx *Transaction) Update(name string, data []byte) (Version, error) {
+	return tx.update(name, data, nil)
+}
+
+func (tx *Transaction) UpdateIf(name string, data []byte, expected Version) (Version, error) {
+	return tx.update(name, data, &expected)
+}
+
+func (tx *Transaction) update(name string, data []byte, expected *Version) (Version, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.finished {
+		return 0, ErrTransactionFinished
+	}
+	current, err := tx.currentVersion(name)
+	if err != nil {
+		return 0, err
+	}
+	if expected != nil && current != *expected {
+		return 0, &ConflictError{Name: name, Expected: *expected, Current: current}
+	}
+	staged := tx.staged[name]
+	if staged != nil {
+		staged.data = data
+	} else {
+		staged = &stagedEntry{base: current, data: data}
+		tx.stage(name, staged)
+	}
+	return staged.version(), nil
+}
+
+func (tx *Transaction) Delete(name string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.finished {
+		return ErrTransactionFinished
+	}
+	current, err := tx.currentVersion(name)
+	if err != nil {
+		return err
+	}
+	staged := tx.staged[name]
+	if staged != nil {
+		staged.data = nil
+	} else {
+		tx.stage(name, &stagedEntry{base: current})
+	}
+	return nil
+}
+
+func (tx *Transaction) List() (Names, error) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	backendNames, err := tx.backend.List()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for {
+		name := backendNames.Next()
+		if name == "" {
+			break
+		}
+		staged := tx.staged[name]
+		if staged == nil || staged.data != nil {
+			names = append(names, name)
+		}
+	}
+	for name, staged := range tx.staged {
+		if staged.base == 0 && staged.data != nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return &memoryBackendNames{names: names}, nil
+}
+
+func (tx *Transaction) Get(name string) ([]byte, error) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	staged := tx.staged[name]
+	if staged == nil {
+		return tx.backend.Get(name)
+	}
+	if staged.data == nil {
+		return nil, ErrNotExist
+	}
+	return staged.data, nil
+}
+
+func (tx *Transaction) GetVersions(name string) ([]Version, error) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	staged := tx.staged[name]
+	if staged == nil {
+		return tx.backend.GetVersions(name)
+	}
+	if staged.data == nil {
+		return nil, ErrNotExist
+	}
+	if staged.base == 0 {
+		return []Version{staged.version()}, nil
+	}
+	versions, err := tx.backend.GetVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Version{staged.version()}, versions...), nil
+}
+
+func (tx *Transaction) GetVersion(name string, version Version) ([]byte, error) {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	staged := tx.staged[name]
+	if staged == nil {
+		return tx.backend.GetVersion(name, version)
+	}
+	if staged.data == nil || (staged.base == 0 && version != staged.version()) {
+		return nil, ErrNotExist
+	}
+	if version == staged.version() {
+		return staged.data, nil
+	}
+	return tx.backend.GetVersion(name, version)
+}
+
+func (tx *Transaction) ListHistory() (Names, error) {
+	history, ok := tx.backend.(HistoryBackend)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return history.ListHistory()
+}
+
+func (tx *Transaction) GetHistory(name string) (*History, error) {
+	history, ok := tx.backend.(HistoryBackend)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return history.GetHistory(name)
+}
+
+func (tx *Transaction) GetHistoryVersion(name string, version Version) ([]byte, error) {
+	history, ok := tx.backend.(HistoryBackend)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return history.GetHistoryVersion(name, version)
+}
+
+func (tx *Transaction) Log(name string, message string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.finished {
+		return ErrTransactionFinished
+	}
+	tx.logs = append(tx.logs, stagedLog{name: name, message: message})
+	return nil
+}
+
+func (tx *Transaction) ReadLog(name string) ([]byte, error) {
+	logReader, ok := tx.backend.(LogReaderBackend)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return logReader.ReadLog(name)
+}
+
+// currentVersion determines the current version of an entry as seen by the transaction.
+func (tx *Transaction) currentVersion(name string) (Version, error) {
+	staged := tx.staged[name]
+	if staged != nil {
+		if staged.data == nil {
+			return staged.base, ErrNotExist
+		}
+		return staged.version(), nil
+	}
+	versions, err := tx.backend.GetVersions(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, ErrNotExist
+	}
+	return versions[0], nil
+}
+
+func (tx *Transaction) stage(name string, staged *stagedEntry) {
+	tx.staged[name] = staged
+	if !slices.Contains(tx.names, name) {
+		tx.names = append(tx.names, name)
+	}
+}
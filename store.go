@@ -8,19 +8,26 @@ package certstore
 
 import (
 	"bytes"
+	"cmp"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"maps"
+	"math/big"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hdecarne-github/go-certstore/certs"
@@ -29,18 +36,28 @@ import (
 	"github.com/hdecarne-github/go-log"
 	"github.com/jellydator/ttlcache/v3"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/hkdf"
 )
 
 var ErrNoKey = errors.New("no key")
 var ErrNoCertificate = errors.New("no certificate")
+var ErrNoCertificateRequest = errors.New("no certificate request")
 var ErrInvalidIssuer = errors.New("invalid issuer certificate")
+var ErrAlreadyRevoked = errors.New("certificate already revoked")
+var ErrReadOnly = errors.New("read-only store entry")
 
 // A Registry represents a X.509 certificate store.
 type Registry struct {
-	settings   *storeSettings
-	backend    storage.Backend
-	entryCache *ttlcache.Cache[string, *RegistryEntry]
-	logger     *zerolog.Logger
+	settings           *storeSettings
+	backend            storage.Backend
+	entryCache         *ttlcache.Cache[string, *RegistryEntry]
+	auditChain         *auditChain
+	auditSink          AuditSink
+	auditSinks         AuditSink
+	auditFailurePolicy AuditFailurePolicy
+	keyStores          map[string]keys.KeyStore
+	changes            *changeNotifier
+	logger             *zerolog.Logger
 }
 
 // Name gets the registry name which is derived from the registry's storage location.
@@ -59,20 +76,22 @@ func (registry *Registry) Name() string {
 func (registry *Registry) CreateCertificate(name string, factory certs.CertificateFactory, user string) (string, error) {
 	key, certificate, err := factory.New()
 	if err != nil {
-		return "", err
+		return "", registry.auditFailure(auditCreateCertificate, name, user, err)
 	}
 	data := &registryEntryData{}
 	if key != nil {
-		err = data.setKey(key, registry.settings.Secret)
+		err = registry.setEntryKey(data, key)
 		if err != nil {
-			return "", err
+			return "", registry.auditFailure(auditCreateCertificate, name, user, err)
 		}
 	}
 	data.setCertificate(certificate)
+	data.Factory = factory.Name()
 	createdName, err := registry.createEntryData(name, data)
-	if err == nil {
-		registry.audit(auditCreateCertificate, createdName, user)
+	if err != nil {
+		return "", registry.auditFailure(auditCreateCertificate, name, user, err)
 	}
+	err = registry.audit(auditCreateCertificate, createdName, user, auditSerial(certificate.SerialNumber))
 	return createdName, err
 }
 
@@ -86,11 +105,11 @@ func (registry *Registry) CreateCertificate(name string, factory certs.Certifica
 func (registry *Registry) MergeCertificate(name string, certificate *x509.Certificate, user string) (string, bool, error) {
 	entries, err := registry.Entries()
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeCertificate, name, user, err)
 	}
 	entry, err := entries.Find(func(entry *RegistryEntry) bool { return entry.matchCertificate(certificate) })
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeCertificate, name, user, err)
 	}
 	var mergedName string
 	var merged bool
@@ -100,7 +119,7 @@ func (registry *Registry) MergeCertificate(name string, certificate *x509.Certif
 		if merged {
 			err = entry.mergeCertificate(certificate)
 			if err != nil {
-				return "", false, err
+				return "", false, registry.auditFailure(auditMergeCertificate, name, user, err)
 			}
 		}
 	} else {
@@ -108,16 +127,16 @@ func (registry *Registry) MergeCertificate(name string, certificate *x509.Certif
 		data.setCertificate(certificate)
 		mergedName, err = registry.createEntryData(name, data)
 		if err != nil {
-			return "", false, err
+			return "", false, registry.auditFailure(auditMergeCertificate, name, user, err)
 		}
 	}
 	if merged {
 		if registry.entryCache != nil {
 			registry.entryCache.Delete(mergedName)
 		}
-		registry.audit(auditMergeCertificate, mergedName, user)
+		err = registry.audit(auditMergeCertificate, mergedName, user, auditSerial(certificate.SerialNumber))
 	}
-	return mergedName, merged, nil
+	return mergedName, merged, err
 }
 
 // CreateCertificateRequest creates a new X.509 certificate request using the provided [certs.CertificateRequestFactory].
@@ -131,21 +150,85 @@ func (registry *Registry) MergeCertificate(name string, certificate *x509.Certif
 func (registry *Registry) CreateCertificateRequest(name string, factory certs.CertificateRequestFactory, user string) (string, error) {
 	key, certificateRequest, err := factory.New()
 	if err != nil {
-		return "", err
+		return "", registry.auditFailure(auditCreateCertificateRequest, name, user, err)
 	}
 	data := &registryEntryData{}
-	err = data.setKey(key, registry.settings.Secret)
+	err = registry.setEntryKey(data, key)
 	if err != nil {
-		return "", err
+		return "", registry.auditFailure(auditCreateCertificateRequest, name, user, err)
 	}
 	data.setCertificateRequest(certificateRequest)
 	createdName, err := registry.createEntryData(name, data)
-	if err == nil {
-		registry.audit(auditCreateCertificateRequest, createdName, user)
+	if err != nil {
+		return "", registry.auditFailure(auditCreateCertificateRequest, name, user, err)
 	}
+	err = registry.audit(auditCreateCertificateRequest, createdName, user)
 	return createdName, err
 }
 
+// SignRequest issues a new X.509 certificate for the certificate request stored in the named request entry.
+//
+// The certificate is issued by the named issuer entry using the submitted template. If the template does not define
+// a subject or any subject alternative names, these are taken from the certificate request. The request's signature
+// is verified before the certificate is issued. The issued certificate is merged into the request entry, so
+// key, certificate request and certificate are kept together.
+// If the request entry does not contain a certificate request, [ErrNoCertificateRequest] is returned.
+// If the issuer entry is not suitable for issuing certificates, [ErrInvalidIssuer] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) SignRequest(issuerName string, requestName string, template *x509.Certificate, user string) (*x509.Certificate, error) {
+	requestEntry, err := registry.Entry(requestName)
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, err, auditIssuer(issuerName))
+	}
+	if !requestEntry.HasCertificateRequest() {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, ErrNoCertificateRequest, auditIssuer(issuerName))
+	}
+	certificateRequest := requestEntry.CertificateRequest()
+	err = certificateRequest.CheckSignature()
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, fmt.Errorf("invalid certificate request signature (cause: %w)", err), auditIssuer(issuerName))
+	}
+	issuerEntry, err := registry.Entry(issuerName)
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, err, auditIssuer(issuerName))
+	}
+	if !issuerEntry.CanIssue(x509.KeyUsageCertSign) {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, ErrInvalidIssuer, auditIssuer(issuerName))
+	}
+	issuerKey, err := issuerEntry.AccessKey(user)
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, err, auditIssuer(issuerName))
+	}
+	applyCertificateRequest(template, certificateRequest)
+	factory := certs.NewRemoteCertificateFactoryWithSerialNumbers(template, certificateRequest, issuerEntry.Certificate(), issuerKey, registry.NewSerialNumberGenerator(false))
+	_, certificate, err := factory.New()
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, err, auditIssuer(issuerName))
+	}
+	err = requestEntry.mergeCertificate(certificate)
+	if err != nil {
+		return nil, registry.auditFailure(auditSignCertificateRequest, requestName, user, err, auditIssuer(issuerName))
+	}
+	if registry.entryCache != nil {
+		registry.entryCache.Delete(requestName)
+	}
+	err = registry.audit(auditSignCertificateRequest, requestName, user, auditSerial(certificate.SerialNumber), auditIssuer(issuerName))
+	return certificate, err
+}
+
+func applyCertificateRequest(template *x509.Certificate, certificateRequest *x509.CertificateRequest) {
+	if template.Subject.CommonName == "" && len(template.Subject.Names) == 0 && len(template.Subject.ExtraNames) == 0 {
+		template.Subject = certificateRequest.Subject
+	}
+	if len(template.DNSNames) == 0 && len(template.EmailAddresses) == 0 && len(template.IPAddresses) == 0 && len(template.URIs) == 0 {
+		template.DNSNames = certificateRequest.DNSNames
+		template.EmailAddresses = certificateRequest.EmailAddresses
+		template.IPAddresses = certificateRequest.IPAddresses
+		template.URIs = certificateRequest.URIs
+	}
+}
+
 // MergeCertificateRequest merges a X.509 certificate request into the store.
 //
 // If the certfiicate request is already in the store, the name of the existing store entry as well as false is returned.
@@ -156,11 +239,11 @@ func (registry *Registry) CreateCertificateRequest(name string, factory certs.Ce
 func (registry *Registry) MergeCertificateRequest(name string, certificateRequest *x509.CertificateRequest, user string) (string, bool, error) {
 	entries, err := registry.Entries()
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeCertificateRequest, name, user, err)
 	}
 	entry, err := entries.Find(func(entry *RegistryEntry) bool { return entry.matchCertificateRequest(certificateRequest) })
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeCertificateRequest, name, user, err)
 	}
 	var mergedName string
 	var merged bool
@@ -170,7 +253,7 @@ func (registry *Registry) MergeCertificateRequest(name string, certificateReques
 		if merged {
 			err = entry.mergeCertificateRequest(certificateRequest)
 			if err != nil {
-				return "", false, err
+				return "", false, registry.auditFailure(auditMergeCertificateRequest, name, user, err)
 			}
 		}
 	} else {
@@ -178,16 +261,16 @@ func (registry *Registry) MergeCertificateRequest(name string, certificateReques
 		data.setCertificateRequest(certificateRequest)
 		mergedName, err = registry.createEntryData(name, data)
 		if err != nil {
-			return "", false, err
+			return "", false, registry.auditFailure(auditMergeCertificateRequest, name, user, err)
 		}
 	}
 	if merged {
 		if registry.entryCache != nil {
 			registry.entryCache.Delete(mergedName)
 		}
-		registry.audit(auditMergeCertificateRequest, mergedName, user)
+		err = registry.audit(auditMergeCertificateRequest, mergedName, user)
 	}
-	return mergedName, merged, nil
+	return mergedName, merged, err
 }
 
 // MergeKey merges a X.509 certificate key into the store.
@@ -200,11 +283,11 @@ func (registry *Registry) MergeCertificateRequest(name string, certificateReques
 func (registry *Registry) MergeKey(name string, key crypto.PrivateKey, user string) (string, bool, error) {
 	entries, err := registry.Entries()
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeKey, name, user, err)
 	}
 	entry, err := entries.Find(func(entry *RegistryEntry) bool { return entry.matchKey(key) })
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeKey, name, user, err)
 	}
 	var mergedName string
 	var merged bool
@@ -214,24 +297,27 @@ func (registry *Registry) MergeKey(name string, key crypto.PrivateKey, user stri
 		if merged {
 			err = entry.mergeKey(key)
 			if err != nil {
-				return "", false, err
+				return "", false, registry.auditFailure(auditMergeKey, name, user, err)
 			}
 		}
 	} else {
 		data := &registryEntryData{}
-		data.setKey(key, registry.settings.Secret)
+		err = registry.setEntryKey(data, key)
+		if err != nil {
+			return "", false, registry.auditFailure(auditMergeKey, name, user, err)
+		}
 		mergedName, err = registry.createEntryData(name, data)
 		if err != nil {
-			return "", false, err
+			return "", false, registry.auditFailure(auditMergeKey, name, user, err)
 		}
 	}
 	if merged {
 		if registry.entryCache != nil {
 			registry.entryCache.Delete(mergedName)
 		}
-		registry.audit(auditMergeKey, mergedName, user)
+		err = registry.audit(auditMergeKey, mergedName, user)
 	}
-	return mergedName, merged, nil
+	return mergedName, merged, err
 }
 
 // MergeRevocationList merges a X.509 certificate revocation list into the store.
@@ -244,11 +330,11 @@ func (registry *Registry) MergeKey(name string, key crypto.PrivateKey, user stri
 func (registry *Registry) MergeRevocationList(name string, revocationList *x509.RevocationList, user string) (string, bool, error) {
 	entries, err := registry.Entries()
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeRevocationList, name, user, err)
 	}
 	entry, err := entries.Find(func(entry *RegistryEntry) bool { return entry.matchRevocationList(revocationList) })
 	if err != nil {
-		return "", false, err
+		return "", false, registry.auditFailure(auditMergeRevocationList, name, user, err)
 	}
 	var mergedName string
 	var merged bool
@@ -258,7 +344,7 @@ func (registry *Registry) MergeRevocationList(name string, revocationList *x509.
 		if merged {
 			err = entry.mergeRevocationList(revocationList)
 			if err != nil {
-				return "", false, err
+				return "", false, registry.auditFailure(auditMergeRevocationList, name, user, err)
 			}
 		}
 	} else {
@@ -266,24 +352,35 @@ func (registry *Registry) MergeRevocationList(name string, revocationList *x509.
 		data.setRevocationList(revocationList)
 		mergedName, err = registry.createEntryData(name, data)
 		if err != nil {
-			return "", false, err
+			return "", false, registry.auditFailure(auditMergeRevocationList, name, user, err)
 		}
 	}
 	if merged {
 		if registry.entryCache != nil {
 			registry.entryCache.Delete(mergedName)
 		}
-		registry.audit(auditMergeRevocationList, mergedName, user)
+		err = registry.audit(auditMergeRevocationList, mergedName, user)
 	}
-	return mergedName, merged, nil
+	return mergedName, merged, err
 }
 
 // Merge merges another X.509 certificate store into the store.
 //
-// The submitted store is merged by merging each of its entries individually.
+// The submitted store is merged by merging each of its entries individually. If the store's backend supports
+// transactions (see [Registry.Transaction]), the merge is applied atomically. Means, either all or none of the
+// submitted store's entries are merged.
 //
 // Invoking this function is recorded in the audit log using the the submitted user name.
 func (registry *Registry) Merge(other *Registry, user string) error {
+	if _, ok := registry.backend.(storage.TransactionalBackend); ok {
+		return registry.Transaction(func(tx *Registry) error {
+			return tx.merge(other, user)
+		})
+	}
+	return registry.merge(other, user)
+}
+
+func (registry *Registry) merge(other *Registry, user string) error {
 	otherEntries, err := other.Entries()
 	if err != nil {
 		return err
@@ -318,7 +415,11 @@ func (registry *Registry) mergeEntry(entry *RegistryEntry, user string) error {
 		}
 	}
 	if entry.HasKey() {
-		_, _, err := registry.MergeKey("Imported key", entry.Key(user), user)
+		key, err := entry.AccessKey(user)
+		if err != nil {
+			return err
+		}
+		_, _, err = registry.MergeKey("Imported key", key, user)
 		if err != nil {
 			return err
 		}
@@ -347,19 +448,51 @@ func (registry *Registry) Entries() (*RegistryEntries, error) {
 
 // Entry looks up the entry with the submitted name in the store.
 //
+// A cached entry is only returned, if it still matches the entry's current storage version. Hence
+// updates made via other [Registry] instances or processes are always reflected.
+//
 // If the submitted name does not exist, [storage.ErrNotExist] is returned.
 func (registry *Registry) Entry(name string) (*RegistryEntry, error) {
 	if registry.entryCache != nil {
 		cached := registry.entryCache.Get(name)
 		if cached != nil {
-			return cached.Value(), nil
+			versions, err := registry.backend.GetVersions(name)
+			if err != nil {
+				registry.entryCache.Delete(name)
+				return nil, err
+			}
+			if len(versions) == 0 {
+				registry.entryCache.Delete(name)
+				return nil, storage.ErrNotExist
+			}
+			if versions[0] == cached.Value().version {
+				return cached.Value(), nil
+			}
+			registry.logger.Debug().Msgf("discarding stale cached entry '%s' (cached version: %d current version: %d)", name, cached.Value().version, versions[0])
 		}
 	}
-	data, err := registry.getEntryData(name)
+	version, data, err := registry.getLatestEntryData(name)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := registry.newEntry(name, version, data)
 	if err != nil {
 		return nil, err
 	}
-	key, err := data.getKey(registry.settings.Secret)
+	if registry.entryCache != nil {
+		registry.entryCache.Set(name, entry, ttlcache.DefaultTTL)
+	}
+	return entry, nil
+}
+
+func (registry *Registry) newEntry(name string, version storage.Version, data *registryEntryData) (*RegistryEntry, error) {
+	var key crypto.PrivateKey
+	var err error
+	if data.KeyRef != "" {
+		key, err = registry.resolveKeyRef(data.KeyRef)
+	} else {
+		key, err = registry.getEntryKey(data)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -375,43 +508,241 @@ func (registry *Registry) Entry(name string) (*RegistryEntry, error) {
 	if err != nil {
 		return nil, err
 	}
+	revocations, err := data.getRevocations()
+	if err != nil {
+		return nil, err
+	}
 	entry := &RegistryEntry{
 		registry:           registry,
 		name:               name,
+		version:            version,
 		key:                key,
 		certificate:        certificate,
 		certificateRequest: certificateRequest,
 		revocationList:     revocationList,
+		revocations:        revocations,
+		attributes:         data.Attributes,
 	}
-	if registry.entryCache != nil {
-		registry.entryCache.Set(name, entry, ttlcache.DefaultTTL)
+	return entry, nil
+}
+
+func (registry *Registry) newReadOnlyEntry(name string, version storage.Version, dataBytes []byte) (*RegistryEntry, error) {
+	data, err := registry.unmarshalEntryData(dataBytes)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := registry.newEntry(name, version, data)
+	if err != nil {
+		return nil, err
 	}
+	entry.readOnly = true
 	return entry, nil
 }
 
+// Restore restores the given version of the entry with the submitted name.
+//
+// The restored data is written back as the newest version of the entry. Hence the entry's history is preserved.
+// If the submitted name or version does not exist, [storage.ErrNotExist] is returned.
+// If the entry is updated concurrently while restoring, [storage.ErrConflict] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) Restore(name string, version storage.Version, user string) (storage.Version, error) {
+	versions, err := registry.backend.GetVersions(name)
+	if err != nil {
+		return 0, registry.auditFailure(auditRestore, name, user, err, auditVersion(version))
+	}
+	if len(versions) == 0 {
+		return 0, registry.auditFailure(auditRestore, name, user, storage.ErrNotExist, auditVersion(version))
+	}
+	dataBytes, err := registry.backend.GetVersion(name, version)
+	if err != nil {
+		return 0, registry.auditFailure(auditRestore, name, user, err, auditVersion(version))
+	}
+	_, err = registry.unmarshalEntryData(dataBytes)
+	if err != nil {
+		return 0, registry.auditFailure(auditRestore, name, user, err, auditVersion(version))
+	}
+	registry.logger.Info().Msgf("restoring version %d of entry '%s'...", version, name)
+	restoredVersion, err := storage.UpdateIf(registry.backend, name, dataBytes, versions[0])
+	if err != nil {
+		return 0, registry.auditFailure(auditRestore, name, user, err, auditVersion(version))
+	}
+	if registry.entryCache != nil {
+		registry.entryCache.Delete(name)
+	}
+	registry.notify(ChangeUpdated, name, restoredVersion)
+	err = registry.audit(auditRestore, name, user, auditVersion(version))
+	return restoredVersion, err
+}
+
 // Delete deletes the entry with the submitted name from the store.
 //
 // If the submitted name does not exist, [storage.ErrNotExist] is returned.
 func (registry *Registry) Delete(name string, user string) error {
 	err := registry.backend.Delete(name)
+	if err != nil {
+		return registry.auditFailure(auditDelete, name, user, err)
+	}
+	if registry.entryCache != nil {
+		registry.entryCache.Delete(name)
+	}
+	registry.notify(ChangeDeleted, name, 0)
+	return registry.audit(auditDelete, name, user)
+}
+
+// RevocationReason represents the reason code of a certificate revocation (see RFC 5280 section 5.3.1).
+type RevocationReason int
+
+const (
+	RevocationReasonUnspecified          RevocationReason = 0
+	RevocationReasonKeyCompromise        RevocationReason = 1
+	RevocationReasonCACompromise         RevocationReason = 2
+	RevocationReasonAffiliationChanged   RevocationReason = 3
+	RevocationReasonSuperseded           RevocationReason = 4
+	RevocationReasonCessationOfOperation RevocationReason = 5
+	RevocationReasonCertificateHold      RevocationReason = 6
+	RevocationReasonPrivilegeWithdrawn   RevocationReason = 9
+	RevocationReasonAACompromise         RevocationReason = 10
+)
+
+const defaultRevocationListLifetime = 30 * 24 * time.Hour
+
+// Revoke revokes the certificate of the entry with the submitted name.
+//
+// The issuing CA entry is looked up in the store and the revocation is recorded there. Afterwards
+// the issuer's revocation list is re-signed containing all revocations recorded so far (including the entries
+// of a revocation list set via [RegistryEntry.ResetRevocationList]). The number of
+// the re-signed revocation list is derived from the previous one by incrementing it.
+// If the entry does not contain a certificate, [ErrNoCertificate] is returned.
+// If no suitable issuer entry is found, [ErrInvalidIssuer] is returned.
+// If the certificate has already been revoked, [ErrAlreadyRevoked] is returned.
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (registry *Registry) Revoke(name string, reason RevocationReason, user string) error {
+	entry, err := registry.Entry(name)
+	if err != nil {
+		return registry.auditFailure(auditRevokeCertificate, name, user, err)
+	}
+	if !entry.HasCertificate() {
+		return registry.auditFailure(auditRevokeCertificate, name, user, ErrNoCertificate)
+	}
+	issuer, err := registry.findIssuer(entry.Certificate(), x509.KeyUsageCRLSign)
+	if err != nil {
+		return registry.auditFailure(auditRevokeCertificate, name, user, err)
+	}
+	if issuer == nil {
+		return registry.auditFailure(auditRevokeCertificate, name, user, ErrInvalidIssuer)
+	}
+	issuerKey, err := issuer.AccessKey(user)
+	if err != nil {
+		return registry.auditFailure(auditRevokeCertificate, name, user, err)
+	}
+	serialNumber := entry.Certificate().SerialNumber
+	_, _, err = registry.modifyEntryData(issuer.Name(), func(data *registryEntryData) error {
+		revocations, err := data.getRevocations()
+		if err != nil {
+			return err
+		}
+		previous, err := data.getRevocationList()
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			// retain the entries of a revocation list set via ResetRevocationList
+			revocations = mergeRevocations(revocations, previous.RevokedCertificateEntries)
+		}
+		for _, revocation := range revocations {
+			if revocation.SerialNumber.Cmp(serialNumber) == 0 {
+				return ErrAlreadyRevoked
+			}
+		}
+		now := time.Now()
+		revocations = append(revocations, x509.RevocationListEntry{
+			SerialNumber:   serialNumber,
+			RevocationTime: now,
+			ReasonCode:     int(reason),
+		})
+		template := newRevocationListTemplate(previous, revocations, now)
+		revocationList, err := certs.NewLocalRevocationListFactory(template).New(issuer.Certificate(), issuerKey)
+		if err != nil {
+			return err
+		}
+		data.setRevocations(revocations)
+		data.setRevocationList(revocationList)
+		return nil
+	})
+	if err != nil {
+		return registry.auditFailure(auditRevokeCertificate, name, user, err)
+	}
+	err = registry.audit(auditRevokeCertificate, name, user, auditSerial(serialNumber), auditIssuer(issuer.Name()))
 	if err != nil {
 		return err
 	}
-	registry.entryCache.Delete(name)
-	registry.audit(auditDelete, name, user)
-	return nil
+	return registry.audit(auditCreateRevocationList, issuer.Name(), user)
+}
+
+// mergeRevocations adds the submitted entries not yet contained in the submitted revocations.
+func mergeRevocations(revocations []x509.RevocationListEntry, entries []x509.RevocationListEntry) []x509.RevocationListEntry {
+	for _, entry := range entries {
+		if !slices.ContainsFunc(revocations, func(revocation x509.RevocationListEntry) bool {
+			return revocation.SerialNumber.Cmp(entry.SerialNumber) == 0
+		}) {
+			revocations = append(revocations, x509.RevocationListEntry{
+				SerialNumber:   entry.SerialNumber,
+				RevocationTime: entry.RevocationTime,
+				ReasonCode:     entry.ReasonCode,
+			})
+		}
+	}
+	return revocations
+}
+
+func (registry *Registry) findIssuer(certificate *x509.Certificate, keyUsage x509.KeyUsage) (*RegistryEntry, error) {
+	if certs.IsRoot(certificate) {
+		return nil, nil
+	}
+	entries, err := registry.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return entries.Find(func(entry *RegistryEntry) bool {
+		return entry.CanIssue(keyUsage) && certs.IsIssuedBy(certificate, entry.Certificate())
+	})
+}
+
+func newRevocationListTemplate(previous *x509.RevocationList, revocations []x509.RevocationListEntry, now time.Time) *x509.RevocationList {
+	number := big.NewInt(1)
+	lifetime := defaultRevocationListLifetime
+	if previous != nil {
+		if previous.Number != nil {
+			number.Add(previous.Number, big.NewInt(1))
+		}
+		if previous.NextUpdate.After(previous.ThisUpdate) {
+			lifetime = previous.NextUpdate.Sub(previous.ThisUpdate)
+		}
+	}
+	return &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(lifetime),
+		RevokedCertificateEntries: revocations,
+	}
 }
 
 // CertPools wraps this store's entries into a [x509.CertPool].
 //
 // The first returned pool contains the root certificates. The second on the intermediate certificates.
 func (registry *Registry) CertPools() (*x509.CertPool, *x509.CertPool, error) {
-	roots := x509.NewCertPool()
-	intermediates := x509.NewCertPool()
 	entries, err := registry.Entries()
 	if err != nil {
 		return nil, nil, err
 	}
+	return entries.certPools()
+}
+
+func (entries *RegistryEntries) certPools() (*x509.CertPool, *x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
 	for {
 		entry, err := entries.Next()
 		if err != nil {
@@ -435,7 +766,61 @@ func (registry *Registry) isValidEntryName(name string) bool {
 	return !strings.HasPrefix(name, ".")
 }
 
+// historyBackend gets the [storage.HistoryBackend] interface of the submitted backend or
+// [errors.ErrUnsupported], if the backend does not record any history.
+func historyBackend(backend storage.Backend) (storage.HistoryBackend, error) {
+	history, ok := backend.(storage.HistoryBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w (backend '%s' does not record history)", errors.ErrUnsupported, backend.URI())
+	}
+	return history, nil
+}
+
+// logReaderBackend gets the [storage.LogReaderBackend] interface of the submitted backend or
+// [errors.ErrUnsupported], if the backend's logs cannot be read back.
+func logReaderBackend(backend storage.Backend) (storage.LogReaderBackend, error) {
+	logReader, ok := backend.(storage.LogReaderBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w (backend '%s' does not support log reads)", errors.ErrUnsupported, backend.URI())
+	}
+	return logReader, nil
+}
+
+// rewritableBackend gets the [storage.RewritableBackend] interface of the submitted backend or
+// [errors.ErrUnsupported], if the backend does not support rewriting entries.
+func rewritableBackend(backend storage.Backend) (storage.RewritableBackend, error) {
+	rewritable, ok := backend.(storage.RewritableBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w (backend '%s' does not support rewriting entries)", errors.ErrUnsupported, backend.URI())
+	}
+	return rewritable, nil
+}
+
+// prunableBackend gets the [storage.PrunableBackend] interface of the submitted backend or
+// [errors.ErrUnsupported], if the backend cannot remove previous versions of an entry.
+func prunableBackend(backend storage.Backend) (storage.PrunableBackend, error) {
+	prunable, ok := backend.(storage.PrunableBackend)
+	if !ok {
+		return nil, fmt.Errorf("%w (backend '%s' does not support pruning entries)", errors.ErrUnsupported, backend.URI())
+	}
+	return prunable, nil
+}
+
+// listAllEntries lists the names of all existing as well as deleted entries. If the submitted backend does not
+// record any history, only the existing entries are listed.
+func listAllEntries(backend storage.Backend) (storage.Names, error) {
+	history, ok := backend.(storage.HistoryBackend)
+	if !ok {
+		return backend.List()
+	}
+	return history.ListHistory()
+}
+
 func (registry *Registry) createEntryData(name string, data *registryEntryData) (string, error) {
+	err := data.assignID(nil)
+	if err != nil {
+		return "", err
+	}
 	dataBytes, err := registry.marshalEntryData(data)
 	if err != nil {
 		return "", err
@@ -444,22 +829,88 @@ func (registry *Registry) createEntryData(name string, data *registryEntryData)
 	if err != nil {
 		return "", err
 	}
+	registry.recordEntrySerialNumbers(createdName, data)
+	registry.notify(ChangeCreated, createdName, 1)
+	err = registry.checkEntryKey(createdName, data)
+	if err != nil {
+		return "", err
+	}
 	return createdName, nil
 }
 
-func (registry *Registry) updateEntryData(name string, data *registryEntryData) (storage.Version, error) {
+// recordEntrySerialNumbers records the serial numbers of a written entry in the serial number indexes.
+// As the entry itself has already been written at this point, a failure is only logged.
+func (registry *Registry) recordEntrySerialNumbers(name string, data *registryEntryData) {
+	err := registry.recordSerialNumbers(data)
+	if err != nil {
+		registry.logger.Warn().Err(err).Msgf("failed to record serial numbers of entry '%s'", name)
+	}
+}
+
+// entryUpdateRetryLimit defines how often an entry update is retried in case of concurrent updates.
+const entryUpdateRetryLimit = 5
+
+// updateEntryData writes the submitted entry data as a new version of the entry. The update fails with
+// [storage.ErrConflict], if the entry has been updated concurrently after the submitted version has been read.
+// Entry data without an id (written by a previous schema) gets a new id, which is persisted by the
+// conditional update exactly once.
+func (registry *Registry) updateEntryData(name string, version storage.Version, data *registryEntryData) (storage.Version, error) {
+	err := data.assignID(nil)
+	if err != nil {
+		return 0, err
+	}
 	dataBytes, err := registry.marshalEntryData(data)
 	if err != nil {
 		return 0, err
 	}
-	version, err := registry.backend.Update(name, dataBytes)
+	updatedVersion, err := storage.UpdateIf(registry.backend, name, dataBytes, version)
+	if err != nil {
+		return 0, err
+	}
+	registry.recordEntrySerialNumbers(name, data)
+	registry.notify(ChangeUpdated, name, updatedVersion)
+	err = registry.checkEntryKey(name, data)
 	if err != nil {
 		return 0, err
 	}
-	return version, nil
+	return updatedVersion, nil
+}
+
+// modifyEntryData reads the latest entry data, applies the submitted modification and writes it back.
+// If the entry has been updated concurrently in between, the modification is re-applied to the then latest
+// entry data. If the entry is still updated concurrently after [entryUpdateRetryLimit] attempts,
+// [storage.ErrConflict] is returned.
+func (registry *Registry) modifyEntryData(name string, modify func(data *registryEntryData) error) (storage.Version, *registryEntryData, error) {
+	var err error
+	for attempt := 1; attempt <= entryUpdateRetryLimit; attempt++ {
+		var version storage.Version
+		var data *registryEntryData
+		version, data, err = registry.getLatestEntryData(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		err = modify(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		var updatedVersion storage.Version
+		updatedVersion, err = registry.updateEntryData(name, version, data)
+		if err == nil {
+			if registry.entryCache != nil {
+				registry.entryCache.Delete(name)
+			}
+			return updatedVersion, data, nil
+		}
+		if !errors.Is(err, storage.ErrConflict) {
+			return 0, nil, err
+		}
+		registry.logger.Debug().Err(err).Msgf("retrying update of entry '%s' (attempt %d)...", name, attempt)
+	}
+	return 0, nil, fmt.Errorf("failed to update entry '%s' (cause: %w)", name, err)
 }
 
 func (registry *Registry) marshalEntryData(data *registryEntryData) ([]byte, error) {
+	data.Schema = entryDataSchemaCurrent
 	dataBytes, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal entry data (cause: %w)", err)
@@ -479,48 +930,44 @@ func (registry *Registry) getEntryData(name string) (*registryEntryData, error)
 	return data, nil
 }
 
-func (registry *Registry) unmarshalEntryData(dataBytes []byte) (*registryEntryData, error) {
-	data := &registryEntryData{Attributes: make(map[string]string, 0)}
-	err := json.Unmarshal(dataBytes, data)
+func (registry *Registry) getLatestEntryData(name string) (storage.Version, *registryEntryData, error) {
+	versions, err := registry.backend.GetVersions(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal entry data (cause: %w)", err)
+		return 0, nil, err
 	}
-	return data, nil
-}
-
-const storeAuditName = ".audit"
-
-func (registry *Registry) audit(pattern auditPattern, name string, user string) {
-	message := pattern.sprintf(name, user)
-	registry.logger.Info().Msgf("audit: %s", message)
-	err := registry.backend.Log(storeAuditName, message)
+	if len(versions) == 0 {
+		return 0, nil, storage.ErrNotExist
+	}
+	dataBytes, err := registry.backend.GetVersion(name, versions[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := registry.unmarshalEntryData(dataBytes)
 	if err != nil {
-		registry.logger.Fatal().Err(err).Msgf("failed to write audit log '%s'", message)
+		return 0, nil, err
 	}
+	return versions[0], data, nil
 }
 
-type auditPattern string
-
-const (
-	auditCreateCertificate        auditPattern = "%d;Create;Certificate;%s;%s"
-	auditCreateCertificateRequest auditPattern = "%d;Create;CertificateRequest;%s;%s"
-	auditCreateRevocationList     auditPattern = "%d;Create;RevocationList;%s;%s"
-	auditAccessKey                auditPattern = "%d;Access;Key;%s;%s"
-	auditMergeCertificate         auditPattern = "%d;Merge;Certificate;%s;%s"
-	auditMergeCertificateRequest  auditPattern = "%d;Merge;CertificateRequest;%s;%s"
-	auditMergeKey                 auditPattern = "%d;Merge;Key;%s;%s"
-	auditMergeRevocationList      auditPattern = "%d;Merge;RevocationList;%s;%s"
-	auditDelete                   auditPattern = "%d;Delete;-;%s;%s"
-)
-
-func (pattern auditPattern) sprintf(name string, user string) string {
-	return fmt.Sprintf(string(pattern), time.Now().UnixMilli(), name, user)
+func (registry *Registry) unmarshalEntryData(dataBytes []byte) (*registryEntryData, error) {
+	data, err := registry.decodeEntryData(dataBytes)
+	if err != nil {
+		return nil, err
+	}
+	// ids are only assigned by persisting writes (see updateEntryData)
+	_, err = registry.migrateEntryData(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 // RegistryEntries represents a traversable collection of store entries.
 type RegistryEntries struct {
 	registry *Registry
+	view     *RegistryView
 	names    storage.Names
+	name     string
 }
 
 // Next gets the next store entry in the collection.
@@ -530,12 +977,21 @@ func (entries *RegistryEntries) Next() (*RegistryEntry, error) {
 	var name string
 	for {
 		name = entries.names.Next()
+		entries.name = name
 		if name == "" {
 			return nil, nil
 		}
-		if entries.registry.isValidEntryName(name) {
+		if !entries.registry.isValidEntryName(name) {
+			continue
+		}
+		if entries.view == nil {
 			break
 		}
+		entry, err := entries.view.Entry(name)
+		if errors.Is(err, storage.ErrNotExist) {
+			continue
+		}
+		return entry, err
 	}
 	return entries.registry.Entry(name)
 }
@@ -561,11 +1017,14 @@ func (entries *RegistryEntries) Find(match func(entry *RegistryEntry) bool) (*Re
 type RegistryEntry struct {
 	registry           *Registry
 	name               string
+	version            storage.Version
 	key                crypto.PrivateKey
 	certificate        *x509.Certificate
 	certificateRequest *x509.CertificateRequest
 	revocationList     *x509.RevocationList
+	revocations        []x509.RevocationListEntry
 	attributes         map[string]string
+	readOnly           bool
 }
 
 // Name gets the name of the store entry.
@@ -573,6 +1032,64 @@ func (entry *RegistryEntry) Name() string {
 	return entry.name
 }
 
+// Version gets the storage version of the store entry.
+//
+// The version reflects the state of the store entry at the time it has been retrieved from the store.
+func (entry *RegistryEntry) Version() storage.Version {
+	return entry.version
+}
+
+// Versions gets the storage versions available for this store entry (newest first).
+//
+// The number of available versions is limited by the [storage.VersionLimit] of the underlying backend.
+func (entry *RegistryEntry) Versions() ([]storage.Version, error) {
+	return entry.registry.backend.GetVersions(entry.name)
+}
+
+// Modified gets the time the storage version of this store entry has been written.
+//
+// The zero time is returned, if the version is no longer retained by the underlying backend or the backend
+// does not implement [storage.HistoryBackend].
+func (entry *RegistryEntry) Modified() (time.Time, error) {
+	historyBackend, ok := entry.registry.backend.(storage.HistoryBackend)
+	if !ok {
+		return time.Time{}, nil
+	}
+	history, err := historyBackend.GetHistory(entry.name)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	for _, versionInfo := range history.Versions {
+		if versionInfo.Version == entry.version {
+			return versionInfo.Time, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// LoadVersion loads the state of this store entry as of the given storage version.
+//
+// The returned entry provides read access to the certificate, certificate request, revocation list,
+// attributes and key of the given version. Like for the current version, accessing the key is recorded
+// in the audit log. The returned entry is read-only (see [ErrReadOnly]).
+// If the submitted version does not exist, [storage.ErrNotExist] is returned.
+func (entry *RegistryEntry) LoadVersion(version storage.Version) (*RegistryEntry, error) {
+	dataBytes, err := entry.registry.backend.GetVersion(entry.name, version)
+	if err != nil {
+		return nil, err
+	}
+	return entry.registry.newReadOnlyEntry(entry.name, version, dataBytes)
+}
+
+// IsReadOnly determines whether this store entry is read-only (true) or not (false).
+//
+// Store entries representing a previous version (see [RegistryEntry.LoadVersion] and [Registry.AsOf]) are read-only.
+func (entry *RegistryEntry) IsReadOnly() bool {
+	return entry.readOnly
+}
+
 // IsRoot reports whether this store entry represents a root certificate.
 //
 // A store entry represents a root certificate if it contains a certificate and the latter is self-signed.
@@ -612,14 +1129,34 @@ func (entry *RegistryEntry) HasKey() bool {
 
 // Key gets the store entry's key.
 //
-// nil is returned if the store entry does not contain a key.
+// If the key is held by a [keys.KeyStore], the returned key is a [keys.StoredKey], which is only usable
+// as a [crypto.Signer]. nil is returned if the store entry does not contain a key. nil is also returned, if recording the key access
+// in the audit log fails (see [AuditFailurePolicy]). Use [RegistryEntry.AccessKey] to distinguish both cases.
 //
 // Invoking this function is recorded in the audit log using the the submitted user name.
 func (entry *RegistryEntry) Key(user string) crypto.PrivateKey {
-	if entry.key != nil {
-		entry.registry.audit(auditAccessKey, entry.name, user)
+	key, err := entry.AccessKey(user)
+	if err != nil {
+		entry.registry.logger.Error().Err(err).Msgf("denying access to key of entry '%s'", entry.name)
+		return nil
+	}
+	return key
+}
+
+// AccessKey gets the store entry's key like [RegistryEntry.Key], but reports a failure to record the key access
+// in the audit log as an error (wrapping [ErrAuditFailed]).
+//
+// Invoking this function is recorded in the audit log using the the submitted user name.
+func (entry *RegistryEntry) AccessKey(user string) (crypto.PrivateKey, error) {
+	if entry.key == nil {
+		return nil, nil
+	}
+	err := entry.registry.audit(auditAccessKey, entry.name, user)
+	if err != nil {
+		return nil, err
 	}
-	return entry.key
+	entry.registry.notify(ChangeKeyAccessed, entry.name, entry.version)
+	return entry.key, nil
 }
 
 // HasCertificate reports whether this store entry contains a certificate.
@@ -656,13 +1193,13 @@ type ExportFormat interface {
 
 func (entry *RegistryEntry) Export(out io.Writer, format ExportFormat, option ExportOption, password string, user string) error {
 	if entry.certificate == nil {
-		return ErrNoCertificate
+		return entry.registry.auditFailure(auditExportCertificate, entry.name, user, ErrNoCertificate, auditFormat(format))
 	}
 	var chain []*x509.Certificate
 	if (option & ExportOptionChain) == ExportOptionChain {
 		roots, intermediates, err := entry.registry.CertPools()
 		if err != nil {
-			return err
+			return entry.registry.auditFailure(auditExportCertificate, entry.name, user, err, auditFormat(format))
 		}
 		chains, err := entry.certificate.Verify(x509.VerifyOptions{
 			Roots:         roots,
@@ -678,13 +1215,24 @@ func (entry *RegistryEntry) Export(out io.Writer, format ExportFormat, option Ex
 	}
 	var key crypto.PrivateKey
 	if (option & ExportOptionKey) == ExportOptionKey {
-		key = entry.Key(user)
+		if isStoredKey(entry.key) {
+			return entry.registry.auditFailure(auditExportCertificate, entry.name, user, ErrKeyNotExportable, auditFormat(format))
+		}
+		var err error
+		key, err = entry.AccessKey(user)
+		if err != nil {
+			return entry.registry.auditFailure(auditExportCertificate, entry.name, user, err, auditFormat(format))
+		}
 	}
 	err := format.CanExport(entry.certificate, chain, key)
 	if err != nil {
-		return err
+		return entry.registry.auditFailure(auditExportCertificate, entry.name, user, err, auditFormat(format))
 	}
-	return format.Export(out, entry.certificate, chain, key, password)
+	err = format.Export(out, entry.certificate, chain, key, password)
+	if err != nil {
+		return entry.registry.auditFailure(auditExportCertificate, entry.name, user, err, auditFormat(format))
+	}
+	return entry.registry.audit(auditExportCertificate, entry.name, user, auditSerial(entry.certificate.SerialNumber), auditFormat(format))
 }
 
 type exportFormatPEM struct{}
@@ -769,22 +1317,30 @@ func (entry *RegistryEntry) CertificateRequest() *x509.CertificateRequest {
 //
 // The newly created [x509.RevocationList] is returned.
 // If the store entry is not suitable for signing a revocation list, [ErrInvalidIssuer] is returned.
+// If the store entry is read-only, [ErrReadOnly] is returned.
 //
 // Invoking this function is recorded in the audit log using the the submitted user name.
 func (entry *RegistryEntry) ResetRevocationList(factory certs.RevocationListFactory, user string) (*x509.RevocationList, error) {
+	if entry.readOnly {
+		return nil, entry.registry.auditFailure(auditCreateRevocationList, entry.name, user, ErrReadOnly)
+	}
 	if !entry.CanIssue(x509.KeyUsageCRLSign) {
-		return nil, ErrInvalidIssuer
+		return nil, entry.registry.auditFailure(auditCreateRevocationList, entry.name, user, ErrInvalidIssuer)
 	}
-	revocationList, err := factory.New(entry.Certificate(), entry.Key(user))
+	key, err := entry.AccessKey(user)
 	if err != nil {
-		return nil, err
+		return nil, entry.registry.auditFailure(auditCreateRevocationList, entry.name, user, err)
+	}
+	revocationList, err := factory.New(entry.Certificate(), key)
+	if err != nil {
+		return nil, entry.registry.auditFailure(auditCreateRevocationList, entry.name, user, err)
 	}
 	err = entry.mergeRevocationList(revocationList)
 	if err != nil {
-		return nil, err
+		return nil, entry.registry.auditFailure(auditCreateRevocationList, entry.name, user, err)
 	}
-	entry.registry.audit(auditCreateRevocationList, entry.name, user)
-	return revocationList, nil
+	err = entry.registry.audit(auditCreateRevocationList, entry.name, user)
+	return revocationList, err
 }
 
 // HasRevocationList reports whether this store entry contains a revocation list.
@@ -799,6 +1355,11 @@ func (entry *RegistryEntry) RevocationList() *x509.RevocationList {
 	return entry.revocationList
 }
 
+// Revocations gets the revocations recorded for certificates issued by this store entry (see [Registry.Revoke]).
+func (entry *RegistryEntry) Revocations() []x509.RevocationListEntry {
+	return slices.Clone(entry.revocations)
+}
+
 // Attributes gets the attributes (key value pairs) associated with the store entry.
 func (entry *RegistryEntry) Attributes() map[string]string {
 	return maps.Clone(entry.attributes)
@@ -807,7 +1368,11 @@ func (entry *RegistryEntry) Attributes() map[string]string {
 // SetAttributes sets the attributes (key value pairs) associated with the store entry.
 //
 // Any previously set attributes are overwritten or removed if no longer defined.
+// If the store entry is read-only, [ErrReadOnly] is returned.
 func (entry *RegistryEntry) SetAttributes(attributes map[string]string) error {
+	if entry.readOnly {
+		return ErrReadOnly
+	}
 	err := entry.mergeAttributes(attributes)
 	if err != nil {
 		return err
@@ -826,12 +1391,14 @@ func (entry *RegistryEntry) matchCertificate(certificate *x509.Certificate) bool
 }
 
 func (entry *RegistryEntry) mergeCertificate(certificate *x509.Certificate) error {
-	data, err := entry.registry.getEntryData(entry.name)
+	version, _, err := entry.registry.modifyEntryData(entry.name, func(data *registryEntryData) error {
+		data.setCertificate(certificate)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	data.setCertificate(certificate)
-	entry.registry.updateEntryData(entry.name, data)
+	entry.version = version
 	entry.certificate = certificate
 	return nil
 }
@@ -847,12 +1414,14 @@ func (entry *RegistryEntry) matchCertificateRequest(certificateRequest *x509.Cer
 }
 
 func (entry *RegistryEntry) mergeCertificateRequest(certificateRequest *x509.CertificateRequest) error {
-	data, err := entry.registry.getEntryData(entry.name)
+	version, _, err := entry.registry.modifyEntryData(entry.name, func(data *registryEntryData) error {
+		data.setCertificateRequest(certificateRequest)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	data.setCertificateRequest(certificateRequest)
-	entry.registry.updateEntryData(entry.name, data)
+	entry.version = version
 	entry.certificateRequest = certificateRequest
 	return nil
 }
@@ -871,12 +1440,13 @@ func (entry *RegistryEntry) matchKey(key crypto.PrivateKey) bool {
 }
 
 func (entry *RegistryEntry) mergeKey(key crypto.PrivateKey) error {
-	data, err := entry.registry.getEntryData(entry.name)
+	version, _, err := entry.registry.modifyEntryData(entry.name, func(data *registryEntryData) error {
+		return entry.registry.setEntryKey(data, key)
+	})
 	if err != nil {
 		return err
 	}
-	data.setKey(key, entry.registry.settings.Secret)
-	entry.registry.updateEntryData(entry.name, data)
+	entry.version = version
 	entry.key = key
 	return nil
 }
@@ -892,60 +1462,142 @@ func (entry *RegistryEntry) matchRevocationList(revocationList *x509.RevocationL
 }
 
 func (entry *RegistryEntry) mergeRevocationList(revocationList *x509.RevocationList) error {
-	data, err := entry.registry.getEntryData(entry.name)
+	version, _, err := entry.registry.modifyEntryData(entry.name, func(data *registryEntryData) error {
+		data.setRevocationList(revocationList)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	data.setRevocationList(revocationList)
-	entry.registry.updateEntryData(entry.name, data)
+	entry.version = version
 	entry.revocationList = revocationList
 	return nil
 }
 
 func (entry *RegistryEntry) mergeAttributes(attributes map[string]string) error {
-	data, err := entry.registry.getEntryData(entry.name)
+	version, data, err := entry.registry.modifyEntryData(entry.name, func(data *registryEntryData) error {
+		data.Attributes = maps.Clone(attributes)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	data.Attributes = maps.Clone(attributes)
-	entry.registry.updateEntryData(entry.name, data)
+	entry.version = version
 	entry.attributes = data.Attributes
 	return nil
 }
 
 type registryEntryData struct {
-	EncodedKey                string            `json:"key"`
-	EncodedCertificate        string            `json:"crt"`
-	EncodedCertificateRequest string            `json:"csr"`
-	EncodedRevocationList     string            `json:"crl"`
-	Attributes                map[string]string `json:"attributes"`
-}
-
-func (entryData *registryEntryData) setKey(key crypto.PrivateKey, secret string) error {
+	Schema                    int                       `json:"schema,omitempty"`
+	ID                        string                    `json:"id,omitempty"`
+	EncodedKey                string                    `json:"key"`
+	KeyRef                    string                    `json:"key_ref,omitempty"`
+	EncodedKeyPublic          string                    `json:"key_pub,omitempty"`
+	EncodedCertificate        string                    `json:"crt"`
+	EncodedCertificateRequest string                    `json:"csr"`
+	EncodedRevocationList     string                    `json:"crl"`
+	Revocations               []registryEntryRevocation `json:"revocations,omitempty"`
+	SerialNumber              string                    `json:"serial,omitempty"`
+	Factory                   string                    `json:"factory,omitempty"`
+	Attributes                map[string]string         `json:"attributes"`
+	key                       crypto.PrivateKey
+	keySettingsVersion        storage.Version
+}
+
+type registryEntryRevocation struct {
+	SerialNumber   string `json:"serial"`
+	RevocationTime int64  `json:"time"`
+	ReasonCode     int    `json:"reason"`
+}
+
+func (entryData *registryEntryData) setKey(key crypto.PrivateKey, settings *storeSettings) error {
+	storedKey, ok := key.(keys.StoredKey)
+	if ok {
+		entryData.EncodedKey = ""
+		entryData.EncodedKeyPublic = ""
+		entryData.KeyRef = encodeKeyRef(storedKey)
+		return nil
+	}
+	entryData.KeyRef = ""
+	err := entryData.assignID(nil)
+	if err != nil {
+		return err
+	}
 	keyData, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		return fmt.Errorf("failed to marshal private key (cause: %w)", err)
 	}
-	encryptedKeyData, err := entryData.encryptData(keyData, secret)
+	publicKeyData, err := x509.MarshalPKIXPublicKey(keys.PublicFromPrivate(key))
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key (cause: %w)", err)
+	}
+	secretID, secret := settings.currentSecret()
+	binding := keyBinding(publicKeyData)
+	entryKey, err := deriveEntryKey(secret, binding)
+	if err != nil {
+		return err
+	}
+	encryptedKeyData, err := entryData.encryptData(keyData, entryKey, keyAAD(encryptedKeyFormatCurrent, secretID, entryData.ID+";"+binding))
 	if err != nil {
 		return fmt.Errorf("failed to encrypt private key (cause: %w)", err)
 	}
-	entryData.EncodedKey = base64.StdEncoding.EncodeToString(encryptedKeyData)
+	entryData.EncodedKey = encodeEncryptedKey(encryptedKeyFormatCurrent, secretID, encryptedKeyData)
+	entryData.EncodedKeyPublic = base64.StdEncoding.EncodeToString(publicKeyData)
 	return nil
 }
 
-func (entryData *registryEntryData) getKey(secret string) (crypto.PrivateKey, error) {
+func (entryData *registryEntryData) getKey(settings *storeSettings) (crypto.PrivateKey, error) {
 	if entryData.EncodedKey == "" {
 		return nil, nil
 	}
-	encryptedKeyData, err := base64.StdEncoding.DecodeString(entryData.EncodedKey)
+	format, secretID, encryptedKeyData, err := decodeEncryptedKey(entryData.EncodedKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode key data (cause: %w)", err)
+		return nil, err
 	}
-	keyData, err := entryData.decryptData(encryptedKeyData, secret)
+	secret, err := settings.lookupSecret(secretID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt key data (cause: %w)", err)
 	}
+	var keyData []byte
+	switch format {
+	case encryptedKeyFormatLegacy, encryptedKeyFormatV1:
+		secretBytes, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode secret (cause: %w)", err)
+		}
+		keyData, err = entryData.decryptData(encryptedKeyData, secretBytes, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key data (cause: %w)", err)
+		}
+	case encryptedKeyFormatV2:
+		if entryData.ID == "" {
+			return nil, fmt.Errorf("failed to decrypt key data (missing entry id)")
+		}
+		entryKey, err := deriveEntryKey(secret, entryData.ID)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err = entryData.decryptData(encryptedKeyData, entryKey, keyAAD(format, secretID, entryData.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key data (cause: %w)", err)
+		}
+	default:
+		if entryData.ID == "" {
+			return nil, fmt.Errorf("failed to decrypt key data (missing entry id)")
+		}
+		binding, err := entryData.keyBinding()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key data (cause: %w)", err)
+		}
+		entryKey, err := deriveEntryKey(secret, binding)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err = entryData.decryptData(encryptedKeyData, entryKey, keyAAD(format, secretID, entryData.ID+";"+binding))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key data (cause: %w)", err)
+		}
+	}
 	key, err := x509.ParsePKCS8PrivateKey(keyData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse key data (cause: %w)", err)
@@ -953,6 +1605,209 @@ func (entryData *registryEntryData) getKey(secret string) (crypto.PrivateKey, er
 	return key, nil
 }
 
+// keyBinding gets the binding of this entry's encrypted key. Keys are bound to the public key of the entry's
+// certificate or certificate request. Key-only entries are bound to the public key recorded alongside the encrypted
+// key. As the latter is moved along with the key, the entry id is bound to the key as well (via the associated data).
+// Hence a key transplanted into another entry cannot be decrypted.
+func (entryData *registryEntryData) keyBinding() (string, error) {
+	var publicKey crypto.PublicKey
+	if entryData.EncodedCertificate != "" {
+		certificate, err := entryData.getCertificate()
+		if err != nil {
+			return "", err
+		}
+		publicKey = certificate.PublicKey
+	} else if entryData.EncodedCertificateRequest != "" {
+		certificateRequest, err := entryData.getCertificateRequest()
+		if err != nil {
+			return "", err
+		}
+		publicKey = certificateRequest.PublicKey
+	} else {
+		publicKeyData, err := base64.StdEncoding.DecodeString(entryData.EncodedKeyPublic)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode public key (cause: %w)", err)
+		}
+		return keyBinding(publicKeyData), nil
+	}
+	publicKeyData, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key (cause: %w)", err)
+	}
+	return keyBinding(publicKeyData), nil
+}
+
+func keyBinding(publicKeyData []byte) string {
+	digest := sha256.Sum256(publicKeyData)
+	return hex.EncodeToString(digest[:])
+}
+
+// setEntryKey sets the submitted entry data's key using the current store secret. Store settings updated by other
+// store instances (e.g. by rotating the store secret) are reloaded first. This way keys are not encrypted with a
+// secret already retired elsewhere. As the store secret may still be rotated until the entry data has been written,
+// the key is re-checked after writing the entry data (see checkEntryKey).
+func (registry *Registry) setEntryKey(data *registryEntryData, key crypto.PrivateKey) error {
+	settings := registry.settings
+	err := settings.refresh()
+	if err != nil {
+		return err
+	}
+	settings.mutex.RLock()
+	settingsVersion := settings.version
+	settings.mutex.RUnlock()
+	err = data.setKey(key, settings)
+	if err != nil {
+		return err
+	}
+	if data.EncodedKey != "" {
+		data.key = key
+		data.keySettingsVersion = settingsVersion
+	}
+	return nil
+}
+
+// checkEntryKey re-encrypts the key just written with the submitted entry data, if the store settings have been
+// updated in the meantime. A concurrent secret rotation (see [Registry.RotateSecret]) may have scanned the entry
+// before it has been written and hence may have dropped the secret used for encrypting the key. The written entry
+// version is re-encrypted in place with the then current secret, which keeps it readable. As rotating the store
+// secret requires a [storage.RewritableBackend], other backends are not affected.
+func (registry *Registry) checkEntryKey(name string, data *registryEntryData) error {
+	if data.key == nil || registry.settings.backend == nil {
+		return nil
+	}
+	rewritable, ok := registry.backend.(storage.RewritableBackend)
+	if !ok {
+		return nil
+	}
+	settingsVersion, err := latestStoreSettingsVersion(registry.settings.backend)
+	if err != nil {
+		return err
+	}
+	if settingsVersion == data.keySettingsVersion {
+		return nil
+	}
+	registry.logger.Info().Msgf("store settings updated while writing entry '%s'; re-encrypting key...", name)
+	err = registry.settings.refresh()
+	if err != nil {
+		return err
+	}
+	return rewritable.Rewrite(name, func(version storage.Version, dataBytes []byte) ([]byte, error) {
+		written, err := registry.decodeEntryData(dataBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite entry '%s' version %d (cause: %w)", name, version, err)
+		}
+		if written.EncodedKey != data.EncodedKey {
+			return nil, nil
+		}
+		err = written.setKey(data.key, registry.settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite entry '%s' version %d (cause: %w)", name, version, err)
+		}
+		return registry.marshalEntryData(written)
+	})
+}
+
+// getEntryKey gets the submitted entry data's key. As unknown secrets may have been introduced by another
+// store instance, the store settings are reloaded in case the key's secret is unknown.
+func (registry *Registry) getEntryKey(data *registryEntryData) (crypto.PrivateKey, error) {
+	key, err := data.getKey(registry.settings)
+	if errors.Is(err, errUnknownStoreSecret) {
+		reloadErr := registry.settings.reload()
+		if reloadErr != nil {
+			return nil, errors.Join(err, reloadErr)
+		}
+		key, err = data.getKey(registry.settings)
+	}
+	return key, err
+}
+
+const entryKeyInfo = "certstore entry key"
+
+// deriveEntryKey derives the entry specific key encryption key from the store secret and the submitted key binding
+// (the entry id for format 2 keys).
+func deriveEntryKey(secret string, binding string) ([]byte, error) {
+	secretBytes, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret (cause: %w)", err)
+	}
+	entryKey := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secretBytes, []byte(binding), []byte(entryKeyInfo)), entryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive entry key (cause: %w)", err)
+	}
+	return entryKey, nil
+}
+
+// keyAAD gets the associated data binding an encrypted key to its entry.
+func keyAAD(format int, secretID uint32, binding string) []byte {
+	return fmt.Appendf(nil, "v%d;k%d;%s", format, secretID, binding)
+}
+
+func newEntryID() (string, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate entry id (cause: %w)", err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// Encrypted keys are encoded as "v<format>:k<secret id>:<base64 encrypted key>" (format 2 and later). Format 3 keys
+// are encrypted with a key derived from the public key of their entry and bound to this public key via associated
+// data. Format 2 keys are encrypted and bound the same way using the entry id. Format 1 keys are encoded
+// as "k<secret id>:<base64 encrypted key>" and encrypted with the store secret directly. Legacy (format 0) keys
+// are encoded without prefix and encrypted with the initial store secret (id 0).
+const (
+	encryptedKeyFormatLegacy  = 0
+	encryptedKeyFormatV1      = 1
+	encryptedKeyFormatV2      = 2
+	encryptedKeyFormatV3      = 3
+	encryptedKeyFormatCurrent = encryptedKeyFormatV3
+)
+
+const encryptedKeyFormatPrefix = "v"
+const encryptedKeySecretIDPrefix = "k"
+const encryptedKeySeparator = ":"
+
+func encodeEncryptedKey(format int, secretID uint32, encryptedKeyData []byte) string {
+	encoded := encryptedKeySecretIDPrefix + strconv.FormatUint(uint64(secretID), 10) + encryptedKeySeparator + base64.StdEncoding.EncodeToString(encryptedKeyData)
+	if format >= encryptedKeyFormatV2 {
+		encoded = encryptedKeyFormatPrefix + strconv.Itoa(format) + encryptedKeySeparator + encoded
+	}
+	return encoded
+}
+
+func decodeEncryptedKey(encodedKey string) (int, uint32, []byte, error) {
+	parts := strings.Split(encodedKey, encryptedKeySeparator)
+	format := encryptedKeyFormatLegacy
+	secretID := uint64(0)
+	var err error
+	switch len(parts) {
+	case 1:
+	case 2:
+		format = encryptedKeyFormatV1
+	case 3:
+		format, err = strconv.Atoi(strings.TrimPrefix(parts[0], encryptedKeyFormatPrefix))
+		if err != nil || !strings.HasPrefix(parts[0], encryptedKeyFormatPrefix) || format < encryptedKeyFormatV2 || format > encryptedKeyFormatCurrent {
+			return 0, 0, nil, fmt.Errorf("unsupported key data format '%s'", parts[0])
+		}
+		parts = parts[1:]
+	default:
+		return 0, 0, nil, fmt.Errorf("invalid key data format")
+	}
+	if format != encryptedKeyFormatLegacy {
+		secretID, err = strconv.ParseUint(strings.TrimPrefix(parts[0], encryptedKeySecretIDPrefix), 10, 32)
+		if err != nil || !strings.HasPrefix(parts[0], encryptedKeySecretIDPrefix) {
+			return 0, 0, nil, fmt.Errorf("invalid key data secret id '%s'", parts[0])
+		}
+	}
+	encryptedKeyData, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to decode key data (cause: %w)", err)
+	}
+	return format, uint32(secretID), encryptedKeyData, nil
+}
+
 func (entryData *registryEntryData) setCertificate(certificate *x509.Certificate) {
 	entryData.EncodedCertificate = base64.StdEncoding.EncodeToString(certificate.Raw)
 }
@@ -1010,8 +1865,50 @@ func (entryData *registryEntryData) getRevocationList() (*x509.RevocationList, e
 	return revocationList, nil
 }
 
-func (entryData *registryEntryData) encryptData(data []byte, secret string) ([]byte, error) {
-	gcm, err := entryData.newGCM(secret)
+func (entryData *registryEntryData) setRevocations(revocations []x509.RevocationListEntry) {
+	entryData.Revocations = make([]registryEntryRevocation, 0, len(revocations))
+	for _, revocation := range revocations {
+		entryData.Revocations = append(entryData.Revocations, registryEntryRevocation{
+			SerialNumber:   revocation.SerialNumber.Text(16),
+			RevocationTime: revocation.RevocationTime.UnixMilli(),
+			ReasonCode:     revocation.ReasonCode,
+		})
+	}
+}
+
+func (entryData *registryEntryData) getRevocations() ([]x509.RevocationListEntry, error) {
+	revocations := make([]x509.RevocationListEntry, 0, len(entryData.Revocations))
+	for _, revocation := range entryData.Revocations {
+		serialNumber, ok := new(big.Int).SetString(revocation.SerialNumber, 16)
+		if !ok {
+			return nil, fmt.Errorf("failed to decode revoked serial number '%s'", revocation.SerialNumber)
+		}
+		revocations = append(revocations, x509.RevocationListEntry{
+			SerialNumber:   serialNumber,
+			RevocationTime: time.UnixMilli(revocation.RevocationTime),
+			ReasonCode:     revocation.ReasonCode,
+		})
+	}
+	return revocations, nil
+}
+
+func (entryData *registryEntryData) setSerialNumber(serialNumber *big.Int) {
+	entryData.SerialNumber = serialNumber.Text(16)
+}
+
+func (entryData *registryEntryData) getSerialNumber() (*big.Int, error) {
+	if entryData.SerialNumber == "" {
+		return big.NewInt(0), nil
+	}
+	serialNumber, ok := new(big.Int).SetString(entryData.SerialNumber, 16)
+	if !ok {
+		return nil, fmt.Errorf("failed to decode serial number counter '%s'", entryData.SerialNumber)
+	}
+	return serialNumber, nil
+}
+
+func (entryData *registryEntryData) encryptData(data []byte, key []byte, aad []byte) ([]byte, error) {
+	gcm, err := entryData.newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -1020,31 +1917,30 @@ func (entryData *registryEntryData) encryptData(data []byte, secret string) ([]b
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate nonce (cause: %w)", err)
 	}
-	encrypted := gcm.Seal(nonce, nonce, data, nil)
+	encrypted := gcm.Seal(nonce, nonce, data, aad)
 	return encrypted, nil
 }
 
-func (entryData *registryEntryData) decryptData(data []byte, secret string) ([]byte, error) {
-	gcm, err := entryData.newGCM(secret)
+func (entryData *registryEntryData) decryptData(data []byte, key []byte, aad []byte) ([]byte, error) {
+	gcm, err := entryData.newGCM(key)
 	if err != nil {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("invalid encrypted data")
+	}
 	nonce := data[:nonceSize]
 	ciphertext := data[nonceSize:]
-	decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
+	decrypted, err := gcm.Open(nil, nonce, ciphertext, aad)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt data (cause: %w)", err)
 	}
 	return decrypted, nil
 }
 
-func (entryData *registryEntryData) newGCM(secret string) (cipher.AEAD, error) {
-	secretBytes, err := base64.StdEncoding.DecodeString(secret)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode secret (cause: %w)", err)
-	}
-	aes, err := aes.NewCipher(secretBytes)
+func (entryData *registryEntryData) newGCM(key []byte) (cipher.AEAD, error) {
+	aes, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher (cause: %w)", err)
 	}
@@ -1058,16 +1954,111 @@ func (entryData *registryEntryData) newGCM(secret string) (cipher.AEAD, error) {
 const storeSettingsName = ".store"
 
 type storeSettings struct {
-	Secret string `json:"secret"`
+	Schema             int                    `json:"schema,omitempty"`
+	Secret             string                 `json:"secret,omitempty"`
+	Protection         *storeSecretProtection `json:"protection,omitempty"`
+	SecretID           uint32                 `json:"secret_id,omitempty"`
+	RetiredSecrets     []*storeRetiredSecret  `json:"retired_secrets,omitempty"`
+	AuditKey           string                 `json:"audit_key,omitempty"`
+	AuditKeyProtection *storeSecretProtection `json:"audit_key_protection,omitempty"`
+	AuditUnchained     int                    `json:"audit_unchained,omitempty"`
+	AuditRekeyed       uint64                 `json:"audit_rekeyed,omitempty"`
+	loadedSchema       int
+	persist            bool
+	mutex              sync.RWMutex
+	rotation           sync.Mutex
+	backend            storage.Backend
+	version            storage.Version
+	unlocker           *secretUnlock
+	secrets            map[uint32]string
+	auditKeyValue      string
+}
+
+// storeRetiredSecret holds a previous store secret still required to decrypt keys not yet re-encrypted
+// with the current store secret (see [Registry.RotateSecret]).
+type storeRetiredSecret struct {
+	ID         uint32                 `json:"id"`
+	Secret     string                 `json:"secret,omitempty"`
+	Protection *storeSecretProtection `json:"protection,omitempty"`
+}
+
+// currentSecret gets the id and value of the secret to use for encryption.
+func (settings *storeSettings) currentSecret() (uint32, string) {
+	settings.mutex.RLock()
+	defer settings.mutex.RUnlock()
+	return settings.SecretID, settings.secrets[settings.SecretID]
+}
+
+// errUnknownStoreSecret indicates a key encrypted with a secret not known to this store instance.
+var errUnknownStoreSecret = errors.New("unknown store secret")
+
+// lookupSecret gets the value of the secret with the submitted id (either the current or a retired one).
+func (settings *storeSettings) lookupSecret(secretID uint32) (string, error) {
+	settings.mutex.RLock()
+	defer settings.mutex.RUnlock()
+	secret, found := settings.secrets[secretID]
+	if !found {
+		return "", fmt.Errorf("%w %d", errUnknownStoreSecret, secretID)
+	}
+	return secret, nil
+}
+
+// auditKey gets the store's audit key.
+func (settings *storeSettings) auditKey() ([]byte, error) {
+	settings.mutex.RLock()
+	encoded := settings.auditKeyValue
+	settings.mutex.RUnlock()
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode audit key (cause: %w)", err)
+	}
+	return key, nil
+}
+
+// A StoreOption configures optional store features during [NewStore].
+type StoreOption func(options *storeOptions)
+
+type storeOptions struct {
+	auditSinks            []AuditSink
+	auditFailurePolicy    AuditFailurePolicy
+	auditCheckpointSigner crypto.Signer
+	unlock                *secretUnlock
+	keyStores             []keys.KeyStore
+	watchPollInterval     time.Duration
+}
+
+// WithAuditSinks adds the submitted [AuditSink]s to the store. Each recorded audit event is written to
+// the store's own audit log first and afterwards to all of the submitted sinks. Failing sinks are buffered
+// and retried (see [AuditSink]).
+func WithAuditSinks(sinks ...AuditSink) StoreOption {
+	return func(options *storeOptions) {
+		options.auditSinks = append(options.auditSinks, sinks...)
+	}
+}
+
+// WithAuditFailurePolicy sets the [AuditFailurePolicy] applied in case an audit event cannot be written
+// to the store's own audit log (default: [AuditFailureExit]).
+func WithAuditFailurePolicy(policy AuditFailurePolicy) StoreOption {
+	return func(options *storeOptions) {
+		options.auditFailurePolicy = policy
+	}
 }
 
 // NewStore creates a certificate store using the submitted storage backend and parameters.
 //
 // If the submitted storage location is used for the first time, a new certificate store is setup.
 // Using the same storage location again, opens the previously created certificate store.
-func NewStore(backend storage.Backend, cacheTTL time.Duration) (*Registry, error) {
+//
+// The store secret protecting the stored keys is itself protected, if one of the unlock options
+// [WithPassphrase], [WithPassphraseEnv] or [WithKeyFile] is submitted. Opening a protected store
+// without unlock option fails with [ErrStoreLocked].
+func NewStore(backend storage.Backend, cacheTTL time.Duration, options ...StoreOption) (*Registry, error) {
 	logger := log.RootLogger().With().Str("Registry", backend.URI()).Logger()
-	settings, err := newStoreSettings(backend, &logger)
+	storeOptions := &storeOptions{}
+	for _, option := range options {
+		option(storeOptions)
+	}
+	settings, err := newStoreSettings(backend, &logger, storeOptions.unlock)
 	if err != nil {
 		return nil, err
 	}
@@ -1077,35 +2068,216 @@ func NewStore(backend storage.Backend, cacheTTL time.Duration) (*Registry, error
 		go entryCache.Start()
 		runtime.SetFinalizer(entryCache, func(cache *ttlcache.Cache[string, *RegistryEntry]) { cache.Stop() })
 	}
+	auditChain, err := newAuditChain(backend, settings, storeOptions.auditCheckpointSigner, &logger)
+	if err != nil {
+		return nil, err
+	}
+	if settings.loadedSchema < storeSettingsSchemaV2 {
+		err = auditChain.anchor(settings.AuditRekeyed > 0 && settings.loadedSchema == 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var auditSink AuditSink = auditChain
+	if storeOptions.auditFailurePolicy == AuditFailureRetry {
+		auditSink = newRetryAuditSink(auditChain, AuditRetryBufferLimit, false)
+	}
+	var auditSinks AuditSink
+	if len(storeOptions.auditSinks) > 0 {
+		retrySinks := make([]AuditSink, 0, len(storeOptions.auditSinks))
+		for _, sink := range storeOptions.auditSinks {
+			retrySinks = append(retrySinks, newAsyncRetryAuditSink(sink, AuditRetryBufferLimit, &logger))
+		}
+		auditSinks = NewFanOutAuditSink(retrySinks...)
+	}
+	keyStores := make(map[string]keys.KeyStore, len(storeOptions.keyStores))
+	for _, keyStore := range storeOptions.keyStores {
+		keyStores[keyStore.Name()] = keyStore
+	}
 	return &Registry{
-		settings:   settings,
-		backend:    backend,
-		entryCache: entryCache,
-		logger:     &logger,
+		settings:           settings,
+		backend:            backend,
+		entryCache:         entryCache,
+		auditChain:         auditChain,
+		auditSink:          auditSink,
+		auditSinks:         auditSinks,
+		auditFailurePolicy: storeOptions.auditFailurePolicy,
+		keyStores:          keyStores,
+		changes:            newChangeNotifier(backend, entryCache, storeOptions.watchPollInterval, &logger),
+		logger:             &logger,
 	}, nil
 }
 
-func newStoreSettings(backend storage.Backend, logger *zerolog.Logger) (*storeSettings, error) {
-	data, err := backend.Get(storeSettingsName)
+// Close flushes the events buffered for additional audit sinks and releases the resources held by the store's audit sinks.
+func (registry *Registry) Close() error {
+	err := registry.auditSink.Close()
+	if registry.auditSinks != nil {
+		err = errors.Join(err, registry.auditSinks.Close())
+	}
+	return err
+}
+
+// storeSettingsLoadRetryLimit defines how often loading the store settings is retried in case of concurrent updates.
+const storeSettingsLoadRetryLimit = 3
+
+func newStoreSettings(backend storage.Backend, logger *zerolog.Logger, unlock *secretUnlock) (*storeSettings, error) {
+	var settings *storeSettings
+	var err error
+	for attempt := 1; attempt <= storeSettingsLoadRetryLimit; attempt++ {
+		settings, err = loadStoreSettings(backend, logger, unlock)
+		if !errors.Is(err, storage.ErrConflict) {
+			break
+		}
+		logger.Debug().Err(err).Msgf("retrying to load store settings (attempt %d)...", attempt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings.backend = backend
+	return settings, nil
+}
+
+// loadStoreSettings reads (or initializes) the store settings. Settings changed while unlocking or migrating them
+// are written back conditionally. Hence loading fails with [storage.ErrConflict], if the settings have been
+// updated concurrently.
+func loadStoreSettings(backend storage.Backend, logger *zerolog.Logger, unlock *secretUnlock) (*storeSettings, error) {
 	settings := &storeSettings{}
-	if err == nil {
-		err = json.Unmarshal(data, settings)
-	} else if err == storage.ErrNotExist {
-		err = initStoreSettings(backend, logger, settings)
-	} else {
+	version, err := latestStoreSettingsVersion(backend)
+	if errors.Is(err, storage.ErrNotExist) {
+		err = initStoreSettings(backend, logger, settings, unlock)
+		if err != nil {
+			return nil, err
+		}
+		settings.version, err = latestStoreSettingsVersion(backend)
+		return settings, err
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := backend.GetVersion(storeSettingsName, version)
+	if err != nil {
 		return nil, fmt.Errorf("failed to read store settings '%s' (cause: %w)", storeSettingsName, err)
 	}
-	return settings, err
+	settings.version = version
+	err = json.Unmarshal(data, settings)
+	if err == nil && settings.Schema > storeSettingsSchemaCurrent {
+		err = fmt.Errorf("%w (store settings schema %d)", ErrNewerSchema, settings.Schema)
+	}
+	settings.loadedSchema = settings.Schema
+	protect := false
+	if err == nil {
+		protect, err = settings.unlock(logger, unlock)
+	}
+	if err == nil {
+		err = settings.migrate(backend)
+	}
+	if err == nil && protect {
+		// migrate unprotected store (previous settings versions containing the plain secret must be pruned)
+		logger.Info().Msgf("protecting store secret using %s...", unlock.source)
+		_, err = prunableBackend(backend)
+		if err == nil {
+			err = settings.write(backend)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to protect store secret (cause: %w)", err)
+		}
+	} else if err == nil && settings.persist {
+		logger.Info().Msgf("migrating store settings from schema %d...", settings.loadedSchema)
+		err = settings.write(backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func latestStoreSettingsVersion(backend storage.Backend) (storage.Version, error) {
+	versions, err := backend.GetVersions(storeSettingsName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read store settings versions (cause: %w)", err)
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("failed to read store settings versions (no versions)")
+	}
+	return versions[0], nil
+}
+
+// refresh reloads the store settings, if they have been updated by another store instance since they have been
+// loaded or written by this store instance.
+func (settings *storeSettings) refresh() error {
+	if settings.backend == nil {
+		return nil
+	}
+	version, err := latestStoreSettingsVersion(settings.backend)
+	if err != nil {
+		return err
+	}
+	settings.mutex.RLock()
+	changed := version != settings.version
+	settings.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	return settings.reload()
+}
+
+// reload re-reads the store secrets to catch up with changes made by other store instances sharing the
+// same backend (e.g. by rotating the store secret). As reading the store settings may require the backend's lock,
+// this function must not be invoked while rewriting entries.
+func (settings *storeSettings) reload() error {
+	if settings.backend == nil {
+		return nil
+	}
+	version, err := latestStoreSettingsVersion(settings.backend)
+	if err != nil {
+		return err
+	}
+	data, err := settings.backend.GetVersion(storeSettingsName, version)
+	if err != nil {
+		return fmt.Errorf("failed to read store settings '%s' (cause: %w)", storeSettingsName, err)
+	}
+	loaded := &storeSettings{}
+	err = json.Unmarshal(data, loaded)
+	if err != nil {
+		return fmt.Errorf("failed to decode store settings (cause: %w)", err)
+	}
+	if loaded.Schema > storeSettingsSchemaCurrent {
+		return fmt.Errorf("%w (store settings schema %d)", ErrNewerSchema, loaded.Schema)
+	}
+	nopLogger := zerolog.Nop()
+	_, err = loaded.unlock(&nopLogger, settings.unlocker)
+	if err != nil {
+		return err
+	}
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	settings.SecretID = loaded.SecretID
+	settings.secrets = loaded.secrets
+	settings.version = version
+	return nil
 }
 
-func initStoreSettings(backend storage.Backend, logger *zerolog.Logger, settings *storeSettings) error {
+func initStoreSettings(backend storage.Backend, logger *zerolog.Logger, settings *storeSettings, unlock *secretUnlock) error {
 	logger.Info().Msg("initializing store settings...")
-	secretBytes := make([]byte, 32)
-	_, err := rand.Read(secretBytes)
+	settings.unlocker = unlock
+	secret, err := newStoreSecret()
+	if err != nil {
+		return err
+	}
+	auditKey, err := newStoreSecret()
+	if err != nil {
+		return err
+	}
+	settings.secrets = map[uint32]string{0: secret}
+	settings.auditKeyValue = auditKey
+	settings.AuditUnchained, err = countUnchainedAuditRecords(backend)
 	if err != nil {
-		return fmt.Errorf("failed to generate random secret (cause: %w)", err)
+		return err
+	}
+	err = settings.seal()
+	if err != nil {
+		return err
 	}
-	settings.Secret = base64.StdEncoding.EncodeToString(secretBytes)
+	settings.loadedSchema = settings.Schema
 	data, err := json.MarshalIndent(settings, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to encode store settings (cause: %w)", err)
@@ -1113,3 +2285,119 @@ func initStoreSettings(backend storage.Backend, logger *zerolog.Logger, settings
 	_, err = backend.Create(storeSettingsName, data)
 	return err
 }
+
+func newStoreSecret() (string, error) {
+	secretBytes := make([]byte, 32)
+	_, err := rand.Read(secretBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random secret (cause: %w)", err)
+	}
+	return base64.StdEncoding.EncodeToString(secretBytes), nil
+}
+
+// unlock opens the store secrets and determines whether the store secret has to be protected (true) or not (false).
+func (settings *storeSettings) unlock(logger *zerolog.Logger, unlock *secretUnlock) (bool, error) {
+	protected := settings.Protection != nil
+	if protected && unlock == nil {
+		return false, ErrStoreLocked
+	}
+	settings.unlocker = unlock
+	settings.secrets = make(map[uint32]string, 1+len(settings.RetiredSecrets))
+	secret, err := settings.open(settings.Secret, settings.Protection)
+	if err != nil {
+		return false, err
+	}
+	settings.secrets[settings.SecretID] = secret
+	for _, retired := range settings.RetiredSecrets {
+		secret, err = settings.open(retired.Secret, retired.Protection)
+		if err != nil {
+			return false, err
+		}
+		settings.secrets[retired.ID] = secret
+	}
+	settings.auditKeyValue, err = settings.open(settings.AuditKey, settings.AuditKeyProtection)
+	if err != nil {
+		return false, err
+	}
+	if protected {
+		return false, nil
+	}
+	if unlock == nil {
+		logger.Warn().Msg("store secret is not protected")
+		return false, nil
+	}
+	return true, nil
+}
+
+// open gets the value of a secret stored either plain or protected.
+func (settings *storeSettings) open(plain string, protection *storeSecretProtection) (string, error) {
+	if protection == nil {
+		return plain, nil
+	}
+	if settings.unlocker == nil {
+		return "", ErrStoreLocked
+	}
+	return settings.unlocker.unprotect(protection)
+}
+
+// sealSecret prepares a secret for storing (protected, if an unlock option is in use).
+func (settings *storeSettings) sealSecret(secret string) (string, *storeSecretProtection, error) {
+	if settings.unlocker == nil || secret == "" {
+		return secret, nil, nil
+	}
+	protection, err := settings.unlocker.protect(secret)
+	return "", protection, err
+}
+
+// seal updates the persistent fields from the current (in-memory) secrets.
+func (settings *storeSettings) seal() error {
+	settings.Schema = storeSettingsSchemaCurrent
+	var err error
+	settings.Secret, settings.Protection, err = settings.sealSecret(settings.secrets[settings.SecretID])
+	if err != nil {
+		return err
+	}
+	settings.RetiredSecrets = nil
+	for secretID, secret := range settings.secrets {
+		if secretID == settings.SecretID {
+			continue
+		}
+		retired := &storeRetiredSecret{ID: secretID}
+		retired.Secret, retired.Protection, err = settings.sealSecret(secret)
+		if err != nil {
+			return err
+		}
+		settings.RetiredSecrets = append(settings.RetiredSecrets, retired)
+	}
+	slices.SortFunc(settings.RetiredSecrets, func(a *storeRetiredSecret, b *storeRetiredSecret) int { return cmp.Compare(a.ID, b.ID) })
+	settings.AuditKey, settings.AuditKeyProtection, err = settings.sealSecret(settings.auditKeyValue)
+	return err
+}
+
+// write seals and stores the settings. Previous versions (possibly containing outdated or unprotected secrets) are removed.
+func (settings *storeSettings) write(backend storage.Backend) error {
+	err := settings.seal()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode store settings (cause: %w)", err)
+	}
+	version, err := storage.UpdateIf(backend, storeSettingsName, data, settings.version)
+	if err != nil {
+		return fmt.Errorf("failed to update store settings (cause: %w)", err)
+	}
+	settings.version = version
+	settings.persist = false
+	prunable, err := prunableBackend(backend)
+	if err != nil {
+		// callers dropping secrets or their protection require a prunable backend
+		return nil
+	}
+	err = prunable.Prune(storeSettingsName)
+	if err != nil {
+		return fmt.Errorf("failed to prune store settings (cause: %w)", err)
+	}
+	return nil
+}
@@ -10,9 +10,11 @@ import (
 	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"fmt"
 	"math/big"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -77,6 +79,146 @@ func TestCreateCertificateRequest(t *testing.T) {
 	require.NotNil(t, entryCertificate)
 }
 
+func TestSignRequest(t *testing.T) {
+	name := "TestSignRequest"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	issuerName, err := registry.CreateCertificate(name+"Issuer", newTestRootCertificateFactory(name+"Issuer"), user)
+	require.NoError(t, err)
+	requestName, err := registry.CreateCertificateRequest(name, newTestCertificateRequestFactory(name), user)
+	require.NoError(t, err)
+	now := time.Now()
+	template := &x509.Certificate{
+		NotBefore: now,
+		NotAfter:  now.AddDate(0, 0, 1),
+	}
+	certificate, err := registry.SignRequest(issuerName, requestName, template, user)
+	require.NoError(t, err)
+	require.Equal(t, name, certificate.Subject.CommonName)
+	entry, err := registry.Entry(requestName)
+	require.NoError(t, err)
+	require.True(t, entry.HasKey())
+	require.True(t, entry.HasCertificateRequest())
+	require.True(t, entry.HasCertificate())
+	require.Equal(t, certificate.Raw, entry.Certificate().Raw)
+	issuer, err := registry.Entry(issuerName)
+	require.NoError(t, err)
+	require.True(t, certs.IsIssuedBy(entry.Certificate(), issuer.Certificate()))
+	_, err = registry.SignRequest(issuerName, issuerName, template, user)
+	require.ErrorIs(t, err, certstore.ErrNoCertificateRequest)
+	_, err = registry.SignRequest(requestName, requestName, template, user)
+	require.ErrorIs(t, err, certstore.ErrInvalidIssuer)
+}
+
+func TestRenew(t *testing.T) {
+	name := "TestRenew"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	rootName, err := registry.CreateCertificate(name+"Root", newTestRootCertificateFactory(name+"Root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	leafName, err := registry.CreateCertificate(name+"Leaf", newTestLeafCertificateFactory(name+"Leaf", root.Certificate(), root.Key(user)), user)
+	require.NoError(t, err)
+	leaf, err := registry.Entry(leafName)
+	require.NoError(t, err)
+	// reuse key
+	renewed, err := registry.Renew(leafName, &certstore.RenewOptions{ReuseKey: true}, user)
+	require.NoError(t, err)
+	renewedLeaf, err := registry.Entry(leafName)
+	require.NoError(t, err)
+	require.Equal(t, renewed.Raw, renewedLeaf.Certificate().Raw)
+	require.Greater(t, renewedLeaf.Version(), leaf.Version())
+	require.Equal(t, leaf.Certificate().Subject.CommonName, renewed.Subject.CommonName)
+	require.NotEqual(t, 0, leaf.Certificate().SerialNumber.Cmp(renewed.SerialNumber))
+	require.True(t, keys.PublicsEqual(leaf.Certificate().PublicKey, renewed.PublicKey))
+	require.True(t, certs.IsIssuedBy(renewed, root.Certificate()))
+	// re-key
+	renewed, err = registry.Renew(leafName, &certstore.RenewOptions{Validity: 2 * time.Hour}, user)
+	require.NoError(t, err)
+	require.False(t, keys.PublicsEqual(leaf.Certificate().PublicKey, renewed.PublicKey))
+	require.Equal(t, 2*time.Hour, renewed.NotAfter.Sub(renewed.NotBefore))
+	renewedLeaf, err = registry.Entry(leafName)
+	require.NoError(t, err)
+	require.True(t, keys.PublicsEqual(renewed.PublicKey, keys.PublicFromPrivate(renewedLeaf.Key(user))))
+	// self-signed
+	renewed, err = registry.Renew(rootName, &certstore.RenewOptions{ReuseKey: true}, user)
+	require.NoError(t, err)
+	require.True(t, certs.IsRoot(renewed))
+	require.True(t, renewed.IsCA)
+	require.Equal(t, root.Certificate().SubjectKeyId, renewed.SubjectKeyId)
+	// re-key CA
+	root, err = registry.Entry(rootName)
+	require.NoError(t, err)
+	_, err = registry.Renew(rootName, &certstore.RenewOptions{}, user)
+	require.ErrorIs(t, err, certstore.ErrCARekey)
+	unchangedRoot, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	require.Equal(t, root.Version(), unchangedRoot.Version())
+	// CA with default options
+	renewed, err = registry.Renew(rootName, nil, user)
+	require.NoError(t, err)
+	require.True(t, keys.PublicsEqual(root.Certificate().PublicKey, renewed.PublicKey))
+	require.Equal(t, root.Certificate().SubjectKeyId, renewed.SubjectKeyId)
+	// non-default subject encoding
+	rawSubjectTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		RawSubject:            newTestUTF8Subject(t, name+"UTF8"),
+		BasicConstraintsValid: true,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, 1),
+	}
+	rawSubjectName, err := registry.CreateCertificate(name+"UTF8", certs.NewLocalCertificateFactory(rawSubjectTemplate, testKeyAlg.NewKeyPairFactory(), root.Certificate(), root.Key(user)), user)
+	require.NoError(t, err)
+	rawSubjectEntry, err := registry.Entry(rawSubjectName)
+	require.NoError(t, err)
+	renewed, err = registry.Renew(rawSubjectName, nil, user)
+	require.NoError(t, err)
+	require.Equal(t, rawSubjectEntry.Certificate().RawSubject, renewed.RawSubject)
+	// no certificate
+	requestName, err := registry.CreateCertificateRequest(name+"Request", newTestCertificateRequestFactory(name+"Request"), user)
+	require.NoError(t, err)
+	_, err = registry.Renew(requestName, &certstore.RenewOptions{}, user)
+	require.ErrorIs(t, err, certstore.ErrNoCertificate)
+}
+
+func TestVersions(t *testing.T) {
+	name := "TestVersions"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(3), 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	original, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	_, err = registry.Renew(createdName, &certstore.RenewOptions{ReuseKey: true}, user)
+	require.NoError(t, err)
+	renewed, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	versions, err := renewed.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []storage.Version{renewed.Version(), original.Version()}, versions)
+	loaded, err := renewed.LoadVersion(original.Version())
+	require.NoError(t, err)
+	require.Equal(t, original.Version(), loaded.Version())
+	require.Equal(t, original.Certificate().Raw, loaded.Certificate().Raw)
+	require.True(t, keys.PrivatesEqual(original.Key(user), loaded.Key(user)))
+	_, err = renewed.LoadVersion(renewed.Version() + 1)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+	restoredVersion, err := registry.Restore(createdName, original.Version(), user)
+	require.NoError(t, err)
+	restored, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	require.Equal(t, restoredVersion, restored.Version())
+	require.Greater(t, restored.Version(), renewed.Version())
+	require.Equal(t, original.Certificate().Raw, restored.Certificate().Raw)
+	versions, err = restored.Versions()
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+}
+
 func TestResetRevocationList(t *testing.T) {
 	name := "TestResetRevocationList"
 	user := name + "User"
@@ -100,6 +242,291 @@ func TestResetRevocationList(t *testing.T) {
 	require.Equal(t, revocationList1, revocationList2)
 }
 
+func TestRevoke(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	user := "TestRevokeUser"
+	populateTestStore(t, registry, user, 2)
+	err = registry.Revoke("root1_intermediate1", certstore.RevocationReasonKeyCompromise, user)
+	require.NoError(t, err)
+	err = registry.Revoke("root1_intermediate2", certstore.RevocationReasonSuperseded, user)
+	require.NoError(t, err)
+	err = registry.Revoke("root1_intermediate2", certstore.RevocationReasonSuperseded, user)
+	require.ErrorIs(t, err, certstore.ErrAlreadyRevoked)
+	err = registry.Revoke("root1", certstore.RevocationReasonUnspecified, user)
+	require.ErrorIs(t, err, certstore.ErrInvalidIssuer)
+	err = registry.Revoke("request1", certstore.RevocationReasonUnspecified, user)
+	require.ErrorIs(t, err, certstore.ErrNoCertificate)
+	issuer, err := registry.Entry("root1")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(issuer.Revocations()))
+	revocationList := issuer.RevocationList()
+	require.NotNil(t, revocationList)
+	require.NoError(t, revocationList.CheckSignatureFrom(issuer.Certificate()))
+	require.Equal(t, int64(3), revocationList.Number.Int64())
+	require.Equal(t, 2, len(revocationList.RevokedCertificateEntries))
+	revoked, err := registry.Entry("root1_intermediate1")
+	require.NoError(t, err)
+	require.Equal(t, 0, revoked.Certificate().SerialNumber.Cmp(revocationList.RevokedCertificateEntries[0].SerialNumber))
+	require.Equal(t, int(certstore.RevocationReasonKeyCompromise), revocationList.RevokedCertificateEntries[0].ReasonCode)
+}
+
+func TestRevokeAfterResetRevocationList(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	user := "TestRevokeAfterResetRevocationListUser"
+	populateTestStore(t, registry, user, 1)
+	issuer, err := registry.Entry("root1")
+	require.NoError(t, err)
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.AddDate(0, 1, 0),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(4711), RevocationTime: now, ReasonCode: int(certstore.RevocationReasonCessationOfOperation)},
+		},
+	}
+	_, err = issuer.ResetRevocationList(certs.NewLocalRevocationListFactory(template), user)
+	require.NoError(t, err)
+	// entries of the reset revocation list are retained
+	err = registry.Revoke("root1_intermediate1", certstore.RevocationReasonKeyCompromise, user)
+	require.NoError(t, err)
+	issuer, err = registry.Entry("root1")
+	require.NoError(t, err)
+	revocationList := issuer.RevocationList()
+	require.NoError(t, revocationList.CheckSignatureFrom(issuer.Certificate()))
+	require.Equal(t, 2, len(revocationList.RevokedCertificateEntries))
+	require.Equal(t, int64(4711), revocationList.RevokedCertificateEntries[0].SerialNumber.Int64())
+	require.Equal(t, int(certstore.RevocationReasonCessationOfOperation), revocationList.RevokedCertificateEntries[0].ReasonCode)
+	require.Equal(t, 2, len(issuer.Revocations()))
+}
+
+func TestConcurrentRevoke(t *testing.T) {
+	name := "TestConcurrentRevoke"
+	user := name + "User"
+	path, err := os.MkdirTemp("", name+"*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry := openTestFSStore(t, path)
+	rootName, err := registry.CreateCertificate(name+"Root", newTestRootCertificateFactory(name+"Root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	leafNames := make([]string, 4)
+	for i := range leafNames {
+		leafName := fmt.Sprintf("%sLeaf%d", name, i+1)
+		leafNames[i], err = registry.CreateCertificate(leafName, newTestLeafCertificateFactory(leafName, root.Certificate(), root.Key(user)), user)
+		require.NoError(t, err)
+	}
+	// revoke concurrently using separate registry instances (like separate processes sharing the store)
+	var wg sync.WaitGroup
+	errs := make([]error, len(leafNames))
+	for i, leafName := range leafNames {
+		concurrentRegistry, err := certstore.NewStore(newTestFSBackend(t, path), 0)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = concurrentRegistry.Revoke(leafName, certstore.RevocationReasonUnspecified, user)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	registry, err = certstore.NewStore(newTestFSBackend(t, path), 0)
+	require.NoError(t, err)
+	root, err = registry.Entry(rootName)
+	require.NoError(t, err)
+	require.Len(t, root.Revocations(), len(leafNames))
+	require.Len(t, root.RevocationList().RevokedCertificateEntries, len(leafNames))
+}
+
+func TestUpdateConflict(t *testing.T) {
+	name := "TestUpdateConflict"
+	user := name + "User"
+	backend := &conflictingBackend{testBackend: storage.NewMemoryStorage(testVersionLimit).(testBackend)}
+	registry, err := certstore.NewStore(backend, 0)
+	require.NoError(t, err)
+	createdName, err := registry.CreateCertificate(name, newTestRootCertificateFactory(name), user)
+	require.NoError(t, err)
+	entry, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	// conflicts are retried
+	backend.conflicts = 1
+	err = entry.SetAttributes(map[string]string{"key": "value1"})
+	require.NoError(t, err)
+	entry, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	require.Equal(t, "value1", entry.Attributes()["key"])
+	// persistent conflicts are surfaced
+	backend.conflicts = -1
+	err = entry.SetAttributes(map[string]string{"key": "value2"})
+	require.ErrorIs(t, err, storage.ErrConflict)
+	entry, err = registry.Entry(createdName)
+	require.NoError(t, err)
+	require.Equal(t, "value1", entry.Attributes()["key"])
+	// restore does not overwrite concurrent updates
+	versions, err := entry.Versions()
+	require.NoError(t, err)
+	backend.conflicts = 1
+	_, err = registry.Restore(createdName, versions[len(versions)-1], user)
+	require.ErrorIs(t, err, storage.ErrConflict)
+}
+
+// testBackend combines the optional backend interfaces used by the tests wrapping a backend.
+type testBackend interface {
+	storage.ConditionalBackend
+	storage.HistoryBackend
+	storage.LogAppenderBackend
+	storage.PrunableBackend
+	storage.RewritableBackend
+}
+
+// conflictingBackend simulates concurrent updates by updating the entry right before a conditional update.
+type conflictingBackend struct {
+	testBackend
+	conflicts int
+}
+
+func (backend *conflictingBackend) UpdateIf(name string, data []byte, expected storage.Version) (storage.Version, error) {
+	if backend.conflicts != 0 {
+		backend.conflicts--
+		current, err := backend.testBackend.Get(name)
+		if err != nil {
+			return 0, err
+		}
+		_, err = backend.testBackend.Update(name, current)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return backend.testBackend.UpdateIf(name, data, expected)
+}
+
+func TestCacheCoherence(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestCacheCoherence*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry, err := certstore.NewStore(newTestFSBackend(t, path), testCacheTTL)
+	require.NoError(t, err)
+	other, err := certstore.NewStore(newTestFSBackend(t, path), testCacheTTL)
+	require.NoError(t, err)
+	user := "TestCacheCoherenceUser"
+	name, err := registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	cached, err := registry.Entry(name)
+	require.NoError(t, err)
+	entry, err := registry.Entry(name)
+	require.NoError(t, err)
+	require.Same(t, cached, entry)
+	// update via other registry
+	otherEntry, err := other.Entry(name)
+	require.NoError(t, err)
+	err = otherEntry.SetAttributes(map[string]string{"Key": "Value"})
+	require.NoError(t, err)
+	entry, err = registry.Entry(name)
+	require.NoError(t, err)
+	require.NotSame(t, cached, entry)
+	require.Equal(t, otherEntry.Version(), entry.Version())
+	require.Equal(t, "Value", entry.Attributes()["Key"])
+	// delete via other registry
+	err = other.Delete(name, user)
+	require.NoError(t, err)
+	_, err = registry.Entry(name)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func TestCacheEmptyVersions(t *testing.T) {
+	backend := &emptyVersionsBackend{Backend: storage.NewMemoryStorage(testVersionLimit)}
+	registry, err := certstore.NewStore(backend, testCacheTTL)
+	require.NoError(t, err)
+	user := "TestCacheEmptyVersionsUser"
+	name, err := registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	_, err = registry.Entry(name)
+	require.NoError(t, err)
+	backend.empty = name
+	_, err = registry.Entry(name)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+// emptyVersionsBackend reports no versions for the entry named empty.
+type emptyVersionsBackend struct {
+	storage.Backend
+	empty string
+}
+
+func (backend *emptyVersionsBackend) GetVersions(name string) ([]storage.Version, error) {
+	if name == backend.empty {
+		return []storage.Version{}, nil
+	}
+	return backend.Backend.GetVersions(name)
+}
+
+func newTestFSBackend(t *testing.T, path string) storage.Backend {
+	backend, err := storage.NewFSStorage(path, testVersionLimit)
+	require.NoError(t, err)
+	return backend
+}
+
+func TestSerialNumberGenerator(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	user := "TestSerialNumberGeneratorUser"
+	createdName, err := registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	// counter
+	counter := registry.NewSerialNumberGenerator(true)
+	for i := int64(1); i <= 3; i++ {
+		serialNumber, err := counter.Next(root.Certificate())
+		require.NoError(t, err)
+		require.Equal(t, big.NewInt(i), serialNumber)
+	}
+	serialNumber, err := registry.NewSerialNumberGenerator(true).Next(root.Certificate())
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(4), serialNumber)
+	// random
+	random := registry.NewSerialNumberGenerator(false)
+	serialNumber, err = random.Next(root.Certificate())
+	require.NoError(t, err)
+	require.Equal(t, 1, serialNumber.Sign())
+	// issue
+	template := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "leaf"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().AddDate(0, 0, 1),
+	}
+	factory := certs.NewLocalCertificateFactoryWithSerialNumbers(template, testKeyAlg.NewKeyPairFactory(), root.Certificate(), root.Key(user), counter)
+	createdName, err = registry.CreateCertificate("leaf", factory, user)
+	require.NoError(t, err)
+	leaf, err := registry.Entry(createdName)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(5), leaf.Certificate().SerialNumber)
+	// serial numbers issued elsewhere are recorded
+	factory = certs.NewLocalCertificateFactoryWithSerialNumbers(template, testKeyAlg.NewKeyPairFactory(), root.Certificate(), root.Key(user), fixedSerialNumber(6))
+	_, err = registry.CreateCertificate("leaf", factory, user)
+	require.NoError(t, err)
+	serialNumber, err = counter.Next(root.Certificate())
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(7), serialNumber)
+	// issuer entry is left untouched
+	root, err = registry.Entry(root.Name())
+	require.NoError(t, err)
+	versions, err := root.Versions()
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+}
+
+type fixedSerialNumber int64
+
+func (serialNumber fixedSerialNumber) Next(_ *x509.Certificate) (*big.Int, error) {
+	return big.NewInt(int64(serialNumber)), nil
+}
+
 func TestAttributes(t *testing.T) {
 	name := "TestAttributes"
 	user := name + "User"
@@ -346,6 +773,14 @@ func createTestRequestEntries(t *testing.T, registry *certstore.Registry, user s
 	}
 }
 
+// newTestUTF8Subject encodes a subject containing a UTF8String common name (instead of the default PrintableString).
+func newTestUTF8Subject(t *testing.T, cn string) []byte {
+	rdn := pkix.RDNSequence{{{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(cn)}}}}
+	rawSubject, err := asn1.Marshal(rdn)
+	require.NoError(t, err)
+	return rawSubject
+}
+
 func newTestRootCertificateFactory(cn string) certs.CertificateFactory {
 	now := time.Now()
 	template := &x509.Certificate{
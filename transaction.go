@@ -0,0 +1,110 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"errors"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+// Transaction runs the submitted function within a store transaction.
+//
+// The [Registry] passed to the function stages all entry creations, updates and deletions instead of writing
+// them to the store directly. If the function returns without error, the staged modifications are committed
+// atomically together with the records of the successful operations in the store's audit log. If the function
+// fails or the commit is rejected, none of the staged modifications are applied and only the failed operations
+// are recorded. A commit is rejected with [storage.ErrConflict], if one of the modified entries has been modified
+// concurrently. A commit failing with [storage.ErrCommitPending] has been accepted and is completed during the next
+// access of the store.
+//
+// The passed [Registry] as well as the [RegistryEntry] values retrieved from it must not be used after the
+// function has returned. Operations rewriting the whole store (e.g. [Registry.RotateSecret]) are not available
+// within a transaction.
+//
+// If the store's backend does not implement [storage.TransactionalBackend], [errors.ErrUnsupported] is returned.
+func (registry *Registry) Transaction(run func(tx *Registry) error) error {
+	tx, err := storage.Begin(registry.backend)
+	if err != nil {
+		return err
+	}
+	auditBuffer := &transactionAuditSink{}
+	txRegistry := &Registry{
+		settings:           registry.settings,
+		backend:            tx,
+		auditChain:         registry.auditChain,
+		auditSink:          auditBuffer,
+		auditFailurePolicy: registry.auditFailurePolicy,
+		keyStores:          registry.keyStores,
+		changes:            newBufferedChangeNotifier(registry.logger),
+		logger:             registry.logger,
+	}
+	err = run(txRegistry)
+	if err != nil {
+		tx.Rollback()
+		registry.logger.Debug().Err(err).Msg("transaction rolled back")
+		registry.writeTransactionAuditEvents(auditBuffer.outcomeEvents(AuditOutcomeFailure))
+		return err
+	}
+	successEvents := auditBuffer.outcomeEvents(AuditOutcomeSuccess)
+	err = registry.auditChain.commit(tx, successEvents)
+	if registry.entryCache != nil {
+		for _, name := range tx.Names() {
+			registry.entryCache.Delete(name)
+		}
+	}
+	if err != nil && !errors.Is(err, storage.ErrCommitPending) {
+		registry.writeTransactionAuditEvents(auditBuffer.outcomeEvents(AuditOutcomeFailure))
+		return err
+	}
+	registry.changes.notify(txRegistry.changes.pending...)
+	registry.writeTransactionAuditEvents(auditBuffer.outcomeEvents(AuditOutcomeFailure))
+	if registry.auditSinks != nil {
+		for _, event := range successEvents {
+			sinkErr := registry.auditSinks.Write(event)
+			if sinkErr != nil {
+				registry.logger.Error().Err(sinkErr).Msgf("failed to forward audit log '%s'", event)
+			}
+		}
+	}
+	return err
+}
+
+// writeTransactionAuditEvents writes the submitted events recorded within a transaction directly to the store's
+// audit log. As these events are written after the transaction has finished, failing to record them is only logged.
+func (registry *Registry) writeTransactionAuditEvents(events []*AuditEvent) {
+	for _, event := range events {
+		_ = registry.writeAuditEvent(event)
+	}
+}
+
+// transactionAuditSink buffers the audit events recorded within a transaction until the transaction is committed.
+type transactionAuditSink struct {
+	events []*AuditEvent
+}
+
+func (sink *transactionAuditSink) outcomeEvents(outcome AuditOutcome) []*AuditEvent {
+	events := make([]*AuditEvent, 0, len(sink.events))
+	for _, event := range sink.events {
+		if event.Outcome == outcome {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (sink *transactionAuditSink) Name() string {
+	return "transaction"
+}
+
+func (sink *transactionAuditSink) Write(event *AuditEvent) error {
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *transactionAuditSink) Close() error {
+	return nil
+}
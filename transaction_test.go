@@ -0,0 +1,129 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/certs"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestTransaction*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry, err := certstore.NewStore(newTestFSBackend(t, path), testCacheTTL)
+	require.NoError(t, err)
+	user := "TestTransactionUser"
+	rootName, err := registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	revokedName, err := registry.CreateCertificate("revoked", newTestLeafCertificateFactory("revoked", root.Certificate(), root.Key(user)), user)
+	require.NoError(t, err)
+	// issue a certificate and revoke the previous one at once
+	var leafName string
+	err = registry.Transaction(func(tx *certstore.Registry) error {
+		template := &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "leaf"},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().AddDate(0, 0, 1),
+		}
+		factory := certs.NewLocalCertificateFactoryWithSerialNumbers(template, testKeyAlg.NewKeyPairFactory(), root.Certificate(), root.Key(user), tx.NewSerialNumberGenerator(true))
+		var err error
+		leafName, err = tx.CreateCertificate("leaf", factory, user)
+		if err != nil {
+			return err
+		}
+		err = tx.Revoke(revokedName, certstore.RevocationReasonSuperseded, user)
+		if err != nil {
+			return err
+		}
+		// not yet visible outside of the transaction
+		_, err = registry.Entry(leafName)
+		require.ErrorIs(t, err, storage.ErrNotExist)
+		return nil
+	})
+	require.NoError(t, err)
+	leaf, err := registry.Entry(leafName)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(1), leaf.Certificate().SerialNumber)
+	root, err = registry.Entry(rootName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(root.Revocations()))
+	events := readAuditEvents(t, registry, &certstore.AuditFilter{Name: leafName})
+	require.Equal(t, 1, len(events))
+	// the events committed with the transaction continue the audit chain
+	verification, err := registry.VerifyAudit()
+	require.NoError(t, err)
+	require.True(t, verification.Valid(), verification.Reason)
+	require.Equal(t, len(readAuditEvents(t, registry, nil)), verification.Records)
+}
+
+func TestTransactionRollback(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	user := "TestTransactionRollbackUser"
+	populateTestStore(t, registry, user, 1)
+	eventCount := len(readAuditEvents(t, registry, nil))
+	// failing function
+	failure := errors.New("failure")
+	err = registry.Transaction(func(tx *certstore.Registry) error {
+		_, err := tx.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+		require.NoError(t, err)
+		err = tx.Delete("root1", user)
+		require.NoError(t, err)
+		err = tx.Backup(&bytes.Buffer{}, &certstore.BackupOptions{IncludeKeys: true}, user)
+		require.ErrorIs(t, err, certstore.ErrPassphraseRequired)
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	checkStoreEntries(t, registry, 4, 1)
+	// only the failed operation is recorded
+	events := readAuditEvents(t, registry, nil)
+	require.Equal(t, eventCount+1, len(events))
+	require.Equal(t, certstore.AuditOutcomeFailure, events[len(events)-1].Outcome)
+	eventCount++
+	// conflicting commit
+	err = registry.Transaction(func(tx *certstore.Registry) error {
+		_, err := tx.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+		require.NoError(t, err)
+		entry, err := tx.Entry("root1")
+		require.NoError(t, err)
+		err = entry.SetAttributes(map[string]string{"Key": "Transaction"})
+		require.NoError(t, err)
+		concurrent, err := registry.Entry("root1")
+		require.NoError(t, err)
+		return concurrent.SetAttributes(map[string]string{"Key": "Concurrent"})
+	})
+	require.ErrorIs(t, err, storage.ErrConflict)
+	checkStoreEntries(t, registry, 4, 1)
+	root, err := registry.Entry("root1")
+	require.NoError(t, err)
+	require.Equal(t, "Concurrent", root.Attributes()["Key"])
+	require.Equal(t, eventCount, len(readAuditEvents(t, registry, nil)))
+}
+
+func TestTransactionUnsupported(t *testing.T) {
+	registry, err := certstore.NewStore(&nonTransactionalBackend{Backend: storage.NewMemoryStorage(testVersionLimit)}, 0)
+	require.NoError(t, err)
+	err = registry.Transaction(func(tx *certstore.Registry) error { return nil })
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+type nonTransactionalBackend struct {
+	storage.Backend
+}
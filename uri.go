@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hdecarne-github/go-certstore/storage"
@@ -27,7 +28,13 @@ import (
 // Known uri parameters are:
 //
 //  1. cache_ttl: The cache ttl (see [time.ParseDuration])
-//  1. cache_ttl: The version limit (see [time.ParseUint])
+//  2. version_limit: The version limit (see [strconv.ParseUint])
+//  3. audit_sink: An additional audit sink (see [AuditSink]; may be repeated to configure multiple sinks). Supported
+//     sinks are syslog (local syslog daemon), syslog:<socket path>, file:<path> (rotating file, relative paths are
+//     evaluated using the submitted base path) and http(s)://<url> (webhook; the URL must be query escaped)
+//  4. audit_failure: The audit failure policy (exit, error or retry; see [AuditFailurePolicy])
+//  5. passphrase_env: The environment variable containing the passphrase protecting the store secret (see [WithPassphraseEnv])
+//  6. key_file: The key file protecting the store secret (see [WithKeyFile]; relative paths are evaluated using the submitted base path)
 //
 // See [NewStore] for further details.
 func NewStoreFromURI(uri string, basePath string) (*Registry, error) {
@@ -44,7 +51,19 @@ func NewStoreFromURI(uri string, basePath string) (*Registry, error) {
 	if err != nil {
 		return nil, err
 	}
-	registry, err := NewStore(backend, context.cacheTTL)
+	auditSinks := context.newAuditSinks(basePath)
+	options := []StoreOption{WithAuditSinks(auditSinks...), WithAuditFailurePolicy(context.auditFailurePolicy)}
+	if context.passphraseEnv != "" {
+		options = append(options, WithPassphraseEnv(context.passphraseEnv))
+	}
+	if context.keyFile != "" {
+		keyFile := context.keyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(basePath, keyFile)
+		}
+		options = append(options, WithKeyFile(keyFile))
+	}
+	registry, err := NewStore(backend, context.cacheTTL, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -52,10 +71,14 @@ func NewStoreFromURI(uri string, basePath string) (*Registry, error) {
 }
 
 type decodeStoreURIContext struct {
-	uri            *url.URL
-	backendFactory func(context *decodeStoreURIContext, basePath string) (storage.Backend, error)
-	cacheTTL       time.Duration
-	versionLimit   storage.VersionLimit
+	uri                *url.URL
+	backendFactory     func(context *decodeStoreURIContext, basePath string) (storage.Backend, error)
+	cacheTTL           time.Duration
+	versionLimit       storage.VersionLimit
+	auditSinks         []string
+	auditFailurePolicy AuditFailurePolicy
+	passphraseEnv      string
+	keyFile            string
 }
 
 func (context *decodeStoreURIContext) decodeStoreURI() error {
@@ -97,6 +120,13 @@ func (context *decodeStoreURIContext) decodeStoreURIParameters() error {
 		return fmt.Errorf("failed to parse URI parameters '%s' (cause: %w)", context.uri.RawQuery, err)
 	}
 	for key, values := range parameters {
+		if key == "audit_sink" {
+			err = context.decodeStoreURIAuditSinks(values)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		value, err := context.decodeStoreURIParameterValue(key, values)
 		if err != nil {
 			return err
@@ -106,6 +136,12 @@ func (context *decodeStoreURIContext) decodeStoreURIParameters() error {
 			err = context.decodeStoreURICacheTTL(value)
 		case "version_limit":
 			err = context.decodeStoreURIVersionLimit(value)
+		case "audit_failure":
+			err = context.decodeStoreURIAuditFailure(value)
+		case "passphrase_env":
+			context.passphraseEnv = value
+		case "key_file":
+			context.keyFile = value
 		default:
 			err = fmt.Errorf("unrecognized URI parameter '%s'", key)
 		}
@@ -113,6 +149,9 @@ func (context *decodeStoreURIContext) decodeStoreURIParameters() error {
 			return err
 		}
 	}
+	if context.passphraseEnv != "" && context.keyFile != "" {
+		return fmt.Errorf("conflicting URI parameters 'passphrase_env' and 'key_file'")
+	}
 	return nil
 }
 
@@ -141,3 +180,52 @@ func (context *decodeStoreURIContext) decodeStoreURICacheTTL(value string) error
 	context.cacheTTL = parsedCacheTTL
 	return nil
 }
+
+func (context *decodeStoreURIContext) decodeStoreURIAuditSinks(values []string) error {
+	for _, sink := range values {
+		sink = strings.TrimSpace(sink)
+		switch {
+		case sink == "syslog", strings.HasPrefix(sink, "syslog:"):
+		case strings.HasPrefix(sink, "file:") && len(sink) > len("file:"):
+		case strings.HasPrefix(sink, "http://"), strings.HasPrefix(sink, "https://"):
+		default:
+			return fmt.Errorf("unrecognized audit sink '%s'", sink)
+		}
+		context.auditSinks = append(context.auditSinks, sink)
+	}
+	return nil
+}
+
+func (context *decodeStoreURIContext) decodeStoreURIAuditFailure(value string) error {
+	for _, policy := range []AuditFailurePolicy{AuditFailureExit, AuditFailureError, AuditFailureRetry} {
+		if value == policy.String() {
+			context.auditFailurePolicy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unrecognized audit failure policy '%s'", value)
+}
+
+const uriFileAuditSinkMaxSize = 100
+const uriFileAuditSinkMaxBackups = 10
+
+func (context *decodeStoreURIContext) newAuditSinks(basePath string) []AuditSink {
+	sinks := make([]AuditSink, 0, len(context.auditSinks))
+	for _, sink := range context.auditSinks {
+		switch {
+		case sink == "syslog":
+			sinks = append(sinks, NewSyslogAuditSink(""))
+		case strings.HasPrefix(sink, "syslog:"):
+			sinks = append(sinks, NewSyslogAuditSink(strings.TrimPrefix(sink, "syslog:")))
+		case strings.HasPrefix(sink, "file:"):
+			path := strings.TrimPrefix(sink, "file:")
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(basePath, path)
+			}
+			sinks = append(sinks, NewFileAuditSink(path, uriFileAuditSinkMaxSize, uriFileAuditSinkMaxBackups))
+		default:
+			sinks = append(sinks, NewWebhookAuditSink(sink, nil))
+		}
+	}
+	return sinks
+}
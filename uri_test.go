@@ -27,6 +27,7 @@ func TestFSStoreURI(t *testing.T) {
 	name := fmt.Sprintf("Registry[fs://%s]", basePath)
 	checkURI(t, "fs://.", basePath, name)
 	checkURI(t, "fs://.?cache_ttl=60s&version_limit=10", basePath, name)
+	checkURI(t, "fs://.?audit_sink=syslog&audit_sink=file:audit.log&audit_sink=https%3A%2F%2Flocalhost%2Faudit%3Fsource%3Da%2Cb&audit_failure=retry", basePath, name)
 }
 
 func TestInvalidStoreURI(t *testing.T) {
@@ -36,6 +37,10 @@ func TestInvalidStoreURI(t *testing.T) {
 	require.Error(t, err)
 	_, err = certstore.NewStoreFromURI("memory://?cache_ttl=0&cache_ttl=1", "")
 	require.Error(t, err)
+	_, err = certstore.NewStoreFromURI("memory://?audit_sink=syslog&audit_sink=foo:bar", "")
+	require.Error(t, err)
+	_, err = certstore.NewStoreFromURI("memory://?audit_failure=ignore", "")
+	require.Error(t, err)
 }
 
 func checkURI(t *testing.T, uri string, basePath string, name string) {
@@ -43,4 +48,6 @@ func checkURI(t *testing.T, uri string, basePath string, name string) {
 	require.NoError(t, err)
 	require.NotNil(t, registry)
 	require.Equal(t, name, registry.Name())
+	err = registry.Close()
+	require.NoError(t, err)
 }
@@ -0,0 +1,92 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+)
+
+// A RegistryView provides read-only access to the state of a store at a given point in time.
+type RegistryView struct {
+	registry *Registry
+	time     time.Time
+}
+
+// AsOf gets a read-only view of this store reflecting its state at the submitted time.
+//
+// The view is derived from the version history retained by the store's backend. Entries deleted after the submitted
+// time are included as long as their history is still available. As the number of retained versions is limited
+// (see [storage.VersionLimit]), entries whose history does not reach back to the submitted time are not included.
+// If the store's backend does not implement [storage.HistoryBackend], accessing the view's entries fails with
+// [errors.ErrUnsupported].
+func (registry *Registry) AsOf(t time.Time) *RegistryView {
+	return &RegistryView{
+		registry: registry,
+		time:     t,
+	}
+}
+
+// Time gets the point in time this view reflects.
+func (view *RegistryView) Time() time.Time {
+	return view.time
+}
+
+// Entries lists the store entries existing at the view's point in time.
+func (view *RegistryView) Entries() (*RegistryEntries, error) {
+	history, err := historyBackend(view.registry.backend)
+	if err != nil {
+		return nil, err
+	}
+	names, err := history.ListHistory()
+	if err != nil {
+		return nil, err
+	}
+	return &RegistryEntries{registry: view.registry, view: view, names: names}, nil
+}
+
+// Entry looks up the store entry with the submitted name as it existed at the view's point in time.
+//
+// The returned entry is read-only (see [ErrReadOnly]).
+// If the entry did not exist at the view's point in time (or its history is no longer available),
+// [storage.ErrNotExist] is returned.
+func (view *RegistryView) Entry(name string) (*RegistryEntry, error) {
+	historyBackend, err := historyBackend(view.registry.backend)
+	if err != nil {
+		return nil, err
+	}
+	history, err := historyBackend.GetHistory(name)
+	if err != nil {
+		return nil, err
+	}
+	if !history.Deleted.IsZero() && !view.time.Before(history.Deleted) {
+		return nil, storage.ErrNotExist
+	}
+	for _, versionInfo := range history.Versions {
+		if versionInfo.Time.After(view.time) {
+			continue
+		}
+		dataBytes, err := historyBackend.GetHistoryVersion(name, versionInfo.Version)
+		if err != nil {
+			return nil, err
+		}
+		return view.registry.newReadOnlyEntry(name, versionInfo.Version, dataBytes)
+	}
+	return nil, storage.ErrNotExist
+}
+
+// CertPools wraps the view's entries into a [x509.CertPool].
+//
+// The first returned pool contains the root certificates. The second on the intermediate certificates.
+func (view *RegistryView) CertPools() (*x509.CertPool, *x509.CertPool, error) {
+	entries, err := view.Entries()
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries.certPools()
+}
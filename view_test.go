@@ -0,0 +1,81 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsOf(t *testing.T) {
+	name := "TestAsOf"
+	user := name + "User"
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), 0)
+	require.NoError(t, err)
+	t0 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	rootName, err := registry.CreateCertificate(name+"Root", newTestRootCertificateFactory(name+"Root"), user)
+	require.NoError(t, err)
+	root, err := registry.Entry(rootName)
+	require.NoError(t, err)
+	leafName, err := registry.CreateCertificate(name+"Leaf", newTestLeafCertificateFactory(name+"Leaf", root.Certificate(), root.Key(user)), user)
+	require.NoError(t, err)
+	leaf, err := registry.Entry(leafName)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = registry.Renew(leafName, &certstore.RenewOptions{ReuseKey: true}, user)
+	require.NoError(t, err)
+	err = registry.Delete(rootName, user)
+	require.NoError(t, err)
+	otherName, err := registry.CreateCertificate(name+"Other", newTestRootCertificateFactory(name+"Other"), user)
+	require.NoError(t, err)
+	// before creation
+	checkViewEntries(t, registry.AsOf(t0), []string{})
+	// before renewal and deletion
+	view := registry.AsOf(t1)
+	require.Equal(t, t1, view.Time())
+	checkViewEntries(t, view, []string{rootName, leafName})
+	viewLeaf, err := view.Entry(leafName)
+	require.NoError(t, err)
+	require.True(t, viewLeaf.IsReadOnly())
+	require.Equal(t, leaf.Certificate().Raw, viewLeaf.Certificate().Raw)
+	err = viewLeaf.SetAttributes(map[string]string{"Key": "Value"})
+	require.ErrorIs(t, err, certstore.ErrReadOnly)
+	viewRoot, err := view.Entry(rootName)
+	require.NoError(t, err)
+	require.Equal(t, root.Certificate().Raw, viewRoot.Certificate().Raw)
+	roots, _, err := view.CertPools()
+	require.NoError(t, err)
+	_, err = leaf.Certificate().Verify(x509.VerifyOptions{Roots: roots})
+	require.NoError(t, err)
+	// now
+	checkViewEntries(t, registry.AsOf(time.Now()), []string{leafName, otherName})
+	_, err = registry.AsOf(time.Now()).Entry(rootName)
+	require.ErrorIs(t, err, storage.ErrNotExist)
+}
+
+func checkViewEntries(t *testing.T, view *certstore.RegistryView, expected []string) {
+	entries, err := view.Entries()
+	require.NoError(t, err)
+	actual := make([]string, 0)
+	for {
+		entry, err := entries.Next()
+		require.NoError(t, err)
+		if entry == nil {
+			break
+		}
+		require.True(t, entry.IsReadOnly())
+		actual = append(actual, entry.Name())
+	}
+	require.ElementsMatch(t, expected, actual)
+}
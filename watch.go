@@ -0,0 +1,278 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/rs/zerolog"
+)
+
+// ChangeKind defines the kind of a [ChangeEvent].
+type ChangeKind int
+
+const (
+	// ChangeCreated reports the creation of a store entry.
+	ChangeCreated ChangeKind = iota + 1
+	// ChangeUpdated reports a new version of a store entry.
+	ChangeUpdated
+	// ChangeDeleted reports the deletion of a store entry.
+	ChangeDeleted
+	// ChangeKeyAccessed reports an access to the key of a store entry (see [RegistryEntry.Key]).
+	ChangeKeyAccessed
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case ChangeCreated:
+		return "created"
+	case ChangeUpdated:
+		return "updated"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeKeyAccessed:
+		return "key accessed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(kind))
+}
+
+// A ChangeEvent reports a change of a store entry (see [Registry.Watch]).
+type ChangeEvent struct {
+	// Kind is the kind of change.
+	Kind ChangeKind
+	// Name is the name of the changed store entry.
+	Name string
+	// Version is the storage version of the store entry after the change (0, if the store entry has been deleted).
+	Version storage.Version
+}
+
+func (event *ChangeEvent) String() string {
+	return fmt.Sprintf("%s '%s' (version: %d)", event.Kind, event.Name, event.Version)
+}
+
+// WatchBufferLimit is the maximum number of events buffered per watcher (see [Registry.Watch]).
+// Events exceeding the limit are dropped.
+const WatchBufferLimit = 64
+
+// DefaultWatchPollInterval is the interval used to check for changes made by other processes (see [WithWatchPollInterval]).
+const DefaultWatchPollInterval = 2 * time.Second
+
+// WithWatchPollInterval sets the interval used to check for changes made by other processes
+// (default: [DefaultWatchPollInterval]). See [Registry.Watch] for details.
+func WithWatchPollInterval(interval time.Duration) StoreOption {
+	return func(options *storeOptions) {
+		options.watchPollInterval = interval
+	}
+}
+
+// Watch reports the changes of the store's entries until the submitted context is done.
+//
+// The returned channel receives a [ChangeEvent] for every store entry created, updated or deleted as well
+// as for every key access via this [Registry]. If the store's backend implements [storage.WatchableBackend],
+// changes made via other [Registry] instances or processes are detected by polling the backend
+// (see [WithWatchPollInterval]) and reported as well. Detecting such a change also invalidates the
+// corresponding entry cached by this [Registry]. Polling takes place only as long as there are active watchers.
+//
+// Events are buffered up to [WatchBufferLimit] events per watcher. If a watcher does not keep up, further
+// events are dropped. The returned channel is closed as soon as the submitted context is done.
+func (registry *Registry) Watch(ctx context.Context) <-chan *ChangeEvent {
+	return registry.changes.watch(ctx)
+}
+
+func (registry *Registry) notify(kind ChangeKind, name string, version storage.Version) {
+	registry.changes.notify(&ChangeEvent{Kind: kind, Name: name, Version: version})
+}
+
+type changeNotifier struct {
+	lock         sync.Mutex
+	backend      storage.Backend
+	entryCache   *ttlcache.Cache[string, *RegistryEntry]
+	pollInterval time.Duration
+	// watchers maps the watchers to the number of events dropped since their last successful delivery
+	watchers map[chan *ChangeEvent]uint64
+	// known holds the entry versions known to the poller (nil, if not polling)
+	known    map[string]storage.Version
+	stopPoll chan struct{}
+	// pending holds the events of a transaction until it is committed (nil, if not buffering)
+	pending []*ChangeEvent
+	logger  *zerolog.Logger
+}
+
+func newChangeNotifier(backend storage.Backend, entryCache *ttlcache.Cache[string, *RegistryEntry], pollInterval time.Duration, logger *zerolog.Logger) *changeNotifier {
+	if pollInterval <= 0 {
+		pollInterval = DefaultWatchPollInterval
+	}
+	return &changeNotifier{
+		backend:      backend,
+		entryCache:   entryCache,
+		pollInterval: pollInterval,
+		watchers:     make(map[chan *ChangeEvent]uint64),
+		logger:       logger,
+	}
+}
+
+func newBufferedChangeNotifier(logger *zerolog.Logger) *changeNotifier {
+	return &changeNotifier{
+		watchers: make(map[chan *ChangeEvent]uint64),
+		pending:  make([]*ChangeEvent, 0),
+		logger:   logger,
+	}
+}
+
+func (notifier *changeNotifier) watch(ctx context.Context) <-chan *ChangeEvent {
+	events := make(chan *ChangeEvent, WatchBufferLimit)
+	notifier.lock.Lock()
+	notifier.watchers[events] = 0
+	if watchable, ok := notifier.backend.(storage.WatchableBackend); ok && notifier.stopPoll == nil {
+		notifier.stopPoll = make(chan struct{})
+		notifier.known = notifier.snapshot(watchable)
+		go notifier.poll(watchable, notifier.stopPoll)
+	}
+	notifier.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		notifier.lock.Lock()
+		defer notifier.lock.Unlock()
+		dropped := notifier.watchers[events]
+		if dropped > 0 {
+			notifier.logger.Warn().Msgf("watcher closed after dropping %d event(s)", dropped)
+		}
+		delete(notifier.watchers, events)
+		close(events)
+		if len(notifier.watchers) == 0 && notifier.stopPoll != nil {
+			close(notifier.stopPoll)
+			notifier.stopPoll = nil
+			notifier.known = nil
+		}
+	}()
+	return events
+}
+
+func (notifier *changeNotifier) notify(events ...*ChangeEvent) {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if notifier.pending != nil {
+		notifier.pending = append(notifier.pending, events...)
+		return
+	}
+	for _, event := range events {
+		if notifier.isKnown(event) {
+			continue
+		}
+		notifier.publish(event)
+	}
+}
+
+// isKnown checks whether the submitted event has already been reported by the poller and
+// records the event's version otherwise.
+func (notifier *changeNotifier) isKnown(event *ChangeEvent) bool {
+	if notifier.known == nil {
+		return false
+	}
+	knownVersion, known := notifier.known[event.Name]
+	switch event.Kind {
+	case ChangeCreated, ChangeUpdated:
+		if known && knownVersion >= event.Version {
+			return true
+		}
+		notifier.known[event.Name] = event.Version
+	case ChangeDeleted:
+		if !known {
+			return true
+		}
+		delete(notifier.known, event.Name)
+	}
+	return false
+}
+
+// publish delivers the submitted event to all watchers. Dropped events are counted per watcher and logged
+// once the watcher catches up again (instead of logging every single dropped event).
+func (notifier *changeNotifier) publish(event *ChangeEvent) {
+	for watcher, dropped := range notifier.watchers {
+		select {
+		case watcher <- event:
+			if dropped > 0 {
+				notifier.logger.Warn().Msgf("watcher buffer exceeded; dropped %d event(s)", dropped)
+				notifier.watchers[watcher] = 0
+			}
+		default:
+			notifier.watchers[watcher] = dropped + 1
+		}
+	}
+}
+
+func (notifier *changeNotifier) poll(backend storage.WatchableBackend, stop chan struct{}) {
+	ticker := time.NewTicker(notifier.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			notifier.pollChanges(backend, stop)
+		}
+	}
+}
+
+func (notifier *changeNotifier) pollChanges(backend storage.WatchableBackend, stop chan struct{}) {
+	snapshot := notifier.snapshot(backend)
+	if snapshot == nil {
+		return
+	}
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	if notifier.stopPoll != stop {
+		return
+	}
+	if notifier.known == nil {
+		// initial snapshot failed; use this one as the baseline
+		notifier.known = snapshot
+		return
+	}
+	events := make([]*ChangeEvent, 0)
+	for name, version := range snapshot {
+		knownVersion, known := notifier.known[name]
+		if !known {
+			events = append(events, &ChangeEvent{Kind: ChangeCreated, Name: name, Version: version})
+		} else if knownVersion < version {
+			events = append(events, &ChangeEvent{Kind: ChangeUpdated, Name: name, Version: version})
+		}
+	}
+	for name := range notifier.known {
+		if _, exists := snapshot[name]; !exists {
+			events = append(events, &ChangeEvent{Kind: ChangeDeleted, Name: name})
+		}
+	}
+	for _, event := range events {
+		notifier.logger.Debug().Msgf("detected external change %s", event)
+		if notifier.entryCache != nil {
+			notifier.entryCache.Delete(event.Name)
+		}
+		if !notifier.isKnown(event) {
+			notifier.publish(event)
+		}
+	}
+}
+
+func (notifier *changeNotifier) snapshot(backend storage.WatchableBackend) map[string]storage.Version {
+	snapshot, err := backend.Snapshot()
+	if err != nil {
+		notifier.logger.Error().Err(err).Msg("failed to poll store changes")
+		return nil
+	}
+	for name := range snapshot {
+		if strings.HasPrefix(name, ".") {
+			delete(snapshot, name)
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2023-2024 Holger de Carne and contributors
+//
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+
+package certstore_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hdecarne-github/go-certstore"
+	"github.com/hdecarne-github/go-certstore/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	registry, err := certstore.NewStore(storage.NewMemoryStorage(testVersionLimit), testCacheTTL)
+	require.NoError(t, err)
+	user := "TestWatchUser"
+	ctx, cancel := context.WithCancel(context.Background())
+	events := registry.Watch(ctx)
+	name, err := registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeCreated, name, 1)
+	entry, err := registry.Entry(name)
+	require.NoError(t, err)
+	err = entry.SetAttributes(map[string]string{"Key": "Value"})
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeUpdated, name, 2)
+	entry, err = registry.Entry(name)
+	require.NoError(t, err)
+	require.NotNil(t, entry.Key(user))
+	checkChangeEvent(t, events, certstore.ChangeKeyAccessed, name, 2)
+	err = registry.Transaction(func(tx *certstore.Registry) error {
+		_, err := tx.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+		require.NoError(t, err)
+		// not reported before commit
+		require.Empty(t, events)
+		return nil
+	})
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeCreated, name+" (2)", 1)
+	err = registry.Delete(name, user)
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeDeleted, name, 0)
+	cancel()
+	_, open := <-events
+	require.False(t, open)
+}
+
+func TestWatchExternalChanges(t *testing.T) {
+	path, err := os.MkdirTemp("", "TestWatchExternalChanges*")
+	require.NoError(t, err)
+	defer os.RemoveAll(path)
+	registry, err := certstore.NewStore(newTestFSBackend(t, path), testCacheTTL, certstore.WithWatchPollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	external, err := certstore.NewStore(newTestFSBackend(t, path), 0)
+	require.NoError(t, err)
+	user := "TestWatchExternalChangesUser"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := registry.Watch(ctx)
+	name, err := external.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeCreated, name, 1)
+	cached, err := registry.Entry(name)
+	require.NoError(t, err)
+	require.Empty(t, cached.Attributes())
+	entry, err := external.Entry(name)
+	require.NoError(t, err)
+	err = entry.SetAttributes(map[string]string{"Key": "Value"})
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeUpdated, name, 2)
+	// cached entry has been invalidated
+	updated, err := registry.Entry(name)
+	require.NoError(t, err)
+	require.Equal(t, "Value", updated.Attributes()["Key"])
+	err = external.Delete(name, user)
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeDeleted, name, 0)
+	// own changes are reported once
+	name, err = registry.CreateCertificate("root", newTestRootCertificateFactory("root"), user)
+	require.NoError(t, err)
+	checkChangeEvent(t, events, certstore.ChangeCreated, name, 1)
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, events)
+}
+
+func checkChangeEvent(t *testing.T, events <-chan *certstore.ChangeEvent, kind certstore.ChangeKind, name string, version storage.Version) {
+	select {
+	case event := <-events:
+		require.Equal(t, kind, event.Kind)
+		require.Equal(t, name, event.Name)
+		require.Equal(t, version, event.Version)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "missing change event", "%s '%s'", kind, name)
+	}
+}